@@ -0,0 +1,587 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// admin.go contains the Tailscale endpoints of the Caddy admin API.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	tailscaleroot "tailscale.com"
+	"tailscale.com/util/clientmetric"
+	"tailscale.com/util/cmpver"
+)
+
+func init() {
+	caddy.RegisterModule(adminAPI{})
+}
+
+// Endpoints used to check for Tailscale updates and vulnerabilities.
+var (
+	// latestVersionURL returns the latest stable Tailscale release, as used by "tailscale update".
+	latestVersionURL = "https://pkgs.tailscale.com/stable/?mode=json"
+
+	// vulnQueryURL queries the OSV database, which includes the Go vulnerability database.
+	vulnQueryURL = "https://api.osv.dev/v1/query"
+)
+
+// versionCacheTTL is how long update server responses are cached.
+const versionCacheTTL = time.Hour
+
+// adminAPI is a module that provides the /tailscale/ endpoints of the Caddy admin API.
+//
+// GET /tailscale/version reports the version of the Tailscale library built into Caddy,
+// the latest Tailscale release, and known vulnerabilities affecting the built-in version,
+// to help operators track when Caddy needs to be rebuilt.
+//
+// GET /tailscale/services reports the tailnet peers seen by running nodes and the services they advertise.
+//
+// GET /tailscale/portmap reports whether port mapping is enabled and working for running nodes.
+//
+// GET /tailscale/derp reports the home DERP region of running nodes and their latency to each region.
+//
+// GET /tailscale/lock reports the tailnet lock status of running nodes.
+//
+// GET /tailscale/keys reports the machine key, node key and SSH host keys of running nodes.
+//
+// GET /tailscale/errors reports the last error reported by each node, with a code identifying it.
+//
+// GET /tailscale/listeners reports the tailnet addresses and URLs where Tailscale listeners are reachable.
+//
+// GET /tailscale/sites reports the sites served on each Tailscale listener and the hosts they match,
+// and which site serves requests for the MagicDNS name of the listener's node.
+//
+// GET /tailscale/metrics reports the Tailscale client library's metrics in the Prometheus text format.
+//
+// GET /tailscale/prom-sd lists the tailnet peers of running nodes in the Prometheus HTTP service discovery format,
+// optionally filtered by ?tag=, with ?port= added to their addresses and limited to the peers of ?node=.
+//
+// GET /tailscale/client-ca returns the certificate of the authority that issues client certificates to nodes,
+// for upstreams that require mTLS to trust.
+//
+// POST /tailscale/nodes/<name>/state/export and /tailscale/nodes/<name>/state/import
+// export and import a node's state, encrypted with a passphrase, to migrate it between hosts.
+type adminAPI struct {
+	ctx caddy.Context
+}
+
+func (adminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.tailscale",
+		New: func() caddy.Module { return new(adminAPI) },
+	}
+}
+
+// Provision implements caddy.Provisioner.
+// Routes are created before the module is provisioned, so handlers that need ctx use a pointer receiver.
+func (a *adminAPI) Provision(ctx caddy.Context) error {
+	a.ctx = ctx
+	return nil
+}
+
+// Routes implements caddy.AdminRouter.
+func (a *adminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{
+			Pattern: "/tailscale/version",
+			Handler: caddy.AdminHandlerFunc(a.handleVersion),
+		},
+		{
+			Pattern: "/tailscale/services",
+			Handler: caddy.AdminHandlerFunc(a.handleServices),
+		},
+		{
+			Pattern: "/tailscale/portmap",
+			Handler: caddy.AdminHandlerFunc(a.handlePortMap),
+		},
+		{
+			Pattern: "/tailscale/derp",
+			Handler: caddy.AdminHandlerFunc(a.handleDERP),
+		},
+		{
+			Pattern: "/tailscale/lock",
+			Handler: caddy.AdminHandlerFunc(a.handleLock),
+		},
+		{
+			Pattern: "/tailscale/keys",
+			Handler: caddy.AdminHandlerFunc(a.handleKeys),
+		},
+		{
+			Pattern: "/tailscale/errors",
+			Handler: caddy.AdminHandlerFunc(a.handleErrors),
+		},
+		{
+			Pattern: "/tailscale/listeners",
+			Handler: caddy.AdminHandlerFunc(a.handleListeners),
+		},
+		{
+			Pattern: "/tailscale/sites",
+			Handler: caddy.AdminHandlerFunc(a.handleSites),
+		},
+		{
+			Pattern: "/tailscale/metrics",
+			Handler: caddy.AdminHandlerFunc(a.handleMetrics),
+		},
+		{
+			Pattern: "/tailscale/prom-sd",
+			Handler: caddy.AdminHandlerFunc(a.handlePromSD),
+		},
+		{
+			Pattern: "/tailscale/client-ca",
+			Handler: caddy.AdminHandlerFunc(a.handleClientCA),
+		},
+		{
+			Pattern: "/tailscale/nodes/",
+			Handler: caddy.AdminHandlerFunc(a.handleNodeState),
+		},
+	}
+}
+
+// versionInfo is the response of the /tailscale/version endpoint.
+type versionInfo struct {
+	// Version is the version of the Tailscale library built into Caddy.
+	Version string `json:"version"`
+
+	// Latest is the latest stable Tailscale release.
+	Latest string `json:"latest"`
+
+	// UpdateAvailable reports whether Latest is newer than Version.
+	UpdateAvailable bool `json:"update_available"`
+
+	// Vulnerabilities are the known vulnerabilities affecting Version.
+	Vulnerabilities []vulnerability `json:"vulnerabilities"`
+}
+
+// vulnerability is a known vulnerability in the Tailscale library.
+type vulnerability struct {
+	ID      string   `json:"id"`
+	Aliases []string `json:"aliases,omitempty"`
+	Summary string   `json:"summary,omitempty"`
+}
+
+var versionCache struct {
+	sync.Mutex
+	info    *versionInfo
+	fetched time.Time
+}
+
+func (adminAPI) handleVersion(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	info, err := getVersionInfo(r.Context())
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadGateway,
+			Err:        err,
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(info)
+}
+
+func (adminAPI) handleServices(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	catalog, err := tailnetServices(r.Context())
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusInternalServerError,
+			Err:        err,
+		}
+	}
+	if catalog == nil {
+		catalog = []peerServices{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(catalog)
+}
+
+func (adminAPI) handlePortMap(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	status, err := getPortMapStatus(r.Context())
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusInternalServerError,
+			Err:        err,
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(status)
+}
+
+func (adminAPI) handleDERP(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	status, err := tailnetDERP(r.Context())
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusInternalServerError,
+			Err:        err,
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(status)
+}
+
+func (adminAPI) handleLock(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	statuses, err := tailnetLockStatus(r.Context())
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusInternalServerError,
+			Err:        err,
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(statuses)
+}
+
+func (adminAPI) handleKeys(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	keys, err := tailnetNodeKeys(r.Context())
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusInternalServerError,
+			Err:        err,
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(keys)
+}
+
+func (adminAPI) handleErrors(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(tailnetErrors())
+}
+
+func (adminAPI) handleListeners(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(tailnetListeners(r.Context()))
+}
+
+func (a *adminAPI) handleSites(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	sites := tailnetSites(a.ctx)
+	if sites == nil {
+		sites = []listenerSites{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(sites)
+}
+
+func (adminAPI) handleMetrics(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	clientmetric.WritePrometheusExpositionFormat(w)
+	return nil
+}
+
+func (adminAPI) handlePromSD(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	query := r.URL.Query()
+	q, err := parsePromSDQuery(query["tag"], query.Get("port"), query.Get("node"))
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        err,
+		}
+	}
+	groups, err := promSDTargets(r.Context(), q)
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusInternalServerError,
+			Err:        err,
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(groups)
+}
+
+func (a *adminAPI) handleClientCA(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	cert, _, err := loadClientCA(r.Context(), a.ctx.Storage())
+	if errors.Is(err, fs.ErrNotExist) {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("no client certificate authority, client_identity is not enabled"),
+		}
+	}
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusInternalServerError,
+			Err:        err,
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	_, err = w.Write(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+	return err
+}
+
+// stateExportRequest is the body of a state export request.
+type stateExportRequest struct {
+	Passphrase string `json:"passphrase"`
+}
+
+// stateImportRequest is the body of a state import request.
+type stateImportRequest struct {
+	Passphrase string       `json:"passphrase"`
+	State      *stateExport `json:"state"`
+}
+
+func (a *adminAPI) handleNodeState(w http.ResponseWriter, r *http.Request) error {
+	name, op, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/tailscale/nodes/"), "/state/")
+	if !ok || name == "" || strings.Contains(name, "/") || (op != "export" && op != "import") {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("not found"),
+		}
+	}
+	if r.Method != http.MethodPost {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	// Only nodes that aren't in use can be exported or imported,
+	// so that the same identity isn't used by two running nodes.
+	if _, inUse := nodes.References(name); inUse {
+		return caddy.APIError{
+			HTTPStatus: http.StatusConflict,
+			Err:        fmt.Errorf("node %q is in use; remove it from the config first", name),
+		}
+	}
+	app, err := getApp(a.ctx)
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusInternalServerError,
+			Err:        err,
+		}
+	}
+	dir, err := getStateDir(name, app)
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusInternalServerError,
+			Err:        err,
+		}
+	}
+
+	if op == "export" {
+		var req stateExportRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        err,
+			}
+		}
+		exp, err := exportState(name, dir, req.Passphrase)
+		if err != nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        err,
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(exp)
+	}
+
+	var req stateImportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.State == nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("invalid import request: %v", err),
+		}
+	}
+	if err := importState(name, dir, req.Passphrase, req.State); err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, errStateExists) {
+			status = http.StatusConflict
+		}
+		return caddy.APIError{
+			HTTPStatus: status,
+			Err:        err,
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// getVersionInfo returns the version information, fetching it if the cached copy is stale.
+func getVersionInfo(ctx context.Context) (*versionInfo, error) {
+	versionCache.Lock()
+	defer versionCache.Unlock()
+	if versionCache.info != nil && time.Since(versionCache.fetched) < versionCacheTTL {
+		return versionCache.info, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	info := &versionInfo{Version: strings.TrimSpace(tailscaleroot.VersionDotTxt)}
+	var err error
+	if info.Latest, err = fetchLatestVersion(ctx); err != nil {
+		return nil, err
+	}
+	info.UpdateAvailable = cmpver.Compare(info.Latest, info.Version) > 0
+	if info.Vulnerabilities, err = fetchVulnerabilities(ctx, info.Version); err != nil {
+		return nil, err
+	}
+
+	versionCache.info = info
+	versionCache.fetched = time.Now()
+	return info, nil
+}
+
+// fetchLatestVersion returns the latest stable Tailscale release.
+func fetchLatestVersion(ctx context.Context) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", latestVersionURL, nil)
+	if err != nil {
+		return "", err
+	}
+	var latest struct {
+		Version string
+	}
+	if err := doJSON(req, &latest); err != nil {
+		return "", fmt.Errorf("fetching latest tailscale version: %w", err)
+	}
+	if latest.Version == "" {
+		return "", fmt.Errorf("fetching latest tailscale version: no version in response")
+	}
+	return latest.Version, nil
+}
+
+// fetchVulnerabilities returns the known vulnerabilities affecting version of the Tailscale library.
+func fetchVulnerabilities(ctx context.Context, version string) ([]vulnerability, error) {
+	query, err := json.Marshal(map[string]any{
+		"package": map[string]string{"name": "tailscale.com", "ecosystem": "Go"},
+		"version": version,
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", vulnQueryURL, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	var resp struct {
+		Vulns []vulnerability `json:"vulns"`
+	}
+	if err := doJSON(req, &resp); err != nil {
+		return nil, fmt.Errorf("fetching tailscale vulnerabilities: %w", err)
+	}
+	if resp.Vulns == nil {
+		resp.Vulns = []vulnerability{}
+	}
+	return resp.Vulns, nil
+}
+
+// doJSON sends req and decodes the JSON response into v.
+func doJSON(req *http.Request, v any) error {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+var (
+	_ caddy.Provisioner = (*adminAPI)(nil)
+	_ caddy.AdminRouter = (*adminAPI)(nil)
+)
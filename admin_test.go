@@ -0,0 +1,113 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	tailscaleroot "tailscale.com"
+)
+
+func Test_AdminVersion(t *testing.T) {
+	version := strings.TrimSpace(tailscaleroot.VersionDotTxt)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /stable/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"Version": "99.0.0", "Tarballs": {}}`))
+	})
+	mux.HandleFunc("POST /v1/query", func(w http.ResponseWriter, r *http.Request) {
+		var q struct {
+			Package struct{ Name, Ecosystem string }
+			Version string
+		}
+		if err := json.NewDecoder(r.Body).Decode(&q); err != nil || q.Package.Name != "tailscale.com" || q.Package.Ecosystem != "Go" || q.Version != version {
+			http.Error(w, "bad query", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"vulns": [{"id": "GO-2099-0001", "aliases": ["CVE-2099-0001"], "summary": "Something bad"}]}`))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	oldLatest, oldVuln := latestVersionURL, vulnQueryURL
+	latestVersionURL, vulnQueryURL = srv.URL+"/stable/?mode=json", srv.URL+"/v1/query"
+	defer func() {
+		latestVersionURL, vulnQueryURL = oldLatest, oldVuln
+		versionCache.info = nil
+	}()
+
+	rec := httptest.NewRecorder()
+	if err := (adminAPI{}).handleVersion(rec, httptest.NewRequest("GET", "/tailscale/version", nil)); err != nil {
+		t.Fatal(err)
+	}
+	var got versionInfo
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	want := versionInfo{
+		Version:         version,
+		Latest:          "99.0.0",
+		UpdateAvailable: true,
+		Vulnerabilities: []vulnerability{{ID: "GO-2099-0001", Aliases: []string{"CVE-2099-0001"}, Summary: "Something bad"}},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("handleVersion() mismatch (-want +got):\n%s", diff)
+	}
+
+	if err := (adminAPI{}).handleVersion(httptest.NewRecorder(), httptest.NewRequest("POST", "/tailscale/version", nil)); err == nil {
+		t.Error("POST succeeded, want error")
+	}
+}
+
+func Test_AdminNodeState(t *testing.T) {
+	src := t.TempDir()
+	dst := filepath.Join(t.TempDir(), "node")
+	state := []byte(`{"_machinekey": "secret"}`)
+	if err := os.WriteFile(filepath.Join(src, stateFileName), state, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	exp, err := exportState("node", src, "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(exp.Ciphertext, state) {
+		t.Error("exported state is not encrypted")
+	}
+	if err := checkNotExported("node", src); err == nil {
+		t.Error("exported node can still be started on the old host")
+	}
+
+	if err := importState("node", dst, "wrong", exp); err == nil {
+		t.Error("importState() with wrong passphrase succeeded")
+	}
+	if err := importState("other", dst, "hunter2", exp); err == nil {
+		t.Error("importState() with wrong node name succeeded")
+	}
+	if err := importState("node", dst, "hunter2", exp); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(filepath.Join(dst, stateFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, state) {
+		t.Errorf("imported state = %q, want %q", got, state)
+	}
+	if err := checkNotExported("node", dst); err != nil {
+		t.Errorf("imported node can't be started: %v", err)
+	}
+	if err := importState("node", dst, "hunter2", exp); !errors.Is(err, errStateExists) {
+		t.Errorf("importState() over existing state = %v, want %v", err, errStateExists)
+	}
+}
@@ -6,6 +6,13 @@ package tscaddy
 // app.go contains App and Node, which provide global configuration for registering Tailscale nodes.
 
 import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"maps"
+	"net/http"
+	"slices"
+
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
@@ -26,12 +33,22 @@ type App struct {
 	// DefaultAuthKey is the default auth key to use for Tailscale if no other auth key is specified.
 	DefaultAuthKey string `json:"auth_key,omitempty" caddy:"namespace=tailscale.auth_key"`
 
+	// DefaultAuthKeyFile is the path of a file containing the default auth key, used if no other auth key is specified.
+	// Nodes watch the file, and log in with the new key if it changes while they need to log in.
+	DefaultAuthKeyFile string `json:"auth_key_file,omitempty" caddy:"namespace=tailscale.auth_key_file"`
+
 	// ControlURL specifies the default control URL to use for nodes.
 	ControlURL string `json:"control_url,omitempty" caddy:"namespace=tailscale.control_url"`
 
 	// Ephemeral specifies whether Tailscale nodes should be registered as ephemeral.
 	Ephemeral bool `json:"ephemeral,omitempty" caddy:"namespace=tailscale.ephemeral"`
 
+	// UniqueSuffix is appended to the hostnames of nodes, for short-lived instances such as CI preview deployments.
+	// If "random", a random suffix is generated for each node; otherwise it is used as is, such as a build ID.
+	// Nodes with a unique suffix are ephemeral, keep their state in memory,
+	// and log out of the tailnet when they are stopped, deleting their devices.
+	UniqueSuffix string `json:"unique_suffix,omitempty" caddy:"namespace=tailscale.unique_suffix"`
+
 	// StateDir specifies the default state directory for Tailscale nodes.
 	// Each node will have a subdirectory under this parent directory for its state.
 	StateDir string `json:"state_dir,omitempty" caddy:"namespace=tailscale.state_dir"`
@@ -39,13 +56,145 @@ type App struct {
 	// WebUI specifies whether Tailscale nodes should run the Web UI for remote management.
 	WebUI bool `json:"webui,omitempty" caddy:"namespace=tailscale.webui"`
 
+	// WebUIAllow specifies the login names and tags of the tailnet peers allowed to connect to the Web UI of nodes.
+	// Connections from other peers are dropped by Caddy. If empty, any peer allowed by the tailnet policy can connect.
+	WebUIAllow []string `json:"webui_allow,omitempty" caddy:"namespace=tailscale.webui_allow"`
+
+	// ReadOnlyState specifies whether nodes treat their existing state as read-only,
+	// for deployments where state is baked into an image.
+	// Nodes fail to start if they have no state, and changes to their state, such as a new identity, are refused.
+	ReadOnlyState bool `json:"read_only_state,omitempty" caddy:"namespace=tailscale.read_only_state"`
+
+	// Preauthorized specifies whether auth keys created with an OAuth client secret
+	// register pre-authorized devices, which skip device approval.
+	// Default: true
+	Preauthorized opt.Bool `json:"preauthorized,omitempty" caddy:"namespace=tailscale.preauthorized"`
+
+	// KeyExpiry specifies whether key expiry is enabled for devices registered with an OAuth client secret.
+	// Disabling key expiry keeps unattended servers from dropping off the tailnet when their key expires.
+	// If unset, the tailnet's default is used.
+	KeyExpiry opt.Bool `json:"key_expiry,omitempty" caddy:"namespace=tailscale.key_expiry"`
+
 	// Tags specifies the list of tags to apply to all nodes.
 	Tags []string `json:"tags,omitempty" caddy:"namespace=tailscale.tags"`
 
+	// PortMapping specifies whether nodes attempt to open ports on the local router
+	// using UPnP, NAT-PMP and PCP, to improve direct connectivity.
+	// Disabling it stops the associated probing of the local network, which can trigger
+	// intrusion detection alerts on some networks.
+	// The Tailscale client library only supports this setting for all nodes in the process.
+	// Default: true
+	PortMapping opt.Bool `json:"port_mapping,omitempty" caddy:"namespace=tailscale.port_mapping"`
+
+	// UPnP specifies whether nodes use UPnP for port mapping.
+	// The Tailscale client library only supports this setting for all nodes in the process.
+	// Default: true
+	UPnP opt.Bool `json:"upnp,omitempty" caddy:"namespace=tailscale.upnp"`
+
+	// STUNWhenIdle specifies whether nodes keep sending periodic STUN probes
+	// to discover their public endpoints while there is no active peer traffic.
+	// The Tailscale client library only supports this setting for all nodes in the process,
+	// and the interval of the probes isn't configurable.
+	// Default: true
+	STUNWhenIdle opt.Bool `json:"stun_when_idle,omitempty" caddy:"namespace=tailscale.stun_when_idle"`
+
+	// MTU specifies the MTU of the nodes' virtual network interface, in bytes.
+	// Raising it can help on networks whose path MTU is known to be larger, and it can't be lower than 1280,
+	// the minimum MTU of IPv6. The Tailscale client library only supports this setting for all nodes in the process,
+	// and it can't be lowered while nodes are running.
+	// Default: 1280
+	MTU int `json:"mtu,omitempty" caddy:"namespace=tailscale.mtu"`
+
+	// HostinfoApp is the app identifier nodes report to the control server,
+	// which helps identify Caddy nodes in the admin console.
+	// The Tailscale client library only supports this setting for all nodes in the process,
+	// and it only applies to nodes started after the config starts.
+	// Default: caddy
+	HostinfoApp string `json:"hostinfo_app,omitempty" caddy:"namespace=tailscale.hostinfo_app"`
+
+	// DeviceModel is a description of the device that nodes report to the control server,
+	// such as the name of the Caddy instance.
+	// The Tailscale client library only supports this setting for all nodes in the process,
+	// and it only applies to nodes started after the config starts.
+	// Default: the versions of Caddy and this plugin, and the optional features of the plugin in the build
+	DeviceModel string `json:"device_model,omitempty" caddy:"namespace=tailscale.device_model"`
+
+	// LowMemory reduces the memory used by nodes, for running on memory-constrained devices
+	// such as a Raspberry Pi, at the cost of throughput on high-latency connections.
+	// Nodes use smaller TCP buffers in their userspace network stack, keep less history of peers' endpoints for debugging,
+	// and the Web UI is only run on nodes that explicitly enable it.
+	// The endpoint history is process-wide, and is restored to its default when the option is removed.
+	LowMemory bool `json:"low_memory,omitempty" caddy:"namespace=tailscale.low_memory"`
+
+	// LockSigner is the name of a node whose tailnet lock key is a trusted signing key.
+	// If set and tailnet lock is enabled, other nodes are signed by it when they connect to the tailnet,
+	// so that they can connect to peers without being signed manually.
+	LockSigner string `json:"lock_signer,omitempty" caddy:"namespace=tailscale.lock_signer"`
+
+	// Proxy is the URL of an HTTP, HTTPS or SOCKS5 proxy used by nodes to connect to
+	// the control server and DERP relays, for hosts that can only reach the internet through a proxy.
+	// If unset, the HTTPS_PROXY, HTTP_PROXY and NO_PROXY environment variables are used.
+	// Nodes with their own proxy use it instead for their control server and its DERP relays.
+	Proxy string `json:"proxy,omitempty" caddy:"namespace=tailscale.proxy"`
+
+	// SlowRequestThreshold is how long requests received on nodes can take before they are logged as slow
+	// by the tailscale_metrics handler. If zero, slow requests are not logged.
+	SlowRequestThreshold caddy.Duration `json:"slow_request_threshold,omitempty" caddy:"namespace=tailscale.slow_request_threshold"`
+
+	// MaxBodySize is the maximum size in bytes of the bodies of requests received on nodes,
+	// enforced by the tailscale_limits handler. If zero, request bodies are not limited.
+	MaxBodySize int64 `json:"max_body_size,omitempty" caddy:"namespace=tailscale.max_body_size"`
+
+	// Methods is the list of HTTP methods allowed for requests received on nodes,
+	// enforced by the tailscale_limits handler. If empty, all methods are allowed.
+	Methods []string `json:"methods,omitempty" caddy:"namespace=tailscale.methods"`
+
+	// FunnelHeaders are response headers, such as Strict-Transport-Security and Content-Security-Policy,
+	// set by the tailscale_headers handler on responses to requests received over Funnel on nodes.
+	FunnelHeaders http.Header `json:"funnel_headers,omitempty" caddy:"namespace=tailscale.funnel_headers"`
+
+	// TailnetHeaders are response headers set by the tailscale_headers handler
+	// on responses to other requests received on nodes.
+	TailnetHeaders http.Header `json:"tailnet_headers,omitempty" caddy:"namespace=tailscale.tailnet_headers"`
+
+	// Reap configures periodic deletion of stale devices using the Tailscale API,
+	// such as those registered by short-lived preview environments. If nil, devices are never deleted.
+	Reap *Reaper `json:"reap,omitempty" caddy:"namespace=tailscale.reap"`
+
+	// RollingRestart coordinates restarts of Caddy instances whose nodes share a tag, so they restart one at a time.
+	RollingRestart *RollingRestart `json:"rolling_restart,omitempty" caddy:"namespace=tailscale.rolling_restart"`
+
 	// Nodes is a map of per-node configuration which overrides global options.
 	Nodes map[string]Node `json:"nodes,omitempty" caddy:"namespace=tailscale"`
 
-	logger *zap.Logger
+	// NodesFile is the path of a JSON file of node configs by name, in the same format as Nodes,
+	// which are merged into Nodes when the config is loaded. Nodes also configured in Nodes take precedence.
+	// The config is reloaded when the file changes, through the admin API on its default address.
+	NodesFile string `json:"nodes_file,omitempty" caddy:"namespace=tailscale.nodes_file"`
+
+	// Testing runs nodes on an in-process tailnet instead of the configured control server, for integration tests.
+	// Auth keys, state directories and unique suffixes are ignored, and the device reaper doesn't run.
+	Testing *TestingMode `json:"testing,omitempty" caddy:"namespace=tailscale.testing"`
+
+	ctx            caddy.Context
+	logger         *zap.Logger
+	requestMetrics *requestMetrics
+	forwarders     []*forwarder
+	forwardNodes   []string           // names of nodes held by forwarders
+	stopReaper     context.CancelFunc // stops the device reaper, if running
+	transports     []*Transport       // proxy transports of this config, whose nodes are created when the app starts
+	hostinfoApp    string             // HostinfoApp with placeholders resolved
+	deviceModel    string             // DeviceModel with placeholders resolved
+
+	nodesFileHash      [sha256.Size]byte  // hash of the nodes file when it was loaded
+	stopNodesFileWatch context.CancelFunc // stops watching the nodes file, if watching
+
+	testNetwork *testNetwork // in-process tailnet nodes join in testing mode, if enabled
+
+	// siteConfigs are the site-specific node configurations registered by tailscale directives of this config,
+	// which are published to create nodes once they are resolved. They are guarded by siteConfigsMu.
+	siteConfigs         siteConfigSnapshot
+	siteConfigsResolved bool
 }
 
 // Node is a Tailscale node configuration.
@@ -55,15 +204,42 @@ type Node struct {
 	// AuthKey is the Tailscale auth key used to register the node.
 	AuthKey string `json:"auth_key,omitempty" caddy:"namespace=auth_key"`
 
+	// AuthKeyFile is the path of a file containing the auth key used to register the node, if AuthKey is not set.
+	// The node watches the file, and logs in with the new key if it changes while the node needs to log in.
+	AuthKeyFile string `json:"auth_key_file,omitempty" caddy:"namespace=tailscale.auth_key_file"`
+
 	// ControlURL specifies the control URL to use for the node.
 	ControlURL string `json:"control_url,omitempty" caddy:"namespace=tailscale.control_url"`
 
 	// Ephemeral specifies whether the node should be registered as ephemeral.
 	Ephemeral opt.Bool `json:"ephemeral,omitempty" caddy:"namespace=tailscale.ephemeral"`
 
+	// UniqueSuffix is appended to the node's hostname. See App.UniqueSuffix.
+	UniqueSuffix string `json:"unique_suffix,omitempty" caddy:"namespace=tailscale.unique_suffix"`
+
 	// WebUI specifies whether the node should run the Web UI for remote management.
 	WebUI opt.Bool `json:"webui,omitempty" caddy:"namespace=tailscale.webui"`
 
+	// WebUIAllow specifies the login names and tags of the tailnet peers allowed to connect to the node's Web UI.
+	WebUIAllow []string `json:"webui_allow,omitempty" caddy:"namespace=tailscale.webui_allow"`
+
+	// PeerAPI specifies whether tailnet peers can connect to the node's peer API,
+	// which serves DNS queries from peers owned by the same user or tagged, among other features.
+	// If false, only Funnel ingress nodes can connect. Default: true
+	PeerAPI opt.Bool `json:"peerapi,omitempty" caddy:"namespace=tailscale.peerapi"`
+
+	// PeerAPIAllow specifies the login names and tags of the tailnet peers allowed to connect to the node's peer API,
+	// in addition to Funnel ingress nodes. If empty, any peer allowed by the tailnet policy can connect.
+	PeerAPIAllow []string `json:"peerapi_allow,omitempty" caddy:"namespace=tailscale.peerapi_allow"`
+
+	// Preauthorized specifies whether an auth key created with an OAuth client secret
+	// registers a pre-authorized device.
+	Preauthorized opt.Bool `json:"preauthorized,omitempty" caddy:"namespace=tailscale.preauthorized"`
+
+	// KeyExpiry specifies whether key expiry is enabled for the node's device.
+	// It can only be set if the node's auth key is an OAuth client secret.
+	KeyExpiry opt.Bool `json:"key_expiry,omitempty" caddy:"namespace=tailscale.key_expiry"`
+
 	// Hostname is the hostname to use when registering the node.
 	Hostname string `json:"hostname,omitempty" caddy:"namespace=tailscale.hostname"`
 
@@ -72,12 +248,150 @@ type Node struct {
 	// StateDir specifies the state directory for the node.
 	StateDir string `json:"state_dir,omitempty" caddy:"namespace=tailscale.state_dir"`
 
+	// ReadOnlyState specifies whether the node treats its existing state as read-only.
+	ReadOnlyState opt.Bool `json:"read_only_state,omitempty" caddy:"namespace=tailscale.read_only_state"`
+
+	// Proxy is the URL of a proxy used by the node to connect to its control server and its DERP relays.
+	// Nodes using the same control server must use the same proxy, or all use the app's proxy.
+	Proxy string `json:"proxy,omitempty" caddy:"namespace=tailscale.proxy"`
+
+	// Start controls when the node is created and connected to the tailnet
+	// when used as a proxy transport. Listeners always start the node when they are bound.
+	//
+	// By default, the node is created when the configuration using it is loaded,
+	// and connects to the tailnet on first use.
+	// If "eager", the node also connects to the tailnet when the configuration is loaded.
+	// If "lazy", the node is not created until it is first used,
+	// which defers resolving its auth key and creating its state directory.
+	Start string `json:"start,omitempty" caddy:"namespace=tailscale.start"`
+
 	// Tags specifies the list of tags to apply to this node.
 	Tags []string `json:"tags,omitempty" caddy:"namespace=tailscale.tags"`
 
+	// AcceptDNS specifies whether the node uses the tailnet's DNS configuration,
+	// such as split DNS nameservers, when resolving names.
+	// Nodes never change the system's DNS configuration, and peers' MagicDNS names
+	// can be dialed regardless of this setting.
+	// Default: true
+	AcceptDNS opt.Bool `json:"accept_dns,omitempty" caddy:"namespace=tailscale.accept_dns"`
+
+	// Nameservers are resolvers for names that are not tailnet peers, used when the node dials them,
+	// such as by proxy transports. Nameservers can be limited to domains for split horizon DNS,
+	// so that internal names are resolved by internal resolvers. Other names are resolved as usual.
+	Nameservers []Nameserver `json:"nameservers,omitempty" caddy:"namespace=tailscale.nameservers"`
+
+	// AdvertiseRoutes is a list of subnet routes, such as 192.168.1.0/24, that the node advertises to the tailnet.
+	// Once approved, the node forwards traffic for them from peers, making it a subnet router.
+	AdvertiseRoutes []string `json:"advertise_routes,omitempty" caddy:"namespace=tailscale.advertise_routes"`
+
+	// AdvertiseExitNode specifies whether the node offers to be an exit node for the tailnet.
+	AdvertiseExitNode bool `json:"advertise_exit_node,omitempty" caddy:"namespace=tailscale.advertise_exit_node"`
+
+	// AdvertiseServices is a list of Tailscale services, such as svc:web, that the node advertises as a host for,
+	// so that the admin console shows which sites it serves. The svc: prefix may be omitted.
+	// Services must be defined in the tailnet, and hosts must be approved, before peers can reach them.
+	AdvertiseServices []string `json:"advertise_services,omitempty" caddy:"namespace=tailscale.advertise_services"`
+
+	// ExitNode is the hostname or Tailscale IP of a tailnet exit node that the node routes outbound traffic through,
+	// such as dials by proxy transports to hosts that aren't tailnet peers, so that they egress from the exit node.
+	// The exit node is used once the node has connected to the tailnet, since hostnames are resolved from its network map;
+	// outbound traffic before then isn't routed through it.
+	ExitNode string `json:"exit_node,omitempty" caddy:"namespace=tailscale.exit_node"`
+
+	// ApproveRoutes specifies whether the node's advertised routes, including exit node routes,
+	// are approved using the Tailscale API once it has connected, instead of in the admin console.
+	// It can only be set if the node's auth key is an OAuth client secret.
+	ApproveRoutes bool `json:"approve_routes,omitempty" caddy:"namespace=tailscale.approve_routes"`
+
+	// Labels are arbitrary key/value pairs used to select the node
+	// with a label selector instead of its name, such as "region=eu".
+	// Labels are local to the Caddy configuration and are not sent to the tailnet.
+	Labels map[string]string `json:"labels,omitempty" caddy:"namespace=tailscale.labels"`
+
+	// AdvertiseEndpoints is a list of additional ip:port endpoints to advertise to peers,
+	// such as a public address with a manually forwarded port.
+	// The port should forward to the node's UDP Port, which should be set explicitly.
+	// This can improve direct connection rates when endpoint discovery fails.
+	AdvertiseEndpoints []string `json:"advertise_endpoints,omitempty" caddy:"namespace=tailscale.advertise_endpoints"`
+
+	// DERPRegion is the ID of the DERP region the node uses as its home, overriding automatic selection
+	// by latency, for predictable latency in single-region deployments. Peers reach the node through
+	// the region when they can't connect directly. If the region can't be reached, the node falls back
+	// to automatic selection until it can. If zero, the region is selected automatically.
+	DERPRegion int `json:"derp_region,omitempty" caddy:"namespace=tailscale.derp_region"`
+
+	// CopyBufferSize is the size in bytes of the buffer used to write response bodies
+	// on the node's plain TCP listeners. Larger buffers reduce per-write overhead
+	// in the userspace network stack when serving large files.
+	// Buffers are pooled and shared between connections. If zero, the net/http default is used.
+	CopyBufferSize int `json:"copy_buffer_size,omitempty" caddy:"namespace=tailscale.copy_buffer_size"`
+
+	// TCPSendBufferSize is the maximum size in bytes that the node's TCP send buffers can grow to.
+	// If zero, the tsnet default is used.
+	TCPSendBufferSize int `json:"tcp_send_buffer_size,omitempty" caddy:"namespace=tailscale.tcp_send_buffer_size"`
+
+	// SlowRequestThreshold is how long requests received on the node can take before they are logged as slow.
+	SlowRequestThreshold caddy.Duration `json:"slow_request_threshold,omitempty" caddy:"namespace=tailscale.slow_request_threshold"`
+
+	// MaxBodySize is the maximum size in bytes of the bodies of requests received on the node.
+	MaxBodySize int64 `json:"max_body_size,omitempty" caddy:"namespace=tailscale.max_body_size"`
+
+	// Methods is the list of HTTP methods allowed for requests received on the node.
+	Methods []string `json:"methods,omitempty" caddy:"namespace=tailscale.methods"`
+
+	// Funnel specifies whether the node's TCP listeners on Funnel ports (443, 8443 and 10000)
+	// are also exposed to the public internet with Tailscale Funnel, like listeners on the tailscale+funnel network.
+	// Listeners on other ports are only reachable from the tailnet.
+	Funnel bool `json:"funnel,omitempty" caddy:"namespace=tailscale.funnel"`
+
+	// TailnetOnly specifies whether sites with a tailscale directive for the node must only be reachable from the tailnet.
+	// The config fails to load if the server of such a site also listens on another address,
+	// such as when the site has no bind directive, or on a port the node exposes with Funnel.
+	// It is only supported in the tailscale directive.
+	TailnetOnly bool `json:"tailnet_only,omitempty" caddy:"namespace=tailscale.tailnet_only"`
+
+	// FunnelHeaders are response headers set on responses to requests received over Funnel on the node.
+	FunnelHeaders http.Header `json:"funnel_headers,omitempty" caddy:"namespace=tailscale.funnel_headers"`
+
+	// TailnetHeaders are response headers set on responses to other requests received on the node.
+	TailnetHeaders http.Header `json:"tailnet_headers,omitempty" caddy:"namespace=tailscale.tailnet_headers"`
+
+	// Forwards are TCP forwarders that accept connections on local ports and forward them
+	// to tailnet targets through the node, exposing tailnet services to local clients.
+	// Nodes with forwards are created when the config is loaded.
+	// Forwards are only supported on nodes configured in the App, and the tailscale directive rejects them.
+	Forwards []Forward `json:"forwards,omitempty" caddy:"namespace=tailscale.forwards"`
+
+	// Exposes forward connections on the node's tailnet ports to local addresses, such as Unix sockets,
+	// making local services available to peers as TCP services.
+	// Nodes with exposes are started when the config is loaded.
+	// Exposes are only supported on nodes configured in the App, and the tailscale directive rejects them.
+	Exposes []Expose `json:"exposes,omitempty" caddy:"namespace=tailscale.exposes"`
+
 	name string
 }
 
+// clone returns a copy of n that shares no slices or maps with it.
+func (n Node) clone() Node {
+	n.WebUIAllow = slices.Clone(n.WebUIAllow)
+	n.PeerAPIAllow = slices.Clone(n.PeerAPIAllow)
+	n.Tags = slices.Clone(n.Tags)
+	n.AdvertiseRoutes = slices.Clone(n.AdvertiseRoutes)
+	n.AdvertiseServices = slices.Clone(n.AdvertiseServices)
+	n.Labels = maps.Clone(n.Labels)
+	n.AdvertiseEndpoints = slices.Clone(n.AdvertiseEndpoints)
+	n.Methods = slices.Clone(n.Methods)
+	n.FunnelHeaders = n.FunnelHeaders.Clone()
+	n.TailnetHeaders = n.TailnetHeaders.Clone()
+	n.Forwards = slices.Clone(n.Forwards)
+	n.Exposes = slices.Clone(n.Exposes)
+	n.Nameservers = slices.Clone(n.Nameservers)
+	for i := range n.Nameservers {
+		n.Nameservers[i].Domains = slices.Clone(n.Nameservers[i].Domains)
+	}
+	return n
+}
+
 func (App) CaddyModule() caddy.ModuleInfo {
 	return caddy.ModuleInfo{
 		ID:  "tailscale",
@@ -86,16 +400,83 @@ func (App) CaddyModule() caddy.ModuleInfo {
 }
 
 func (t *App) Provision(ctx caddy.Context) error {
+	t.ctx = ctx
 	t.logger = ctx.Logger(t)
-	return nil
+	if err := t.loadNodesFile(); err != nil {
+		return err
+	}
+	if err := t.normalizeTags(); err != nil {
+		return err
+	}
+	if err := t.provisionTesting(); err != nil {
+		return err
+	}
+	var err error
+	if t.requestMetrics, err = newRequestMetrics(ctx.GetMetricsRegistry()); err != nil {
+		return err
+	}
+	if err := registerPeerLatencyMetrics(ctx.GetMetricsRegistry()); err != nil {
+		return err
+	}
+	if err := registerControlMetrics(ctx.GetMetricsRegistry()); err != nil {
+		return err
+	}
+	if err := t.validateProxies(); err != nil {
+		return err
+	}
+	if err := t.resolveHostinfo(); err != nil {
+		return err
+	}
+	return t.validateMTU()
 }
 
-func (t *App) Start() error {
+func (t *App) Start() (err error) {
+	if err := t.checkTailnetOnly(); err != nil {
+		return err
+	}
+	// Process-wide settings are applied before nodes are started,
+	// and the previous config's settings are restored if the app fails to start.
+	restoreProxy, err := t.applyProxy()
+	if err != nil {
+		return err
+	}
+	restoreKnobs := t.applyKnobs()
+	defer func() {
+		if err != nil {
+			restoreKnobs()
+			restoreProxy()
+		}
+	}()
+	t.resolveSiteConfigs()
+	if err := t.startTransports(); err != nil {
+		return err
+	}
+	if err := t.startForwards(); err != nil {
+		return errors.Join(err, t.stopForwards())
+	}
+	if err := t.startReaper(); err != nil {
+		return errors.Join(err, t.stopForwards())
+	}
+	if err := t.startRollingRestart(); err != nil {
+		// Unwind what was started, in reverse order.
+		t.cancelReaper()
+		return errors.Join(err, t.stopForwards())
+	}
+	t.watchNodesFile()
+	t.logSites()
+	t.logConfigChanges()
 	return nil
 }
 
 func (t *App) Stop() error {
-	return nil
+	t.resetProxy()
+	t.resetKnobs()
+	t.stopRollingRestart()
+	if t.stopNodesFileWatch != nil {
+		t.stopNodesFileWatch()
+	}
+	t.cancelReaper()
+	return t.stopForwards()
 }
 
 func parseAppConfig(d *caddyfile.Dispenser, _ any) (any, error) {
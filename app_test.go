@@ -5,11 +5,14 @@ package tscaddy
 
 import (
 	"encoding/json"
+	"os"
 	"testing"
 
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/google/go-cmp/cmp"
+	"tailscale.com/envknob"
+	"tailscale.com/types/opt"
 )
 
 func Test_ParseApp(t *testing.T) {
@@ -104,6 +107,434 @@ func Test_ParseApp(t *testing.T) {
 			wantErr: false,
 			authKey: "tskey-node",
 		},
+		{
+			name: "buffer sizes",
+			d: caddyfile.NewTestDispenser(`
+				tailscsale {
+					foo {
+						copy_buffer_size 256KiB
+						tcp_send_buffer_size 8MiB
+					}
+				}`),
+			want: `{"nodes":{"foo":{"copy_buffer_size":262144,"tcp_send_buffer_size":8388608}}}`,
+		},
+		{
+			name: "derp region",
+			d: caddyfile.NewTestDispenser(`
+				tailscsale {
+					foo {
+						derp_region 4
+					}
+				}`),
+			want: `{"nodes":{"foo":{"derp_region":4}}}`,
+		},
+		{
+			name: "netcheck options",
+			d: caddyfile.NewTestDispenser(`
+				tailscsale {
+					port_mapping false
+					upnp
+					stun_when_idle false
+				}`),
+			want: `{"port_mapping":false,"upnp":true,"stun_when_idle":false}`,
+		},
+		{
+			name: "labels",
+			d: caddyfile.NewTestDispenser(`
+				tailscsale {
+					foo {
+						label region eu
+						label tier edge
+					}
+				}`),
+			want: `{"nodes":{"foo":{"labels":{"region":"eu","tier":"edge"}}}}`,
+		},
+		{
+			name: "reap",
+			d: caddyfile.NewTestDispenser(`
+				tailscsale {
+					reap {
+						hostname_prefix preview-
+						tags tag:ci
+						ttl 12h
+					}
+				}`),
+			want: `{"reap":{"hostname_prefix":"preview-","tags":["tag:ci"],"ttl":43200000000000}}`,
+		},
+		{
+			name: "reap without filters",
+			d: caddyfile.NewTestDispenser(`
+				tailscsale {
+					reap {
+						ttl 12h
+					}
+				}`),
+			wantErr: true,
+		},
+		{
+			name: "rolling restart",
+			d: caddyfile.NewTestDispenser(`
+				tailscsale {
+					rolling_restart tag:web {
+						settle 30s
+					}
+				}`),
+			want: `{"rolling_restart":{"tag":"tag:web","settle":30000000000}}`,
+		},
+		{
+			name: "auth key files",
+			d: caddyfile.NewTestDispenser(`
+				tailscsale {
+					auth_key_file /run/secrets/ts-authkey
+					foo {
+						auth_key_file /run/secrets/foo-authkey
+					}
+				}`),
+			want: `{"auth_key_file":"/run/secrets/ts-authkey","nodes":{"foo":{"auth_key_file":"/run/secrets/foo-authkey"}}}`,
+		},
+		{
+			name: "nodes file",
+			d: caddyfile.NewTestDispenser(`
+				tailscsale {
+					nodes_file /etc/caddy/tailscale-nodes.json
+				}`),
+			want: `{"nodes_file":"/etc/caddy/tailscale-nodes.json"}`,
+		},
+		{
+			name: "testing mode",
+			d: caddyfile.NewTestDispenser(`
+				tailscsale {
+					testing
+				}`),
+			want: `{"testing":{}}`,
+		},
+		{
+			name: "testing mode with options",
+			d: caddyfile.NewTestDispenser(`
+				tailscsale {
+					testing {
+						control_listen 127.0.0.1:9901
+						base_port 41641
+					}
+				}`),
+			want: `{"testing":{"control_listen":"127.0.0.1:9901","base_port":41641}}`,
+		},
+		{
+			name: "testing mode with invalid base port",
+			d: caddyfile.NewTestDispenser(`
+				tailscsale {
+					testing {
+						base_port 70000
+					}
+				}`),
+			wantErr: true,
+		},
+		{
+			name: "rolling restart without tag",
+			d: caddyfile.NewTestDispenser(`
+				tailscsale {
+					rolling_restart
+				}`),
+			wantErr: true,
+		},
+		{
+			name: "invalid label",
+			d: caddyfile.NewTestDispenser(`
+				tailscsale {
+					foo {
+						label region=eu
+					}
+				}`),
+			wantErr: true,
+		},
+		{
+			name: "read-only state",
+			d: caddyfile.NewTestDispenser(`
+				tailscsale {
+					read_only_state
+					foo {
+						read_only_state false
+					}
+				}`),
+			want: `{"read_only_state":true,"nodes":{"foo":{"read_only_state":false}}}`,
+		},
+		{
+			name: "lock signer",
+			d: caddyfile.NewTestDispenser(`
+				tailscsale {
+					lock_signer signer
+				}`),
+			want: `{"lock_signer":"signer"}`,
+		},
+		{
+			name: "slow request threshold",
+			d: caddyfile.NewTestDispenser(`
+				tailscsale {
+					slow_request_threshold 5s
+					foo {
+						slow_request_threshold 500ms
+					}
+				}`),
+			want: `{"slow_request_threshold":5000000000,"nodes":{"foo":{"slow_request_threshold":500000000}}}`,
+		},
+		{
+			name: "advertise routes",
+			d: caddyfile.NewTestDispenser(`
+				tailscsale {
+					router {
+						advertise_routes 192.168.1.0/24 10.0.0.0/8
+						advertise_exit_node
+						approve_routes
+					}
+				}`),
+			want: `{"nodes":{"router":{"advertise_routes":["192.168.1.0/24","10.0.0.0/8"],"advertise_exit_node":true,"approve_routes":true}}}`,
+		},
+		{
+			name: "advertise services",
+			d: caddyfile.NewTestDispenser(`
+				tailscsale {
+					web {
+						advertise_services svc:web api
+					}
+				}`),
+			want: `{"nodes":{"web":{"advertise_services":["svc:web","api"]}}}`,
+		},
+		{
+			name: "nameservers",
+			d: caddyfile.NewTestDispenser(`
+				tailscsale {
+					foo {
+						nameserver 10.0.0.53 corp.example.com example.internal
+						nameserver [fd00::53]:5353
+					}
+				}`),
+			want: `{"nodes":{"foo":{"nameservers":[{"address":"10.0.0.53","domains":["corp.example.com","example.internal"]},{"address":"[fd00::53]:5353"}]}}}`,
+		},
+		{
+			name: "invalid nameserver",
+			d: caddyfile.NewTestDispenser(`
+				tailscsale {
+					foo {
+						nameserver dns.example.com
+					}
+				}`),
+			wantErr: true,
+		},
+		{
+			name: "funnel",
+			d: caddyfile.NewTestDispenser(`
+				tailscsale {
+					public {
+						funnel
+					}
+					private {
+						funnel false
+					}
+				}`),
+			want: `{"nodes":{"private":{},"public":{"funnel":true}}}`,
+		},
+		{
+			name: "exit_node",
+			d: caddyfile.NewTestDispenser(`
+				tailscsale {
+					egress {
+						exit_node eu-exit
+					}
+				}`),
+			want: `{"nodes":{"egress":{"exit_node":"eu-exit"}}}`,
+		},
+		{
+			name: "tailnet_only",
+			d: caddyfile.NewTestDispenser(`
+				tailscsale {
+					admin {
+						tailnet_only
+					}
+					other {
+						tailnet_only false
+					}
+				}`),
+			want: `{"nodes":{"admin":{"tailnet_only":true},"other":{}}}`,
+		},
+		{
+			name: "ingress headers",
+			d: caddyfile.NewTestDispenser(`
+				tailscsale {
+					tailnet_headers {
+						X-Frame-Options DENY
+					}
+					foo {
+						funnel_headers {
+							Strict-Transport-Security "max-age=31536000"
+							Content-Security-Policy "default-src 'self'"
+						}
+					}
+				}`),
+			want: `{"tailnet_headers":{"X-Frame-Options":["DENY"]},"nodes":{"foo":{"funnel_headers":{"Content-Security-Policy":["default-src 'self'"],"Strict-Transport-Security":["max-age=31536000"]}}}}`,
+		},
+		{
+			name: "proxy",
+			d: caddyfile.NewTestDispenser(`
+				tailscsale {
+					proxy http://proxy.example.com:3128
+					foo {
+						proxy socks5://127.0.0.1:1080
+					}
+				}`),
+			want: `{"proxy":"http://proxy.example.com:3128","nodes":{"foo":{"proxy":"socks5://127.0.0.1:1080"}}}`,
+		},
+		{
+			name: "forwards",
+			d: caddyfile.NewTestDispenser(`
+				tailscsale {
+					foo {
+						forward 5432 db:5432
+						forward 0.0.0.0:6379 redis.tail1234.ts.net:6379
+					}
+				}`),
+			want: `{"nodes":{"foo":{"forwards":[{"listen":"5432","to":"db:5432"},{"listen":"0.0.0.0:6379","to":"redis.tail1234.ts.net:6379"}]}}}`,
+		},
+		{
+			name: "exposes",
+			d: caddyfile.NewTestDispenser(`
+				tailscsale {
+					foo {
+						expose 8080 unix//run/app.sock
+						expose 5432 127.0.0.1:5432
+					}
+				}`),
+			want: `{"nodes":{"foo":{"exposes":[{"port":8080,"to":"unix//run/app.sock"},{"port":5432,"to":"127.0.0.1:5432"}]}}}`,
+		},
+		{
+			name: "invalid expose address",
+			d: caddyfile.NewTestDispenser(`
+				tailscsale {
+					foo {
+						expose 8080 127.0.0.1:8000-8010
+					}
+				}`),
+			wantErr: true,
+		},
+		{
+			name: "forward recording",
+			d: caddyfile.NewTestDispenser(`
+				tailscsale {
+					foo {
+						forward 5432 db:5432 {
+							recorder 100.64.0.10:80 100.64.0.11:80
+							record_dir /var/lib/caddy/recordings
+							record_fail_open
+						}
+					}
+				}`),
+			want: `{"nodes":{"foo":{"forwards":[{"listen":"5432","to":"db:5432","record":{"recorders":["100.64.0.10:80","100.64.0.11:80"],"dir":"/var/lib/caddy/recordings","fail_open":true}}]}}}`,
+		},
+		{
+			name: "invalid forward recorder",
+			d: caddyfile.NewTestDispenser(`
+				tailscsale {
+					foo {
+						forward 5432 db:5432 {
+							recorder recorder.tail1234.ts.net
+						}
+					}
+				}`),
+			wantErr: true,
+		},
+		{
+			name: "invalid forward target",
+			d: caddyfile.NewTestDispenser(`
+				tailscsale {
+					foo {
+						forward 5432 db
+					}
+				}`),
+			wantErr: true,
+		},
+		{
+			name: "oauth device options",
+			d: caddyfile.NewTestDispenser(`
+				tailscsale {
+					preauthorized false
+					foo {
+						key_expiry false
+					}
+				}`),
+			want: `{"preauthorized":false,"nodes":{"foo":{"key_expiry":false}}}`,
+		},
+		{
+			name: "hostinfo options",
+			d: caddyfile.NewTestDispenser(`
+				tailscsale {
+					hostinfo_app caddy-edge
+					device_model "Caddy (edge-1)"
+				}`),
+			want: `{"hostinfo_app":"caddy-edge","device_model":"Caddy (edge-1)"}`,
+		},
+		{
+			name: "low memory",
+			d: caddyfile.NewTestDispenser(`
+				tailscsale {
+					low_memory
+				}`),
+			want: `{"low_memory":true}`,
+		},
+		{
+			name: "mtu",
+			d: caddyfile.NewTestDispenser(`
+				tailscsale {
+					mtu 1400
+				}`),
+			want: `{"mtu":1400}`,
+		},
+		{
+			name: "invalid mtu",
+			d: caddyfile.NewTestDispenser(`
+				tailscsale {
+					mtu large
+				}`),
+			wantErr: true,
+		},
+		{
+			name: "lazy start",
+			d: caddyfile.NewTestDispenser(`
+				tailscsale {
+					foo {
+						start lazy
+					}
+				}`),
+			want: `{"nodes":{"foo":{"start":"lazy"}}}`,
+		},
+		{
+			name: "invalid start",
+			d: caddyfile.NewTestDispenser(`
+				tailscsale {
+					foo {
+						start later
+					}
+				}`),
+			wantErr: true,
+		},
+		{
+			name: "invalid derp region",
+			d: caddyfile.NewTestDispenser(`
+				tailscsale {
+					foo {
+						derp_region nyc
+					}
+				}`),
+			wantErr: true,
+		},
+		{
+			name: "invalid buffer size",
+			d: caddyfile.NewTestDispenser(`
+				tailscsale {
+					foo {
+						copy_buffer_size lots
+					}
+				}`),
+			wantErr: true,
+		},
 	}
 
 	for _, testcase := range tests {
@@ -132,6 +563,30 @@ func Test_ParseApp(t *testing.T) {
 
 }
 
+func Test_ApplyNetcheckKnobs(t *testing.T) {
+	for _, env := range []string{envDisablePortMapper, envDisableUPnP, envSTUNStopOnIdle} {
+		t.Setenv(env, "")
+		t.Cleanup(func() { envknob.Setenv(env, "") })
+	}
+
+	app := &App{
+		PortMapping:  opt.NewBool(false),
+		STUNWhenIdle: opt.NewBool(true),
+	}
+	app.applyNetcheckKnobs()
+
+	if got, want := envknob.Bool(envDisablePortMapper), true; got != want {
+		t.Errorf("%s = %v, want %v", envDisablePortMapper, got, want)
+	}
+	if got, want := envknob.Bool(envSTUNStopOnIdle), false; got != want {
+		t.Errorf("%s = %v, want %v", envSTUNStopOnIdle, got, want)
+	}
+	// unset options leave the environment untouched
+	if got, want := os.Getenv(envDisableUPnP), ""; got != want {
+		t.Errorf("%s = %q, want %q", envDisableUPnP, got, want)
+	}
+}
+
 func compareJSON(s1, s2 string, t *testing.T) string {
 	var v1, v2 map[string]any
 	if err := json.Unmarshal([]byte(s1), &v1); err != nil {
@@ -143,3 +598,60 @@ func compareJSON(s1, s2 string, t *testing.T) string {
 
 	return cmp.Diff(v1, v2)
 }
+
+func Test_NormalizeTags(t *testing.T) {
+	tests := map[string]struct {
+		tags    []string
+		want    []string
+		wantErr bool
+	}{
+		"valid": {
+			tags: []string{"tag:server"},
+			want: []string{"tag:server"},
+		},
+		"missing prefix": {
+			tags: []string{"webserver"},
+			want: []string{"tag:webserver"},
+		},
+		"uppercase and duplicates": {
+			tags: []string{"tag:Web", "web", "tag:db"},
+			want: []string{"tag:db", "tag:web"},
+		},
+		"invalid": {
+			tags:    []string{"web server"},
+			wantErr: true,
+		},
+		"empty": {},
+	}
+	for tn, tt := range tests {
+		t.Run(tn, func(t *testing.T) {
+			got, err := normalizeTags(tt.tags)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("normalizeTags() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if diff := cmp.Diff(got, tt.want); diff != "" {
+				t.Errorf("normalizeTags() diff(-got +want):\n%s", diff)
+			}
+		})
+	}
+}
+
+func Test_HasAnyTag(t *testing.T) {
+	tests := map[string]struct {
+		have []string
+		want []string
+		ok   bool
+	}{
+		"shared tag":   {have: []string{"tag:db", "tag:server"}, want: []string{"tag:server"}, ok: true},
+		"no shared":    {have: []string{"tag:db"}, want: []string{"tag:server", "tag:web"}},
+		"untagged":     {want: []string{"tag:server"}},
+		"nothing want": {have: []string{"tag:server"}},
+	}
+	for tn, tt := range tests {
+		t.Run(tn, func(t *testing.T) {
+			if got := hasAnyTag(tt.have, tt.want); got != tt.ok {
+				t.Errorf("hasAnyTag(%v, %v) = %v, want %v", tt.have, tt.want, got, tt.ok)
+			}
+		})
+	}
+}
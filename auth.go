@@ -6,24 +6,30 @@ package tscaddy
 // auth.go contains the TailscaleAuth module and supporting logic.
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
 	"reflect"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp/caddyauth"
-	"tailscale.com/client/tailscale"
+	"go.uber.org/zap"
+	"tailscale.com/tailcfg"
 	"tailscale.com/tsnet"
 )
 
 func init() {
 	caddy.RegisterModule(Auth{})
-	httpcaddyfile.RegisterHandlerDirective("tailscale_auth", parseAuthConfig)
+	httpcaddyfile.RegisterDirective("tailscale_auth", parseAuthDirective)
 	httpcaddyfile.RegisterDirectiveOrder("tailscale_auth", httpcaddyfile.After, "basicauth")
 }
 
@@ -32,9 +38,29 @@ func init() {
 // that node will be used to identify the user information for inbound requests.
 // Otherwise, it will attempt to find and use the local tailscaled daemon running on the system.
 type Auth struct {
-	localclient *tailscale.LocalClient
+	// ResolverRaw configures how the Tailscale identity of the client is resolved.
+	// If unset, the node that received the request is queried with WhoIs.
+	ResolverRaw json.RawMessage `json:"resolver,omitempty" caddy:"namespace=tailscale.identity inline_key=source"`
+
+	// Timeout is how long resolving the client's identity can take before the request is handled
+	// according to OnTimeout, so that a slow node doesn't stall requests. If zero, there is no limit.
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	// OnTimeout is what happens to requests whose identity isn't resolved within Timeout:
+	// "deny" fails authentication, and "allow" lets the request through without an identity,
+	// with an empty user ID and no Tailscale user metadata. Default: deny
+	OnTimeout string `json:"on_timeout,omitempty"`
+
+	resolver IdentityResolver
+	logger   *zap.Logger
 }
 
+// Policies for requests whose identity isn't resolved in time.
+const (
+	onTimeoutDeny  = "deny"
+	onTimeoutAllow = "allow"
+)
+
 func (Auth) CaddyModule() caddy.ModuleInfo {
 	return caddy.ModuleInfo{
 		ID:  "http.authentication.providers.tailscale",
@@ -42,6 +68,28 @@ func (Auth) CaddyModule() caddy.ModuleInfo {
 	}
 }
 
+// Provision implements caddy.Provisioner.
+func (ta *Auth) Provision(ctx caddy.Context) error {
+	ta.logger = ctx.Logger()
+	switch ta.OnTimeout {
+	case "", onTimeoutDeny, onTimeoutAllow:
+	default:
+		return fmt.Errorf("invalid on_timeout policy %q, must be %q or %q", ta.OnTimeout, onTimeoutDeny, onTimeoutAllow)
+	}
+
+	if ta.ResolverRaw == nil {
+		ta.resolver = new(WhoIsResolver)
+		return nil
+	}
+
+	mod, err := ctx.LoadModule(ta, "ResolverRaw")
+	if err != nil {
+		return fmt.Errorf("loading identity resolver: %v", err)
+	}
+	ta.resolver = mod.(IdentityResolver)
+	return nil
+}
+
 // findTsnetListener recursively searches ln for wrapped or embedded net.Listeners
 // until it finds a tsnetListener or runs out.
 // ok indicates if a tsnetListener was found.
@@ -90,35 +138,6 @@ type wrappedListener interface {
 	Unwrap() net.Listener
 }
 
-// client returns the tailscale LocalClient for the TailscaleAuth module.
-// If the LocalClient has not already been configured, the provided request will be used to
-// lookup the tailscale node that serviced the request, and get the associated LocalClient.
-func (ta *Auth) client(r *http.Request) (*tailscale.LocalClient, error) {
-	if ta.localclient != nil {
-		return ta.localclient, nil
-	}
-
-	// if request was made through a tsnet listener, set up the client for the associated tsnet
-	// server.
-	server := r.Context().Value(caddyhttp.ServerCtxKey).(*caddyhttp.Server)
-	for _, listener := range server.Listeners() {
-		if tsl, ok := findTsnetListener(listener); ok {
-			var err error
-			ta.localclient, err = tsl.Server().LocalClient()
-			if err != nil {
-				return nil, err
-			}
-		}
-	}
-
-	if ta.localclient == nil {
-		// default to empty client that will talk to local tailscaled
-		ta.localclient = new(tailscale.LocalClient)
-	}
-
-	return ta.localclient, nil
-}
-
 // tsnetListener is an interface that is implemented by [tsnet.Listener].
 type tsnetListener interface {
 	Server() *tsnet.Server
@@ -132,25 +151,29 @@ type tsnetListener interface {
 //   - tailscale_name: the user's display name
 //   - tailscale_profile_picture: the user's profile picture URL
 //   - tailscale_tailnet: the user's tailnet name (if the user is not connecting to a shared node)
-func (ta Auth) Authenticate(w http.ResponseWriter, r *http.Request) (caddyauth.User, bool, error) {
+//   - tailscale_node: the name of the user's node
+//   - tailscale_os: the operating system of the user's node, if known
+//   - tailscale_capabilities: comma-separated, sorted list of peer capabilities granted to the user's node
+func (ta *Auth) Authenticate(w http.ResponseWriter, r *http.Request) (caddyauth.User, bool, error) {
 	user := caddyauth.User{}
 
-	client, err := ta.client(r)
-	if err != nil {
-		return user, false, err
+	info, err := resolveIdentityWithin(ta.resolver, r, time.Duration(ta.Timeout))
+	if errors.Is(err, errIdentityTimeout) && ta.OnTimeout == onTimeoutAllow {
+		if ta.logger != nil {
+			ta.logger.Warn("allowing request without tailscale identity", zap.String("remote_addr", r.RemoteAddr), zap.Error(err))
+		}
+		return user, true, nil
 	}
-
-	info, err := client.WhoIs(r.Context(), r.RemoteAddr)
 	if err != nil {
 		return user, false, err
 	}
 
 	if len(info.Node.Tags) != 0 {
-		return user, false, fmt.Errorf("node %s has tags", info.Node.Hostinfo.Hostname())
+		return user, false, fmt.Errorf("node %s has tags", info.Node.ComputedName)
 	}
 
 	var tailnet string
-	if !info.Node.Hostinfo.ShareeNode() {
+	if !info.Node.Hostinfo.Valid() || !info.Node.Hostinfo.ShareeNode() {
 		if s, found := strings.CutPrefix(info.Node.Name, info.Node.ComputedName+"."); found {
 			tailnet = strings.TrimSuffix(s, ".")
 		}
@@ -163,20 +186,132 @@ func (ta Auth) Authenticate(w http.ResponseWriter, r *http.Request) (caddyauth.U
 		"tailscale_name":            info.UserProfile.DisplayName,
 		"tailscale_profile_picture": info.UserProfile.ProfilePicURL,
 		"tailscale_tailnet":         tailnet,
+		"tailscale_node":            info.Node.ComputedName,
+		"tailscale_os":              nodeOS(info.Node),
+		"tailscale_capabilities":    capabilityNames(info.CapMap),
 	}
 	return user, true, nil
 }
 
-func parseAuthConfig(_ httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+// nodeOS returns the operating system reported by node, or an empty string if unknown.
+func nodeOS(node *tailcfg.Node) string {
+	if !node.Hostinfo.Valid() {
+		return ""
+	}
+	return node.Hostinfo.OS()
+}
+
+// capabilityNames returns the sorted, comma-separated names of the capabilities in capMap.
+func capabilityNames(capMap tailcfg.PeerCapMap) string {
+	names := make([]string, 0, len(capMap))
+	for c := range capMap {
+		names = append(names, string(c))
+	}
+	slices.Sort(names)
+	return strings.Join(names, ",")
+}
+
+// parseAuthDirective parses the tailscale_auth directive, which adds a route that scrubs identity headers sent by clients,
+// unless disabled, followed by the authentication route.
+func parseAuthDirective(h httpcaddyfile.Helper) ([]httpcaddyfile.ConfigValue, error) {
+	if !h.Next() {
+		return nil, h.ArgErr()
+	}
+	matcherSet, err := h.ExtractMatcherSet()
+	if err != nil {
+		return nil, err
+	}
+	auth, scrub, err := parseAuthConfig(h)
+	if err != nil {
+		return nil, err
+	}
+
+	var routes []httpcaddyfile.ConfigValue
+	if scrub != nil {
+		// Headers are scrubbed from all requests, whether or not they match, since other routes may proxy them.
+		routes = h.NewRoute(nil, scrub)
+	}
+	return append(routes, h.NewRoute(matcherSet, auth)...), nil
+}
+
+// parseAuthConfig parses the tailscale_auth directive, returning the authentication handler
+// and the header scrubbing handler, which is nil if disabled. Syntax:
+//
+//	tailscale_auth {
+//	  resolver <source> [<args...>]
+//	  timeout <duration>
+//	  on_timeout deny|allow
+//	  scrub_headers <header>...|off
+//	}
+func parseAuthConfig(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, *ScrubHeaders, error) {
 	var ta Auth
+	scrub := new(ScrubHeaders)
+
+	h.Next() // consume directive name
+	if h.NextArg() {
+		return nil, nil, h.ArgErr()
+	}
+	for h.NextBlock(0) {
+		switch h.Val() {
+		case "resolver":
+			if !h.NextArg() {
+				return nil, nil, h.ArgErr()
+			}
+			source := h.Val()
+			unm, err := caddyfile.UnmarshalModule(h.Dispenser, "tailscale.identity."+source)
+			if err != nil {
+				return nil, nil, err
+			}
+			ta.ResolverRaw = caddyconfig.JSONModuleObject(unm, "source", source, nil)
+
+		case "timeout":
+			if !h.NextArg() {
+				return nil, nil, h.ArgErr()
+			}
+			v, err := caddy.ParseDuration(h.Val())
+			if err != nil {
+				return nil, nil, h.WrapErr(err)
+			}
+			ta.Timeout = caddy.Duration(v)
+			if h.NextArg() {
+				return nil, nil, h.ArgErr()
+			}
+
+		case "on_timeout":
+			if !h.AllArgs(&ta.OnTimeout) {
+				return nil, nil, h.ArgErr()
+			}
+			if ta.OnTimeout != onTimeoutDeny && ta.OnTimeout != onTimeoutAllow {
+				return nil, nil, h.Errf("on_timeout must be %s or %s", onTimeoutDeny, onTimeoutAllow)
+			}
+
+		case "scrub_headers":
+			args := h.RemainingArgs()
+			if len(args) == 0 {
+				return nil, nil, h.ArgErr()
+			}
+			if len(args) == 1 && args[0] == "off" {
+				scrub = nil
+				continue
+			}
+			if scrub == nil {
+				return nil, nil, h.Err("scrub_headers is off")
+			}
+			scrub.Headers = append(scrub.Headers, args...)
+
+		default:
+			return nil, nil, h.Errf("unrecognized subdirective: %s", h.Val())
+		}
+	}
 
 	return caddyauth.Authentication{
 		ProvidersRaw: caddy.ModuleMap{
 			"tailscale": caddyconfig.JSON(ta, nil),
 		},
-	}, nil
+	}, scrub, nil
 }
 
 var (
+	_ caddy.Provisioner       = (*Auth)(nil)
 	_ caddyauth.Authenticator = (*Auth)(nil)
 )
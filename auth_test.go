@@ -0,0 +1,222 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/google/go-cmp/cmp"
+	"tailscale.com/client/tailscale/apitype"
+)
+
+func Test_AuthenticateStatic(t *testing.T) {
+	ta := &Auth{resolver: StaticResolver{
+		Identities: map[string]StaticIdentity{
+			"100.64.0.1": {
+				Login:          "alice@example.com",
+				Name:           "Alice",
+				ProfilePicture: "https://example.com/alice.png",
+				Node:           "laptop.tail1234.ts.net.",
+				OS:             "macOS",
+				Capabilities:   []string{"example.com/cap/managed", "example.com/cap/admin"},
+			},
+			"100.64.0.2": {
+				Login: "tagged-devices",
+				Node:  "server.tail1234.ts.net.",
+				Tags:  []string{"tag:server"},
+			},
+		},
+	}}
+
+	tests := map[string]struct {
+		remoteAddr string
+		wantOK     bool
+		wantID     string
+		wantMeta   map[string]string
+	}{
+		"known user": {
+			remoteAddr: "100.64.0.1:1234",
+			wantOK:     true,
+			wantID:     "alice@example.com",
+			wantMeta: map[string]string{
+				"tailscale_login":           "alice",
+				"tailscale_user":            "alice@example.com",
+				"tailscale_name":            "Alice",
+				"tailscale_profile_picture": "https://example.com/alice.png",
+				"tailscale_tailnet":         "tail1234.ts.net",
+				"tailscale_node":            "laptop",
+				"tailscale_os":              "macOS",
+				"tailscale_capabilities":    "example.com/cap/admin,example.com/cap/managed",
+			},
+		},
+		"tagged node": {
+			remoteAddr: "100.64.0.2:1234",
+		},
+		"unknown address": {
+			remoteAddr: "100.64.0.3:1234",
+		},
+	}
+	for tn, tt := range tests {
+		t.Run(tn, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+
+			user, ok, err := ta.Authenticate(httptest.NewRecorder(), r)
+			if ok != tt.wantOK {
+				t.Fatalf("Authenticate() ok = %v, want %v (err: %v)", ok, tt.wantOK, err)
+			}
+			if !ok {
+				return
+			}
+			if user.ID != tt.wantID {
+				t.Errorf("Authenticate() user.ID = %v, want %v", user.ID, tt.wantID)
+			}
+			if diff := cmp.Diff(user.Metadata, tt.wantMeta); diff != "" {
+				t.Errorf("Authenticate() metadata diff(-got +want):\n%s", diff)
+			}
+		})
+	}
+}
+
+func Test_HeaderResolver(t *testing.T) {
+	hr := new(HeaderResolver)
+	if err := hr.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		trusted   bool
+		headers   map[string]string
+		wantErr   bool
+		wantLogin string
+		wantName  string
+	}{
+		"trusted proxy": {
+			trusted:   true,
+			headers:   map[string]string{"Tailscale-User-Login": "alice@example.com", "Tailscale-User-Name": "Alice"},
+			wantLogin: "alice@example.com",
+			wantName:  "Alice",
+		},
+		"encoded display name": {
+			trusted:   true,
+			headers:   map[string]string{"Tailscale-User-Login": "bob@example.com", "Tailscale-User-Name": "=?utf-8?q?B=C3=B6b?="},
+			wantLogin: "bob@example.com",
+			wantName:  "Böb",
+		},
+		"untrusted proxy": {
+			headers: map[string]string{"Tailscale-User-Login": "alice@example.com"},
+			wantErr: true,
+		},
+		"missing login": {
+			trusted: true,
+			wantErr: true,
+		},
+	}
+	for tn, tt := range tests {
+		t.Run(tn, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			vars := map[string]any{caddyhttp.TrustedProxyVarKey: tt.trusted}
+			r = r.WithContext(context.WithValue(r.Context(), caddyhttp.VarsCtxKey, vars))
+
+			info, err := hr.ResolveIdentity(r)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ResolveIdentity() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got := info.UserProfile.LoginName; got != tt.wantLogin {
+				t.Errorf("ResolveIdentity() login = %v, want %v", got, tt.wantLogin)
+			}
+			if got := info.UserProfile.DisplayName; got != tt.wantName {
+				t.Errorf("ResolveIdentity() name = %v, want %v", got, tt.wantName)
+			}
+		})
+	}
+}
+
+// slowResolver is an identity resolver whose lookups don't finish until the request's context is done.
+type slowResolver struct{}
+
+func (slowResolver) ResolveIdentity(r *http.Request) (*apitype.WhoIsResponse, error) {
+	<-r.Context().Done()
+	return nil, r.Context().Err()
+}
+
+func Test_AuthenticateTimeout(t *testing.T) {
+	tests := map[string]struct {
+		resolver  IdentityResolver
+		onTimeout string
+		wantOK    bool
+		wantID    string
+	}{
+		"resolved in time": {
+			resolver: StaticResolver{Identities: map[string]StaticIdentity{"100.64.0.1": {Login: "alice@example.com"}}},
+			wantOK:   true,
+			wantID:   "alice@example.com",
+		},
+		"deny by default": {
+			resolver: slowResolver{},
+		},
+		"deny": {
+			resolver:  slowResolver{},
+			onTimeout: "deny",
+		},
+		"allow": {
+			resolver:  slowResolver{},
+			onTimeout: "allow",
+			wantOK:    true,
+		},
+	}
+	for tn, tt := range tests {
+		t.Run(tn, func(t *testing.T) {
+			ta := &Auth{
+				Timeout:   caddy.Duration(10 * time.Millisecond),
+				OnTimeout: tt.onTimeout,
+				resolver:  tt.resolver,
+			}
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = "100.64.0.1:1234"
+
+			user, ok, err := ta.Authenticate(httptest.NewRecorder(), r)
+			if ok != tt.wantOK {
+				t.Fatalf("Authenticate() ok = %v, want %v (err: %v)", ok, tt.wantOK, err)
+			}
+			if !ok && !errors.Is(err, errIdentityTimeout) {
+				t.Errorf("Authenticate() err = %v, want %v", err, errIdentityTimeout)
+			}
+			if user.ID != tt.wantID {
+				t.Errorf("Authenticate() user.ID = %q, want %q", user.ID, tt.wantID)
+			}
+		})
+	}
+}
+
+func Test_AuthDirectiveTimeout(t *testing.T) {
+	caddyfile := ":80 {\n\ttailscale_auth {\n\t\ttimeout 500ms\n\t\ton_timeout allow\n\t}\n\trespond ok\n}\n"
+	cfg, warnings, err := caddyconfig.GetAdapter("caddyfile").Adapt([]byte(caddyfile), nil)
+	if err != nil {
+		t.Fatalf("Adapt() error = %v, warnings: %v", err, warnings)
+	}
+	if want := `"tailscale":{"on_timeout":"allow","timeout":500000000}`; !strings.Contains(string(cfg), want) {
+		t.Errorf("Adapt() = %s, want provider %s", cfg, want)
+	}
+
+	caddyfile = ":80 {\n\ttailscale_auth {\n\t\ton_timeout maybe\n\t}\n}\n"
+	if _, _, err := caddyconfig.GetAdapter("caddyfile").Adapt([]byte(caddyfile), nil); err == nil {
+		t.Error("Adapt() with invalid on_timeout policy succeeded")
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// authkeyfile.go contains support for reading auth keys from files, and for logging in with a new key
+// when the file changes, so that keys rotated by external secret managers are used without restarting Caddy.
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"tailscale.com/ipn"
+)
+
+// authKeyFilePollInterval is how often auth key files are checked for changes.
+var authKeyFilePollInterval = 10 * time.Second
+
+// configuredAuthKey returns the auth key or the auth key file configured for the named node,
+// whichever takes precedence. Site-specific configuration takes precedence over node configuration,
+// which takes precedence over the app defaults, and at each level an auth key takes precedence over a file.
+func configuredAuthKey(name string, app *App) (key, file string) {
+	// Check site-specific configuration first
+	if siteNode, exists := getSiteConfig(name); exists {
+		if siteNode.AuthKey != "" || siteNode.AuthKeyFile != "" {
+			return siteNode.AuthKey, siteNode.AuthKeyFile
+		}
+	}
+
+	if node, ok := app.Nodes[name]; ok {
+		if node.AuthKey != "" || node.AuthKeyFile != "" {
+			return node.AuthKey, node.AuthKeyFile
+		}
+	}
+
+	return app.DefaultAuthKey, app.DefaultAuthKeyFile
+}
+
+// getAuthKeyFile returns the path of the file the named node's auth key is read from, if any.
+func getAuthKeyFile(name string, app *App) string {
+	if key, file := configuredAuthKey(name, app); key == "" {
+		return file
+	}
+	return ""
+}
+
+// readAuthKeyFile returns the auth key in the file at path, ignoring surrounding whitespace.
+func readAuthKeyFile(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("reading auth key file: %w", err)
+	}
+	key := strings.TrimSpace(string(b))
+	if key == "" {
+		return "", fmt.Errorf("auth key file %s is empty", path)
+	}
+	return key, nil
+}
+
+// watchAuthKeyFile logs the node in with the key in its auth key file when the file changes, until ctx is done.
+// Nodes only use their auth key to log in, so nodes that are already logged in keep running with their current session.
+func (t *tailscaleNode) watchAuthKeyFile(ctx context.Context) {
+	ticker := time.NewTicker(authKeyFilePollInterval)
+	defer ticker.Stop()
+	lastKey := t.authKeyFileKey
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		key, err := readAuthKeyFile(t.authKeyFile)
+		if err != nil || key == lastKey {
+			// The file may be briefly missing or empty while it is replaced, so the old key is kept.
+			continue
+		}
+		lastKey = key
+		if strings.HasPrefix(key, "tskey-client-") {
+			t.logger.Warn("auth key file changed to an OAuth client secret, which is used when the node is next created")
+			continue
+		}
+		if err := t.logInWithKey(ctx, key); err != nil {
+			t.reportError("logging in with rotated auth key", err)
+		}
+	}
+}
+
+// logInWithKey logs the node in with key, if it needs to log in.
+func (t *tailscaleNode) logInWithKey(ctx context.Context, key string) error {
+	lc, err := t.LocalClient()
+	if err != nil {
+		return err
+	}
+	st, err := lc.StatusWithoutPeers(ctx)
+	if err != nil {
+		return err
+	}
+	if st.BackendState == ipn.Running.String() {
+		t.logger.Info("auth key file changed, node is already logged in")
+		return nil
+	}
+	t.logger.Info("auth key file changed, logging in with new key")
+	if err := lc.Start(ctx, ipn.Options{AuthKey: key}); err != nil {
+		return err
+	}
+	return lc.StartLoginInteractive(ctx)
+}
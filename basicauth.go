@@ -0,0 +1,260 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// basicauth.go contains a handler that logs tailnet users in to upstreams that only support HTTP basic auth,
+// with per-user passwords derived from a secret, so users never handle the passwords themselves.
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/bcrypt"
+	"tailscale.com/client/tailscale/apitype"
+)
+
+func init() {
+	caddy.RegisterModule(&BasicAuthBridge{})
+	httpcaddyfile.RegisterHandlerDirective("tailscale_basic_auth", parseBasicAuthBridge)
+	httpcaddyfile.RegisterDirectiveOrder("tailscale_basic_auth", httpcaddyfile.Before, "reverse_proxy")
+}
+
+// Values of BasicAuthBridge.Username.
+const (
+	basicAuthUsernameLogin = "login"
+	basicAuthUsernameShort = "short"
+)
+
+// BasicAuthBridge is a Caddy HTTP handler that sets an Authorization: Basic header on requests from tailnet users,
+// for upstreams that only support basic auth. Each user's password is derived from the secret,
+// so the upstream can be provisioned with the passwords using "caddy tailscale basic-auth-password".
+//
+// Authorization headers sent by clients are removed, so that users can't log in as someone else.
+// Requests from tagged nodes, or whose Tailscale identity can't be resolved, are rejected.
+type BasicAuthBridge struct {
+	// Secret is the secret from which passwords are derived. It may use placeholders, such as {env.BASIC_AUTH_SECRET}.
+	// Changing it changes all passwords.
+	Secret string `json:"secret"`
+
+	// Username is "login" to use the user's full login name, such as "alice@example.com",
+	// or "short" to use the part before the @ for users in Domain, such as "alice".
+	// Default: login
+	Username string `json:"username,omitempty"`
+
+	// Domain is the login domain, such as "example.com", whose users get short usernames if Username is "short".
+	// Users of other domains, such as guests invited to the tailnet, keep their full login name,
+	// so that they can't get the same username as a user in Domain. It is required if Username is "short".
+	Domain string `json:"domain,omitempty"`
+
+	// ResolverRaw configures how the Tailscale identity of the client is resolved.
+	// If unset, the node that received the request is queried with WhoIs.
+	ResolverRaw json.RawMessage `json:"resolver,omitempty" caddy:"namespace=tailscale.identity inline_key=source"`
+
+	secret   []byte
+	resolver IdentityResolver
+}
+
+func (*BasicAuthBridge) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.tailscale_basic_auth",
+		New: func() caddy.Module { return new(BasicAuthBridge) },
+	}
+}
+
+// Provision implements caddy.Provisioner.
+func (ba *BasicAuthBridge) Provision(ctx caddy.Context) error {
+	switch ba.Username {
+	case "":
+		ba.Username = basicAuthUsernameLogin
+	case basicAuthUsernameLogin, basicAuthUsernameShort:
+	default:
+		return fmt.Errorf("username must be %q or %q, got %q", basicAuthUsernameLogin, basicAuthUsernameShort, ba.Username)
+	}
+	if (ba.Username == basicAuthUsernameShort) != (ba.Domain != "") {
+		return fmt.Errorf("domain must be set if and only if username is %q", basicAuthUsernameShort)
+	}
+	secret, err := repl.ReplaceOrErr(ba.Secret, true, true)
+	if err != nil {
+		return fmt.Errorf("secret: %v", err)
+	}
+	if secret == "" {
+		return errors.New("secret is required")
+	}
+	ba.secret = []byte(secret)
+
+	if ba.ResolverRaw == nil {
+		ba.resolver = new(WhoIsResolver)
+		return nil
+	}
+	mod, err := ctx.LoadModule(ba, "ResolverRaw")
+	if err != nil {
+		return fmt.Errorf("loading identity resolver: %v", err)
+	}
+	ba.resolver = mod.(IdentityResolver)
+	return nil
+}
+
+// ServeHTTP implements caddyhttp.MiddlewareHandler.
+func (ba *BasicAuthBridge) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	r.Header.Del("Authorization")
+
+	info, err := ba.resolver.ResolveIdentity(r)
+	if err != nil {
+		return caddyhttp.Error(http.StatusForbidden, err)
+	}
+	username, err := basicAuthUsername(info, ba.Username, ba.Domain)
+	if err != nil {
+		return caddyhttp.Error(http.StatusForbidden, err)
+	}
+	r.SetBasicAuth(username, basicAuthPassword(ba.secret, username))
+	return next.ServeHTTP(w, r)
+}
+
+// basicAuthUsername returns the basic auth username of the tailnet user identified by info, in the given format.
+// Short usernames are only used for users in domain, so that they don't collide with users of other domains.
+func basicAuthUsername(info *apitype.WhoIsResponse, format, domain string) (string, error) {
+	if info.Node != nil && info.Node.IsTagged() {
+		return "", fmt.Errorf("node %s has tags", info.Node.ComputedName)
+	}
+	if info.UserProfile == nil || info.UserProfile.LoginName == "" {
+		return "", errors.New("no tailnet user")
+	}
+	login := info.UserProfile.LoginName
+	if format == basicAuthUsernameShort {
+		if name, d, ok := strings.Cut(login, "@"); ok && strings.EqualFold(d, domain) {
+			login = name
+		}
+	}
+	if strings.Contains(login, ":") {
+		return "", fmt.Errorf("login name %q can't be used as a basic auth username", login)
+	}
+	return login, nil
+}
+
+// basicAuthPassword returns the password of username, derived from secret.
+func basicAuthPassword(secret []byte, username string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("caddy-tailscale basic auth\x00" + username))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:24])
+}
+
+// UnmarshalCaddyfile sets up the handler from Caddyfile tokens. Syntax:
+//
+//	tailscale_basic_auth <secret> {
+//	  username login|short <domain>
+//	  resolver <source> [<args...>]
+//	}
+func (ba *BasicAuthBridge) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume directive name
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	ba.Secret = d.Val()
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "username":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			switch d.Val() {
+			case basicAuthUsernameLogin:
+				ba.Username = d.Val()
+			case basicAuthUsernameShort:
+				ba.Username = d.Val()
+				if !d.AllArgs(&ba.Domain) {
+					return d.ArgErr()
+				}
+			default:
+				return d.Errf("username must be %q or %q, got %q", basicAuthUsernameLogin, basicAuthUsernameShort, d.Val())
+			}
+
+		case "resolver":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			source := d.Val()
+			unm, err := caddyfile.UnmarshalModule(d, "tailscale.identity."+source)
+			if err != nil {
+				return err
+			}
+			ba.ResolverRaw = caddyconfig.JSONModuleObject(unm, "source", source, nil)
+
+		default:
+			return d.Errf("unrecognized subdirective: %s", d.Val())
+		}
+	}
+	return nil
+}
+
+// parseBasicAuthBridge parses the tailscale_basic_auth directive.
+func parseBasicAuthBridge(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	ba := new(BasicAuthBridge)
+	err := ba.UnmarshalCaddyfile(h.Dispenser)
+	return ba, err
+}
+
+func tailscaleBasicAuthPasswordCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "basic-auth-password [--secret-env <name>] [--htpasswd] <username>...",
+		Short: "Prints the basic auth passwords of tailnet users",
+		Long: `
+Prints the passwords that the tailscale_basic_auth handler sends for the given
+usernames, so that an upstream that only supports basic auth can be provisioned
+with them. The secret is read from the environment variable named by
+--secret-env, so that it doesn't appear in the shell history.
+
+With --htpasswd, bcrypt hashes of the passwords are printed as htpasswd lines
+instead of the passwords themselves.
+`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: caddycmd.WrapCommandFuncForCobra(cmdTailscaleBasicAuthPassword),
+	}
+	cmd.Flags().String("secret-env", "TAILSCALE_BASIC_AUTH_SECRET", "Environment variable containing the secret")
+	cmd.Flags().Bool("htpasswd", false, "Print bcrypt hashes in htpasswd format")
+	return cmd
+}
+
+func cmdTailscaleBasicAuthPassword(fl caddycmd.Flags) (int, error) {
+	secret := os.Getenv(fl.String("secret-env"))
+	if secret == "" {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("environment variable %s is not set", fl.String("secret-env"))
+	}
+	for _, username := range fl.Args() {
+		password := basicAuthPassword([]byte(secret), username)
+		if !fl.Bool("htpasswd") {
+			fmt.Printf("%s:%s\n", username, password)
+			continue
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return caddy.ExitCodeFailedStartup, err
+		}
+		fmt.Printf("%s:%s\n", username, hash)
+	}
+	return caddy.ExitCodeSuccess, nil
+}
+
+var (
+	_ caddyhttp.MiddlewareHandler = (*BasicAuthBridge)(nil)
+	_ caddy.Provisioner           = (*BasicAuthBridge)(nil)
+	_ caddyfile.Unmarshaler       = (*BasicAuthBridge)(nil)
+)
@@ -0,0 +1,174 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func Test_BasicAuthBridge(t *testing.T) {
+	ba := &BasicAuthBridge{
+		Username: basicAuthUsernameShort,
+		Domain:   "example.com",
+		secret:   []byte("secret"),
+		resolver: StaticResolver{Identities: map[string]StaticIdentity{
+			"100.64.0.1": {Login: "alice@example.com"},
+			"100.64.0.2": {Login: "tagged-devices", Tags: []string{"tag:ci"}},
+			"100.64.0.3": {Login: "alice@guest.example"},
+		}},
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		wantUser   string
+		wantErr    bool
+	}{
+		{name: "user", remoteAddr: "100.64.0.1:1234", wantUser: "alice"},
+		{name: "user of other domain", remoteAddr: "100.64.0.3:1234", wantUser: "alice@guest.example"},
+		{name: "tagged node", remoteAddr: "100.64.0.2:1234", wantErr: true},
+		{name: "unknown client", remoteAddr: "192.0.2.1:1234", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			r.SetBasicAuth("admin", "spoofed")
+
+			var got *http.Request
+			next := caddyhttp.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) error {
+				got = r
+				return nil
+			})
+			err := ba.ServeHTTP(httptest.NewRecorder(), r, next)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ServeHTTP() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if r.Header.Get("Authorization") != "" {
+					t.Error("client Authorization header was not removed")
+				}
+				return
+			}
+			user, pass, ok := got.BasicAuth()
+			if !ok || user != tt.wantUser || pass != basicAuthPassword([]byte("secret"), tt.wantUser) {
+				t.Errorf("BasicAuth() = %q, %q, %v, want %q and its password", user, pass, ok, tt.wantUser)
+			}
+		})
+	}
+}
+
+func Test_BasicAuthPassword(t *testing.T) {
+	p := basicAuthPassword([]byte("secret"), "alice")
+	if len(p) != 32 {
+		t.Errorf("len(password) = %d, want 32", len(p))
+	}
+	if p != basicAuthPassword([]byte("secret"), "alice") {
+		t.Error("password is not deterministic")
+	}
+	if p == basicAuthPassword([]byte("secret"), "bob") {
+		t.Error("different users have the same password")
+	}
+	if p == basicAuthPassword([]byte("other"), "alice") {
+		t.Error("different secrets give the same password")
+	}
+}
+
+func Test_BasicAuthBridgeUnmarshalCaddyfile(t *testing.T) {
+	tests := []struct {
+		name         string
+		d            *caddyfile.Dispenser
+		wantSecret   string
+		wantUsername string
+		wantDomain   string
+		wantResolver bool
+		wantErr      bool
+	}{
+		{
+			name:       "secret",
+			d:          caddyfile.NewTestDispenser(`tailscale_basic_auth {env.SECRET}`),
+			wantSecret: "{env.SECRET}",
+		},
+		{
+			name: "username and resolver",
+			d: caddyfile.NewTestDispenser(`
+				tailscale_basic_auth s3cret {
+					username short example.com
+					resolver whois
+				}`),
+			wantSecret:   "s3cret",
+			wantUsername: "short",
+			wantDomain:   "example.com",
+			wantResolver: true,
+		},
+		{
+			name:    "missing secret",
+			d:       caddyfile.NewTestDispenser(`tailscale_basic_auth`),
+			wantErr: true,
+		},
+		{
+			name: "short username without domain",
+			d: caddyfile.NewTestDispenser(`
+				tailscale_basic_auth s3cret {
+					username short
+				}`),
+			wantErr: true,
+		},
+		{
+			name: "invalid username",
+			d: caddyfile.NewTestDispenser(`
+				tailscale_basic_auth s3cret {
+					username email
+				}`),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ba := new(BasicAuthBridge)
+			err := ba.UnmarshalCaddyfile(tt.d)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("UnmarshalCaddyfile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if ba.Secret != tt.wantSecret || ba.Username != tt.wantUsername || ba.Domain != tt.wantDomain || (ba.ResolverRaw != nil) != tt.wantResolver {
+				t.Errorf("UnmarshalCaddyfile() = %+v", ba)
+			}
+		})
+	}
+}
+
+func Test_BasicAuthBridgeProvision(t *testing.T) {
+	t.Setenv("TEST_BASIC_AUTH_SECRET", "s3cret")
+	tests := []struct {
+		name    string
+		ba      BasicAuthBridge
+		wantErr bool
+	}{
+		{name: "login", ba: BasicAuthBridge{Secret: "{env.TEST_BASIC_AUTH_SECRET}"}},
+		{name: "short", ba: BasicAuthBridge{Secret: "s3cret", Username: basicAuthUsernameShort, Domain: "example.com"}},
+		{name: "short without domain", ba: BasicAuthBridge{Secret: "s3cret", Username: basicAuthUsernameShort}, wantErr: true},
+		{name: "domain without short", ba: BasicAuthBridge{Secret: "s3cret", Domain: "example.com"}, wantErr: true},
+		{name: "unknown placeholder", ba: BasicAuthBridge{Secret: "{env.TEST_UNSET_BASIC_AUTH_SECRET}"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.ba.Provision(caddy.Context{})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Provision() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && string(tt.ba.secret) != "s3cret" {
+				t.Errorf("secret = %q, want %q", tt.ba.secret, "s3cret")
+			}
+		})
+	}
+}
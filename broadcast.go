@@ -0,0 +1,405 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// broadcast.go contains a publish/subscribe handler for tailnet clients,
+// so internal tools can push events to browsers and scripts without running a separate service.
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/coder/websocket"
+	"github.com/dustin/go-humanize"
+	"tailscale.com/client/tailscale/apitype"
+)
+
+func init() {
+	caddy.RegisterModule(&Broadcast{})
+	httpcaddyfile.RegisterHandlerDirective("tailscale_broadcast", parseBroadcast)
+	httpcaddyfile.RegisterDirectiveOrder("tailscale_broadcast", httpcaddyfile.Before, "respond")
+}
+
+const (
+	// defaultMaxEventSize is the default maximum size of published events.
+	defaultMaxEventSize = 64 << 10
+
+	// subscriberBuffer is the number of events buffered for each subscriber.
+	// Subscribers that fall further behind are disconnected, so that they don't hold up publishers.
+	subscriberBuffer = 16
+
+	// sseKeepAlive is how often a comment is sent to idle event streams, so proxies don't close them.
+	sseKeepAlive = 30 * time.Second
+)
+
+// Broadcast is a Caddy HTTP handler that fans out events published by tailnet peers to subscribed tailnet clients.
+// The request path is the topic, so one handler can serve many topics.
+//
+// Clients subscribe with a GET request, either as a Server-Sent Events stream (Accept: text/event-stream)
+// or as a WebSocket, which receives each event as a text message.
+// Events are published with a POST request, whose body is sent to the topic's current subscribers.
+//
+// Publishers and subscribers are identified by the node that received the request, so requests received over Funnel
+// or on other listeners are rejected. Each list of identities contains login names, such as "alice@example.com",
+// or tags, such as "tag:ci".
+type Broadcast struct {
+	// Publishers are the identities allowed to publish events. If empty, no one can publish.
+	Publishers []string `json:"publishers,omitempty"`
+
+	// Subscribers are the identities allowed to subscribe. If empty, anyone on the tailnet can subscribe.
+	Subscribers []string `json:"subscribers,omitempty"`
+
+	// MaxEventSize is the maximum size in bytes of published events.
+	// Default: 64KiB
+	MaxEventSize int64 `json:"max_event_size,omitempty"`
+
+	hub *broadcastHub
+}
+
+func (*Broadcast) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.tailscale_broadcast",
+		New: func() caddy.Module { return new(Broadcast) },
+	}
+}
+
+// Provision implements caddy.Provisioner.
+func (b *Broadcast) Provision(_ caddy.Context) error {
+	if b.MaxEventSize == 0 {
+		b.MaxEventSize = defaultMaxEventSize
+	}
+	b.hub = &broadcastHub{topics: make(map[string]map[*subscriber]bool)}
+	return nil
+}
+
+// Cleanup implements caddy.CleanerUpper. It disconnects all subscribers.
+func (b *Broadcast) Cleanup() error {
+	if b.hub != nil {
+		b.hub.close()
+	}
+	return nil
+}
+
+// ServeHTTP implements caddyhttp.MiddlewareHandler.
+func (b *Broadcast) ServeHTTP(w http.ResponseWriter, r *http.Request, _ caddyhttp.Handler) error {
+	node, ok := requestNode(r)
+	if !ok || isFunnelRequest(r) {
+		return caddyhttp.Error(http.StatusForbidden, errors.New("tailscale_broadcast only serves tailnet clients"))
+	}
+	lc, err := node.LocalClient()
+	if err != nil {
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+	info, err := lc.WhoIs(r.Context(), r.RemoteAddr)
+	if err != nil {
+		return caddyhttp.Error(http.StatusForbidden, err)
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		if !identityAllowed(info, b.Publishers) {
+			return caddyhttp.Error(http.StatusForbidden, fmt.Errorf("%s is not allowed to publish", identityName(info)))
+		}
+		return b.publish(w, r)
+	case http.MethodGet:
+		if len(b.Subscribers) > 0 && !identityAllowed(info, b.Subscribers) {
+			return caddyhttp.Error(http.StatusForbidden, fmt.Errorf("%s is not allowed to subscribe", identityName(info)))
+		}
+		if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+			return b.serveWebSocket(w, r)
+		}
+		return b.serveEvents(w, r)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		return caddyhttp.Error(http.StatusMethodNotAllowed, nil)
+	}
+}
+
+// publish sends the request body to the subscribers of the request path.
+func (b *Broadcast) publish(w http.ResponseWriter, r *http.Request) error {
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, b.MaxEventSize))
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			return caddyhttp.Error(http.StatusRequestEntityTooLarge, err)
+		}
+		return caddyhttp.Error(http.StatusBadRequest, err)
+	}
+	n := b.hub.publish(r.URL.Path, data)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	_, err = fmt.Fprintf(w, `{"subscribers":%d}`+"\n", n)
+	return err
+}
+
+// serveEvents streams the events of the request path as Server-Sent Events until the client disconnects.
+func (b *Broadcast) serveEvents(w http.ResponseWriter, r *http.Request) error {
+	if !strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		return caddyhttp.Error(http.StatusNotAcceptable, errors.New("subscribers must accept text/event-stream or use a WebSocket"))
+	}
+	sub := b.hub.subscribe(r.URL.Path)
+	defer b.hub.unsubscribe(r.URL.Path, sub)
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(sseKeepAlive)
+	defer ticker.Stop()
+	for {
+		var err error
+		select {
+		case <-r.Context().Done():
+			return nil
+		case ev, ok := <-sub.events:
+			if !ok {
+				return nil
+			}
+			_, err = w.Write(formatEvent(ev))
+		case <-ticker.C:
+			_, err = io.WriteString(w, ": keep-alive\n\n")
+		}
+		if err == nil {
+			err = rc.Flush()
+		}
+		if err != nil {
+			return nil // client disconnected
+		}
+	}
+}
+
+// formatEvent formats ev as a Server-Sent Event, with a data field for each line.
+func formatEvent(ev broadcastEvent) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "id: %d\n", ev.id)
+	for line := range strings.Lines(string(ev.data)) {
+		fmt.Fprintf(&buf, "data: %s\n", strings.TrimRight(line, "\r\n"))
+	}
+	if len(ev.data) == 0 {
+		buf.WriteString("data: \n")
+	}
+	buf.WriteString("\n")
+	return buf.Bytes()
+}
+
+// serveWebSocket sends the events of the request path to a WebSocket until the client disconnects.
+func (b *Broadcast) serveWebSocket(w http.ResponseWriter, r *http.Request) error {
+	conn, err := websocket.Accept(hijackWriter{w}, r, nil)
+	if err != nil {
+		return nil // Accept has written the error response
+	}
+	defer conn.CloseNow()
+
+	sub := b.hub.subscribe(r.URL.Path)
+	defer b.hub.unsubscribe(r.URL.Path, sub)
+
+	// Messages from subscribers are not used, but must be read to handle pings and closes.
+	ctx := conn.CloseRead(r.Context())
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case ev, ok := <-sub.events:
+			if !ok {
+				conn.Close(websocket.StatusGoingAway, "")
+				return nil
+			}
+			if err := conn.Write(ctx, websocket.MessageText, ev.data); err != nil {
+				return nil
+			}
+		}
+	}
+}
+
+// hijackWriter makes the hijacking support of wrapped response writers visible to the WebSocket library.
+type hijackWriter struct {
+	http.ResponseWriter
+}
+
+func (w hijackWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+// identityAllowed reports whether the tailnet identity info has a login name or tag in allowed.
+func identityAllowed(info *apitype.WhoIsResponse, allowed []string) bool {
+	if info.Node != nil && info.Node.IsTagged() {
+		return slices.ContainsFunc(info.Node.Tags, func(tag string) bool { return slices.Contains(allowed, tag) })
+	}
+	return info.UserProfile != nil && slices.Contains(allowed, info.UserProfile.LoginName)
+}
+
+// identityName returns the login name or tags of the tailnet identity info, for error messages.
+func identityName(info *apitype.WhoIsResponse) string {
+	if info.Node != nil && info.Node.IsTagged() {
+		return strings.Join(info.Node.Tags, ",")
+	}
+	if info.UserProfile != nil {
+		return info.UserProfile.LoginName
+	}
+	return "unknown identity"
+}
+
+// broadcastEvent is an event published to a topic.
+type broadcastEvent struct {
+	id   uint64
+	data []byte
+}
+
+// subscriber is a client subscribed to a topic.
+type subscriber struct {
+	events chan broadcastEvent
+}
+
+// broadcastHub tracks the subscribers of each topic.
+type broadcastHub struct {
+	mu     sync.Mutex
+	topics map[string]map[*subscriber]bool
+	lastID uint64
+	closed bool
+}
+
+// subscribe adds a subscriber to topic.
+func (h *broadcastHub) subscribe(topic string) *subscriber {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	sub := &subscriber{events: make(chan broadcastEvent, subscriberBuffer)}
+	if h.closed {
+		close(sub.events)
+		return sub
+	}
+	if h.topics[topic] == nil {
+		h.topics[topic] = make(map[*subscriber]bool)
+	}
+	h.topics[topic][sub] = true
+	return sub
+}
+
+// unsubscribe removes sub from topic, if it is still subscribed.
+func (h *broadcastHub) unsubscribe(topic string, sub *subscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.topics[topic][sub] {
+		h.remove(topic, sub)
+	}
+}
+
+// remove removes sub from topic and closes its events. h.mu must be held.
+func (h *broadcastHub) remove(topic string, sub *subscriber) {
+	delete(h.topics[topic], sub)
+	if len(h.topics[topic]) == 0 {
+		delete(h.topics, topic)
+	}
+	close(sub.events)
+}
+
+// publish sends data to the subscribers of topic, returning how many it was sent to.
+// Subscribers whose buffers are full are disconnected.
+func (h *broadcastHub) publish(topic string, data []byte) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastID++
+	ev := broadcastEvent{id: h.lastID, data: data}
+	n := 0
+	for sub := range h.topics[topic] {
+		select {
+		case sub.events <- ev:
+			n++
+		default:
+			h.remove(topic, sub)
+		}
+	}
+	return n
+}
+
+// close disconnects all subscribers, and any that subscribe later.
+func (h *broadcastHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for topic, subs := range h.topics {
+		for sub := range subs {
+			h.remove(topic, sub)
+		}
+	}
+}
+
+// UnmarshalCaddyfile sets up the handler from Caddyfile tokens. Syntax:
+//
+//	tailscale_broadcast {
+//	  publishers <login|tag>...
+//	  subscribers <login|tag>...
+//	  max_event_size <size>
+//	}
+func (b *Broadcast) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume directive name
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "publishers":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			b.Publishers = append(b.Publishers, args...)
+
+		case "subscribers":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			b.Subscribers = append(b.Subscribers, args...)
+
+		case "max_event_size":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			v, err := humanize.ParseBytes(d.Val())
+			if err != nil {
+				return d.WrapErr(err)
+			}
+			if v > 1<<30 {
+				return d.Errf("max_event_size too large: %s", d.Val())
+			}
+			b.MaxEventSize = int64(v)
+
+		default:
+			return d.Errf("unrecognized subdirective: %s", d.Val())
+		}
+	}
+	return nil
+}
+
+// parseBroadcast parses the tailscale_broadcast directive.
+func parseBroadcast(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	b := new(Broadcast)
+	err := b.UnmarshalCaddyfile(h.Dispenser)
+	return b, err
+}
+
+var (
+	_ caddyhttp.MiddlewareHandler = (*Broadcast)(nil)
+	_ caddy.Provisioner           = (*Broadcast)(nil)
+	_ caddy.CleanerUpper          = (*Broadcast)(nil)
+	_ caddyfile.Unmarshaler       = (*Broadcast)(nil)
+)
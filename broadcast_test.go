@@ -0,0 +1,168 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+import (
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/google/go-cmp/cmp"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+func Test_BroadcastHub(t *testing.T) {
+	h := &broadcastHub{topics: make(map[string]map[*subscriber]bool)}
+	a := h.subscribe("/deploys")
+	b := h.subscribe("/deploys")
+	other := h.subscribe("/alerts")
+
+	if n := h.publish("/deploys", []byte("v1")); n != 2 {
+		t.Errorf("publish() = %d, want 2", n)
+	}
+	if ev := <-a.events; string(ev.data) != "v1" {
+		t.Errorf("event = %q, want %q", ev.data, "v1")
+	}
+	if len(other.events) != 0 {
+		t.Error("subscriber of other topic received event")
+	}
+
+	// b hasn't read its first event, so it is disconnected once its buffer overflows.
+	for range subscriberBuffer {
+		h.publish("/deploys", []byte("v2"))
+	}
+	if _, ok := h.topics["/deploys"][b]; ok {
+		t.Error("slow subscriber is still subscribed")
+	}
+	for range b.events {
+	}
+
+	h.unsubscribe("/deploys", a)
+	if n := h.publish("/deploys", []byte("v3")); n != 0 {
+		t.Errorf("publish() after unsubscribe = %d, want 0", n)
+	}
+
+	h.close()
+	if _, ok := <-other.events; ok {
+		t.Error("subscriber is not disconnected when the hub is closed")
+	}
+	if _, ok := <-h.subscribe("/alerts").events; ok {
+		t.Error("subscriber of closed hub is not disconnected")
+	}
+}
+
+func Test_FormatEvent(t *testing.T) {
+	tests := []struct {
+		name string
+		ev   broadcastEvent
+		want string
+	}{
+		{name: "single line", ev: broadcastEvent{id: 1, data: []byte("hello")}, want: "id: 1\ndata: hello\n\n"},
+		{name: "multiple lines", ev: broadcastEvent{id: 2, data: []byte("a\r\nb\n")}, want: "id: 2\ndata: a\ndata: b\n\n"},
+		{name: "empty", ev: broadcastEvent{id: 3}, want: "id: 3\ndata: \n\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(formatEvent(tt.ev)); got != tt.want {
+				t.Errorf("formatEvent() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_IdentityAllowed(t *testing.T) {
+	user := &apitype.WhoIsResponse{
+		Node:        &tailcfg.Node{},
+		UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com"},
+	}
+	tagged := &apitype.WhoIsResponse{
+		Node:        &tailcfg.Node{Tags: []string{"tag:ci"}},
+		UserProfile: &tailcfg.UserProfile{LoginName: "tagged-devices"},
+	}
+
+	tests := []struct {
+		name    string
+		info    *apitype.WhoIsResponse
+		allowed []string
+		want    bool
+	}{
+		{name: "allowed user", info: user, allowed: []string{"alice@example.com"}, want: true},
+		{name: "other user", info: user, allowed: []string{"bob@example.com", "tag:ci"}},
+		{name: "allowed tag", info: tagged, allowed: []string{"tag:ci"}, want: true},
+		{name: "tagged node by login", info: tagged, allowed: []string{"tagged-devices"}},
+		{name: "empty list", info: user},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := identityAllowed(tt.info, tt.allowed); got != tt.want {
+				t.Errorf("identityAllowed() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_BroadcastUnmarshalCaddyfile(t *testing.T) {
+	tests := []struct {
+		name    string
+		d       *caddyfile.Dispenser
+		want    *Broadcast
+		wantErr bool
+	}{
+		{
+			name: "defaults",
+			d:    caddyfile.NewTestDispenser(`tailscale_broadcast`),
+			want: &Broadcast{},
+		},
+		{
+			name: "all options",
+			d: caddyfile.NewTestDispenser(`
+				tailscale_broadcast {
+					publishers alice@example.com tag:ci
+					subscribers tag:dashboard
+					max_event_size 1KiB
+				}`),
+			want: &Broadcast{
+				Publishers:   []string{"alice@example.com", "tag:ci"},
+				Subscribers:  []string{"tag:dashboard"},
+				MaxEventSize: 1024,
+			},
+		},
+		{
+			name:    "argument",
+			d:       caddyfile.NewTestDispenser(`tailscale_broadcast /events`),
+			wantErr: true,
+		},
+		{
+			name: "missing publishers",
+			d: caddyfile.NewTestDispenser(`
+				tailscale_broadcast {
+					publishers
+				}`),
+			wantErr: true,
+		},
+		{
+			name: "invalid size",
+			d: caddyfile.NewTestDispenser(`
+				tailscale_broadcast {
+					max_event_size big
+				}`),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := new(Broadcast)
+			err := got.UnmarshalCaddyfile(tt.d)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("UnmarshalCaddyfile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if diff := cmp.Diff(tt.want, got, cmp.AllowUnexported(Broadcast{})); diff != "" {
+				t.Errorf("UnmarshalCaddyfile() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
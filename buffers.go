@@ -0,0 +1,143 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// buffers.go contains tuning of buffer sizes for data sent over Tailscale nodes.
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"tailscale.com/wgengine/netstack"
+)
+
+// copyBufferPools are the pools of buffers used by copyBufferConns, keyed by buffer size.
+var copyBufferPools sync.Map // map[int]*sync.Pool
+
+func copyBufferPool(size int) *sync.Pool {
+	if p, ok := copyBufferPools.Load(size); ok {
+		return p.(*sync.Pool)
+	}
+	p, _ := copyBufferPools.LoadOrStore(size, &sync.Pool{
+		New: func() any {
+			b := make([]byte, size)
+			return &b
+		},
+	})
+	return p.(*sync.Pool)
+}
+
+// copyBufferListener wraps accepted connections in copyBufferConns.
+type copyBufferListener struct {
+	net.Listener
+	pool *sync.Pool
+}
+
+// newCopyBufferListener returns a listener whose connections copy data using pooled buffers of the given size.
+// If size is zero, ln is returned unchanged.
+func newCopyBufferListener(ln net.Listener, size int) net.Listener {
+	if size <= 0 {
+		return ln
+	}
+	return &copyBufferListener{Listener: ln, pool: copyBufferPool(size)}
+}
+
+func (l *copyBufferListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &copyBufferConn{Conn: c, pool: l.pool}, nil
+}
+
+func (l *copyBufferListener) Unwrap() net.Listener {
+	return l.Listener
+}
+
+// copyBufferConn is a net.Conn that implements io.ReaderFrom using a pooled buffer.
+// net/http uses io.ReaderFrom on the underlying connection when writing response bodies,
+// such as files served by the file_server handler.
+type copyBufferConn struct {
+	net.Conn
+	pool *sync.Pool
+}
+
+func (c *copyBufferConn) ReadFrom(r io.Reader) (int64, error) {
+	bp := c.pool.Get().(*[]byte)
+	defer c.pool.Put(bp)
+
+	// Hide any WriterTo or ReaderFrom implementations, which would bypass our buffer.
+	return io.CopyBuffer(struct{ io.Writer }{c.Conn}, struct{ io.Reader }{r}, *bp)
+}
+
+// NetConn returns the underlying connection.
+func (c *copyBufferConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// lowMemoryTCPBufferSize is the maximum size of netstack's TCP buffers in low memory mode.
+// The tsnet defaults allow buffers of several megabytes per connection.
+const lowMemoryTCPBufferSize = 256 << 10
+
+// envRingBufferMaxSize is the environment knob read by the Tailscale client library
+// for the total size of the per-peer history of endpoint updates that nodes keep for debugging.
+const envRingBufferMaxSize = "TS_DEBUG_MAGICSOCK_RING_BUFFER_MAX_SIZE_BYTES"
+
+// lowMemoryRingBufferSize is the total size of the endpoint update history in low memory mode,
+// instead of 4MiB. The history always keeps at least two updates per peer.
+const lowMemoryRingBufferSize = 64 << 10
+
+// applyLowMemoryKnobs limits the memory the Tailscale client library retains for debugging in low memory mode,
+// or resets the limit otherwise. The history is process-wide, so low memory mode applies to all nodes.
+// It must be called with knobs locked.
+func (t *App) applyLowMemoryKnobs() {
+	if !t.LowMemory {
+		resetKnob(envRingBufferMaxSize)
+		return
+	}
+	setKnob(envRingBufferMaxSize, strconv.Itoa(lowMemoryRingBufferSize))
+}
+
+// configureNetstack applies buffer size settings to the node's userspace network stack.
+func (t *tailscaleNode) configureNetstack() error {
+	if t.tcpSendBufferSize <= 0 && t.tcpRecvBufferSize <= 0 {
+		return nil
+	}
+
+	impl, ok := t.Sys().Netstack.GetOK()
+	if !ok {
+		return nil
+	}
+	ns, ok := impl.(*netstack.Impl)
+	if !ok {
+		return nil
+	}
+
+	if t.tcpSendBufferSize > 0 {
+		opt := tcpip.TCPSendBufferSizeRangeOption{
+			Min:     tcp.MinBufferSize,
+			Default: min(tcp.DefaultSendBufferSize, t.tcpSendBufferSize),
+			Max:     max(tcp.MinBufferSize, t.tcpSendBufferSize),
+		}
+		if err := ns.SetTransportProtocolOption(tcp.ProtocolNumber, &opt); err != nil {
+			return fmt.Errorf("setting TCP send buffer size: %v", err)
+		}
+	}
+	if t.tcpRecvBufferSize > 0 {
+		opt := tcpip.TCPReceiveBufferSizeRangeOption{
+			Min:     tcp.MinBufferSize,
+			Default: min(tcp.DefaultReceiveBufferSize, t.tcpRecvBufferSize),
+			Max:     max(tcp.MinBufferSize, t.tcpRecvBufferSize),
+		}
+		if err := ns.SetTransportProtocolOption(tcp.ProtocolNumber, &opt); err != nil {
+			return fmt.Errorf("setting TCP receive buffer size: %v", err)
+		}
+	}
+	return nil
+}
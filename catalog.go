@@ -0,0 +1,189 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// catalog.go contains discovery of the services advertised by tailnet peers,
+// which can be used to render a directory of services on the tailnet.
+
+import (
+	"cmp"
+	"context"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/templates"
+	"go.uber.org/zap"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+)
+
+func init() {
+	caddy.RegisterModule(TemplateFunctions{})
+}
+
+// peerServices describes a tailnet peer and the services it advertises.
+type peerServices struct {
+	// Node is the name of the node configuration that sees the peer.
+	Node string `json:"node"`
+
+	// Peer is the peer's MagicDNS name.
+	Peer string `json:"peer"`
+
+	// Hostname is the peer's hostname.
+	Hostname string `json:"hostname"`
+
+	// Addresses are the peer's Tailscale IP addresses.
+	Addresses []string `json:"addresses"`
+
+	// Tags are the peer's ACL tags, if any.
+	Tags []string `json:"tags,omitempty"`
+
+	// Online reports whether the peer is connected to the tailnet.
+	Online bool `json:"online"`
+
+	// Services are the TCP services the peer advertises.
+	Services []peerService `json:"services"`
+}
+
+// peerService is a TCP service advertised by a tailnet peer.
+type peerService struct {
+	Port        uint16 `json:"port"`
+	Description string `json:"description,omitempty"`
+
+	// URL is an http URL for the service on the peer's MagicDNS name.
+	// The service is not known to speak HTTP.
+	URL string `json:"url"`
+}
+
+// tailnetServices returns the services advertised by the peers of all running nodes.
+//
+// Peers report the services listening on them if service collection is enabled for the tailnet.
+// See https://tailscale.com/kb/1100/services.
+func tailnetServices(ctx context.Context) ([]peerServices, error) {
+	var catalog []peerServices
+	for _, node := range runningNodes() {
+		peers, err := node.peerServices(ctx)
+		if err != nil {
+			// The peers of other nodes are still listed.
+			if node.logger != nil {
+				node.logger.Warn("listing peer services", zap.Error(err))
+			}
+			continue
+		}
+		catalog = append(catalog, peers...)
+	}
+	return catalog, nil
+}
+
+// peerServices returns the services advertised by the node's peers.
+func (t *tailscaleNode) peerServices(ctx context.Context) ([]peerServices, error) {
+	lc, err := t.LocalClient()
+	if err != nil {
+		return nil, err
+	}
+	st, err := lc.Status(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var peers []peerServices
+	for _, ps := range st.Peer {
+		if len(ps.TailscaleIPs) == 0 {
+			continue
+		}
+		whois, err := lc.WhoIs(ctx, ps.TailscaleIPs[0].String())
+		if err != nil {
+			return nil, err
+		}
+		peers = append(peers, newPeerServices(t.name, ps, whois.Node))
+	}
+	slices.SortFunc(peers, func(a, b peerServices) int { return cmp.Compare(a.Peer, b.Peer) })
+	return peers, nil
+}
+
+func newPeerServices(nodeName string, ps *ipnstate.PeerStatus, node *tailcfg.Node) peerServices {
+	p := peerServices{
+		Node:     nodeName,
+		Peer:     strings.TrimSuffix(ps.DNSName, "."),
+		Hostname: ps.HostName,
+		Online:   ps.Online,
+		Services: []peerService{},
+	}
+	for _, ip := range ps.TailscaleIPs {
+		p.Addresses = append(p.Addresses, ip.String())
+	}
+	if ps.Tags != nil {
+		p.Tags = ps.Tags.AsSlice()
+	}
+
+	host := p.Peer
+	if host == "" && len(p.Addresses) > 0 {
+		host = p.Addresses[0]
+	}
+	if node != nil && node.Hostinfo.Valid() {
+		for _, svc := range node.Hostinfo.Services().All() {
+			if svc.Proto != tailcfg.TCP {
+				continue
+			}
+			p.Services = append(p.Services, peerService{
+				Port:        svc.Port,
+				Description: svc.Description,
+				URL:         "http://" + net.JoinHostPort(host, strconv.Itoa(int(svc.Port))) + "/",
+			})
+		}
+	}
+	slices.SortFunc(p.Services, func(a, b peerService) int { return cmp.Compare(a.Port, b.Port) })
+	return p
+}
+
+// TemplateFunctions is a Caddy templates extension that provides Tailscale template functions:
+//   - tailscaleServices: returns the tailnet peers seen by running nodes and the services they advertise,
+//     as a list of objects with the Node, Peer, Hostname, Addresses, Tags, Online and Services fields.
+//     Each service has Port, Description and URL fields.
+//
+// For example, to render a directory of services on the tailnet:
+//
+//	{{range tailscaleServices}}{{range .Services}}<a href="{{.URL}}">{{.Description}}</a>{{end}}{{end}}
+type TemplateFunctions struct{}
+
+func (TemplateFunctions) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.templates.functions.tailscale",
+		New: func() caddy.Module { return new(TemplateFunctions) },
+	}
+}
+
+// CustomTemplateFunctions implements templates.CustomFunctions.
+func (TemplateFunctions) CustomTemplateFunctions() template.FuncMap {
+	return template.FuncMap{
+		"tailscaleServices": func() ([]peerServices, error) {
+			return tailnetServices(context.Background())
+		},
+	}
+}
+
+// UnmarshalCaddyfile sets up the extension from Caddyfile tokens. Syntax:
+//
+//	templates {
+//	  extensions {
+//	    tailscale
+//	  }
+//	}
+func (*TemplateFunctions) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume extension name
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	return nil
+}
+
+var (
+	_ templates.CustomFunctions = (*TemplateFunctions)(nil)
+	_ caddyfile.Unmarshaler     = (*TemplateFunctions)(nil)
+)
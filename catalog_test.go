@@ -0,0 +1,51 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/views"
+)
+
+func Test_NewPeerServices(t *testing.T) {
+	tags := views.SliceOf([]string{"tag:server"})
+	ps := &ipnstate.PeerStatus{
+		DNSName:      "nas.tail1234.ts.net.",
+		HostName:     "nas",
+		TailscaleIPs: []netip.Addr{netip.MustParseAddr("100.64.0.2")},
+		Tags:         &tags,
+		Online:       true,
+	}
+	node := &tailcfg.Node{
+		Hostinfo: (&tailcfg.Hostinfo{
+			Services: []tailcfg.Service{
+				{Proto: tailcfg.TCP, Port: 8080, Description: "grafana"},
+				{Proto: tailcfg.PeerAPI4, Port: 12345},
+				{Proto: tailcfg.TCP, Port: 22, Description: "sshd"},
+			},
+		}).View(),
+	}
+
+	got := newPeerServices("gateway", ps, node)
+	want := peerServices{
+		Node:      "gateway",
+		Peer:      "nas.tail1234.ts.net",
+		Hostname:  "nas",
+		Addresses: []string{"100.64.0.2"},
+		Tags:      []string{"tag:server"},
+		Online:    true,
+		Services: []peerService{
+			{Port: 22, Description: "sshd", URL: "http://nas.tail1234.ts.net:22/"},
+			{Port: 8080, Description: "grafana", URL: "http://nas.tail1234.ts.net:8080/"},
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("newPeerServices() mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// checkauth.go contains the "caddy tailscale check-auth" command,
+// which registers a throwaway node to confirm a node's credentials work.
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/spf13/cobra"
+	"tailscale.com/ipn/store/mem"
+	"tailscale.com/tsnet"
+	"tailscale.com/types/logger"
+	"tailscale.com/types/opt"
+)
+
+// checkAuthResult is what the control server reported about a throwaway node registered by check-auth.
+type checkAuthResult struct {
+	// DNSName is the MagicDNS name the node was assigned.
+	DNSName string
+
+	// Tags are the tags the node was registered with.
+	Tags []string
+
+	// Peers is the number of peers the node can see, which depends on the tailnet's access controls.
+	Peers int
+}
+
+func tailscaleCheckAuthCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "check-auth --node <name> [--config <path>] [--adapter <name>] [--timeout <duration>]",
+		Short: "Checks a node's auth key by registering a throwaway node",
+		Long: `
+Checks that a node's auth key or OAuth client secret can register a node,
+without using or changing the node's state.
+
+An ephemeral node is registered with the named node's auth key, control server
+and tags, under the node's hostname with a "-check-auth" suffix. Its tags and
+the number of peers it can see are printed, confirming the tailnet's access
+controls, and it is then logged out, which removes it from the tailnet.
+
+If the auth key is a single-use key, checking it uses it up.
+`,
+		RunE: caddycmd.WrapCommandFuncForCobra(cmdTailscaleCheckAuth),
+	}
+	cmd.Flags().StringP("config", "c", "", "Configuration file")
+	cmd.Flags().StringP("adapter", "a", "", "Name of config adapter to apply")
+	cmd.Flags().StringP("node", "n", "", "Name of the node whose auth key is checked")
+	cmd.Flags().Duration("timeout", time.Minute, "Maximum time to wait for the node to register")
+	return cmd
+}
+
+func cmdTailscaleCheckAuth(fl caddycmd.Flags) (int, error) {
+	name := fl.String("node")
+	if name == "" {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("--node is required")
+	}
+	cfgJSON, _, err := caddycmd.LoadConfig(fl.String("config"), fl.String("adapter"))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	app, _, err := doctorConfig(cfgJSON)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("invalid config: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), fl.Duration("timeout"))
+	defer cancel()
+	res, err := checkAuth(ctx, name, app)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	fmt.Printf("Registered %s\n", res.DNSName)
+	if len(res.Tags) > 0 {
+		fmt.Printf("Tags: %s\n", strings.Join(res.Tags, ", "))
+	} else {
+		fmt.Println("Tags: none, the node is owned by the user who created the auth key")
+	}
+	fmt.Printf("Peers visible: %d\n", res.Peers)
+	return caddy.ExitCodeSuccess, nil
+}
+
+// checkAuth registers an ephemeral node with the named node's credentials, reports what the control server
+// assigned it, and logs it out. The named node's state is not used.
+func checkAuth(ctx context.Context, name string, app *App) (*checkAuthResult, error) {
+	// Auth keys created from OAuth client secrets must be ephemeral, so the throwaway node is removed when logged out.
+	checkApp := *app
+	checkApp.Nodes = maps.Clone(app.Nodes)
+	node := checkApp.Nodes[name]
+	node.Ephemeral = opt.NewBool(true)
+	if checkApp.Nodes == nil {
+		checkApp.Nodes = make(map[string]Node)
+	}
+	checkApp.Nodes[name] = node
+
+	authKey, err := getAuthKey(name, &checkApp)
+	if err != nil {
+		return nil, err
+	}
+	if authKey == "" {
+		return nil, fmt.Errorf("node %q has no auth key", name)
+	}
+	if authKey, err = resolveAuthKey(caddy.Context{Context: ctx}, name, authKey, &checkApp); err != nil {
+		return nil, fmt.Errorf("creating auth key from OAuth client secret: %w", err)
+	}
+	controlURL, err := getControlURL(name, &checkApp)
+	if err != nil {
+		return nil, err
+	}
+	hostname, err := getHostname(name, &checkApp)
+	if err != nil {
+		return nil, err
+	}
+	if proxy := getProxy(name, &checkApp); proxy != "" {
+		np, err := addControlProxy(controlURL, proxy)
+		if err != nil {
+			return nil, err
+		}
+		defer np.remove()
+	}
+
+	dir, err := os.MkdirTemp("", "tailscale-check-auth-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	s := &tsnet.Server{
+		Dir:        dir,
+		Store:      new(mem.Store),
+		Hostname:   hostname + "-check-auth",
+		AuthKey:    authKey,
+		ControlURL: controlURL,
+		Ephemeral:  true,
+		Logf:       logger.Discard,
+		UserLogf:   logger.Discard,
+	}
+	defer s.Close()
+
+	st, err := s.Up(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("registering node: %w", err)
+	}
+	res := &checkAuthResult{
+		DNSName: strings.TrimSuffix(st.Self.DNSName, "."),
+		Peers:   len(st.Peer),
+	}
+	if st.Self.Tags != nil {
+		res.Tags = st.Self.Tags.AsSlice()
+	}
+
+	lc, err := s.LocalClient()
+	if err != nil {
+		return nil, err
+	}
+	if err := lc.Logout(ctx); err != nil {
+		return nil, fmt.Errorf("logging out node: %w", err)
+	}
+	return res, nil
+}
@@ -0,0 +1,61 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/msfjarvis/caddy-tailscale/tscaddytest"
+	"go.uber.org/zap"
+)
+
+func Test_CheckAuth(t *testing.T) {
+	control := tscaddytest.NewControl(t)
+	control.NewNode(t, "peer")
+
+	stateDir := t.TempDir()
+	app := &App{
+		ControlURL: control.URL,
+		StateDir:   stateDir,
+		Nodes: map[string]Node{
+			"foo": {AuthKey: "tskey-auth-test"},
+		},
+	}
+	app.logger = zap.NewNop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	res, err := checkAuth(ctx, "foo", app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(res.DNSName, "foo-check-auth") {
+		t.Errorf("DNSName = %q, want foo-check-auth", res.DNSName)
+	}
+	if res.Peers != 1 {
+		t.Errorf("Peers = %d, want 1", res.Peers)
+	}
+
+	// The node's own config and state are left alone.
+	if v, ok := app.Nodes["foo"].Ephemeral.Get(); ok {
+		t.Errorf("node config changed, ephemeral = %v", v)
+	}
+	if _, err := os.Stat(filepath.Join(stateDir, "foo")); !os.IsNotExist(err) {
+		t.Errorf("state directory created: %v", err)
+	}
+}
+
+func Test_CheckAuthNoKey(t *testing.T) {
+	t.Setenv("TS_AUTHKEY", "")
+	app := &App{}
+	app.logger = zap.NewNop()
+	if _, err := checkAuth(context.Background(), "foo", app); err == nil {
+		t.Error("checkAuth() with no auth key: want error")
+	}
+}
@@ -0,0 +1,236 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// clientidentity.go contains SPIFFE-style client certificates for nodes,
+// presented to tailnet upstreams that require mTLS in addition to WireGuard.
+
+import (
+	"cmp"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/big"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/certmagic"
+)
+
+const (
+	// defaultClientCertLifetime is how long client certificates are valid for by default.
+	defaultClientCertLifetime = 24 * time.Hour
+
+	// clientCALifetime is how long the client certificate authority is valid for.
+	clientCALifetime = 10 * 365 * 24 * time.Hour
+
+	// Storage keys of the client certificate authority.
+	clientCACertKey = "tailscale/client_ca/ca.crt"
+	clientCAKeyKey  = "tailscale/client_ca/ca.key"
+)
+
+// ClientIdentity configures client certificates presented by the transport's nodes to HTTPS upstreams.
+// Certificates are issued by a certificate authority that is created in Caddy's storage,
+// and which upstreams must trust. They identify the node with a SPIFFE ID of the form
+// spiffe://<trust domain>/tailscale/<hostname>, and its MagicDNS name.
+type ClientIdentity struct {
+	// TrustDomain is the trust domain of SPIFFE IDs.
+	// Default: the node's tailnet DNS name, such as "tail1234.ts.net"
+	TrustDomain string `json:"trust_domain,omitempty"`
+
+	// Lifetime is how long certificates are valid for.
+	// Certificates are renewed when two thirds of their lifetime has passed.
+	// Default: 24h
+	Lifetime caddy.Duration `json:"lifetime,omitempty"`
+}
+
+// clientCA issues client certificates for nodes.
+type clientCA struct {
+	cert     *x509.Certificate
+	key      crypto.Signer
+	lifetime time.Duration
+	domain   string // trust domain, if configured
+
+	mu    sync.Mutex
+	certs map[string]*tls.Certificate // by node name
+}
+
+// newClientCA returns a client certificate authority for id, loading it from storage or creating it.
+func newClientCA(ctx context.Context, storage certmagic.Storage, id *ClientIdentity) (*clientCA, error) {
+	if err := storage.Lock(ctx, clientCACertKey); err != nil {
+		return nil, err
+	}
+	defer storage.Unlock(ctx, clientCACertKey)
+
+	cert, key, err := loadClientCA(ctx, storage)
+	if errors.Is(err, fs.ErrNotExist) {
+		cert, key, err = createClientCA(ctx, storage)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("client certificate authority: %w", err)
+	}
+	return &clientCA{
+		cert:     cert,
+		key:      key,
+		lifetime: cmp.Or(time.Duration(id.Lifetime), defaultClientCertLifetime),
+		domain:   id.TrustDomain,
+		certs:    make(map[string]*tls.Certificate),
+	}, nil
+}
+
+// loadClientCA loads the client certificate authority from storage.
+func loadClientCA(ctx context.Context, storage certmagic.Storage) (*x509.Certificate, crypto.Signer, error) {
+	certPEM, err := storage.Load(ctx, clientCACertKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := storage.Load(ctx, clientCAKeyKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, nil, errors.New("unsupported private key")
+	}
+	return pair.Leaf, key, nil
+}
+
+// createClientCA creates a client certificate authority and saves it to storage.
+func createClientCA(ctx context.Context, storage certmagic.Storage) (*x509.Certificate, crypto.Signer, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "Caddy Tailscale Client CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(clientCALifetime),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := storage.Store(ctx, clientCAKeyKey, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})); err != nil {
+		return nil, nil, err
+	}
+	if err := storage.Store(ctx, clientCACertKey, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})); err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+// getClientCertificate returns a function that returns the node's client certificate for TLS handshakes,
+// issuing a new certificate when the current one is due for renewal.
+func (ca *clientCA) getClientCertificate(node *tailscaleNode) func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return func(cri *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		ca.mu.Lock()
+		defer ca.mu.Unlock()
+
+		now := time.Now()
+		if cert, ok := ca.certs[node.name]; ok && !needsRenewal(cert.Leaf, now) {
+			return cert, nil
+		}
+		lc, err := node.LocalClient()
+		if err != nil {
+			return nil, err
+		}
+		st, err := lc.StatusWithoutPeers(cri.Context())
+		if err != nil {
+			return nil, err
+		}
+		if st.Self == nil || st.CurrentTailnet == nil {
+			return nil, fmt.Errorf("node %s is not connected to a tailnet", node.name)
+		}
+		cert, err := ca.issue(st.Self.HostName, strings.TrimSuffix(st.Self.DNSName, "."), cmp.Or(ca.domain, st.CurrentTailnet.MagicDNSSuffix), now)
+		if err != nil {
+			return nil, fmt.Errorf("issuing client certificate for node %s: %w", node.name, err)
+		}
+		ca.certs[node.name] = cert
+		return cert, nil
+	}
+}
+
+// needsRenewal reports whether two thirds of the lifetime of cert have passed at now.
+func needsRenewal(cert *x509.Certificate, now time.Time) bool {
+	lifetime := cert.NotAfter.Sub(cert.NotBefore)
+	return now.After(cert.NotAfter.Add(-lifetime / 3))
+}
+
+// issue issues a client certificate for the node with the given hostname and MagicDNS name, valid from now.
+func (ca *clientCA) issue(hostname, dnsName, trustDomain string, now time.Time) (*tls.Certificate, error) {
+	if trustDomain == "" {
+		return nil, errors.New("no trust domain")
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cmp.Or(dnsName, hostname)},
+		URIs:         []*url.URL{{Scheme: "spiffe", Host: trustDomain, Path: "/tailscale/" + hostname}},
+		NotBefore:    now.Add(-5 * time.Minute), // allow for clock skew
+		NotAfter:     now.Add(ca.lifetime),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if dnsName != "" {
+		tmpl.DNSNames = []string{dnsName}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, key.Public(), ca.key)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{der, ca.cert.Raw},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+// randomSerial returns a random certificate serial number.
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
@@ -0,0 +1,79 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+import (
+	"context"
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/certmagic"
+)
+
+func Test_NewClientCA(t *testing.T) {
+	ctx := context.Background()
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+
+	ca, err := newClientCA(ctx, storage, &ClientIdentity{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ca.lifetime != defaultClientCertLifetime {
+		t.Errorf("lifetime = %v, want %v", ca.lifetime, defaultClientCertLifetime)
+	}
+
+	// The authority is loaded from storage, rather than created again.
+	loaded, err := newClientCA(ctx, storage, &ClientIdentity{Lifetime: caddy.Duration(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.cert.Equal(ca.cert) {
+		t.Error("loaded client CA differs from created client CA")
+	}
+	if loaded.lifetime != time.Hour {
+		t.Errorf("lifetime = %v, want %v", loaded.lifetime, time.Hour)
+	}
+}
+
+func Test_ClientCA_Issue(t *testing.T) {
+	ca, err := newClientCA(context.Background(), &certmagic.FileStorage{Path: t.TempDir()}, &ClientIdentity{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	cert, err := ca.issue("caddy", "caddy.tail1234.ts.net", "tail1234.ts.net", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf := cert.Leaf
+	if got, want := leaf.URIs[0].String(), "spiffe://tail1234.ts.net/tailscale/caddy"; got != want {
+		t.Errorf("SPIFFE ID = %q, want %q", got, want)
+	}
+	if got, want := leaf.Subject.CommonName, "caddy.tail1234.ts.net"; got != want {
+		t.Errorf("common name = %q, want %q", got, want)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	if _, err := leaf.Verify(x509.VerifyOptions{
+		Roots:     roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}); err != nil {
+		t.Errorf("Verify() error = %v", err)
+	}
+
+	if needsRenewal(leaf, now) {
+		t.Error("needsRenewal() = true for new certificate")
+	}
+	if !needsRenewal(leaf, now.Add(defaultClientCertLifetime*3/4)) {
+		t.Error("needsRenewal() = false after three quarters of lifetime")
+	}
+
+	if _, err := ca.issue("caddy", "", "", now); err == nil {
+		t.Error("issue() without trust domain succeeded")
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// clockcheck.go contains checks of the system clock and trusted CA roots against the control server,
+// since a wrong clock, common on devices without a real-time clock, or a missing private CA
+// otherwise only shows up as TLS errors.
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"tailscale.com/ipn"
+	"tailscale.com/net/tlsdial"
+	"tailscale.com/tailcfg"
+)
+
+// maxClockSkew is the largest difference between the system clock and the control server's clock that isn't reported.
+const maxClockSkew = time.Minute
+
+// clockChecked records the control URLs that the system clock has been checked against.
+var clockChecked sync.Map
+
+// checkClockOnce checks the system clock and CA roots against the control server in the background, once per control URL,
+// logging any problems found.
+func checkClockOnce(controlURL string, logger *zap.Logger) {
+	if controlURL == "" {
+		controlURL = ipn.DefaultControlURL
+	}
+	if _, loaded := clockChecked.LoadOrStore(controlURL, true); loaded {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		// Connection errors are not logged, since they are reported when the node connects.
+		problems, _ := checkClock(ctx, controlURL, time.Now())
+		for _, problem := range problems {
+			logger.Warn(problem, zap.String("control_url", controlURL))
+		}
+	}()
+}
+
+// checkClock compares now to the time reported by the control server at controlURL,
+// and to the validity of the server's certificate chain, returning a description of each problem found.
+// If the chain is within its validity window, it is also verified the way nodes verify it,
+// to report control servers with certificates from a private CA or a TLS-intercepting proxy.
+// An error is returned if the control server can't be reached.
+func checkClock(ctx context.Context, controlURL string, now time.Time) ([]string, error) {
+	// The key endpoint is requested because nodes request it first, so all control servers serve it.
+	keyURL := strings.TrimSuffix(controlURL, "/") + "/key?v=" + strconv.Itoa(int(tailcfg.CurrentCapabilityVersion))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, keyURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy: func(r *http.Request) (*url.URL, error) { return proxyForURL(r.URL) },
+			// The certificate is checked below, to report why it isn't valid.
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+	defer client.CloseIdleConnections()
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	var problems []string
+	if date, err := http.ParseTime(resp.Header.Get("Date")); err == nil {
+		if skew := now.Sub(date); skew > maxClockSkew || skew < -maxClockSkew {
+			problems = append(problems, fmt.Sprintf(
+				"system clock differs from the control server's clock by %s; set the correct time, for example with NTP, or connecting to the tailnet will fail",
+				skew.Round(time.Second)))
+		}
+	}
+	if resp.TLS != nil {
+		expired := false
+		for _, cert := range resp.TLS.PeerCertificates {
+			if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+				expired = true
+				problems = append(problems, fmt.Sprintf(
+					"control server certificate %q is valid from %s to %s, but the system clock is %s; check the system clock and CA certificates",
+					cert.Subject.CommonName, cert.NotBefore.Format(time.RFC3339), cert.NotAfter.Format(time.RFC3339), now.Format(time.RFC3339)))
+			}
+		}
+		if !expired {
+			if err := tlsdial.Config(nil, nil).VerifyConnection(*resp.TLS); err != nil {
+				problems = append(problems, fmt.Sprintf(
+					"control server certificate is not trusted: %v; if the control server or a proxy uses a private CA, "+
+						"add its certificate to the system's CA certificates, or set SSL_CERT_FILE or SSL_CERT_DIR", err))
+			}
+		}
+	}
+	return problems, nil
+}
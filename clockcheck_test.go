@@ -0,0 +1,42 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_CheckClock(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	cert := srv.Certificate()
+
+	tests := []struct {
+		name     string
+		now      time.Time
+		problems int
+	}{
+		// The test server's certificate isn't trusted, which is reported unless it has expired.
+		{name: "correct", now: time.Now(), problems: 1},
+		{name: "slightly skewed", now: time.Now().Add(30 * time.Second), problems: 1},
+		{name: "skewed", now: time.Now().Add(-time.Hour), problems: 2},
+		{name: "before certificate", now: cert.NotBefore.Add(-time.Hour), problems: 2},
+		{name: "after certificate", now: cert.NotAfter.Add(time.Hour), problems: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			problems, err := checkClock(context.Background(), srv.URL, tt.now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(problems) != tt.problems {
+				t.Errorf("checkClock() = %q, want %d problems", problems, tt.problems)
+			}
+		})
+	}
+}
@@ -21,6 +21,7 @@ import (
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp/headers"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
 	"github.com/caddyserver/caddy/v2/modules/caddytls"
+	"github.com/spf13/cobra"
 )
 
 func init() {
@@ -64,6 +65,22 @@ default, all incoming headers are passed through unmodified.)
 	})
 }
 
+func init() {
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name:  "tailscale",
+		Usage: "<command>",
+		Short: "Commands for the Tailscale plugin",
+		Long: `
+Commands for checking and managing the Tailscale nodes used by Caddy.
+`,
+		CobraFunc: func(cmd *cobra.Command) {
+			cmd.AddCommand(tailscaleDoctorCommand())
+			cmd.AddCommand(tailscaleCheckAuthCommand())
+			cmd.AddCommand(tailscaleBasicAuthPasswordCommand())
+		},
+	})
+}
+
 func cmdTailscaleProxy(fs caddycmd.Flags) (int, error) {
 	caddy.TrapSignals()
 
@@ -175,8 +192,14 @@ func cmdTailscaleProxy(fs caddycmd.Flags) (int, error) {
 		},
 	}
 
+	scrubRoute := caddyhttp.Route{
+		HandlersRaw: []json.RawMessage{
+			caddyconfig.JSONModuleObject(ScrubHeaders{}, "handler", "tailscale_scrub_headers", nil),
+		},
+	}
+
 	server := &caddyhttp.Server{
-		Routes: caddyhttp.RouteList{authRoute, route},
+		Routes: caddyhttp.RouteList{scrubRoute, authRoute, route},
 		Listen: []string{listen},
 	}
 
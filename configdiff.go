@@ -0,0 +1,153 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// configdiff.go contains logging of the changes config reloads make to node configurations,
+// so that operators can audit what a reload changed in tailnet-facing behavior.
+
+import (
+	"encoding/json"
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// configSnapshot is the configuration of an app, as the JSON values of its set options by name.
+// Only option names are logged, since values such as auth keys may be secret.
+type configSnapshot struct {
+	global map[string]string            // global options, other than nodes
+	nodes  map[string]map[string]string // options of each configured node, with site-specific options overriding the app's
+}
+
+// lastConfig is the configuration of the last app that started, which reloads are compared to.
+var lastConfig struct {
+	mu       sync.Mutex
+	snapshot *configSnapshot
+}
+
+// snapshotConfig returns the configuration of the app, including its site-specific node configurations.
+func (t *App) snapshotConfig() *configSnapshot {
+	s := &configSnapshot{
+		global: configFields(*t, "nodes"),
+		nodes:  make(map[string]map[string]string),
+	}
+	for name, node := range t.Nodes {
+		s.nodes[name] = configFields(node)
+	}
+	siteConfigsMu.Lock()
+	siteNodes := t.siteConfigs
+	siteConfigsMu.Unlock()
+	for name, node := range siteNodes {
+		fields := s.nodes[name]
+		if fields == nil {
+			fields = make(map[string]string)
+			s.nodes[name] = fields
+		}
+		maps.Copy(fields, configFields(node))
+	}
+	return s
+}
+
+// configFields returns the JSON values of the set fields of the struct v by their JSON names, except those in skip.
+func configFields(v any, skip ...string) map[string]string {
+	fields := make(map[string]string)
+	rv := reflect.ValueOf(v)
+	for i := range rv.NumField() {
+		f := rv.Type().Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if !f.IsExported() || name == "" || name == "-" || slices.Contains(skip, name) || rv.Field(i).IsZero() {
+			continue
+		}
+		b, err := json.Marshal(rv.Field(i).Interface())
+		if err != nil {
+			b = []byte(err.Error())
+		}
+		fields[name] = string(b)
+	}
+	return fields
+}
+
+// changedFields returns the sorted names of the options that differ between old and new.
+func changedFields(old, new map[string]string) []string {
+	var changed []string
+	for name, v := range new {
+		if ov, ok := old[name]; !ok || ov != v {
+			changed = append(changed, name)
+		}
+	}
+	for name := range old {
+		if _, ok := new[name]; !ok {
+			changed = append(changed, name)
+		}
+	}
+	slices.Sort(changed)
+	return changed
+}
+
+// configDiff is the difference between two configurations.
+type configDiff struct {
+	Global  []string            // names of changed global options
+	Added   []string            // names of added nodes
+	Removed []string            // names of removed nodes
+	Changed map[string][]string // names of changed options by node
+}
+
+func (d configDiff) empty() bool {
+	return len(d.Global) == 0 && len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// diffConfigs returns the changes from old to new.
+func diffConfigs(old, new *configSnapshot) configDiff {
+	d := configDiff{Global: changedFields(old.global, new.global)}
+	for name, fields := range new.nodes {
+		oldFields, ok := old.nodes[name]
+		if !ok {
+			d.Added = append(d.Added, name)
+			continue
+		}
+		if changed := changedFields(oldFields, fields); len(changed) > 0 {
+			if d.Changed == nil {
+				d.Changed = make(map[string][]string)
+			}
+			d.Changed[name] = changed
+		}
+	}
+	for name := range old.nodes {
+		if _, ok := new.nodes[name]; !ok {
+			d.Removed = append(d.Removed, name)
+		}
+	}
+	slices.Sort(d.Added)
+	slices.Sort(d.Removed)
+	return d
+}
+
+// logConfigChanges logs the changes from the configuration of the last app that started to this app's, at info level.
+// Nothing is logged when the first config is loaded.
+func (t *App) logConfigChanges() {
+	snapshot := t.snapshotConfig()
+
+	lastConfig.mu.Lock()
+	last := lastConfig.snapshot
+	lastConfig.snapshot = snapshot
+	lastConfig.mu.Unlock()
+
+	if last == nil {
+		return
+	}
+	d := diffConfigs(last, snapshot)
+	if d.empty() {
+		t.logger.Debug("config reload didn't change tailscale configuration")
+		return
+	}
+	t.logger.Info("config reload changed tailscale configuration",
+		zap.Strings("global", d.Global),
+		zap.Strings("added_nodes", d.Added),
+		zap.Strings("removed_nodes", d.Removed),
+		zap.Any("changed_nodes", d.Changed))
+}
@@ -0,0 +1,125 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func Test_DiffConfigs(t *testing.T) {
+	tests := map[string]struct {
+		old  *App
+		new  *App
+		want configDiff
+	}{
+		"unchanged": {
+			old: &App{Ephemeral: true, Nodes: map[string]Node{"a": {Hostname: "a"}}},
+			new: &App{Ephemeral: true, Nodes: map[string]Node{"a": {Hostname: "a"}}},
+		},
+		"global options": {
+			old: &App{DefaultAuthKey: "old", Tags: []string{"tag:a"}},
+			new: &App{DefaultAuthKey: "new", Ephemeral: true, Tags: []string{"tag:a"}},
+			want: configDiff{
+				Global: []string{"auth_key", "ephemeral"},
+			},
+		},
+		"nodes added and removed": {
+			old: &App{Nodes: map[string]Node{"a": {}, "b": {}}},
+			new: &App{Nodes: map[string]Node{"b": {}, "c": {}, "d": {}}},
+			want: configDiff{
+				Added:   []string{"c", "d"},
+				Removed: []string{"a"},
+			},
+		},
+		"node options": {
+			old: &App{Nodes: map[string]Node{"a": {Hostname: "a", AuthKey: "key"}, "b": {Tags: []string{"tag:a"}}}},
+			new: &App{Nodes: map[string]Node{"a": {Hostname: "a2"}, "b": {Tags: []string{"tag:b"}}}},
+			want: configDiff{
+				Changed: map[string][]string{
+					"a": {"auth_key", "hostname"},
+					"b": {"tags"},
+				},
+			},
+		},
+		"site configs": {
+			old: &App{
+				Nodes:       map[string]Node{"a": {Hostname: "a"}},
+				siteConfigs: siteConfigSnapshot{"a": {Hostname: "site"}},
+			},
+			new: &App{
+				Nodes:       map[string]Node{"a": {Hostname: "a"}},
+				siteConfigs: siteConfigSnapshot{"a": {Hostname: "site"}, "b": {}},
+			},
+			want: configDiff{
+				Added: []string{"b"},
+			},
+		},
+		"site config overrides node": {
+			old: &App{Nodes: map[string]Node{"a": {Hostname: "a"}}},
+			new: &App{
+				Nodes:       map[string]Node{"a": {Hostname: "a"}},
+				siteConfigs: siteConfigSnapshot{"a": {Hostname: "site"}},
+			},
+			want: configDiff{
+				Changed: map[string][]string{"a": {"hostname"}},
+			},
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := diffConfigs(tt.old.snapshotConfig(), tt.new.snapshotConfig())
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("diffConfigs() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func Test_LogConfigChanges(t *testing.T) {
+	lastConfig.mu.Lock()
+	saved := lastConfig.snapshot
+	lastConfig.snapshot = nil
+	lastConfig.mu.Unlock()
+	defer func() {
+		lastConfig.mu.Lock()
+		lastConfig.snapshot = saved
+		lastConfig.mu.Unlock()
+	}()
+
+	core, logs := observer.New(zap.InfoLevel)
+	logger := zap.New(core)
+
+	first := &App{logger: logger, Nodes: map[string]Node{"a": {AuthKey: "secret"}}}
+	first.logConfigChanges()
+	if logs.Len() != 0 {
+		t.Fatalf("first config logged %d entries, want 0", logs.Len())
+	}
+
+	same := &App{logger: logger, Nodes: map[string]Node{"a": {AuthKey: "secret"}}}
+	same.logConfigChanges()
+	if logs.Len() != 0 {
+		t.Fatalf("unchanged config logged %d entries, want 0", logs.Len())
+	}
+
+	changed := &App{logger: logger, Nodes: map[string]Node{"a": {AuthKey: "rotated"}}}
+	changed.logConfigChanges()
+	entries := logs.TakeAll()
+	if len(entries) != 1 {
+		t.Fatalf("changed config logged %d entries, want 1", len(entries))
+	}
+	fields := entries[0].ContextMap()
+	if diff := cmp.Diff(map[string][]string{"a": {"auth_key"}}, fields["changed_nodes"]); diff != "" {
+		t.Errorf("changed_nodes mismatch (-want +got):\n%s", diff)
+	}
+	for _, v := range fields {
+		if s, ok := v.(string); ok && (s == "secret" || s == "rotated") {
+			t.Errorf("logged auth key value %q", s)
+		}
+	}
+}
@@ -0,0 +1,301 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// connect.go contains the Connect handler, a forward proxy that tunnels CONNECT requests to tailnet peers.
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+)
+
+func init() {
+	caddy.RegisterModule(&Connect{})
+	httpcaddyfile.RegisterHandlerDirective("tailscale_connect", parseConnect)
+	httpcaddyfile.RegisterDirectiveOrder("tailscale_connect", httpcaddyfile.Before, "respond")
+}
+
+// Connect is a Caddy HTTP handler that acts as a forward proxy for CONNECT requests to tailnet peers,
+// so that browsers and command line tools configured to use Caddy as their proxy can reach internal services.
+// Destinations may be a peer's MagicDNS name, either fully qualified or as a short name, or one of its Tailscale IPs.
+// CONNECT requests to other destinations are refused with 403 Forbidden, and other requests are passed to the next handler.
+// Requests are refused with 503 Service Unavailable until the node is running.
+type Connect struct {
+	// Node is the name of the node used to find and connect to peers.
+	// If empty, the node that accepted the request is used.
+	Node string `json:"node,omitempty"`
+
+	// Tags are the ACL tags of peers that may be connected to. Peers with any of the tags are allowed.
+	// If empty, any peer may be connected to.
+	Tags []string `json:"tags,omitempty"`
+
+	ctx   caddy.Context
+	mu    sync.Mutex
+	nodes map[string]*tailscaleNode // nodes used by the handler, got on first use
+}
+
+func (c *Connect) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.tailscale_connect",
+		New: func() caddy.Module { return new(Connect) },
+	}
+}
+
+// Provision implements caddy.Provisioner.
+func (c *Connect) Provision(ctx caddy.Context) error {
+	c.ctx = ctx
+	c.nodes = make(map[string]*tailscaleNode)
+	var err error
+	if c.Tags, err = normalizeTags(c.Tags); err != nil {
+		return err
+	}
+	if c.Node != "" {
+		if c.Node, err = resolveNodeName(ctx, c.Node); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getNode returns the named node, getting it on first use, since it must not be created while the config is provisioned.
+func (c *Connect) getNode(name string) (*tailscaleNode, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if node, ok := c.nodes[name]; ok {
+		return node, nil
+	}
+	node, err := getNode(c.ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	c.nodes[name] = node
+	return node, nil
+}
+
+// Cleanup implements caddy.CleanerUpper.
+func (c *Connect) Cleanup() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var errs []error
+	for name := range c.nodes {
+		if _, err := nodes.Delete(name); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	c.nodes = nil
+	return errors.Join(errs...)
+}
+
+// ServeHTTP implements caddyhttp.MiddlewareHandler.
+func (c *Connect) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	if r.Method != http.MethodConnect {
+		return next.ServeHTTP(w, r)
+	}
+
+	host, port, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		return caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("invalid CONNECT destination %q: %w", r.Host, err))
+	}
+
+	nodeName := c.Node
+	if nodeName == "" {
+		node, ok := requestNode(r)
+		if !ok {
+			return caddyhttp.Error(http.StatusInternalServerError,
+				errors.New("tailscale_connect must set a node when used on non-Tailscale listeners"))
+		}
+		nodeName = node.name
+	}
+	node, err := c.getNode(nodeName)
+	if err != nil {
+		return caddyhttp.Error(http.StatusBadGateway, err)
+	}
+	if err := node.start(); err != nil {
+		return caddyhttp.Error(http.StatusBadGateway, err)
+	}
+	lc, err := node.LocalClient()
+	if err != nil {
+		return caddyhttp.Error(http.StatusBadGateway, err)
+	}
+	st, err := lc.Status(r.Context())
+	if err != nil {
+		return caddyhttp.Error(http.StatusBadGateway, err)
+	}
+	if st.BackendState != ipn.Running.String() {
+		// Peers aren't known until the node is running, such as while it starts on its first request.
+		return caddyhttp.Error(http.StatusServiceUnavailable, fmt.Errorf("node %q is %s, not connected to the tailnet", nodeName, st.BackendState))
+	}
+	ip, ok := connectPeer(st, host, c.Tags)
+	if !ok {
+		return caddyhttp.Error(http.StatusForbidden, fmt.Errorf("CONNECT destination %q is not an allowed tailnet peer", host))
+	}
+
+	upstream, err := node.dial(r.Context(), "tcp", net.JoinHostPort(ip.String(), port))
+	if err != nil {
+		return caddyhttp.Error(http.StatusBadGateway, err)
+	}
+	defer upstream.Close()
+
+	if r.ProtoMajor == 1 {
+		return tunnelHijacked(w, upstream)
+	}
+	return tunnelStream(w, r, upstream)
+}
+
+// tunnelHijacked tunnels an HTTP/1 CONNECT request to upstream by taking over its connection.
+func tunnelHijacked(w http.ResponseWriter, upstream net.Conn) error {
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		return nil
+	}
+
+	done := make(chan struct{}, 2)
+	go func() {
+		// Data the client sent right after the request may already be buffered.
+		io.Copy(upstream, brw.Reader)
+		closeWrite(upstream)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, upstream)
+		closeWrite(conn)
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+	return nil
+}
+
+// tunnelStream tunnels an HTTP/2 or HTTP/3 CONNECT request to upstream over the request and response bodies.
+func tunnelStream(w http.ResponseWriter, r *http.Request, upstream net.Conn) error {
+	rc := http.NewResponseController(w)
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return nil
+	}
+
+	done := make(chan struct{})
+	go func() {
+		io.Copy(upstream, r.Body)
+		closeWrite(upstream)
+		close(done)
+	}()
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := upstream.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				break
+			}
+			if err := rc.Flush(); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	upstream.Close()
+	<-done
+	return nil
+}
+
+// connectPeer returns the Tailscale IP to connect to for host, if it is the MagicDNS name or a Tailscale IP
+// of a peer in st with one of tags, or of any peer if tags is empty.
+func connectPeer(st *ipnstate.Status, host string, tags []string) (netip.Addr, bool) {
+	ip, err := netip.ParseAddr(host)
+	isIP := err == nil
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, peer := range st.Peer {
+		if len(peer.TailscaleIPs) == 0 {
+			continue
+		}
+		if isIP {
+			if !slices.Contains(peer.TailscaleIPs, ip.Unmap()) {
+				continue
+			}
+		} else {
+			dnsName := strings.ToLower(strings.TrimSuffix(peer.DNSName, "."))
+			short, _, _ := strings.Cut(dnsName, ".")
+			if dnsName == "" || (host != dnsName && host != short) {
+				continue
+			}
+			ip = peer.TailscaleIPs[0]
+		}
+		if len(tags) > 0 {
+			if peer.Tags == nil || !hasAnyTag(peer.Tags.AsSlice(), tags) {
+				return netip.Addr{}, false
+			}
+		}
+		return ip.Unmap(), true
+	}
+	return netip.Addr{}, false
+}
+
+// UnmarshalCaddyfile sets up the handler from Caddyfile tokens. Syntax:
+//
+//	tailscale_connect {
+//	  node <name>
+//	  tags <tags...>
+//	}
+func (c *Connect) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume directive name
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "node":
+			if !d.AllArgs(&c.Node) {
+				return d.ArgErr()
+			}
+
+		case "tags":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			c.Tags = append(c.Tags, args...)
+
+		default:
+			return d.Errf("unrecognized subdirective: %s", d.Val())
+		}
+	}
+	return nil
+}
+
+// parseConnect parses the tailscale_connect directive.
+func parseConnect(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	c := new(Connect)
+	err := c.UnmarshalCaddyfile(h.Dispenser)
+	return c, err
+}
+
+var (
+	_ caddy.Provisioner           = (*Connect)(nil)
+	_ caddy.CleanerUpper          = (*Connect)(nil)
+	_ caddyhttp.MiddlewareHandler = (*Connect)(nil)
+	_ caddyfile.Unmarshaler       = (*Connect)(nil)
+)
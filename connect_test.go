@@ -0,0 +1,207 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/msfjarvis/caddy-tailscale/tscaddytest"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/types/key"
+	"tailscale.com/types/ptr"
+	"tailscale.com/types/views"
+	"tailscale.com/util/must"
+)
+
+func Test_ConnectPeer(t *testing.T) {
+	st := &ipnstate.Status{
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+			key.NewNode().Public(): {
+				DNSName:      "web.tail-scale.ts.net.",
+				TailscaleIPs: []netip.Addr{netip.MustParseAddr("100.64.0.1"), netip.MustParseAddr("fd7a:115c:a1e0::1")},
+				Tags:         ptr.To(views.SliceOf([]string{"tag:web"})),
+			},
+			key.NewNode().Public(): {
+				DNSName:      "laptop.tail-scale.ts.net.",
+				TailscaleIPs: []netip.Addr{netip.MustParseAddr("100.64.0.2")},
+			},
+		},
+	}
+	tests := []struct {
+		name   string
+		host   string
+		tags   []string
+		want   string
+		wantOK bool
+	}{
+		{name: "short name", host: "web", want: "100.64.0.1", wantOK: true},
+		{name: "fully qualified name", host: "WEB.tail-scale.ts.net.", want: "100.64.0.1", wantOK: true},
+		{name: "tailscale ip", host: "fd7a:115c:a1e0::1", want: "fd7a:115c:a1e0::1", wantOK: true},
+		{name: "untagged peer", host: "laptop", want: "100.64.0.2", wantOK: true},
+		{name: "tagged peer allowed", host: "web", tags: []string{"tag:db", "tag:web"}, want: "100.64.0.1", wantOK: true},
+		{name: "untagged peer not allowed", host: "laptop", tags: []string{"tag:web"}},
+		{name: "peer ip not allowed", host: "100.64.0.2", tags: []string{"tag:web"}},
+		{name: "not a peer", host: "example.com"},
+		{name: "not a peer ip", host: "192.0.2.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := connectPeer(st, tt.host, tt.tags)
+			if ok != tt.wantOK {
+				t.Fatalf("connectPeer(%q) ok = %v, want %v", tt.host, ok, tt.wantOK)
+			}
+			if ok && got.String() != tt.want {
+				t.Errorf("connectPeer(%q) = %v, want %v", tt.host, got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_ConnectUnmarshalCaddyfile(t *testing.T) {
+	tests := []struct {
+		name    string
+		d       *caddyfile.Dispenser
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "defaults",
+			d:    caddyfile.NewTestDispenser(`tailscale_connect`),
+			want: `{}`,
+		},
+		{
+			name: "options",
+			d: caddyfile.NewTestDispenser(`
+				tailscale_connect {
+					node proxy
+					tags web tag:db
+				}`),
+			want: `{"node":"proxy","tags":["web","tag:db"]}`,
+		},
+		{
+			name:    "argument",
+			d:       caddyfile.NewTestDispenser(`tailscale_connect proxy`),
+			wantErr: true,
+		},
+		{
+			name: "tags without arguments",
+			d: caddyfile.NewTestDispenser(`
+				tailscale_connect {
+					tags
+				}`),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := new(Connect)
+			err := c.UnmarshalCaddyfile(tt.d)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("UnmarshalCaddyfile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got := string(caddyconfig.JSON(c, nil)); got != tt.want {
+				t.Errorf("UnmarshalCaddyfile() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_Connect(t *testing.T) {
+	control := tscaddytest.NewControl(t)
+	peer := control.NewNode(t, "peer")
+	ln := must.Get(peer.Listen("tcp", ":80"))
+	go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello from the tailnet")
+	}))
+
+	runTestApp(t, newTestApp(t, control, map[string]Node{
+		"proxy": {},
+	}))
+
+	c := &Connect{Node: "proxy"}
+	must.Do(c.Provision(caddy.ActiveContext()))
+	defer c.Cleanup()
+
+	// Wait for the proxy's node to see the peer.
+	node := must.Get(c.getNode("proxy"))
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	must.Get(node.Up(ctx))
+	lc := must.Get(node.LocalClient())
+	for {
+		if st, err := lc.Status(ctx); err == nil && len(st.Peer) > 0 {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatal("proxy node didn't see the peer")
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		io.WriteString(w, "next")
+		return nil
+	})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := c.ServeHTTP(w, r, next); err != nil {
+			var herr caddyhttp.HandlerError
+			if errors.As(err, &herr) {
+				w.WriteHeader(herr.StatusCode)
+			}
+		}
+	}))
+	defer srv.Close()
+
+	connect := func(dest string) (*bufio.Reader, net.Conn, *http.Response) {
+		t.Helper()
+		conn := must.Get(net.Dial("tcp", srv.Listener.Addr().String()))
+		fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", dest, dest)
+		br := bufio.NewReader(conn)
+		resp := must.Get(http.ReadResponse(br, &http.Request{Method: http.MethodConnect}))
+		return br, conn, resp
+	}
+
+	br, conn, resp := connect("peer:80")
+	defer conn.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT peer:80 status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: peer\r\nConnection: close\r\n\r\n")
+	resp = must.Get(http.ReadResponse(br, nil))
+	body := must.Get(io.ReadAll(resp.Body))
+	if got, want := string(body), "hello from the tailnet"; got != want {
+		t.Errorf("tunneled response = %q, want %q", got, want)
+	}
+
+	_, conn, resp = connect("example.com:443")
+	defer conn.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("CONNECT example.com:443 status = %d, want %d", resp.StatusCode, http.StatusForbidden)
+	}
+
+	resp = must.Get(http.Get(srv.URL))
+	body = must.Get(io.ReadAll(resp.Body))
+	resp.Body.Close()
+	if !strings.Contains(string(body), "next") {
+		t.Errorf("GET response = %q, want it passed to the next handler", body)
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// control.go contains monitoring of nodes' connections to the control server.
+// Nodes keep serving and dialing the peers they know with their last network map while the control server is down,
+// so outages are reported rather than treated as failures.
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+const (
+	// controlCheckInterval is how often nodes' connections to the control server are checked.
+	controlCheckInterval = 5 * time.Second
+
+	// controlGracePeriod is how long a node can be disconnected from the control server before a warning is logged,
+	// so that reconnects of its long poll aren't reported.
+	controlGracePeriod = 10 * time.Second
+)
+
+// controlMetrics are the metrics of nodes' connections to the control server, labeled by node.
+// Nodes outlive configs, so the metrics are shared by all configs and registered with each config's registry.
+var controlMetrics = struct {
+	connected *prometheus.GaugeVec
+	staleness *prometheus.GaugeVec
+}{
+	connected: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "caddy",
+		Subsystem: "tailscale",
+		Name:      "node_control_connected",
+		Help:      "Whether the node is connected to the control server.",
+	}, []string{"node"}),
+	staleness: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "caddy",
+		Subsystem: "tailscale",
+		Name:      "node_netmap_staleness_seconds",
+		Help:      "How long the node has been using its last network map while disconnected from the control server, or 0 while connected.",
+	}, []string{"node"}),
+}
+
+// registerControlMetrics registers the control server metrics with registry.
+func registerControlMetrics(registry *prometheus.Registry) error {
+	if registry == nil {
+		return nil
+	}
+	for _, c := range []prometheus.Collector{controlMetrics.connected, controlMetrics.staleness} {
+		if err := registry.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// controlState tracks a node's connection to the control server.
+type controlState struct {
+	connectedOnce  bool      // whether the node has connected, so that it has a network map
+	disconnectedAt time.Time // when the node was last disconnected, if it isn't connected
+	warned         bool      // whether the disconnection was logged
+}
+
+// update records whether the node is connected at now, returning how long it has been disconnected.
+func (s *controlState) update(connected bool, now time.Time) time.Duration {
+	if connected {
+		s.connectedOnce = true
+		s.disconnectedAt = time.Time{}
+		return 0
+	}
+	if s.disconnectedAt.IsZero() {
+		s.disconnectedAt = now
+	}
+	return now.Sub(s.disconnectedAt)
+}
+
+// watchControl periodically checks the node's connection to the control server, updating its metrics,
+// and logs when the node is disconnected for longer than controlGracePeriod, and when it reconnects.
+// It runs until ctx is done.
+func (t *tailscaleNode) watchControl(ctx context.Context) {
+	defer controlMetrics.connected.DeleteLabelValues(t.name)
+	defer controlMetrics.staleness.DeleteLabelValues(t.name)
+
+	var state controlState
+	ticker := time.NewTicker(controlCheckInterval)
+	defer ticker.Stop()
+	for {
+		connected := t.Sys().HealthTracker.Get().GetInPollNetMap()
+		t.checkControl(&state, connected, time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkControl records whether the node is connected to the control server at now.
+func (t *tailscaleNode) checkControl(state *controlState, connected bool, now time.Time) {
+	wasWarned := state.warned
+	disconnected := state.update(connected, now)
+	if !state.connectedOnce {
+		// The node has no network map to use yet.
+		controlMetrics.connected.WithLabelValues(t.name).Set(0)
+		return
+	}
+
+	if connected {
+		controlMetrics.connected.WithLabelValues(t.name).Set(1)
+		controlMetrics.staleness.WithLabelValues(t.name).Set(0)
+		if wasWarned {
+			state.warned = false
+			t.logger.Info("reconnected to the control server")
+		}
+		return
+	}
+	controlMetrics.connected.WithLabelValues(t.name).Set(0)
+	controlMetrics.staleness.WithLabelValues(t.name).Set(disconnected.Seconds())
+	if disconnected >= controlGracePeriod && !state.warned {
+		state.warned = true
+		t.logger.Warn("disconnected from the control server; serving and dialing known peers with the last network map",
+			zap.Duration("disconnected_for", disconnected))
+	}
+}
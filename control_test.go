@@ -0,0 +1,58 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func Test_CheckControl(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	node := &tailscaleNode{name: "control-test", logger: zap.New(core)}
+	defer controlMetrics.connected.DeleteLabelValues(node.name)
+	defer controlMetrics.staleness.DeleteLabelValues(node.name)
+
+	start := time.Now()
+	steps := []struct {
+		name          string
+		connected     bool
+		after         time.Duration
+		wantConnected float64
+		wantStaleness float64 // -1 if not exported
+		wantLogs      int
+	}{
+		{name: "starting", after: 0, wantStaleness: -1},
+		{name: "connected", connected: true, after: 5 * time.Second, wantConnected: 1},
+		{name: "disconnected", after: 10 * time.Second},
+		{name: "within grace period", after: 15 * time.Second, wantStaleness: 5},
+		{name: "past grace period", after: 25 * time.Second, wantStaleness: 15, wantLogs: 1},
+		{name: "still disconnected", after: 30 * time.Second, wantStaleness: 20, wantLogs: 1},
+		{name: "reconnected", connected: true, after: 35 * time.Second, wantConnected: 1, wantLogs: 2},
+		{name: "briefly disconnected", after: 40 * time.Second, wantLogs: 2},
+		{name: "reconnected quietly", connected: true, after: 45 * time.Second, wantConnected: 1, wantLogs: 2},
+	}
+
+	var state controlState
+	for _, step := range steps {
+		node.checkControl(&state, step.connected, start.Add(step.after))
+		if got := testutil.ToFloat64(controlMetrics.connected.WithLabelValues(node.name)); got != step.wantConnected {
+			t.Errorf("%s: connected = %v, want %v", step.name, got, step.wantConnected)
+		}
+		if step.wantStaleness < 0 {
+			if controlMetrics.staleness.DeleteLabelValues(node.name) {
+				t.Errorf("%s: staleness exported before the node connected", step.name)
+			}
+		} else if got := testutil.ToFloat64(controlMetrics.staleness.WithLabelValues(node.name)); got != step.wantStaleness {
+			t.Errorf("%s: staleness = %v, want %v", step.name, got, step.wantStaleness)
+		}
+		if got := logs.Len(); got != step.wantLogs {
+			t.Errorf("%s: logged %d messages, want %d", step.name, got, step.wantLogs)
+		}
+	}
+}
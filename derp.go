@@ -0,0 +1,120 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// derp.go contains support for reporting and pinning the home DERP region of nodes,
+// the relay region that peers use to reach a node when they can't connect directly.
+
+import (
+	"cmp"
+	"context"
+	"strconv"
+	"time"
+
+	"tailscale.com/net/netcheck"
+	"tailscale.com/tailcfg"
+)
+
+// nodeDERP is the DERP status of a node.
+type nodeDERP struct {
+	// Node is the name of the node configuration.
+	Node string `json:"node"`
+
+	// Pinned is the region the node is configured to use as its home, if any.
+	Pinned int `json:"pinned,omitempty"`
+
+	// Home is the node's current home region, or zero if it hasn't chosen one yet.
+	Home int `json:"home"`
+
+	// HomeCode is the code of the node's home region, such as "nyc", if it is in the DERP map.
+	HomeCode string `json:"home_code,omitempty"`
+
+	// Latency is the latency in milliseconds to each region measured by the node's last network check,
+	// by region code, or by region ID for regions that aren't in the DERP map.
+	Latency map[string]float64 `json:"latency"`
+
+	// Error is why the node's DERP status couldn't be read, if it couldn't.
+	Error string `json:"error,omitempty"`
+}
+
+// getDERPRegion returns the DERP region the named node is pinned to, or zero for automatic selection.
+func getDERPRegion(name string, app *App) int {
+	// Check site-specific configuration first
+	if siteNode, exists := getSiteConfig(name); exists {
+		if siteNode.DERPRegion != 0 {
+			return siteNode.DERPRegion
+		}
+	}
+
+	if node, ok := app.Nodes[name]; ok {
+		return node.DERPRegion
+	}
+	return 0
+}
+
+// pinDERPRegion makes the running node prefer its pinned DERP region as its home,
+// and checks the network again so that the region is used right away.
+// The client library falls back to automatic selection while the region can't be reached.
+func (t *tailscaleNode) pinDERPRegion() {
+	if t.derpRegion == 0 {
+		return
+	}
+	ms := t.Sys().MagicSock.Get()
+	ms.DebugForcePreferDERP(t.derpRegion)
+	ms.ReSTUN("derp-region")
+}
+
+// newNodeDERP returns the DERP status of the named node from its pinned region,
+// its last network check report and its DERP map, either of which may be nil.
+func newNodeDERP(name string, pinned int, report *netcheck.Report, dm *tailcfg.DERPMap) nodeDERP {
+	nd := nodeDERP{
+		Node:    name,
+		Pinned:  pinned,
+		Latency: make(map[string]float64),
+	}
+	regionCode := func(id int) string {
+		if dm != nil {
+			if r := dm.Regions[id]; r != nil {
+				return r.RegionCode
+			}
+		}
+		return ""
+	}
+	if report == nil {
+		return nd
+	}
+	nd.Home = report.PreferredDERP
+	if nd.Home != 0 {
+		nd.HomeCode = regionCode(nd.Home)
+	}
+	for id, d := range report.RegionLatency {
+		key := cmp.Or(regionCode(id), strconv.Itoa(id))
+		nd.Latency[key] = float64(d) / float64(time.Millisecond)
+	}
+	return nd
+}
+
+// derpMap returns the DERP map the node is using.
+func (t *tailscaleNode) derpMap(ctx context.Context) (*tailcfg.DERPMap, error) {
+	lc, err := t.LocalClient()
+	if err != nil {
+		return nil, err
+	}
+	return lc.CurrentDERPMap(ctx)
+}
+
+// tailnetDERP returns the DERP status of running nodes.
+func tailnetDERP(ctx context.Context) ([]nodeDERP, error) {
+	status := []nodeDERP{}
+	for _, node := range runningNodes() {
+		dm, err := node.derpMap(ctx)
+		if err != nil {
+			status = append(status, nodeDERP{Node: node.name, Error: err.Error()})
+			continue
+		}
+		report := node.Sys().MagicSock.Get().GetLastNetcheckReport(ctx)
+		status = append(status, newNodeDERP(node.name, node.derpRegion, report, dm))
+	}
+	return status, nil
+}
@@ -0,0 +1,65 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"tailscale.com/net/netcheck"
+	"tailscale.com/tailcfg"
+)
+
+func Test_NewNodeDERP(t *testing.T) {
+	dm := &tailcfg.DERPMap{Regions: map[int]*tailcfg.DERPRegion{
+		1: {RegionID: 1, RegionCode: "nyc"},
+		4: {RegionID: 4, RegionCode: "fra"},
+	}}
+	tests := []struct {
+		name   string
+		pinned int
+		report *netcheck.Report
+		dm     *tailcfg.DERPMap
+		want   nodeDERP
+	}{
+		{
+			name:   "not checked",
+			pinned: 4,
+			want:   nodeDERP{Node: "node", Pinned: 4, Latency: map[string]float64{}},
+		},
+		{
+			name: "automatic",
+			report: &netcheck.Report{
+				PreferredDERP: 1,
+				RegionLatency: map[int]time.Duration{1: 12 * time.Millisecond, 4: 80 * time.Millisecond},
+			},
+			dm: dm,
+			want: nodeDERP{
+				Node:     "node",
+				Home:     1,
+				HomeCode: "nyc",
+				Latency:  map[string]float64{"nyc": 12, "fra": 80},
+			},
+		},
+		{
+			name:   "pinned region not in map",
+			pinned: 900,
+			report: &netcheck.Report{
+				PreferredDERP: 900,
+				RegionLatency: map[int]time.Duration{900: 1500 * time.Microsecond},
+			},
+			dm:   dm,
+			want: nodeDERP{Node: "node", Pinned: 900, Home: 900, Latency: map[string]float64{"900": 1.5}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := newNodeDERP("node", tt.pinned, tt.report, tt.dm)
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("newNodeDERP() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -6,73 +6,103 @@ package tscaddy
 // directive.go contains the Tailscale directive for configuring node options at the virtual host level.
 
 import (
+	"cmp"
+	"errors"
+	"maps"
 	"net/http"
 	"sync"
+	"sync/atomic"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
-	"tailscale.com/types/opt"
 )
 
+// siteConfigSnapshot is an immutable set of site-specific node configurations by node name.
+// Snapshots and their Nodes are never modified once published: registering a configuration
+// publishes a modified copy, so readers can use a snapshot without locking.
+type siteConfigSnapshot map[string]Node
+
 var (
-	// siteConfigs stores site-specific node configurations
-	// Key is the node name, value is the Node configuration
-	siteConfigs   = make(map[string]Node)
-	siteConfigsMu sync.RWMutex
+	// siteConfigs is the snapshot of the site-specific node configurations of the current config,
+	// which is used to create nodes. It is nil until a config is resolved.
+	siteConfigs atomic.Pointer[siteConfigSnapshot]
+
+	// siteConfigsMu serializes changes to the site-specific node configurations of apps,
+	// so that concurrently provisioned configs publish their snapshots in order.
+	siteConfigsMu sync.Mutex
 )
 
 func init() {
 	httpcaddyfile.RegisterHandlerDirective("tailscale", parseTailscaleDirective)
-	httpcaddyfile.RegisterDirectiveOrder("tailscale", httpcaddyfile.After, "header")
+	// The directive runs first, so that handlers using request options of the node see its options.
+	// Ordering it any later, such as after header, would run tailscale_metrics (after tracing)
+	// and tailscale_headers (before header) before it, so they would miss its options.
+	httpcaddyfile.RegisterDirectiveOrder("tailscale", httpcaddyfile.Before, "tracing")
+}
+
+// registerSiteConfig registers a site-specific node configuration of the app's config.
+// Directives may be provisioned before or after other modules that use nodes,
+// so configurations are only used to create nodes once they are resolved.
+func (t *App) registerSiteConfig(nodeName string, config Node) {
+	siteConfigsMu.Lock()
+	defer siteConfigsMu.Unlock()
+	// The app's configurations may already be published, so they are copied rather than modified.
+	configs := make(siteConfigSnapshot, len(t.siteConfigs)+1)
+	maps.Copy(configs, t.siteConfigs)
+	configs[nodeName] = config.clone()
+	t.siteConfigs = configs
+	if t.siteConfigsResolved {
+		siteConfigs.Store(&configs)
+	}
 }
 
-// setSiteConfig stores a site-specific node configuration
-func setSiteConfig(nodeName string, config Node) {
+// resolveSiteConfigs replaces the site-specific node configurations of previous configs with those registered with the app.
+// It is called when the app starts or a node is first requested, whichever happens first.
+// Caddy doesn't start apps in a fixed order, but both happen after every module of the config has been provisioned,
+// so nodes are created with every site configuration of the config.
+// Requests still handled by previous configs keep using the snapshot they got, which is unchanged.
+func (t *App) resolveSiteConfigs() {
 	siteConfigsMu.Lock()
 	defer siteConfigsMu.Unlock()
-	siteConfigs[nodeName] = config
+	if t.siteConfigsResolved {
+		return
+	}
+	t.siteConfigsResolved = true
+	configs := t.siteConfigs
+	if configs == nil {
+		configs = make(siteConfigSnapshot)
+	}
+	siteConfigs.Store(&configs)
 }
 
-// getSiteConfig retrieves a site-specific node configuration
+// getSiteConfig retrieves a site-specific node configuration of the current config.
+// It is safe for concurrent use, including while configs are reloaded.
+// The returned Node is shared with other readers, so its slices and maps must not be modified.
 func getSiteConfig(nodeName string) (Node, bool) {
-	siteConfigsMu.RLock()
-	defer siteConfigsMu.RUnlock()
-	config, exists := siteConfigs[nodeName]
+	configs := siteConfigs.Load()
+	if configs == nil {
+		return Node{}, false
+	}
+	config, exists := (*configs)[nodeName]
 	return config, exists
 }
 
 // TailscaleDirective is a Caddy HTTP handler that configures Tailscale node options
 // for the current virtual host. This allows overriding global Tailscale configuration
 // on a per-site basis.
+//
+// Options used when the node is created, such as its hostname, apply to the node.
+// Options used when handling requests, such as funnel_headers, tailnet_headers, max_body_size, methods
+// and slow_request_threshold, only apply to requests handled by the directive,
+// so a directive in a route or handle block only applies them to the requests matched by the block.
 type TailscaleDirective struct {
 	// NodeName is the name of the Tailscale node to configure.
 	// If empty, it will be derived from the bind address.
 	NodeName string `json:"node_name,omitempty"`
 
-	// AuthKey is the Tailscale auth key used to register the node.
-	AuthKey string `json:"auth_key,omitempty"`
-
-	// ControlURL specifies the control URL to use for the node.
-	ControlURL string `json:"control_url,omitempty"`
-
-	// Ephemeral specifies whether the node should be registered as ephemeral.
-	Ephemeral opt.Bool `json:"ephemeral,omitempty"`
-
-	// WebUI specifies whether the node should run the Web UI for remote management.
-	WebUI opt.Bool `json:"webui,omitempty"`
-
-	// Hostname is the hostname to use when registering the node.
-	Hostname string `json:"hostname,omitempty"`
-
-	// Port is the port to use for the Tailscale node.
-	Port uint16 `json:"port,omitempty"`
-
-	// StateDir specifies the state directory for the node.
-	StateDir string `json:"state_dir,omitempty"`
-
-	// Tags specifies the list of tags to apply to this node.
-	Tags []string `json:"tags,omitempty"`
+	// Node contains the node options to override for this site.
+	Node
 }
 
 func (TailscaleDirective) CaddyModule() caddy.ModuleInfo {
@@ -90,32 +120,78 @@ func (t *TailscaleDirective) Provision(ctx caddy.Context) error {
 		nodeName = "default"
 	}
 
+	if err := t.checkAppOnly(); err != nil {
+		return err
+	}
+
 	// Create a Node configuration from the directive settings
-	node := Node{
-		AuthKey:    t.AuthKey,
-		ControlURL: t.ControlURL,
-		Ephemeral:  t.Ephemeral,
-		WebUI:      t.WebUI,
-		Hostname:   t.Hostname,
-		Port:       t.Port,
-		StateDir:   t.StateDir,
-		Tags:       t.Tags,
-		name:       nodeName,
+	node := t.Node
+	node.name = nodeName
+
+	var err error
+	if node.Tags, err = normalizeNodeTags(ctx.Logger(), node.Tags); err != nil {
+		return err
 	}
 
-	// Store the configuration globally so it can be accessed during node creation
-	setSiteConfig(nodeName, node)
+	// Register the configuration with the app, which makes it available to node creation
+	// once every module of this config has been provisioned.
+	app, err := getApp(ctx)
+	if err != nil {
+		return err
+	}
+	app.registerSiteConfig(nodeName, node)
+
+	return nil
+}
 
+// checkAppOnly returns an error if the directive sets node options that are only supported on nodes configured in the App,
+// since they are started with the app's nodes rather than with sites.
+func (t *TailscaleDirective) checkAppOnly() error {
+	if len(t.Forwards) > 0 {
+		return errors.New("forward is only supported on nodes configured in the global tailscale options")
+	}
+	if len(t.Exposes) > 0 {
+		return errors.New("expose is only supported on nodes configured in the global tailscale options")
+	}
 	return nil
 }
 
 // ServeHTTP implements caddyhttp.MiddlewareHandler.
-// This directive doesn't actually handle HTTP requests - it just configures the Tailscale node.
-// So we pass through to the next handler.
+// The directive doesn't handle requests itself, but records its options for handlers
+// that use the node's request options, then passes through to the next handler.
 func (t TailscaleDirective) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	caddyhttp.SetVar(r.Context(), scopedConfigVarPrefix+cmp.Or(t.NodeName, "default"), scopedConfig{
+		FunnelHeaders:        t.Node.FunnelHeaders,
+		TailnetHeaders:       t.Node.TailnetHeaders,
+		MaxBodySize:          t.Node.MaxBodySize,
+		Methods:              t.Node.Methods,
+		SlowRequestThreshold: t.Node.SlowRequestThreshold,
+	})
 	return next.ServeHTTP(w, r)
 }
 
+// scopedConfigVarPrefix prefixes the names of the request variables holding the options
+// of the tailscale directives that handled a request, by node name.
+const scopedConfigVarPrefix = "tailscale.directive."
+
+// scopedConfig holds the request options of a tailscale directive. Request variables are visible
+// to other handlers and placeholders, so it must not hold credentials such as the node's auth key.
+type scopedConfig struct {
+	FunnelHeaders        http.Header
+	TailnetHeaders       http.Header
+	MaxBodySize          int64
+	Methods              []string
+	SlowRequestThreshold caddy.Duration
+}
+
+// getScopedConfig returns the request options of the tailscale directive for the named node that handled r, if any.
+// Variables are shared by all handlers of the request, so handlers that ran before the directive also see them
+// once it has run.
+func getScopedConfig(r *http.Request, nodeName string) (scopedConfig, bool) {
+	config, ok := caddyhttp.GetVar(r.Context(), scopedConfigVarPrefix+nodeName).(scopedConfig)
+	return config, ok
+}
+
 // parseTailscaleDirective parses the tailscale directive from a Caddyfile.
 func parseTailscaleDirective(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
 	var directive TailscaleDirective
@@ -134,22 +210,13 @@ func parseTailscaleDirective(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandle
 			directive.NodeName = "default"
 		}
 
-		// Create a temporary Node to use with the shared parsing function
-		node := Node{}
-		err := parseNodeOptionsFromHelper(h, &node)
+		err := parseNodeOptionsFromDispenser(h.Dispenser, &directive.Node)
 		if err != nil {
 			return nil, err
 		}
-
-		// Copy the parsed values to the directive
-		directive.AuthKey = node.AuthKey
-		directive.ControlURL = node.ControlURL
-		directive.Ephemeral = node.Ephemeral
-		directive.WebUI = node.WebUI
-		directive.Hostname = node.Hostname
-		directive.Port = node.Port
-		directive.StateDir = node.StateDir
-		directive.Tags = node.Tags
+		if err := directive.checkAppOnly(); err != nil {
+			return nil, h.Err(err.Error())
+		}
 	}
 
 	return directive, nil
@@ -0,0 +1,208 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func Test_NodeClone(t *testing.T) {
+	// Every slice and map of Node is set, so that fields added later must be cloned too.
+	var n Node
+	v := reflect.ValueOf(&n).Elem()
+	for i := range v.NumField() {
+		f := v.Field(i)
+		if !f.CanSet() {
+			continue
+		}
+		switch f.Kind() {
+		case reflect.Slice:
+			f.Set(reflect.MakeSlice(f.Type(), 1, 1))
+		case reflect.Map:
+			f.Set(reflect.MakeMap(f.Type()))
+			f.SetMapIndex(reflect.Zero(f.Type().Key()), reflect.Zero(f.Type().Elem()))
+		case reflect.Pointer:
+			t.Errorf("Node.%s is a pointer, which clone doesn't copy", v.Type().Field(i).Name)
+		}
+	}
+
+	c := n.clone()
+	cv := reflect.ValueOf(c)
+	for i := range v.NumField() {
+		f, cf := v.Field(i), cv.Field(i)
+		if f.Kind() != reflect.Slice && f.Kind() != reflect.Map {
+			continue
+		}
+		name := v.Type().Field(i).Name
+		if cf.Len() != f.Len() {
+			t.Errorf("clone().%s has %d elements, want %d", name, cf.Len(), f.Len())
+		}
+		if f.Pointer() == cf.Pointer() {
+			t.Errorf("clone().%s shares its elements with the original", name)
+		}
+	}
+}
+
+func Test_SiteConfigSnapshotsAreImmutable(t *testing.T) {
+	defer siteConfigs.Store(siteConfigs.Load())
+
+	tags := []string{"tag:foo"}
+	app := new(App)
+	app.registerSiteConfig("foo", Node{Hostname: "foo", Tags: tags})
+	app.resolveSiteConfigs()
+	snapshot := siteConfigs.Load()
+
+	tags[0] = "tag:changed"
+	if got, _ := getSiteConfig("foo"); got.Tags[0] != "tag:foo" {
+		t.Errorf("Tags[0] = %q after the directive's tags changed, want %q", got.Tags[0], "tag:foo")
+	}
+
+	app.registerSiteConfig("bar", Node{Hostname: "bar"})
+	if _, ok := (*snapshot)["bar"]; ok {
+		t.Error("registering a config after it was resolved changed the published snapshot")
+	}
+	if _, ok := getSiteConfig("bar"); !ok {
+		t.Error("config registered after it was resolved isn't used")
+	}
+
+	snapshot = siteConfigs.Load()
+	app.registerSiteConfig("baz", Node{Hostname: "baz"})
+	if _, ok := (*snapshot)["baz"]; ok {
+		t.Error("registering another config changed the snapshot published by the previous registration")
+	}
+}
+
+// Test_SiteConfigsConcurrentReload reloads site configurations while they are read, as when requests are handled
+// during config reloads. Run it with -race to check that snapshots are published safely.
+func Test_SiteConfigsConcurrentReload(t *testing.T) {
+	defer siteConfigs.Store(siteConfigs.Load())
+
+	const generations = 200
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			app := new(App)
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				node, ok := getSiteConfig("web")
+				if !ok {
+					continue
+				}
+				// A node's options all come from the same config.
+				if want := []string{"tag:" + node.Hostname}; !reflect.DeepEqual(node.Tags, want) {
+					t.Errorf("Tags = %v, want %v", node.Tags, want)
+					return
+				}
+				if _, err := getHostname("web", app); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+
+	for gen := range generations {
+		app := new(App)
+		hostname := fmt.Sprintf("gen-%d", gen)
+		app.registerSiteConfig("web", Node{Hostname: hostname, Tags: []string{"tag:" + hostname}})
+		app.resolveSiteConfigs()
+		// Directives provisioned after the config is resolved still publish their configuration.
+		app.registerSiteConfig("api", Node{Hostname: hostname})
+	}
+	close(done)
+	wg.Wait()
+
+	if node, _ := getSiteConfig("web"); node.Hostname != fmt.Sprintf("gen-%d", generations-1) {
+		t.Errorf("Hostname = %q, want the last config's", node.Hostname)
+	}
+}
+
+func Test_DirectiveRequestVarsOmitCredentials(t *testing.T) {
+	directive := TailscaleDirective{
+		NodeName: "app",
+		Node:     Node{AuthKey: "tskey-auth-secret", Methods: []string{"GET"}},
+	}
+	vars := map[string]any{}
+	r := httptest.NewRequest("GET", "/", nil)
+	r = r.WithContext(context.WithValue(r.Context(), caddyhttp.VarsCtxKey, vars))
+
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error { return nil })
+	if err := directive.ServeHTTP(httptest.NewRecorder(), r, next); err != nil {
+		t.Fatal(err)
+	}
+
+	if config, ok := getScopedConfig(r, "app"); !ok || !reflect.DeepEqual(config.Methods, []string{"GET"}) {
+		t.Errorf("getScopedConfig = %+v, %v; want methods [GET]", config, ok)
+	}
+	for name, v := range vars {
+		if s := fmt.Sprintf("%+v", v); strings.Contains(s, "tskey-auth-secret") {
+			t.Errorf("request var %q contains the auth key: %s", name, s)
+		}
+	}
+}
+
+func Test_DirectiveRejectsAppOnlyOptions(t *testing.T) {
+	tests := map[string]string{
+		"forward": `tailscale db {
+			forward 127.0.0.1:5432 db:5432
+		}`,
+		"expose": `tailscale db {
+			expose 8080 unix//run/app.sock
+		}`,
+	}
+	for tn, input := range tests {
+		t.Run(tn, func(t *testing.T) {
+			h := httpcaddyfile.Helper{Dispenser: caddyfile.NewTestDispenser(input)}
+			if _, err := parseTailscaleDirective(h); err == nil || !strings.Contains(err.Error(), tn+" is only supported") {
+				t.Errorf("parseTailscaleDirective() err = %v, want %s rejected", err, tn)
+			}
+			d := &TailscaleDirective{Node: Node{Forwards: []Forward{{}}}}
+			if tn == "expose" {
+				d = &TailscaleDirective{Node: Node{Exposes: []Expose{{}}}}
+			}
+			if err := d.Provision(caddy.Context{}); err == nil {
+				t.Error("Provision() succeeded, want error")
+			}
+		})
+	}
+}
+
+func Test_DirectiveOrder(t *testing.T) {
+	// The handlers using request options of the node must run after the directive, wherever they are written.
+	caddyfile := ":80 {\n\ttailscale_metrics\n\ttailscale_headers\n\ttailscale_limits\n\ttailscale admin\n\trespond ok\n}\n"
+	cfg, warnings, err := caddyconfig.GetAdapter("caddyfile").Adapt([]byte(caddyfile), nil)
+	if err != nil {
+		t.Fatalf("Adapt() error = %v, warnings: %v", err, warnings)
+	}
+	directive := strings.Index(string(cfg), `"handler":"tailscale"`)
+	if directive < 0 {
+		t.Fatalf("Adapt() = %s, want tailscale handler", cfg)
+	}
+	for _, handler := range []string{"tailscale_metrics", "tailscale_headers", "tailscale_limits"} {
+		if i := strings.Index(string(cfg), `"handler":"`+handler+`"`); i < directive {
+			t.Errorf("Adapt() = %s, want %s handler after tailscale handler", cfg, handler)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// dispatch.go contains diagnostics of how requests received on Tailscale listeners are dispatched to sites,
+// to debug sites sharing a node and port where the wrong site is served for the node's tailnet name.
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// listenerSites describes the sites served on a Tailscale listener,
+// in the order that requests are dispatched to them.
+type listenerSites struct {
+	// Listen is the listen address of the server.
+	Listen string `json:"listen"`
+
+	// Server is the name of the HTTP server.
+	Server string `json:"server"`
+
+	// Node is the name of the node configuration.
+	Node string `json:"node"`
+
+	// DNSName is the MagicDNS name of the node, if it is running.
+	DNSName string `json:"dns_name,omitempty"`
+
+	// DNSNameSite is the index in Sites of the site serving requests for DNSName,
+	// or -1 if no site does or the node isn't running.
+	DNSNameSite int `json:"dns_name_site"`
+
+	// Sites are the sites of the server, in the order they are matched.
+	Sites []siteHosts `json:"sites"`
+
+	// SNI are the server names matched by the server's TLS connection policies.
+	SNI []string `json:"sni,omitempty"`
+}
+
+// siteHosts are the hosts matched by a site.
+type siteHosts struct {
+	// Hosts are the hosts of the site.
+	Hosts []string `json:"hosts,omitempty"`
+
+	// CatchAll reports whether the site matches requests for any host.
+	CatchAll bool `json:"catch_all,omitempty"`
+}
+
+// serverSites returns the sites of srv for each of its Tailscale listeners.
+func serverSites(name string, srv *caddyhttp.Server) []listenerSites {
+	var sites []siteHosts
+	for _, route := range srv.Routes {
+		var site siteHosts
+		for _, set := range route.MatcherSetsRaw {
+			var hosts []string
+			if raw, ok := set["host"]; ok && json.Unmarshal(raw, &hosts) == nil {
+				site.Hosts = append(site.Hosts, hosts...)
+			}
+		}
+		site.CatchAll = len(site.Hosts) == 0
+		sites = append(sites, site)
+	}
+
+	var sni []string
+	for _, cp := range srv.TLSConnPolicies {
+		var names []string
+		if raw, ok := cp.MatchersRaw["sni"]; ok && json.Unmarshal(raw, &names) == nil {
+			sni = append(sni, names...)
+		}
+	}
+
+	var listeners []listenerSites
+	for _, l := range srv.Listen {
+		na, err := caddy.ParseNetworkAddress(l)
+		if err != nil || !strings.HasPrefix(na.Network, "tailscale") {
+			continue
+		}
+		listeners = append(listeners, listenerSites{
+			Listen:      l,
+			Server:      name,
+			Node:        na.Host,
+			DNSNameSite: -1,
+			Sites:       sites,
+			SNI:         sni,
+		})
+	}
+	return listeners
+}
+
+// dispatch returns the index in Sites of the first site matching host, or -1 if none does.
+func (ls listenerSites) dispatch(host string) int {
+	r, _ := http.NewRequest(http.MethodGet, "/", nil)
+	r.Host = host
+	r = r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+	for i, site := range ls.Sites {
+		if site.CatchAll {
+			return i
+		}
+		m := caddyhttp.MatchHost(slices.Clone(site.Hosts))
+		if err := m.Provision(caddy.Context{}); err != nil {
+			continue
+		}
+		if ok, _ := m.MatchWithError(r); ok {
+			return i
+		}
+	}
+	return -1
+}
+
+// httpSites returns the sites of each Tailscale listener of the HTTP servers in ctx.
+func httpSites(ctx caddy.Context) []listenerSites {
+	httpApp, err := ctx.AppIfConfigured("http")
+	if err != nil {
+		return nil
+	}
+	servers := httpApp.(*caddyhttp.App).Servers
+	var listeners []listenerSites
+	for _, name := range slices.Sorted(maps.Keys(servers)) {
+		listeners = append(listeners, serverSites(name, servers[name])...)
+	}
+	slices.SortStableFunc(listeners, func(a, b listenerSites) int { return cmp.Compare(a.Listen, b.Listen) })
+	return listeners
+}
+
+// tailnetSites returns the sites of each Tailscale listener,
+// and which of them serves requests for the MagicDNS name of running nodes.
+func tailnetSites(ctx caddy.Context) []listenerSites {
+	running := make(map[string]*tailscaleNode)
+	for _, node := range runningNodes() {
+		running[node.name] = node
+	}
+
+	listeners := httpSites(ctx)
+	for i, ls := range listeners {
+		name := ls.Node
+		if resolved, err := resolveNodeName(ctx, name); err == nil {
+			name = resolved
+		}
+		n, ok := running[name]
+		if !ok {
+			continue
+		}
+		lc, err := n.LocalClient()
+		if err != nil {
+			continue
+		}
+		st, err := lc.StatusWithoutPeers(ctx)
+		if err != nil || st.Self == nil {
+			continue
+		}
+		listeners[i].DNSName = strings.TrimSuffix(st.Self.DNSName, ".")
+		listeners[i].DNSNameSite = ls.dispatch(listeners[i].DNSName)
+	}
+	return listeners
+}
+
+// logSites logs the sites of each Tailscale listener at debug level.
+func (t *App) logSites() {
+	for _, ls := range httpSites(t.ctx) {
+		t.logger.Debug("sites of tailscale listener",
+			zap.String("listen", ls.Listen),
+			zap.String("server", ls.Server),
+			zap.Any("sites", ls.Sites),
+			zap.Strings("sni", ls.SNI))
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+import (
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddytls"
+	"github.com/google/go-cmp/cmp"
+)
+
+func Test_ServerSites(t *testing.T) {
+	hostRoute := func(hosts ...string) caddyhttp.Route {
+		return caddyhttp.Route{MatcherSetsRaw: caddyhttp.RawMatcherSets{
+			{"host": caddyconfig.JSON(hosts, nil)},
+		}}
+	}
+	srv := &caddyhttp.Server{
+		Listen: []string{"tailscale/myhost:443", ":443", "tailscale+tls/other:8443"},
+		Routes: caddyhttp.RouteList{
+			hostRoute("app.example.com"),
+			hostRoute("*.example.com", "example.com"),
+			{MatcherSetsRaw: caddyhttp.RawMatcherSets{{"path": caddyconfig.JSON([]string{"/api/*"}, nil)}}},
+			hostRoute("myhost.tailnet.ts.net"),
+		},
+		TLSConnPolicies: caddytls.ConnectionPolicies{
+			{MatchersRaw: caddy.ModuleMap{"sni": caddyconfig.JSON([]string{"app.example.com"}, nil)}},
+			{},
+		},
+	}
+
+	sites := []siteHosts{
+		{Hosts: []string{"app.example.com"}},
+		{Hosts: []string{"*.example.com", "example.com"}},
+		{CatchAll: true},
+		{Hosts: []string{"myhost.tailnet.ts.net"}},
+	}
+	sni := []string{"app.example.com"}
+	want := []listenerSites{
+		{Listen: "tailscale/myhost:443", Server: "srv0", Node: "myhost", DNSNameSite: -1, Sites: sites, SNI: sni},
+		{Listen: "tailscale+tls/other:8443", Server: "srv0", Node: "other", DNSNameSite: -1, Sites: sites, SNI: sni},
+	}
+	got := serverSites("srv0", srv)
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("serverSites() mismatch (-want +got):\n%s", diff)
+	}
+
+	tests := map[string]int{
+		"app.example.com":       0,
+		"www.example.com":       1,
+		"example.com":           1,
+		"myhost.tailnet.ts.net": 2, // shadowed by the catch-all site
+	}
+	for host, want := range tests {
+		if got := got[0].dispatch(host); got != want {
+			t.Errorf("dispatch(%q) = %d, want %d", host, got, want)
+		}
+	}
+
+	noCatchAll := listenerSites{Sites: []siteHosts{sites[0], sites[3]}}
+	if got := noCatchAll.dispatch("other.tailnet.ts.net"); got != -1 {
+		t.Errorf("dispatch of unmatched host = %d, want -1", got)
+	}
+}
@@ -0,0 +1,439 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// doctor.go contains the "caddy tailscale doctor" command,
+// which checks that a config's nodes can connect to the tailnet before Caddy is started.
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/spf13/cobra"
+	"tailscale.com/ipn"
+	"tailscale.com/net/stun"
+	"tailscale.com/tailcfg"
+)
+
+// defaultDERPMapURL is the URL of the DERP map used by Tailscale's control server,
+// used to find STUN servers to check UDP connectivity.
+const defaultDERPMapURL = "https://controlplane.tailscale.com/derpmap/default"
+
+// stunRegions is the number of DERP regions whose STUN servers are tried when checking UDP connectivity.
+const stunRegions = 3
+
+// doctorStatus is the outcome of a doctor check.
+type doctorStatus string
+
+const (
+	doctorOK   doctorStatus = "ok"
+	doctorWarn doctorStatus = "warn"
+	doctorFail doctorStatus = "fail"
+)
+
+// doctorResult is the outcome of a single doctor check, with a hint for fixing it if it didn't pass.
+type doctorResult struct {
+	Check  string
+	Status doctorStatus
+	Detail string
+	Hint   string
+}
+
+func tailscaleDoctorCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "doctor [--config <path>] [--adapter <name>] [--timeout <duration>]",
+		Short: "Checks that Tailscale nodes in a config can connect",
+		Long: `
+Checks the Tailscale nodes in a config without starting Caddy or the nodes.
+
+Each node configured in the tailscale app or used by a tailscale/ listener is
+checked for a reachable control server, a usable state directory, and an auth
+key, and UDP connectivity to Tailscale's STUN servers is checked once.
+Problems are printed with hints for fixing them.
+
+Options set with the tailscale directive in site blocks are not checked,
+only those in the tailscale app.
+
+Exits with a non-zero status if any check fails.
+`,
+		RunE: caddycmd.WrapCommandFuncForCobra(cmdTailscaleDoctor),
+	}
+	cmd.Flags().StringP("config", "c", "", "Configuration file")
+	cmd.Flags().StringP("adapter", "a", "", "Name of config adapter to apply")
+	cmd.Flags().Duration("timeout", 30*time.Second, "Maximum time to spend on network checks")
+	return cmd
+}
+
+func cmdTailscaleDoctor(fl caddycmd.Flags) (int, error) {
+	cfgJSON, _, err := caddycmd.LoadConfig(fl.String("config"), fl.String("adapter"))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	app, names, err := doctorConfig(cfgJSON)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("invalid config: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), fl.Duration("timeout"))
+	defer cancel()
+
+	failed := 0
+	report := func(results []doctorResult) {
+		for _, r := range results {
+			printDoctorResult(os.Stdout, r)
+			if r.Status == doctorFail {
+				failed++
+			}
+		}
+	}
+	for _, name := range names {
+		fmt.Printf("Node %q:\n", name)
+		report(doctorNode(ctx, name, app))
+	}
+	fmt.Println("Network:")
+	report([]doctorResult{doctorUDP(ctx, nil)})
+
+	if failed > 0 {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("%d checks failed", failed)
+	}
+	return caddy.ExitCodeSuccess, nil
+}
+
+// doctorConfig decodes the tailscale app from a JSON config,
+// returning it along with the names of the nodes it configures or that listeners use.
+func doctorConfig(cfgJSON []byte) (*App, []string, error) {
+	var cfg struct {
+		Apps struct {
+			Tailscale json.RawMessage `json:"tailscale"`
+			HTTP      struct {
+				Servers map[string]struct {
+					Listen []string `json:"listen"`
+				} `json:"servers"`
+			} `json:"http"`
+		} `json:"apps"`
+	}
+	if err := json.Unmarshal(cfgJSON, &cfg); err != nil {
+		return nil, nil, err
+	}
+
+	app := new(App)
+	if len(cfg.Apps.Tailscale) > 0 {
+		if err := caddy.StrictUnmarshalJSON(cfg.Apps.Tailscale, app); err != nil {
+			return nil, nil, fmt.Errorf("tailscale app: %w", err)
+		}
+	}
+	app.logger = caddy.Log()
+	if err := app.loadNodesFile(); err != nil {
+		return nil, nil, err
+	}
+	if err := app.normalizeTags(); err != nil {
+		return nil, nil, err
+	}
+	if err := app.validateProxies(); err != nil {
+		return nil, nil, err
+	}
+	if _, err := app.applyProxy(); err != nil {
+		return nil, nil, err
+	}
+
+	var names []string
+	for name, node := range app.Nodes {
+		for _, fw := range node.Forwards {
+			if err := fw.validate(); err != nil {
+				return nil, nil, fmt.Errorf("node %q: %w", name, err)
+			}
+		}
+		for _, e := range node.Exposes {
+			if err := e.validate(); err != nil {
+				return nil, nil, fmt.Errorf("node %q: %w", name, err)
+			}
+		}
+		names = append(names, name)
+	}
+	for _, srv := range cfg.Apps.HTTP.Servers {
+		for _, l := range srv.Listen {
+			na, err := caddy.ParseNetworkAddress(l)
+			if err == nil && na.Network == "tailscale" && na.Host != "" {
+				names = append(names, na.Host)
+			}
+		}
+	}
+	if app.LockSigner != "" {
+		names = append(names, app.LockSigner)
+	}
+	if len(names) == 0 {
+		return nil, nil, errors.New("config has no Tailscale nodes")
+	}
+	slices.Sort(names)
+	return app, slices.Compact(names), nil
+}
+
+// doctorNode checks that the named node can connect to the tailnet.
+func doctorNode(ctx context.Context, name string, app *App) []doctorResult {
+	var results []doctorResult
+
+	controlURL, err := getControlURL(name, app)
+	if err != nil {
+		results = append(results, doctorResult{Check: "control server", Status: doctorFail, Detail: err.Error()})
+	} else {
+		controlURL = cmp.Or(controlURL, ipn.DefaultControlURL)
+		if proxy := getProxy(name, app); proxy != "" {
+			if np, err := addControlProxy(controlURL, proxy); err != nil {
+				results = append(results, doctorResult{Check: "proxy", Status: doctorFail, Detail: err.Error()})
+			} else {
+				defer np.remove()
+			}
+		}
+		results = append(results, doctorControl(ctx, controlURL)...)
+	}
+
+	stateResult, hasState := doctorState(name, app)
+	results = append(results, stateResult)
+	results = append(results, doctorAuthKey(ctx, name, app, hasState))
+	return results
+}
+
+// doctorControl checks that the control server can be reached, and that its clock and certificate look right.
+func doctorControl(ctx context.Context, controlURL string) []doctorResult {
+	problems, err := checkClock(ctx, controlURL, time.Now())
+	if err != nil {
+		return []doctorResult{{
+			Check:  "control server",
+			Status: doctorFail,
+			Detail: fmt.Sprintf("can't reach %s: %v", controlURL, err),
+			Hint: "check DNS and that outbound HTTPS is allowed; if the host can only reach the internet through a proxy, " +
+				"set the proxy option or the HTTPS_PROXY environment variable",
+		}}
+	}
+	results := []doctorResult{{Check: "control server", Status: doctorOK, Detail: "reached " + controlURL}}
+	for _, problem := range problems {
+		results = append(results, doctorResult{Check: "control server", Status: doctorWarn, Detail: problem})
+	}
+	return results
+}
+
+// doctorState checks that the named node's state directory can be used, and reports whether it has state.
+func doctorState(name string, app *App) (_ doctorResult, hasState bool) {
+	fail := func(err error, hint string) (doctorResult, bool) {
+		return doctorResult{Check: "state", Status: doctorFail, Detail: err.Error(), Hint: hint}, false
+	}
+
+	dir, err := getStateDir(name, app)
+	if err != nil {
+		return fail(err, "set state_dir")
+	}
+	if err := checkNotExported(name, dir); err != nil {
+		return fail(err, "")
+	}
+	_, err = os.Stat(filepath.Join(dir, stateFileName))
+	hasState = err == nil
+
+	if getReadOnlyState(name, app) {
+		if !hasState {
+			return fail(fmt.Errorf("read-only state requires existing state in %s", dir),
+				"copy the node's state into the directory, or disable read_only_state")
+		}
+		return doctorResult{Check: "state", Status: doctorOK, Detail: dir + " (read-only)"}, true
+	}
+
+	// Check the directory is writable the way the node uses it, leaving it in place for the node.
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fail(err, "set state_dir to a writable directory")
+	}
+	f, err := os.CreateTemp(dir, ".doctor-*")
+	if err != nil {
+		return fail(err, "set state_dir to a writable directory")
+	}
+	f.Close()
+	os.Remove(f.Name())
+
+	if !hasState {
+		return doctorResult{Check: "state", Status: doctorOK, Detail: dir + " (no state yet, the node will register when started)"}, false
+	}
+	return doctorResult{Check: "state", Status: doctorOK, Detail: dir}, true
+}
+
+// doctorAuthKey checks that the named node has an auth key it can register with,
+// verifying OAuth client secrets with the Tailscale API.
+// Other auth keys can't be verified without registering a node, so they're only checked when the node starts.
+func doctorAuthKey(ctx context.Context, name string, app *App, hasState bool) doctorResult {
+	authKey, err := getAuthKey(name, app)
+	if err != nil {
+		return doctorResult{Check: "auth key", Status: doctorFail, Detail: err.Error()}
+	}
+	switch {
+	case hasState:
+		return doctorResult{Check: "auth key", Status: doctorOK, Detail: "not needed, the node is already registered"}
+	case authKey == "":
+		return doctorResult{
+			Check:  "auth key",
+			Status: doctorWarn,
+			Detail: "no auth key, so the node will log a login URL and wait for it to be visited",
+			Hint:   "set auth_key, or the TS_AUTHKEY environment variable",
+		}
+	case strings.HasPrefix(authKey, "tskey-client-"):
+		if len(getTags(name, app)) == 0 {
+			return doctorResult{Check: "auth key", Status: doctorFail, Detail: "OAuth client secrets require tags", Hint: "set tags"}
+		}
+		if _, err := oauthCredentials(authKey, app).Token(ctx); err != nil {
+			return doctorResult{
+				Check:  "auth key",
+				Status: doctorFail,
+				Detail: fmt.Sprintf("OAuth client secret was rejected: %v", err),
+				Hint:   "check that the OAuth client exists and has the auth_keys scope",
+			}
+		}
+		return doctorResult{Check: "auth key", Status: doctorOK, Detail: "OAuth client secret accepted"}
+	default:
+		return doctorResult{
+			Check:  "auth key",
+			Status: doctorOK,
+			Detail: "set, and checked when the node registers",
+			Hint:   fmt.Sprintf("run caddy tailscale check-auth --node %s to check it now", name),
+		}
+	}
+}
+
+// doctorUDP checks that STUN servers in dm can be reached over UDP,
+// which nodes need for direct connections to peers.
+// If dm is nil, Tailscale's default DERP map is used.
+func doctorUDP(ctx context.Context, dm *tailcfg.DERPMap) doctorResult {
+	const hint = "allow outbound UDP, including to port 3478; without it, connections to peers are relayed through DERP and are slower"
+	if dm == nil {
+		var err error
+		if dm, err = fetchDERPMap(ctx); err != nil {
+			return doctorResult{Check: "UDP", Status: doctorWarn, Detail: fmt.Sprintf("fetching DERP map: %v", err)}
+		}
+	}
+	addr, region, err := checkSTUN(ctx, dm)
+	if err != nil {
+		return doctorResult{Check: "UDP", Status: doctorWarn, Detail: err.Error(), Hint: hint}
+	}
+	return doctorResult{Check: "UDP", Status: doctorOK, Detail: fmt.Sprintf("STUN server in region %s reports public address %s", region, addr)}
+}
+
+// fetchDERPMap fetches Tailscale's default DERP map.
+func fetchDERPMap(ctx context.Context) (*tailcfg.DERPMap, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, defaultDERPMapURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy: func(r *http.Request) (*url.URL, error) { return proxyForURL(r.URL) },
+		},
+	}
+	defer client.CloseIdleConnections()
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	dm := new(tailcfg.DERPMap)
+	if err := json.NewDecoder(resp.Body).Decode(dm); err != nil {
+		return nil, err
+	}
+	return dm, nil
+}
+
+// checkSTUN sends STUN requests to servers in the first few regions of dm,
+// returning the public address reported by the first to respond and its region.
+func checkSTUN(ctx context.Context, dm *tailcfg.DERPMap) (netip.AddrPort, string, error) {
+	var servers []string
+	var regions []string
+	for _, id := range dm.RegionIDs() {
+		r := dm.Regions[id]
+		for _, n := range r.Nodes {
+			if n.STUNPort < 0 {
+				continue
+			}
+			host := n.HostName
+			if ip, err := netip.ParseAddr(n.IPv4); err == nil {
+				host = ip.String()
+			}
+			port := cmp.Or(n.STUNPort, 3478)
+			servers = append(servers, net.JoinHostPort(host, strconv.Itoa(port)))
+			regions = append(regions, r.RegionCode)
+			break
+		}
+		if len(servers) == stunRegions {
+			break
+		}
+	}
+	if len(servers) == 0 {
+		return netip.AddrPort{}, "", errors.New("DERP map has no STUN servers")
+	}
+
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return netip.AddrPort{}, "", err
+	}
+	defer conn.Close()
+
+	txs := make(map[stun.TxID]string)
+	for i, server := range servers {
+		addr, err := net.ResolveUDPAddr("udp4", server)
+		if err != nil {
+			continue
+		}
+		tx := stun.NewTxID()
+		if _, err := conn.WriteTo(stun.Request(tx), addr); err != nil {
+			continue
+		}
+		txs[tx] = regions[i]
+	}
+	if len(txs) == 0 {
+		return netip.AddrPort{}, "", errors.New("couldn't send STUN requests")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetReadDeadline(deadline)
+	buf := make([]byte, 1024)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				return netip.AddrPort{}, "", fmt.Errorf("no response from STUN servers in regions %s", strings.Join(regions, ", "))
+			}
+			return netip.AddrPort{}, "", err
+		}
+		tx, addr, err := stun.ParseResponse(buf[:n])
+		if err != nil {
+			continue
+		}
+		if region, ok := txs[tx]; ok {
+			return addr, region, nil
+		}
+	}
+}
+
+// printDoctorResult prints a doctor result, with its hint on the following line.
+func printDoctorResult(w io.Writer, r doctorResult) {
+	fmt.Fprintf(w, "  [%s] %s: %s\n", r.Status, r.Check, r.Detail)
+	if r.Hint != "" {
+		fmt.Fprintf(w, "    hint: %s\n", r.Hint)
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/msfjarvis/caddy-tailscale/tscaddytest"
+	"go.uber.org/zap"
+	"tailscale.com/types/opt"
+)
+
+func Test_DoctorConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "nodes and listeners",
+			cfg: `{"apps":{
+				"tailscale":{"lock_signer":"signer","nodes":{"foo":{}}},
+				"http":{"servers":{"srv":{"listen":["tailscale/bar:443","tailscale/foo:80",":8080"]}}}
+			}}`,
+			want: []string{"bar", "foo", "signer"},
+		},
+		{
+			name:    "no nodes",
+			cfg:     `{"apps":{"http":{"servers":{"srv":{"listen":[":8080"]}}}}}`,
+			wantErr: true,
+		},
+		{
+			name:    "unknown field",
+			cfg:     `{"apps":{"tailscale":{"nodes":{"foo":{"auth_kye":"x"}}}}}`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid proxy",
+			cfg:     `{"apps":{"tailscale":{"nodes":{"foo":{"proxy":"proxy:3128"}}}}}`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, names, err := doctorConfig([]byte(tt.cfg))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("doctorConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if diff := cmp.Diff(tt.want, names); diff != "" {
+				t.Errorf("doctorConfig() names mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func Test_DoctorNode(t *testing.T) {
+	control := tscaddytest.NewControl(t)
+	unreachable := httptest.NewServer(nil)
+	unreachable.Close()
+
+	stateDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(stateDir, "registered"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(stateDir, "registered", stateFileName), []byte("{}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	app := &App{
+		ControlURL: control.URL,
+		StateDir:   stateDir,
+		Nodes: map[string]Node{
+			"unreachable": {ControlURL: unreachable.URL},
+			"oauth":       {AuthKey: "tskey-client-xyz"},
+			"readonly":    {ReadOnlyState: opt.NewBool(true)},
+		},
+	}
+	app.logger = zap.NewNop()
+	t.Setenv("TS_AUTHKEY", "")
+
+	tests := []struct {
+		name string
+		want map[string]doctorStatus // status of each check
+	}{
+		{
+			name: "new",
+			want: map[string]doctorStatus{"control server": doctorOK, "state": doctorOK, "auth key": doctorWarn},
+		},
+		{
+			name: "registered",
+			want: map[string]doctorStatus{"control server": doctorOK, "state": doctorOK, "auth key": doctorOK},
+		},
+		{
+			name: "unreachable",
+			want: map[string]doctorStatus{"control server": doctorFail, "state": doctorOK, "auth key": doctorWarn},
+		},
+		{
+			name: "oauth",
+			want: map[string]doctorStatus{"control server": doctorOK, "state": doctorOK, "auth key": doctorFail},
+		},
+		{
+			name: "readonly",
+			want: map[string]doctorStatus{"control server": doctorOK, "state": doctorFail, "auth key": doctorWarn},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := make(map[string]doctorStatus)
+			for _, r := range doctorNode(context.Background(), tt.name, app) {
+				got[r.Check] = r.Status
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("doctorNode() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func Test_DoctorUDP(t *testing.T) {
+	control := tscaddytest.NewControl(t)
+	if r := doctorUDP(context.Background(), control.DERPMap); r.Status != doctorOK {
+		t.Errorf("doctorUDP() = %+v, want ok", r)
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// duplicate.go contains detection of other machines using a node's identity,
+// which happens when node state is copied to more than one host.
+
+import (
+	"context"
+	"net/netip"
+	"slices"
+
+	"go.uber.org/zap"
+	"tailscale.com/ipn"
+	"tailscale.com/types/views"
+)
+
+// duplicateDetector detects endpoints reported to the control server for a node
+// that the node itself never advertised, which means another machine is using its identity.
+// Machines sharing an identity take turns being connected, so connectivity flaps without other errors.
+type duplicateDetector struct {
+	own      map[netip.AddrPort]bool // endpoints the node has advertised
+	reported map[netip.AddrPort]bool // foreign endpoints that have been reported
+}
+
+func newDuplicateDetector() *duplicateDetector {
+	return &duplicateDetector{
+		own:      make(map[netip.AddrPort]bool),
+		reported: make(map[netip.AddrPort]bool),
+	}
+}
+
+// addOwn records endpoints the node advertises, as reported in its status.
+func (d *duplicateDetector) addOwn(addrs []string) {
+	for _, a := range addrs {
+		if ap, err := netip.ParseAddrPort(a); err == nil {
+			d.own[ap] = true
+		}
+	}
+}
+
+// check returns the endpoints in the control server's view of the node that the node never advertised
+// and that haven't been returned before.
+func (d *duplicateDetector) check(controlEndpoints views.Slice[netip.AddrPort]) []netip.AddrPort {
+	var foreign []netip.AddrPort
+	for _, ep := range controlEndpoints.All() {
+		if d.own[ep] || d.reported[ep] {
+			continue
+		}
+		d.reported[ep] = true
+		foreign = append(foreign, ep)
+	}
+	slices.SortFunc(foreign, func(a, b netip.AddrPort) int { return a.Compare(b) })
+	return foreign
+}
+
+// watchDuplicates watches the node's network map for signs that another machine is using its identity,
+// logging an error when it is detected. It runs until ctx is done or the node is closed.
+func (t *tailscaleNode) watchDuplicates(ctx context.Context) {
+	lc, err := t.LocalClient()
+	if err != nil {
+		return
+	}
+	watcher, err := lc.WatchIPNBus(ctx, ipn.NotifyInitialNetMap|ipn.NotifyNoPrivateKeys)
+	if err != nil {
+		return
+	}
+	defer watcher.Close()
+
+	d := newDuplicateDetector()
+	for {
+		n, err := watcher.Next()
+		if err != nil {
+			return
+		}
+		if n.NetMap == nil || !n.NetMap.SelfNode.Valid() {
+			continue
+		}
+		// Endpoints are read after the netmap, so that endpoints the node
+		// advertised since the netmap was sent aren't mistaken for another machine's.
+		st, err := lc.StatusWithoutPeers(ctx)
+		if err != nil {
+			return
+		}
+		if st.Self != nil {
+			d.addOwn(st.Self.Addrs)
+		}
+		if foreign := d.check(n.NetMap.SelfNode.Endpoints()); len(foreign) > 0 {
+			t.reportError("another machine appears to be using this node's identity; "+
+				"this happens when node state is copied to more than one host, and causes connectivity to flap. "+
+				"Give each host its own state, or move state with the export and import admin endpoints",
+				ErrDuplicateNode, zap.Stringers("endpoints", foreign))
+		}
+	}
+}
@@ -0,0 +1,37 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+
+	"tailscale.com/types/views"
+)
+
+func Test_DuplicateDetector(t *testing.T) {
+	ep := netip.MustParseAddrPort
+	d := newDuplicateDetector()
+
+	d.addOwn([]string{"203.0.113.1:41641", "192.168.1.2:41641"})
+	if got := d.check(views.SliceOf([]netip.AddrPort{ep("203.0.113.1:41641")})); len(got) != 0 {
+		t.Errorf("check() of own endpoints = %v, want none", got)
+	}
+
+	// Endpoints the node advertised before remain its own after they change.
+	d.addOwn([]string{"203.0.113.9:41641"})
+	if got := d.check(views.SliceOf([]netip.AddrPort{ep("192.168.1.2:41641"), ep("203.0.113.9:41641")})); len(got) != 0 {
+		t.Errorf("check() of previous endpoints = %v, want none", got)
+	}
+
+	other := []netip.AddrPort{ep("198.51.100.7:41641"), ep("10.0.0.5:41641")}
+	want := []netip.AddrPort{ep("10.0.0.5:41641"), ep("198.51.100.7:41641")}
+	if got := d.check(views.SliceOf(other)); !slices.Equal(got, want) {
+		t.Errorf("check() of another machine's endpoints = %v, want %v", got, want)
+	}
+	if got := d.check(views.SliceOf(other)); len(got) != 0 {
+		t.Errorf("check() reported the same endpoints again: %v", got)
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// errors.go contains the errors reported by nodes, which have codes identifying them in logs,
+// events and the admin API, so that automation can react to them without parsing messages.
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyevents"
+	"go.uber.org/zap"
+)
+
+// Errors reported by nodes. They can be matched with errors.Is.
+var (
+	// ErrAuthKeyInvalid is reported when the control server rejects a node's auth key,
+	// because it is invalid, expired or already used.
+	ErrAuthKeyInvalid = errors.New("auth key rejected")
+
+	// ErrOAuthRequired is reported when a node option requires an OAuth client secret auth key.
+	ErrOAuthRequired = errors.New("an OAuth client secret auth key is required")
+
+	// ErrPortConflict is reported when a node port is used by more than one listener.
+	ErrPortConflict = errors.New("port conflict")
+
+	// ErrControlUnreachable is reported when a node can't connect to the control server.
+	ErrControlUnreachable = errors.New("control server unreachable")
+
+	// ErrStateDir is reported when a node's state directory can't be used.
+	ErrStateDir = errors.New("state directory unusable")
+
+	// ErrDuplicateNode is reported when another machine appears to be using a node's identity.
+	ErrDuplicateNode = errors.New("node identity in use by another machine")
+)
+
+// errorCodes are the codes of the errors reported by nodes.
+var errorCodes = []struct {
+	err  error
+	code string
+}{
+	{ErrAuthKeyInvalid, "auth_key_invalid"},
+	{ErrOAuthRequired, "oauth_required"},
+	{ErrPortConflict, "port_conflict"},
+	{ErrControlUnreachable, "control_unreachable"},
+	{ErrStateDir, "state_dir"},
+	{ErrDuplicateNode, "duplicate_node"},
+}
+
+// errorCodeUnknown is the code of errors that aren't one of the errors reported by nodes.
+const errorCodeUnknown = "unknown"
+
+// errorEventName is the name of the event emitted when a node reports an error.
+const errorEventName = "tailscale_error"
+
+// errorCode returns the code of err.
+func errorCode(err error) string {
+	for _, ec := range errorCodes {
+		if errors.Is(err, ec.err) {
+			return ec.code
+		}
+	}
+	return errorCodeUnknown
+}
+
+// classifyError wraps errors from the control server and network with the matching error reported by nodes.
+// tsnet reports backend errors as messages, so they are matched by their text.
+func classifyError(err error) error {
+	if err == nil || errorCode(err) != errorCodeUnknown {
+		return err
+	}
+	msg := strings.ToLower(err.Error())
+	switch {
+	case strings.Contains(msg, "invalid key"), strings.Contains(msg, "key expired"), strings.Contains(msg, "not valid"):
+		return fmt.Errorf("%w: %w", ErrAuthKeyInvalid, err)
+	case errors.As(err, new(*net.OpError)), errors.As(err, new(*net.DNSError)),
+		strings.Contains(msg, "connection refused"), strings.Contains(msg, "no such host"),
+		strings.Contains(msg, "i/o timeout"), strings.Contains(msg, "network is unreachable"):
+		return fmt.Errorf("%w: %w", ErrControlUnreachable, err)
+	}
+	return err
+}
+
+// nodeError is the last error reported by a node.
+type nodeError struct {
+	// Node is the name of the node configuration.
+	Node string `json:"node"`
+
+	// Code identifies the error, such as "auth_key_invalid", or is "unknown".
+	Code string `json:"code"`
+
+	// Message describes what the node was doing.
+	Message string `json:"message"`
+
+	// Error is the error message.
+	Error string `json:"error"`
+
+	// Time is when the error was reported.
+	Time time.Time `json:"time"`
+}
+
+// nodeErrors are the last errors reported by nodes, by node name.
+var nodeErrors sync.Map
+
+// reportError logs an error that needs attention, records it as the node's last error,
+// and emits it as a tailscale_error event.
+func (t *tailscaleNode) reportError(msg string, err error, fields ...zap.Field) {
+	err = classifyError(err)
+	ne := nodeError{
+		Node:    t.name,
+		Code:    errorCode(err),
+		Message: msg,
+		Error:   err.Error(),
+		Time:    time.Now(),
+	}
+	nodeErrors.Store(t.name, ne)
+	if t.logger != nil {
+		t.logger.Error(msg, append(fields, zap.String("error_code", ne.Code), zap.Error(err))...)
+	}
+	emitNodeError(ne)
+}
+
+// emitNodeError emits ne as an event of the active config, if it has an events app.
+func emitNodeError(ne nodeError) {
+	ctx := caddy.ActiveContext()
+	appIface, err := ctx.AppIfConfigured("tailscale")
+	if err != nil {
+		return
+	}
+	app := appIface.(*App)
+	eventsApp, err := app.ctx.AppIfConfigured("events")
+	if err != nil {
+		return
+	}
+	eventsApp.(*caddyevents.App).Emit(app.ctx, errorEventName, map[string]any{
+		"node":    ne.Node,
+		"code":    ne.Code,
+		"message": ne.Message,
+		"error":   ne.Error,
+	})
+}
+
+// tailnetErrors returns the last errors reported by nodes.
+func tailnetErrors() []nodeError {
+	errs := []nodeError{}
+	nodeErrors.Range(func(_, value any) bool {
+		errs = append(errs, value.(nodeError))
+		return true
+	})
+	slices.SortFunc(errs, func(a, b nodeError) int { return cmp.Compare(a.Node, b.Node) })
+	return errs
+}
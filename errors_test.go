@@ -0,0 +1,81 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+)
+
+func Test_ClassifyError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{
+			name: "invalid key",
+			err:  errors.New("tsnet.Up: backend: invalid key: API key tskey-auth-xxx not valid"),
+			want: "auth_key_invalid",
+		},
+		{
+			name: "dial error",
+			err:  fmt.Errorf("fetching control key: %w", &net.OpError{Op: "dial", Err: errors.New("refused")}),
+			want: "control_unreachable",
+		},
+		{
+			name: "dns error",
+			err:  &net.DNSError{Err: "no such host", Name: "controlplane.example.com"},
+			want: "control_unreachable",
+		},
+		{
+			name: "already classified",
+			err:  fmt.Errorf("node %q: key_expiry: %w", "myhost", ErrOAuthRequired),
+			want: "oauth_required",
+		},
+		{
+			name: "port conflict",
+			err:  fmt.Errorf("%w: port 80 is already used", ErrPortConflict),
+			want: "port_conflict",
+		},
+		{
+			name: "unknown",
+			err:  errors.New("something else"),
+			want: "unknown",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := classifyError(tt.err)
+			if got := errorCode(err); got != tt.want {
+				t.Errorf("errorCode(classifyError(%v)) = %q, want %q", tt.err, got, tt.want)
+			}
+			if !errors.Is(err, tt.err) {
+				t.Errorf("classifyError(%v) doesn't wrap the original error", tt.err)
+			}
+		})
+	}
+}
+
+func Test_ReportError(t *testing.T) {
+	node := &tailscaleNode{name: "errors-test"}
+	defer nodeErrors.Delete(node.name)
+
+	node.reportError("waiting for node", errors.New("backend: invalid key"))
+
+	var got *nodeError
+	for _, ne := range tailnetErrors() {
+		if ne.Node == node.name {
+			got = &ne
+		}
+	}
+	if got == nil {
+		t.Fatal("reported error not recorded")
+	}
+	if got.Code != "auth_key_invalid" || got.Message != "waiting for node" {
+		t.Errorf("recorded error = %+v, want code auth_key_invalid and message %q", got, "waiting for node")
+	}
+}
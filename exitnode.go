@@ -0,0 +1,71 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// exitnode.go contains support for routing nodes' outbound traffic through a tailnet exit node,
+// such as to make proxy transports egress from a specific region.
+
+import (
+	"context"
+
+	"go.uber.org/zap"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+)
+
+// getExitNode returns the hostname or IP of the exit node the named node routes outbound traffic through, if any.
+func getExitNode(name string, app *App) (string, error) {
+	exitNode := ""
+	// Check site-specific configuration first
+	if siteNode, exists := getSiteConfig(name); exists && siteNode.ExitNode != "" {
+		exitNode = siteNode.ExitNode
+	} else if node, ok := app.Nodes[name]; ok {
+		exitNode = node.ExitNode
+	}
+	if exitNode == "" {
+		return "", nil
+	}
+	return repl.ReplaceOrErr(exitNode, true, true)
+}
+
+// exitNodePrefs returns the preferences that make a node use the exit node with the hostname or IP exitNode,
+// among the peers in st.
+func exitNodePrefs(exitNode string, st *ipnstate.Status) (*ipn.MaskedPrefs, error) {
+	mp := &ipn.MaskedPrefs{ExitNodeIDSet: true, ExitNodeIPSet: true}
+	if err := mp.SetExitNodeIP(exitNode, st); err != nil {
+		return nil, err
+	}
+	return mp, nil
+}
+
+// useExitNode waits for the node to connect to the tailnet, then routes its outbound traffic through its exit node.
+// Exit nodes are set once the node has connected, since hostnames are resolved from its network map.
+// Errors are logged, since the node is otherwise usable.
+func (t *tailscaleNode) useExitNode() {
+	ctx := context.Background()
+	if _, err := t.Up(ctx); err != nil {
+		t.reportError("waiting for node to use exit node", err)
+		return
+	}
+	lc, err := t.LocalClient()
+	if err != nil {
+		t.reportError("using exit node", err)
+		return
+	}
+	st, err := lc.Status(ctx)
+	if err != nil {
+		t.reportError("using exit node", err)
+		return
+	}
+	mp, err := exitNodePrefs(t.exitNode, st)
+	if err != nil {
+		t.reportError("using exit node", err, zap.String("exit_node", t.exitNode))
+		return
+	}
+	if _, err := lc.EditPrefs(ctx, mp); err != nil {
+		t.reportError("using exit node", err, zap.String("exit_node", t.exitNode))
+		return
+	}
+	t.logger.Info("using exit node", zap.String("exit_node", t.exitNode), zap.Stringer("ip", mp.ExitNodeIP))
+}
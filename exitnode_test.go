@@ -0,0 +1,115 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+import (
+	"context"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/msfjarvis/caddy-tailscale/tscaddytest"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/net/tsaddr"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+	"tailscale.com/util/must"
+)
+
+func Test_ExitNodePrefs(t *testing.T) {
+	peer := func(name, ip string, exitNode bool) *ipnstate.PeerStatus {
+		return &ipnstate.PeerStatus{
+			DNSName:        name + ".tail-scale.ts.net.",
+			TailscaleIPs:   []netip.Addr{netip.MustParseAddr(ip)},
+			ExitNodeOption: exitNode,
+		}
+	}
+	st := &ipnstate.Status{
+		BackendState:   "Running",
+		MagicDNSSuffix: "tail-scale.ts.net",
+		TailscaleIPs:   []netip.Addr{netip.MustParseAddr("100.64.0.1")},
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+			key.NewNode().Public(): peer("eu-exit", "100.64.0.2", true),
+			key.NewNode().Public(): peer("web", "100.64.0.3", false),
+		},
+	}
+
+	tests := map[string]struct {
+		exitNode string
+		want     netip.Addr
+		wantErr  bool
+	}{
+		"hostname": {
+			exitNode: "eu-exit",
+			want:     netip.MustParseAddr("100.64.0.2"),
+		},
+		"magicdns name": {
+			exitNode: "eu-exit.tail-scale.ts.net.",
+			want:     netip.MustParseAddr("100.64.0.2"),
+		},
+		"ip": {
+			exitNode: "100.64.0.2",
+			want:     netip.MustParseAddr("100.64.0.2"),
+		},
+		"not an exit node": {
+			exitNode: "web",
+			wantErr:  true,
+		},
+		"unknown peer": {
+			exitNode: "us-exit",
+			wantErr:  true,
+		},
+		"own ip": {
+			exitNode: "100.64.0.1",
+			wantErr:  true,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			mp, err := exitNodePrefs(tt.exitNode, st)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("exitNodePrefs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if mp.ExitNodeIP != tt.want || !mp.ExitNodeIPSet || !mp.ExitNodeIDSet || mp.ExitNodeID != tailcfg.StableNodeID("") {
+				t.Errorf("exitNodePrefs() = %v, want exit node %v", mp, tt.want)
+			}
+		})
+	}
+}
+
+func Test_UseExitNode(t *testing.T) {
+	control := tscaddytest.NewControl(t)
+	exit := control.NewNode(t, "exit")
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	exitStatus := must.Get(must.Get(exit.LocalClient()).StatusWithoutPeers(ctx))
+	// Nodes registered afterwards see the exit routes in their network map.
+	control.SetSubnetRoutes(exitStatus.Self.PublicKey, tsaddr.ExitRoutes())
+
+	runTestApp(t, newTestApp(t, control, map[string]Node{
+		"egress": {ExitNode: "exit"},
+	}))
+
+	node := startTestNode(t, "egress")
+	lc := must.Get(node.LocalClient())
+
+	want := exitStatus.TailscaleIPs[0]
+	var got netip.Addr
+	for ctx.Err() == nil {
+		prefs := must.Get(lc.GetPrefs(ctx))
+		if got = prefs.ExitNodeIP; got.IsValid() || !prefs.ExitNodeID.IsZero() {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	st := must.Get(lc.Status(ctx))
+	if st.ExitNodeStatus == nil || !slices.Contains(st.ExitNodeStatus.TailscaleIPs, netip.PrefixFrom(want, want.BitLen())) {
+		t.Errorf("exit node = %+v (prefs IP %v), want %v", st.ExitNodeStatus, got, want)
+	}
+}
@@ -0,0 +1,267 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// fallbackdns.go contains name resolution for upstreams and other names that are not tailnet peers.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+
+	"tailscale.com/tsnet"
+)
+
+// Values of Transport.FallbackDNS, other than a resolver address.
+const (
+	fallbackDNSSystem = "system"
+	fallbackDNSOff    = "off"
+)
+
+// parseFallbackDNS validates a fallback_dns value, returning the resolver address to use, if any.
+// A resolver address without a port uses port 53.
+func parseFallbackDNS(v string) (resolver string, err error) {
+	switch v {
+	case "", fallbackDNSSystem, fallbackDNSOff:
+		return "", nil
+	}
+	addr, err := resolverAddr(v)
+	if err != nil {
+		return "", fmt.Errorf("fallback_dns must be %q, %q or a resolver IP address, got %q", fallbackDNSSystem, fallbackDNSOff, v)
+	}
+	return addr, nil
+}
+
+// resolverAddr returns the address of a resolver given as an IP address with an optional port, which defaults to 53.
+func resolverAddr(v string) (string, error) {
+	if ap, err := netip.ParseAddrPort(v); err == nil {
+		return ap.String(), nil
+	}
+	ip, err := netip.ParseAddr(v)
+	if err != nil {
+		return "", err
+	}
+	return netip.AddrPortFrom(ip, 53).String(), nil
+}
+
+// fallbackDialer dials through a Tailscale node, resolving names of tailnet peers with MagicDNS
+// and other names according to mode, which is a fallback_dns value.
+type fallbackDialer struct {
+	node     *tailscaleNode
+	mode     string
+	resolver *net.Resolver // resolver for names that aren't tailnet peers, if mode is a resolver address
+}
+
+// newFallbackDialer returns a dialer for node. If mode is a resolver address, addr is its parsed form.
+func newFallbackDialer(node *tailscaleNode, mode, addr string) *fallbackDialer {
+	d := &fallbackDialer{node: node, mode: mode}
+	if addr != "" {
+		d.resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var nd net.Dialer
+				return nd.DialContext(ctx, network, addr)
+			},
+		}
+	}
+	return d
+}
+
+func (d *fallbackDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if d.mode == "" || d.mode == fallbackDNSSystem {
+		// The node resolves names that aren't tailnet peers with the system resolver.
+		return d.node.dial(ctx, network, address)
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		return d.node.dial(ctx, network, address)
+	}
+	if err := d.node.start(); err != nil {
+		return nil, err
+	}
+	if ok, err := d.node.isPeerName(ctx, host); err != nil {
+		return nil, err
+	} else if ok {
+		return d.node.dial(ctx, network, address)
+	}
+
+	if d.resolver == nil {
+		return nil, fmt.Errorf("%q is not a tailnet peer, and fallback_dns is off", host)
+	}
+	ips, err := d.resolver.LookupNetIP(ctx, ipNetwork(network), host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("DNS lookup returned no results for %q", host)
+	}
+	return d.node.dial(ctx, network, net.JoinHostPort(ips[0].Unmap().String(), port))
+}
+
+// isPeerName reports whether host is the MagicDNS name of a tailnet peer, or the node itself,
+// either fully qualified or as a short name.
+func (t *tailscaleNode) isPeerName(ctx context.Context, host string) (bool, error) {
+	lc, err := t.LocalClient()
+	if err != nil {
+		return false, err
+	}
+	st, err := lc.Status(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	matches := func(dnsName string) bool {
+		dnsName = strings.ToLower(strings.TrimSuffix(dnsName, "."))
+		short, _, _ := strings.Cut(dnsName, ".")
+		return dnsName != "" && (host == dnsName || host == short)
+	}
+	if st.Self != nil && matches(st.Self.DNSName) {
+		return true, nil
+	}
+	for _, peer := range st.Peer {
+		if matches(peer.DNSName) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Nameserver is a DNS resolver that a node uses to resolve names that are not tailnet peers when it dials them,
+// such as internal names that public resolvers don't know.
+type Nameserver struct {
+	// Address is the IP address of the resolver, with an optional port. Default port: 53
+	// Queries are sent through the node, so the resolver can be a tailnet peer or behind a subnet router.
+	Address string `json:"address,omitempty"`
+
+	// Domains are the domains, such as "corp.example.com", whose names are resolved with the resolver.
+	// If empty, the resolver is used for names that are not in the domains of another nameserver.
+	Domains []string `json:"domains,omitempty"`
+}
+
+func getNameservers(name string, app *App) []Nameserver {
+	if siteNode, exists := getSiteConfig(name); exists && len(siteNode.Nameservers) > 0 {
+		return siteNode.Nameservers
+	}
+	if node, ok := app.Nodes[name]; ok {
+		return node.Nameservers
+	}
+	return nil
+}
+
+// nodeNameservers are the resolvers of a node's nameservers.
+type nodeNameservers struct {
+	domains  map[string]*net.Resolver // resolvers by domain, lowercase and without a trailing dot
+	fallback *net.Resolver            // resolver for names in no domain, if any
+}
+
+// newNodeNameservers returns the resolvers of nameservers, which send queries through s,
+// or nil if there are none.
+func newNodeNameservers(s *tsnet.Server, nameservers []Nameserver) (*nodeNameservers, error) {
+	if len(nameservers) == 0 {
+		return nil, nil
+	}
+	ns := &nodeNameservers{domains: make(map[string]*net.Resolver)}
+	for _, n := range nameservers {
+		addr, err := resolverAddr(n.Address)
+		if err != nil {
+			return nil, fmt.Errorf("nameserver must be a resolver IP address, got %q", n.Address)
+		}
+		r := &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				// Queries use TCP, since the node's connections to other addresses are wrapped,
+				// so UDP connections wouldn't be recognized as packet connections by the resolver.
+				return s.Dial(ctx, "tcp", addr)
+			},
+		}
+		if len(n.Domains) == 0 {
+			if ns.fallback != nil {
+				return nil, errors.New("only one nameserver can be used for names in no domain")
+			}
+			ns.fallback = r
+		}
+		for _, domain := range n.Domains {
+			domain = strings.ToLower(strings.Trim(domain, "."))
+			if domain == "" {
+				return nil, fmt.Errorf("nameserver %s: domain must not be empty", n.Address)
+			}
+			if _, ok := ns.domains[domain]; ok {
+				return nil, fmt.Errorf("nameserver %s: domain %s has another nameserver", n.Address, domain)
+			}
+			ns.domains[domain] = r
+		}
+	}
+	return ns, nil
+}
+
+// resolver returns the resolver for host, and whether host is in one of the nameservers' domains.
+// Names in several domains use the nameserver of the longest one, and other names use the fallback, if any.
+func (ns *nodeNameservers) resolver(host string) (r *net.Resolver, inDomain bool) {
+	name := strings.ToLower(strings.TrimSuffix(host, "."))
+	for {
+		if r, ok := ns.domains[name]; ok {
+			return r, true
+		}
+		_, parent, ok := strings.Cut(name, ".")
+		if !ok {
+			return ns.fallback, false
+		}
+		name = parent
+	}
+}
+
+// resolve returns address with its host resolved by the node's nameservers,
+// or unchanged if it has an IP address, no nameserver is used for it, or it is the MagicDNS name of a tailnet peer.
+// MagicDNS names are only checked for names in no domain, so that domains can override them.
+func (ns *nodeNameservers) resolve(ctx context.Context, t *tailscaleNode, network, address string) (string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return address, nil
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		return address, nil
+	}
+	r, inDomain := ns.resolver(host)
+	if r == nil {
+		return address, nil
+	}
+	if !inDomain {
+		if err := t.start(); err != nil {
+			return "", err
+		}
+		if ok, err := t.isPeerName(ctx, host); err != nil {
+			return "", err
+		} else if ok {
+			return address, nil
+		}
+	}
+	ips, err := r.LookupNetIP(ctx, ipNetwork(network), host)
+	if err != nil {
+		return "", err
+	}
+	if len(ips) == 0 {
+		return "", fmt.Errorf("DNS lookup returned no results for %q", host)
+	}
+	return net.JoinHostPort(ips[0].Unmap().String(), port), nil
+}
+
+// ipNetwork returns the IP network to look up addresses for when dialing network.
+func ipNetwork(network string) string {
+	switch {
+	case strings.HasSuffix(network, "4"):
+		return "ip4"
+	case strings.HasSuffix(network, "6"):
+		return "ip6"
+	default:
+		return "ip"
+	}
+}
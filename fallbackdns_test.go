@@ -0,0 +1,155 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"testing"
+
+	"github.com/msfjarvis/caddy-tailscale/tscaddytest"
+	"golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/tsnet"
+	"tailscale.com/util/must"
+)
+
+func Test_NodeNameservers(t *testing.T) {
+	ns, err := newNodeNameservers(new(tsnet.Server), []Nameserver{
+		{Address: "10.0.0.53", Domains: []string{"corp.example.com", "example.internal."}},
+		{Address: "10.1.0.53:5353", Domains: []string{"EU.corp.example.com"}},
+		{Address: "fd00::53"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	corp := ns.domains["corp.example.com"]
+	eu := ns.domains["eu.corp.example.com"]
+
+	tests := map[string]struct {
+		host         string
+		want         any
+		wantInDomain bool
+	}{
+		"domain":              {host: "wiki.corp.example.com", want: corp, wantInDomain: true},
+		"domain itself":       {host: "corp.example.com.", want: corp, wantInDomain: true},
+		"other domain":        {host: "db.example.internal", want: ns.domains["example.internal"], wantInDomain: true},
+		"longest domain":      {host: "wiki.eu.corp.example.com", want: eu, wantInDomain: true},
+		"case insensitive":    {host: "Wiki.EU.Corp.Example.com", want: eu, wantInDomain: true},
+		"not in domain":       {host: "example.com", want: ns.fallback},
+		"suffix not a domain": {host: "notcorp.example.com", want: ns.fallback},
+		"short name":          {host: "wiki", want: ns.fallback},
+	}
+	for tn, tt := range tests {
+		t.Run(tn, func(t *testing.T) {
+			r, inDomain := ns.resolver(tt.host)
+			if any(r) != tt.want {
+				t.Errorf("resolver(%q) returned the wrong resolver", tt.host)
+			}
+			if inDomain != tt.wantInDomain {
+				t.Errorf("resolver(%q) inDomain = %v, want %v", tt.host, inDomain, tt.wantInDomain)
+			}
+		})
+	}
+
+	// Addresses with IPs are dialed as they are.
+	for _, addr := range []string{"100.64.0.1:80", "[fd7a:115c:a1e0::1]:443"} {
+		if got, err := ns.resolve(context.Background(), nil, "tcp", addr); err != nil || got != addr {
+			t.Errorf("resolve(%q) = %q, %v, want it unchanged", addr, got, err)
+		}
+	}
+}
+
+func Test_NodeNameserversErrors(t *testing.T) {
+	tests := map[string][]Nameserver{
+		"invalid address":   {{Address: "dns.example.com"}},
+		"two fallbacks":     {{Address: "10.0.0.53"}, {Address: "10.0.0.54"}},
+		"duplicate domain":  {{Address: "10.0.0.53", Domains: []string{"corp"}}, {Address: "10.0.0.54", Domains: []string{"CORP."}}},
+		"empty domain":      {{Address: "10.0.0.53", Domains: []string{"."}}},
+		"no address at all": {{Domains: []string{"corp"}}},
+	}
+	for tn, nameservers := range tests {
+		t.Run(tn, func(t *testing.T) {
+			if _, err := newNodeNameservers(new(tsnet.Server), nameservers); err == nil {
+				t.Error("newNodeNameservers() succeeded, want error")
+			}
+		})
+	}
+
+	if ns, err := newNodeNameservers(new(tsnet.Server), nil); ns != nil || err != nil {
+		t.Errorf("newNodeNameservers(nil) = %v, %v, want nil", ns, err)
+	}
+}
+
+// serveDNS answers A queries over TCP on ln with ip.
+func serveDNS(ln net.Listener, ip netip.Addr) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer c.Close()
+			for {
+				var size [2]byte
+				if _, err := io.ReadFull(c, size[:]); err != nil {
+					return
+				}
+				query := make([]byte, int(size[0])<<8|int(size[1]))
+				if _, err := io.ReadFull(c, query); err != nil {
+					return
+				}
+				var m dnsmessage.Message
+				if err := m.Unpack(query); err != nil {
+					return
+				}
+				m.Header.Response = true
+				if len(m.Questions) > 0 && m.Questions[0].Type == dnsmessage.TypeA {
+					m.Answers = []dnsmessage.Resource{{
+						Header: dnsmessage.ResourceHeader{Name: m.Questions[0].Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+						Body:   &dnsmessage.AResource{A: ip.As4()},
+					}}
+				}
+				resp, err := m.Pack()
+				if err != nil {
+					return
+				}
+				c.Write(append([]byte{byte(len(resp) >> 8), byte(len(resp))}, resp...))
+			}
+		}()
+	}
+}
+
+func Test_NodeNameserversDial(t *testing.T) {
+	control := tscaddytest.NewControl(t)
+	peer := control.NewNode(t, "peer")
+	ln := must.Get(peer.Listen("tcp", ":80"))
+	go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello from the tailnet")
+	}))
+	st := must.Get(peer.Up(t.Context()))
+
+	// The corp resolver knows the peer by an internal name.
+	dnsLn := must.Get(net.Listen("tcp", "127.0.0.1:0"))
+	defer dnsLn.Close()
+	go serveDNS(dnsLn, st.TailscaleIPs[0])
+
+	runTestApp(t, newTestApp(t, control, map[string]Node{
+		"egress": {Nameservers: []Nameserver{{Address: dnsLn.Addr().String(), Domains: []string{"corp.example.com"}}}},
+	}))
+
+	node := startTestNode(t, "egress")
+	client := &http.Client{Transport: &http.Transport{DialContext: node.dial}}
+	resp, err := client.Get("http://wiki.corp.example.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := must.Get(io.ReadAll(resp.Body))
+	resp.Body.Close()
+	if got, want := string(body), "hello from the tailnet"; got != want {
+		t.Errorf("body = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,298 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// forward.go contains TCP forwarders, which forward connections on local ports to tailnet targets through a node,
+// and the inverse, which expose local addresses such as Unix sockets on a node's tailnet ports.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// forwardDialTimeout is how long a forwarder waits to connect to its target.
+const forwardDialTimeout = 30 * time.Second
+
+// Forward is a TCP forwarder that accepts connections on a local address
+// and forwards them to a tailnet target through the node.
+type Forward struct {
+	// Listen is the local address to accept connections on.
+	// If it is only a port, connections are only accepted on 127.0.0.1.
+	Listen string `json:"listen,omitempty"`
+
+	// To is the host:port of the tailnet target to forward connections to.
+	// The host can be a MagicDNS name or a Tailscale IP address.
+	To string `json:"to,omitempty"`
+
+	// Record configures session recording of the forwarded connections.
+	// If nil, connections aren't recorded.
+	Record *Recording `json:"record,omitempty"`
+}
+
+// listenAddr returns the local address the forwarder listens on.
+func (f Forward) listenAddr() string {
+	if _, err := strconv.ParseUint(f.Listen, 10, 16); err == nil {
+		return net.JoinHostPort("127.0.0.1", f.Listen)
+	}
+	return f.Listen
+}
+
+// validate checks that the forward has a valid local address and target.
+func (f Forward) validate() error {
+	if _, _, err := net.SplitHostPort(f.listenAddr()); err != nil {
+		return fmt.Errorf("invalid forward listen address %q: %w", f.Listen, err)
+	}
+	host, port, err := net.SplitHostPort(f.To)
+	if err != nil || host == "" || port == "" {
+		return fmt.Errorf("forward target must be <host>:<port>, got %q", f.To)
+	}
+	if f.Record != nil {
+		if err := f.Record.validate(); err != nil {
+			return fmt.Errorf("forward %s: %w", f.Listen, err)
+		}
+	}
+	return nil
+}
+
+// Expose accepts connections on a port of the node's tailnet address
+// and forwards them to a local address, such as a Unix socket.
+// This makes local services that only listen on Unix sockets available to peers,
+// which can connect to them like any other TCP service.
+type Expose struct {
+	// Port is the tailnet port to accept connections on.
+	Port uint16 `json:"port,omitempty"`
+
+	// To is the local address to forward connections to, in Caddy's network address format,
+	// such as "unix//run/app.sock" or "127.0.0.1:8080".
+	To string `json:"to,omitempty"`
+}
+
+// validate checks that the expose has a port and a valid local address.
+func (e Expose) validate() error {
+	if e.Port == 0 {
+		return errors.New("expose requires a tailnet port")
+	}
+	na, err := caddy.ParseNetworkAddress(e.To)
+	if err != nil {
+		return fmt.Errorf("invalid expose address %q: %w", e.To, err)
+	}
+	if !na.IsUnixNetwork() && na.PortRangeSize() != 1 {
+		return fmt.Errorf("expose address must be a Unix socket or a single <host>:<port>, got %q", e.To)
+	}
+	return nil
+}
+
+// forwarderListenerKey marks the contexts of listeners opened by forwarders,
+// which are the only listeners allowed on the tailnet ports of exposes.
+type forwarderListenerKey struct{}
+
+// checkListenPort returns an error if port is the tailnet port of one of the named node's exposes,
+// since connections would otherwise be split between the expose and the listener.
+func checkListenPort(ctx caddy.Context, name, port string) error {
+	if ctx.Value(forwarderListenerKey{}) != nil {
+		return nil
+	}
+	app, err := getApp(ctx)
+	if err != nil {
+		return err
+	}
+	for _, e := range app.Nodes[name].Exposes {
+		if strconv.Itoa(int(e.Port)) == port {
+			return fmt.Errorf("%w: tailscale node %q: port %s is already used by expose to %s", ErrPortConflict, name, port, e.To)
+		}
+	}
+	return nil
+}
+
+// forwarder accepts connections on a listener and copies them to connections made with dial.
+type forwarder struct {
+	ln      net.Listener
+	dial    func(context.Context) (net.Conn, error)
+	record  *Recording     // if non-nil, forwarded connections are recorded
+	node    *tailscaleNode // the node recordings are uploaded through
+	to      string         // the target recorded in recording headers
+	logger  *zap.Logger
+	stopped atomic.Bool
+}
+
+// startForwards starts the forwards and exposes configured on the app's nodes.
+// Each node with forwards or exposes is created when the app starts, and is held until it stops.
+// Nodes with exposes are started immediately, since they listen on the tailnet.
+func (t *App) startForwards() error {
+	for name, n := range t.Nodes {
+		if len(n.Forwards) == 0 && len(n.Exposes) == 0 {
+			continue
+		}
+		node, err := getNode(t.ctx, name)
+		if err != nil {
+			return err
+		}
+		t.forwardNodes = append(t.forwardNodes, name)
+		if getStart(name, t) == startEager {
+			if err := node.start(); err != nil {
+				return err
+			}
+		}
+
+		for _, fw := range n.Forwards {
+			if err := fw.validate(); err != nil {
+				return fmt.Errorf("node %q: %w", name, err)
+			}
+			to := fw.To
+			err := t.startForwarder(fw.listenAddr(), &forwarder{
+				dial: func(ctx context.Context) (net.Conn, error) {
+					if err := node.start(); err != nil {
+						return nil, err
+					}
+					return node.Dial(ctx, "tcp", to)
+				},
+				record: fw.Record,
+				node:   node,
+				to:     to,
+				logger: t.logger.With(zap.String("node", name), zap.String("listen", fw.Listen), zap.String("to", fw.To)),
+			})
+			if err != nil {
+				return fmt.Errorf("node %q: forward %s: %w", name, fw.Listen, err)
+			}
+		}
+
+		for _, e := range n.Exposes {
+			if err := e.validate(); err != nil {
+				return fmt.Errorf("node %q: %w", name, err)
+			}
+			na, _ := caddy.ParseNetworkAddress(e.To)
+			network, addr := na.Network, na.JoinHostPort(0)
+			err := t.startForwarder(caddy.JoinNetworkAddress("tailscale", name, strconv.Itoa(int(e.Port))), &forwarder{
+				dial: func(ctx context.Context) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, network, addr)
+				},
+				logger: t.logger.With(zap.String("node", name), zap.Uint16("port", e.Port), zap.String("to", e.To)),
+			})
+			if err != nil {
+				return fmt.Errorf("node %q: expose %d: %w", name, e.Port, err)
+			}
+		}
+	}
+	return nil
+}
+
+// startForwarder listens on the Caddy network address listen,
+// and forwards accepted connections with f.
+func (t *App) startForwarder(listen string, f *forwarder) error {
+	addr, err := caddy.ParseNetworkAddress(listen)
+	if err != nil {
+		return err
+	}
+	ctx := t.ctx
+	ctx.Context = context.WithValue(ctx.Context, forwarderListenerKey{}, true)
+	ln, err := addr.Listen(ctx, 0, net.ListenConfig{})
+	if err != nil {
+		return err
+	}
+	f.ln = ln.(net.Listener)
+	t.forwarders = append(t.forwarders, f)
+	go f.serve()
+	return nil
+}
+
+// stopForwards closes the app's forwarders and releases their nodes.
+// Connections that are already being forwarded are left open until the node is closed.
+func (t *App) stopForwards() error {
+	var errs []error
+	for _, f := range t.forwarders {
+		f.stopped.Store(true)
+		if err := f.ln.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			errs = append(errs, err)
+		}
+	}
+	t.forwarders = nil
+	for _, name := range t.forwardNodes {
+		if _, err := nodes.Delete(name); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	t.forwardNodes = nil
+	return errors.Join(errs...)
+}
+
+// serve accepts connections until the listener is closed.
+func (f *forwarder) serve() {
+	for {
+		conn, err := f.ln.Accept()
+		if err != nil {
+			if !f.stopped.Load() && !errors.Is(err, net.ErrClosed) {
+				f.logger.Error("accepting forwarded connection", zap.Error(err))
+			}
+			return
+		}
+		go f.forward(conn)
+	}
+}
+
+// forward copies data between conn and a new connection to the target until both directions are done.
+func (f *forwarder) forward(conn net.Conn) {
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), forwardDialTimeout)
+	upstream, err := f.dial(ctx)
+	cancel()
+	if err != nil {
+		f.logger.Error("dialing forward target", zap.Error(err))
+		return
+	}
+	defer upstream.Close()
+
+	in, out := io.Writer(io.Discard), io.Writer(io.Discard)
+	if f.record != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), forwardDialTimeout)
+		rec, err := f.record.open(ctx, f.node, f.to, f.logger)
+		cancel()
+		switch {
+		case err == nil:
+			defer rec.Close()
+			in = recordingWriter{rec: rec, kind: "i", failOpen: f.record.FailOpen}
+			out = recordingWriter{rec: rec, kind: "o", failOpen: f.record.FailOpen}
+		case f.record.FailOpen:
+			f.logger.Warn("forwarding connection without session recording", zap.Error(err))
+		default:
+			f.logger.Error("starting session recording", zap.Error(err))
+			return
+		}
+	}
+
+	done := make(chan struct{}, 2)
+	copyHalf := func(dst, src net.Conn, record io.Writer) {
+		if _, err := io.Copy(dst, io.TeeReader(src, record)); errors.Is(err, errRecordingFailed) {
+			// Connections that can't be recorded are closed, rather than left half-open.
+			f.logger.Error("recording forwarded connection", zap.Error(err))
+			conn.Close()
+			upstream.Close()
+		}
+		closeWrite(dst)
+		done <- struct{}{}
+	}
+	go copyHalf(upstream, conn, in)
+	go copyHalf(conn, upstream, out)
+	<-done
+	<-done
+}
+
+// closeWrite shuts down the writing side of conn, or closes it if half-closing isn't supported.
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		return
+	}
+	conn.Close()
+}
@@ -0,0 +1,354 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// funnel.go contains support for handling requests received over Tailscale Funnel.
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/dustin/go-humanize"
+	"tailscale.com/ipn"
+	"tailscale.com/util/limiter"
+)
+
+func init() {
+	caddy.RegisterModule(FunnelPolicy{})
+	httpcaddyfile.RegisterHandlerDirective("funnel_policy", parseFunnelPolicy)
+	httpcaddyfile.RegisterDirectiveOrder("funnel_policy", httpcaddyfile.Before, "redir")
+}
+
+// isFunnelRequest reports whether r was received from the public internet over Tailscale Funnel.
+func isFunnelRequest(r *http.Request) bool {
+	c, ok := r.Context().Value(caddyhttp.ConnCtxKey).(net.Conn)
+	if !ok {
+		return false
+	}
+	_, ok = findConn[*ipn.FunnelConn](c)
+	return ok
+}
+
+// funnelPorts are the ports Tailscale Funnel accepts public connections on.
+var funnelPorts = []string{"443", "8443", "10000"}
+
+// getFunnel returns whether the named node's listeners are exposed with Funnel.
+func getFunnel(name string, app *App) bool {
+	if siteNode, exists := getSiteConfig(name); exists && siteNode.Funnel {
+		return true
+	}
+	if node, ok := app.Nodes[name]; ok {
+		return node.Funnel
+	}
+	return false
+}
+
+// listenerFunnel reports whether the TCP listener on port of the named node is exposed with Funnel,
+// because it is on the tailscale+funnel network or the node has funnel set.
+// Listeners on other ports, such as Caddy's HTTP redirect listener on port 80, are only reachable from the tailnet,
+// as are all listeners in testing mode, since the test control server doesn't allow Funnel.
+func listenerFunnel(app *App, caddyNetwork, name, port string) bool {
+	if !slices.Contains(funnelPorts, port) || app.testNetwork != nil {
+		return false
+	}
+	return caddyNetwork == "tailscale+funnel" || getFunnel(name, app)
+}
+
+// listenFunnel listens on port on the tailnet and, with Funnel, on the public internet.
+// Funnel is enabled for the port in the node's serve config, which requires HTTPS and the funnel node attribute,
+// and waits for the node to connect to the tailnet.
+func (t *tailscaleNode) listenFunnel(network, port string) (net.Listener, error) {
+	ln, err := t.Server.ListenFunnel(network, ":"+port)
+	if err != nil {
+		return nil, fmt.Errorf("enabling funnel on port %s of tailscale node %q: %w", port, t.name, err)
+	}
+	return funnelListener{ln}, nil
+}
+
+// funnelListener unwraps the TLS connections accepted by tsnet's Funnel listeners before their handshake,
+// since Caddy terminates TLS itself with the certificates of its sites.
+type funnelListener struct {
+	net.Listener
+}
+
+func (l funnelListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if tc, ok := c.(*tls.Conn); ok {
+		return tc.NetConn(), nil
+	}
+	return c, nil
+}
+
+// FunnelPolicy is a Caddy HTTP handler that restricts requests received over Tailscale Funnel.
+// Public exposure usually needs tighter rules than tailnet traffic,
+// so requests from the tailnet or other listeners are not restricted.
+type FunnelPolicy struct {
+	// Methods is the list of HTTP methods allowed for Funnel requests.
+	// Other methods are rejected with 405 Method Not Allowed.
+	// If empty, all methods are allowed.
+	Methods []string `json:"methods,omitempty"`
+
+	// Paths is the list of path prefixes allowed for Funnel requests.
+	// Prefixes match whole path segments, so "/api" allows "/api" and "/api/v1" but not "/apiary".
+	// Other paths are rejected with 404 Not Found.
+	// If empty, all paths are allowed.
+	Paths []string `json:"paths,omitempty"`
+
+	// MaxBodySize is the maximum size in bytes of Funnel request bodies.
+	// Larger bodies are rejected with 413 Request Entity Too Large.
+	// If zero, request bodies are not limited.
+	MaxBodySize int64 `json:"max_body_size,omitempty"`
+
+	// AllowIndexing allows search engines to index the site over Funnel.
+	// By default, a robots.txt that disallows all crawling is served over Funnel,
+	// and an X-Robots-Tag: noindex header is added to Funnel responses,
+	// so that internal tools exposed by accident don't show up in search results.
+	AllowIndexing bool `json:"allow_indexing,omitempty"`
+
+	// RateLimit is the number of Funnel requests each client can make per RateLimitWindow.
+	// Clients are identified by the address reported by the Funnel ingress node,
+	// and further requests are rejected with 429 Too Many Requests.
+	// If zero, Funnel requests are not rate limited.
+	RateLimit int `json:"rate_limit,omitempty"`
+
+	// RateLimitWindow is the window over which RateLimit applies. Default: 1m
+	RateLimitWindow caddy.Duration `json:"rate_limit_window,omitempty"`
+
+	// BlockCountries is the list of ISO 3166-1 alpha-2 codes of countries whose Funnel clients
+	// are rejected with 403 Forbidden. Clients are located with CountryDB.
+	BlockCountries []string `json:"block_countries,omitempty"`
+
+	// CountryDB is the path to a CSV file mapping IP address ranges to countries,
+	// with one "start,end,country" range per line, such as the DB-IP "IP to Country Lite" database.
+	// Funnel ingress nodes only report the client address, so it is required to use BlockCountries.
+	CountryDB string `json:"country_db,omitempty"`
+
+	limiter   *limiter.Limiter[netip.Addr]
+	countries countryDB
+}
+
+// funnelRobotsTxt is the robots.txt served over Funnel unless indexing is allowed.
+const funnelRobotsTxt = "User-agent: *\nDisallow: /\n"
+
+func (FunnelPolicy) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.tailscale_funnel_policy",
+		New: func() caddy.Module { return new(FunnelPolicy) },
+	}
+}
+
+// Provision implements caddy.Provisioner.
+func (fp *FunnelPolicy) Provision(_ caddy.Context) error {
+	for i, m := range fp.Methods {
+		fp.Methods[i] = strings.ToUpper(m)
+	}
+
+	if fp.RateLimit < 0 {
+		return fmt.Errorf("invalid rate_limit %d", fp.RateLimit)
+	}
+	if fp.RateLimit > 0 {
+		window := time.Duration(fp.RateLimitWindow)
+		if window <= 0 {
+			window = time.Minute
+		}
+		fp.limiter = newFunnelLimiter(fp.RateLimit, window)
+	}
+
+	if len(fp.BlockCountries) > 0 {
+		if fp.CountryDB == "" {
+			return fmt.Errorf("block_countries requires country_db")
+		}
+		for i, c := range fp.BlockCountries {
+			fp.BlockCountries[i] = strings.ToUpper(c)
+		}
+		db, err := loadCountryDB(fp.CountryDB)
+		if err != nil {
+			return fmt.Errorf("loading country database: %w", err)
+		}
+		fp.countries = db
+	}
+	return nil
+}
+
+// ServeHTTP implements caddyhttp.MiddlewareHandler.
+func (fp FunnelPolicy) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	if !isFunnelRequest(r) {
+		return next.ServeHTTP(w, r)
+	}
+
+	if client, ok := funnelClientAddr(r); ok {
+		if len(fp.BlockCountries) > 0 {
+			if country := fp.countries.lookup(client); slices.Contains(fp.BlockCountries, country) {
+				return caddyhttp.Error(http.StatusForbidden, fmt.Errorf("funnel client %v is in blocked country %s", client, country))
+			}
+		}
+		if fp.limiter != nil && !fp.limiter.Allow(client) {
+			w.Header().Set("Retry-After", strconv.Itoa(int(fp.limiter.RefillInterval.Seconds()+1)))
+			return caddyhttp.Error(http.StatusTooManyRequests, fmt.Errorf("funnel client %v exceeded rate limit", client))
+		}
+	}
+
+	if !fp.AllowIndexing {
+		w.Header().Set("X-Robots-Tag", "noindex")
+		if r.URL.Path == "/robots.txt" && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			_, err := io.WriteString(w, funnelRobotsTxt)
+			return err
+		}
+	}
+
+	if len(fp.Methods) > 0 && !slices.Contains(fp.Methods, r.Method) {
+		w.Header().Set("Allow", strings.Join(fp.Methods, ", "))
+		return caddyhttp.Error(http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed over funnel", r.Method))
+	}
+
+	if len(fp.Paths) > 0 {
+		// Clean the path so that dot segments can't be used to escape an allowed prefix.
+		p := path.Clean("/" + r.URL.Path)
+		if !slices.ContainsFunc(fp.Paths, func(prefix string) bool { return pathHasPrefix(p, prefix) }) {
+			return caddyhttp.Error(http.StatusNotFound, fmt.Errorf("path %s not allowed over funnel", r.URL.Path))
+		}
+	}
+
+	if fp.MaxBodySize > 0 {
+		if r.ContentLength > fp.MaxBodySize {
+			return caddyhttp.Error(http.StatusRequestEntityTooLarge, fmt.Errorf("request body larger than %d bytes", fp.MaxBodySize))
+		}
+		if r.Body != nil {
+			r.Body = http.MaxBytesReader(w, r.Body, fp.MaxBodySize)
+		}
+	}
+
+	return next.ServeHTTP(w, r)
+}
+
+// UnmarshalCaddyfile sets up the policy from Caddyfile tokens. Syntax:
+//
+//	funnel_policy {
+//	  methods <methods...>
+//	  paths <prefixes...>
+//	  max_body_size <size>
+//	  allow_indexing
+//	  rate_limit <requests> [<window>]
+//	  block_countries <codes...>
+//	  country_db <path>
+//	}
+func (fp *FunnelPolicy) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume directive name
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "methods":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			fp.Methods = append(fp.Methods, d.Val())
+			for d.NextArg() {
+				fp.Methods = append(fp.Methods, d.Val())
+			}
+
+		case "paths":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			fp.Paths = append(fp.Paths, d.Val())
+			for d.NextArg() {
+				fp.Paths = append(fp.Paths, d.Val())
+			}
+
+		case "max_body_size":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			v, err := humanize.ParseBytes(d.Val())
+			if err != nil {
+				return d.WrapErr(err)
+			}
+			fp.MaxBodySize = int64(v)
+
+		case "allow_indexing":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			fp.AllowIndexing = true
+
+		case "rate_limit":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			n, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.WrapErr(err)
+			}
+			fp.RateLimit = n
+			if d.NextArg() {
+				v, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.WrapErr(err)
+				}
+				fp.RateLimitWindow = caddy.Duration(v)
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+
+		case "block_countries":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			fp.BlockCountries = append(fp.BlockCountries, d.Val())
+			for d.NextArg() {
+				fp.BlockCountries = append(fp.BlockCountries, d.Val())
+			}
+
+		case "country_db":
+			if !d.AllArgs(&fp.CountryDB) {
+				return d.ArgErr()
+			}
+
+		default:
+			return d.Errf("unrecognized subdirective: %s", d.Val())
+		}
+	}
+	return nil
+}
+
+// parseFunnelPolicy parses the funnel_policy directive.
+func parseFunnelPolicy(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	var fp FunnelPolicy
+	err := fp.UnmarshalCaddyfile(h.Dispenser)
+	return fp, err
+}
+
+// pathHasPrefix reports whether the cleaned path p is prefix or is under it.
+// A trailing slash in prefix is ignored, so "/public/" also allows "/public".
+func pathHasPrefix(p, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return p == prefix || strings.HasPrefix(p, prefix+"/")
+}
+
+var (
+	_ caddy.Provisioner           = (*FunnelPolicy)(nil)
+	_ caddyhttp.MiddlewareHandler = (*FunnelPolicy)(nil)
+	_ caddyfile.Unmarshaler       = (*FunnelPolicy)(nil)
+)
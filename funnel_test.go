@@ -0,0 +1,321 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"tailscale.com/ipn"
+)
+
+func Test_FunnelPolicy(t *testing.T) {
+	fp := FunnelPolicy{
+		Methods:     []string{"get", "post"},
+		Paths:       []string{"/public/", "/webhook"},
+		MaxBodySize: 8,
+	}
+	if err := fp.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+
+	c, _ := net.Pipe()
+	defer c.Close()
+	funnelConn := &ipn.FunnelConn{Conn: c}
+
+	tests := map[string]struct {
+		conn       net.Conn
+		method     string
+		path       string
+		body       string
+		wantStatus int // 0 if the request is allowed
+	}{
+		"allowed": {
+			conn:   funnelConn,
+			method: "GET",
+			path:   "/public/index.html",
+		},
+		"method not allowed": {
+			conn:       funnelConn,
+			method:     "DELETE",
+			path:       "/public/index.html",
+			wantStatus: http.StatusMethodNotAllowed,
+		},
+		"path not allowed": {
+			conn:       funnelConn,
+			method:     "GET",
+			path:       "/admin",
+			wantStatus: http.StatusNotFound,
+		},
+		"path under prefix": {
+			conn:   funnelConn,
+			method: "POST",
+			path:   "/webhook/github",
+		},
+		"path sharing prefix": {
+			conn:       funnelConn,
+			method:     "GET",
+			path:       "/webhooks",
+			wantStatus: http.StatusNotFound,
+		},
+		"path escaping prefix": {
+			conn:       funnelConn,
+			method:     "GET",
+			path:       "/public/../admin",
+			wantStatus: http.StatusNotFound,
+		},
+		"body too large": {
+			conn:       funnelConn,
+			method:     "POST",
+			path:       "/webhook",
+			body:       "0123456789",
+			wantStatus: http.StatusRequestEntityTooLarge,
+		},
+		"tls funnel conn": {
+			conn:       tls.Server(funnelConn, &tls.Config{}),
+			method:     "GET",
+			path:       "/admin",
+			wantStatus: http.StatusNotFound,
+		},
+		"tailnet request": {
+			conn:   c,
+			method: "DELETE",
+			path:   "/admin",
+		},
+	}
+	for tn, tt := range tests {
+		t.Run(tn, func(t *testing.T) {
+			ctx := context.WithValue(context.Background(), caddyhttp.ConnCtxKey, tt.conn)
+			r := httptest.NewRequestWithContext(ctx, tt.method, "http://example.com/", strings.NewReader(tt.body))
+			r.URL.Path = tt.path
+
+			var called bool
+			next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				called = true
+				_, err := io.ReadAll(r.Body)
+				return err
+			})
+			err := fp.ServeHTTP(httptest.NewRecorder(), r, next)
+
+			if tt.wantStatus == 0 {
+				if err != nil || !called {
+					t.Fatalf("ServeHTTP() err = %v, called = %v; want request allowed", err, called)
+				}
+				return
+			}
+			var herr caddyhttp.HandlerError
+			if !errors.As(err, &herr) || herr.StatusCode != tt.wantStatus {
+				t.Fatalf("ServeHTTP() err = %v, want status %d", err, tt.wantStatus)
+			}
+			if called {
+				t.Errorf("next handler called for rejected request")
+			}
+		})
+	}
+}
+
+func Test_FunnelPolicyIndexing(t *testing.T) {
+	c, _ := net.Pipe()
+	defer c.Close()
+	funnelConn := &ipn.FunnelConn{Conn: c}
+
+	tests := map[string]struct {
+		allowIndexing bool
+		conn          net.Conn
+		path          string
+		wantRobots    bool // whether the restrictive robots.txt is served
+		wantTag       string
+	}{
+		"robots.txt": {
+			conn:       funnelConn,
+			path:       "/robots.txt",
+			wantRobots: true,
+			wantTag:    "noindex",
+		},
+		"other path": {
+			conn:    funnelConn,
+			path:    "/index.html",
+			wantTag: "noindex",
+		},
+		"indexing allowed": {
+			allowIndexing: true,
+			conn:          funnelConn,
+			path:          "/robots.txt",
+		},
+		"tailnet request": {
+			conn: c,
+			path: "/robots.txt",
+		},
+	}
+	for tn, tt := range tests {
+		t.Run(tn, func(t *testing.T) {
+			fp := FunnelPolicy{AllowIndexing: tt.allowIndexing}
+			ctx := context.WithValue(context.Background(), caddyhttp.ConnCtxKey, tt.conn)
+			r := httptest.NewRequestWithContext(ctx, "GET", "http://example.com"+tt.path, nil)
+
+			var called bool
+			next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				called = true
+				return nil
+			})
+			w := httptest.NewRecorder()
+			if err := fp.ServeHTTP(w, r, next); err != nil {
+				t.Fatal(err)
+			}
+
+			if called == tt.wantRobots {
+				t.Errorf("next handler called = %v, want %v", called, !tt.wantRobots)
+			}
+			if tt.wantRobots && w.Body.String() != funnelRobotsTxt {
+				t.Errorf("body = %q, want %q", w.Body.String(), funnelRobotsTxt)
+			}
+			if got := w.Header().Get("X-Robots-Tag"); got != tt.wantTag {
+				t.Errorf("X-Robots-Tag = %q, want %q", got, tt.wantTag)
+			}
+		})
+	}
+}
+
+func Test_FunnelPolicyThrottle(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "countries.csv")
+	db := "1.0.0.0,1.0.0.255,AU\n203.0.113.0,203.0.113.255,XX\n2001:db8::,2001:db8::ffff,XX\n"
+	if err := os.WriteFile(dbPath, []byte(db), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	fp := FunnelPolicy{
+		RateLimit:      2,
+		BlockCountries: []string{"xx"},
+		CountryDB:      dbPath,
+	}
+	if err := fp.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+
+	c, _ := net.Pipe()
+	defer c.Close()
+	funnelConn := func(src string) net.Conn {
+		return &ipn.FunnelConn{Conn: c, Src: netip.MustParseAddrPort(src)}
+	}
+
+	// The cases run in order, since the rate limit applies across requests.
+	tests := []struct {
+		name       string
+		conn       net.Conn
+		wantStatus int // 0 if the request is allowed
+	}{
+		{name: "first request", conn: funnelConn("1.0.0.1:1234")},
+		{name: "second request", conn: funnelConn("1.0.0.1:1235")},
+		{name: "rate limited", conn: funnelConn("1.0.0.1:1236"), wantStatus: http.StatusTooManyRequests},
+		{name: "other client", conn: funnelConn("1.0.0.2:1234")},
+		{name: "blocked country", conn: funnelConn("203.0.113.7:1234"), wantStatus: http.StatusForbidden},
+		{name: "blocked country ipv6", conn: funnelConn("[2001:db8::1]:1234"), wantStatus: http.StatusForbidden},
+		{name: "unknown country", conn: funnelConn("198.51.100.1:1234")},
+		{name: "tailnet request", conn: c},
+		{name: "tailnet request not limited", conn: c},
+		{name: "tailnet request still not limited", conn: c},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.WithValue(context.Background(), caddyhttp.ConnCtxKey, tt.conn)
+			r := httptest.NewRequestWithContext(ctx, "GET", "http://example.com/", nil)
+
+			next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error { return nil })
+			err := fp.ServeHTTP(httptest.NewRecorder(), r, next)
+
+			if tt.wantStatus == 0 {
+				if err != nil {
+					t.Fatalf("ServeHTTP() err = %v, want request allowed", err)
+				}
+				return
+			}
+			var herr caddyhttp.HandlerError
+			if !errors.As(err, &herr) || herr.StatusCode != tt.wantStatus {
+				t.Fatalf("ServeHTTP() err = %v, want status %d", err, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func Test_FunnelPolicyBlockCountriesRequiresDB(t *testing.T) {
+	fp := FunnelPolicy{BlockCountries: []string{"XX"}}
+	if err := fp.Provision(caddy.Context{}); err == nil {
+		t.Error("Provision() succeeded without country_db")
+	}
+}
+
+func Test_ListenerFunnel(t *testing.T) {
+	app := &App{
+		Nodes: map[string]Node{
+			"public":  {Funnel: true},
+			"private": {},
+		},
+	}
+	tests := map[string]struct {
+		network string
+		node    string
+		port    string
+		testing bool
+		want    bool
+	}{
+		"funnel network":              {network: "tailscale+funnel", node: "private", port: "443", want: true},
+		"funnel network on 8443":      {network: "tailscale+funnel", node: "private", port: "8443", want: true},
+		"funnel network on http port": {network: "tailscale+funnel", node: "private", port: "80"},
+		"funnel node":                 {network: "tailscale", node: "public", port: "10000", want: true},
+		"funnel node on other port":   {network: "tailscale", node: "public", port: "8080"},
+		"tailnet only":                {network: "tailscale", node: "private", port: "443"},
+		"unconfigured node":           {network: "tailscale", node: "other", port: "443"},
+		"testing mode":                {network: "tailscale+funnel", node: "public", port: "443", testing: true},
+	}
+	for tn, tt := range tests {
+		t.Run(tn, func(t *testing.T) {
+			app.testNetwork = nil
+			if tt.testing {
+				app.testNetwork = new(testNetwork)
+			}
+			if got := listenerFunnel(app, tt.network, tt.node, tt.port); got != tt.want {
+				t.Errorf("listenerFunnel(%q, %q, %q) = %v, want %v", tt.network, tt.node, tt.port, got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_FunnelListenerUnwrapsTLS(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := funnelListener{tls.NewListener(inner, &tls.Config{})}
+	defer ln.Close()
+
+	go func() {
+		if c, err := net.Dial("tcp", inner.Addr().String()); err == nil {
+			io.WriteString(c, "plain")
+			c.Close()
+		}
+	}()
+	c, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, ok := c.(*tls.Conn); ok {
+		t.Fatal("Accept() returned a TLS connection")
+	}
+	// The connection is unwrapped before the TLS handshake, so the client's bytes are read as sent.
+	if b, _ := io.ReadAll(c); string(b) != "plain" {
+		t.Errorf("read %q, want %q", b, "plain")
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// funnelthrottle.go contains abuse throttling for requests received over Tailscale Funnel:
+// per-client rate limiting and country blocking, based on the client address propagated by the Funnel ingress.
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"tailscale.com/ipn"
+	"tailscale.com/util/limiter"
+)
+
+// funnelRateLimitKeys is the number of Funnel clients whose request rates are tracked precisely.
+const funnelRateLimitKeys = 10000
+
+// funnelClientAddr returns the address of the public client that sent r over Funnel.
+// It is the address reported by the Funnel ingress node, not the ingress node's own address.
+func funnelClientAddr(r *http.Request) (netip.Addr, bool) {
+	c, ok := r.Context().Value(caddyhttp.ConnCtxKey).(net.Conn)
+	if !ok {
+		return netip.Addr{}, false
+	}
+	fc, ok := findConn[*ipn.FunnelConn](c)
+	if !ok || !fc.Src.IsValid() {
+		return netip.Addr{}, false
+	}
+	return fc.Src.Addr().Unmap(), true
+}
+
+// newFunnelLimiter returns a limiter allowing each client n requests per window.
+func newFunnelLimiter(n int, window time.Duration) *limiter.Limiter[netip.Addr] {
+	return &limiter.Limiter[netip.Addr]{
+		Size:           funnelRateLimitKeys,
+		Max:            int64(n),
+		RefillInterval: max(window/time.Duration(n), time.Millisecond),
+	}
+}
+
+// countryRange is a range of IP addresses located in a country.
+type countryRange struct {
+	start, end netip.Addr
+	country    string
+}
+
+// countryDB maps IP addresses to the countries they are located in.
+type countryDB []countryRange
+
+// loadCountryDB loads a country database from a CSV file with one "start,end,country" range per line,
+// such as the free DB-IP "IP to Country Lite" database.
+func loadCountryDB(path string) (countryDB, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var db countryDB
+	s := bufio.NewScanner(f)
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Split(text, ",")
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("%s:%d: want start,end,country", path, line)
+		}
+		start, err := netip.ParseAddr(strings.Trim(fields[0], `"`))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		end, err := netip.ParseAddr(strings.Trim(fields[1], `"`))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		if start.Is4() != end.Is4() || end.Less(start) {
+			return nil, fmt.Errorf("%s:%d: invalid range %v-%v", path, line, start, end)
+		}
+		db = append(db, countryRange{start: start, end: end, country: strings.ToUpper(strings.Trim(fields[2], `"`))})
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	slices.SortFunc(db, func(a, b countryRange) int { return a.start.Compare(b.start) })
+	return db, nil
+}
+
+// lookup returns the country code of addr, or "" if it is unknown.
+func (db countryDB) lookup(addr netip.Addr) string {
+	// Find the last range starting at or before addr.
+	i, found := slices.BinarySearchFunc(db, addr, func(r countryRange, a netip.Addr) int { return r.start.Compare(a) })
+	if !found {
+		i--
+	}
+	if i < 0 || db[i].end.Less(addr) || db[i].start.Is4() != addr.Is4() {
+		return ""
+	}
+	return db[i].country
+}
@@ -0,0 +1,127 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// gate.go contains packet filtering for services that a node serves itself, such as the Web UI and peer API,
+// whose connections never reach Caddy's listeners.
+
+import (
+	"context"
+	"net/netip"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/net/packet"
+	"tailscale.com/net/tstun"
+	"tailscale.com/types/netmap"
+	"tailscale.com/wgengine/filter"
+)
+
+// packetGate restricts which peers can connect to a service of a node.
+type packetGate interface {
+	// update updates the gate from the node's network map and status.
+	update(nm *netmap.NetworkMap, self *ipnstate.PeerStatus)
+
+	// allows reports whether the packet p, received from a peer, may be received by the node.
+	// tun is the node's TUN device, whose packet filter has the capabilities peers are granted.
+	allows(p *packet.Parsed, tun *tstun.Wrapper) bool
+}
+
+// gates returns the node's configured packet gates.
+func (t *tailscaleNode) gates() []packetGate {
+	var gates []packetGate
+	if t.webUI != nil {
+		gates = append(gates, t.webUI)
+	}
+	if t.peerAPI != nil {
+		gates = append(gates, t.peerAPI)
+	}
+	return gates
+}
+
+// installGates installs the node's packet gates and keeps them up to date until ctx is done.
+// It must be called when the node has just started, before it has received packets from peers.
+func (t *tailscaleNode) installGates(ctx context.Context) {
+	gates := t.gates()
+	if len(gates) == 0 {
+		return
+	}
+	tun := t.Sys().Tun.Get()
+	next := tun.PreFilterPacketInboundFromWireGuard
+	tun.PreFilterPacketInboundFromWireGuard = func(p *packet.Parsed, w *tstun.Wrapper) filter.Response {
+		for _, g := range gates {
+			if !g.allows(p, w) {
+				return filter.DropSilently
+			}
+		}
+		if next != nil {
+			return next(p, w)
+		}
+		return filter.Accept
+	}
+	go t.watchGates(ctx, gates)
+}
+
+// watchGates updates gates whenever the node's network map changes.
+func (t *tailscaleNode) watchGates(ctx context.Context, gates []packetGate) {
+	lc, err := t.LocalClient()
+	if err != nil {
+		return
+	}
+	watcher, err := lc.WatchIPNBus(ctx, ipn.NotifyInitialNetMap|ipn.NotifyNoPrivateKeys)
+	if err != nil {
+		t.reportError("watching network map for access control; the Web UI and peer API are unreachable", err)
+		return
+	}
+	defer watcher.Close()
+
+	for {
+		n, err := watcher.Next()
+		if err != nil {
+			return
+		}
+		if n.NetMap == nil {
+			continue
+		}
+		// The status is read after the netmap, since services such as the peer API
+		// are started when the netmap is received.
+		st, err := lc.StatusWithoutPeers(ctx)
+		if err != nil {
+			return
+		}
+		for _, g := range gates {
+			g.update(n.NetMap, st.Self)
+		}
+	}
+}
+
+// selfAddrs returns the Tailscale addresses of the node in nm.
+func selfAddrs(nm *netmap.NetworkMap) map[netip.Addr]bool {
+	addrs := make(map[netip.Addr]bool)
+	for _, pfx := range nm.GetAddresses().All() {
+		addrs[pfx.Addr()] = true
+	}
+	return addrs
+}
+
+// allowedPeerAddrs returns the Tailscale addresses of the peers in nm whose login names or tags are allowed.
+func allowedPeerAddrs(nm *netmap.NetworkMap, allowed []string) map[netip.Addr]bool {
+	addrs := make(map[netip.Addr]bool)
+	for _, peer := range nm.Peers {
+		info := &apitype.WhoIsResponse{Node: peer.AsStruct()}
+		if up, ok := nm.UserProfiles[peer.User()]; ok {
+			info.UserProfile = up.AsStruct()
+		}
+		if !identityAllowed(info, allowed) {
+			continue
+		}
+		for _, pfx := range peer.Addresses().All() {
+			if pfx.IsSingleIP() {
+				addrs[pfx.Addr()] = true
+			}
+		}
+	}
+	return addrs
+}
@@ -0,0 +1,388 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// gateway.go contains the Gateway handler, which proxies a path for each matching tailnet peer.
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/types/opt"
+)
+
+func init() {
+	caddy.RegisterModule(&Gateway{})
+	httpcaddyfile.RegisterHandlerDirective("tailscale_gateway", parseGateway)
+	httpcaddyfile.RegisterDirectiveOrder("tailscale_gateway", httpcaddyfile.Before, "reverse_proxy")
+}
+
+// Gateway is a Caddy HTTP handler that proxies requests for /<peer>/ to a port on each tailnet peer with
+// one of the configured tags, making a single site an internal gateway to the apps on the tailnet.
+// Peers are looked up when each request is made, so peers joining or leaving the tailnet
+// are reflected without reloading the config.
+//
+// The peer is identified by the first path segment, which is its MagicDNS short name.
+// By default, the segment is removed from the path proxied to the peer,
+// and the X-Forwarded-Prefix header is set to it, so that apps can generate links under it.
+// Requests for other paths, such as /, are passed to the next handler,
+// for example to render an index of peers.
+type Gateway struct {
+	// Node is the name of the node used to find and connect to peers.
+	// If empty, the node that accepted the request is used.
+	Node string `json:"node,omitempty"`
+
+	// Tags are the ACL tags of peers to proxy to. Peers with any of the tags are proxied to.
+	Tags []string `json:"tags,omitempty"`
+
+	// Port is the port on peers to proxy to.
+	Port uint16 `json:"port,omitempty"`
+
+	// StripPrefix specifies whether the /<peer> prefix is removed from proxied paths.
+	// Apps that can be configured with a base path may need the prefix kept instead.
+	// Default: true
+	StripPrefix opt.Bool `json:"strip_prefix,omitempty"`
+
+	// Peers overrides settings for individual peers, by MagicDNS short name.
+	Peers map[string]GatewayPeer `json:"peers,omitempty"`
+
+	ctx      caddy.Context
+	mu       sync.Mutex
+	egresses map[string]*egress
+	closed   bool // set by Cleanup, after which no egresses are created
+}
+
+// GatewayPeer is the gateway configuration for an individual peer, which overrides the gateway's settings.
+type GatewayPeer struct {
+	// Port is the port on the peer to proxy to.
+	Port uint16 `json:"port,omitempty"`
+
+	// StripPrefix specifies whether the /<peer> prefix is removed from proxied paths.
+	StripPrefix opt.Bool `json:"strip_prefix,omitempty"`
+
+	// Headers are request headers set when proxying to the peer.
+	Headers http.Header `json:"headers,omitempty"`
+}
+
+func (g *Gateway) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.tailscale_gateway",
+		New: func() caddy.Module { return new(Gateway) },
+	}
+}
+
+// Provision implements caddy.Provisioner.
+func (g *Gateway) Provision(ctx caddy.Context) error {
+	if len(g.Tags) == 0 {
+		return errors.New("at least one tag is required")
+	}
+	if g.Port == 0 {
+		return errors.New("port is required")
+	}
+
+	var err error
+	if g.Tags, err = normalizeTags(g.Tags); err != nil {
+		return err
+	}
+	g.ctx = ctx
+	g.egresses = make(map[string]*egress)
+
+	// Peer names are matched case-insensitively.
+	peers := make(map[string]GatewayPeer, len(g.Peers))
+	for name, p := range g.Peers {
+		peers[strings.ToLower(name)] = p
+	}
+	g.Peers = peers
+
+	if g.Node != "" {
+		name, err := resolveNodeName(ctx, g.Node)
+		if err != nil {
+			return err
+		}
+		// The node is created on first use, since it must not be created while the config is provisioned.
+		g.Node = name
+	}
+	return nil
+}
+
+// getEgress returns the gateway's egress for the named node, creating it if needed.
+func (g *Gateway) getEgress(name string) (*egress, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.closed {
+		return nil, errEgressClosed
+	}
+	if e, ok := g.egresses[name]; ok {
+		return e, nil
+	}
+	node, err := getNode(g.ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	e := &egress{
+		node:      node,
+		transport: &http.Transport{DialContext: node.dial},
+	}
+	g.egresses[name] = e
+	return e, nil
+}
+
+// Cleanup implements caddy.CleanerUpper.
+func (g *Gateway) Cleanup() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.closed = true
+	var errs []error
+	for name, e := range g.egresses {
+		e.transport.CloseIdleConnections()
+		if _, err := nodes.Delete(name); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	g.egresses = nil
+	return errors.Join(errs...)
+}
+
+// ServeHTTP implements caddyhttp.MiddlewareHandler.
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	peerName, rest, hasSlash := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if peerName == "" {
+		return next.ServeHTTP(w, r)
+	}
+
+	nodeName := g.Node
+	if nodeName == "" {
+		node, ok := requestNode(r)
+		if !ok {
+			return caddyhttp.Error(http.StatusInternalServerError,
+				errors.New("tailscale_gateway must set a node when used on non-Tailscale listeners"))
+		}
+		nodeName = node.name
+	}
+	e, err := g.getEgress(nodeName)
+	if err != nil {
+		return caddyhttp.Error(http.StatusBadGateway, err)
+	}
+	lc, err := e.node.LocalClient()
+	if err != nil {
+		return caddyhttp.Error(http.StatusBadGateway, err)
+	}
+	st, err := lc.Status(r.Context())
+	if err != nil {
+		return caddyhttp.Error(http.StatusBadGateway, err)
+	}
+	peer, ok := gatewayPeer(st, peerName, g.Tags)
+	if !ok {
+		return next.ServeHTTP(w, r)
+	}
+
+	if !hasSlash {
+		// Redirect to the peer's root, so that relative links resolve under its path.
+		u := *r.URL
+		u.Path += "/"
+		http.Redirect(w, r, u.String(), http.StatusPermanentRedirect)
+		return nil
+	}
+
+	port, stripPrefix, headers := g.peerSettings(peerName)
+	target := &url.URL{
+		Scheme: "http",
+		Host:   net.JoinHostPort(peer.TailscaleIPs[0].String(), strconv.Itoa(int(port))),
+	}
+	var proxyErr error
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(target)
+			if stripPrefix {
+				pr.Out.URL.Path = "/" + rest
+				pr.Out.URL.RawPath = ""
+				pr.Out.Header.Set("X-Forwarded-Prefix", "/"+peerName)
+			}
+			pr.SetXForwarded()
+			for k, v := range headers {
+				pr.Out.Header[http.CanonicalHeaderKey(k)] = v
+			}
+		},
+		Transport: e.transport,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			proxyErr = err
+		},
+	}
+	proxy.ServeHTTP(w, r)
+	if proxyErr != nil {
+		return caddyhttp.Error(http.StatusBadGateway, proxyErr)
+	}
+	return nil
+}
+
+// peerSettings returns the port, whether to strip the path prefix, and the headers to set for the named peer.
+func (g *Gateway) peerSettings(name string) (port uint16, stripPrefix bool, headers http.Header) {
+	port, stripPrefix = g.Port, true
+	if v, ok := g.StripPrefix.Get(); ok {
+		stripPrefix = v
+	}
+	p, ok := g.Peers[strings.ToLower(name)]
+	if !ok {
+		return port, stripPrefix, nil
+	}
+	if p.Port != 0 {
+		port = p.Port
+	}
+	if v, ok := p.StripPrefix.Get(); ok {
+		stripPrefix = v
+	}
+	return port, stripPrefix, p.Headers
+}
+
+// gatewayPeer returns the peer in st whose MagicDNS short name is name, if it has one of tags.
+func gatewayPeer(st *ipnstate.Status, name string, tags []string) (*ipnstate.PeerStatus, bool) {
+	name = strings.ToLower(name)
+	for _, peer := range st.Peer {
+		short, _, _ := strings.Cut(strings.ToLower(peer.DNSName), ".")
+		if short != name || len(peer.TailscaleIPs) == 0 || peer.Tags == nil {
+			continue
+		}
+		if slices.ContainsFunc(peer.Tags.AsSlice(), func(tag string) bool { return slices.Contains(tags, tag) }) {
+			return peer, true
+		}
+	}
+	return nil, false
+}
+
+// UnmarshalCaddyfile sets up the handler from Caddyfile tokens. Syntax:
+//
+//	tailscale_gateway {
+//	  node <name>
+//	  tags <tags...>
+//	  port <port>
+//	  strip_prefix true|false
+//	  peer <name> {
+//	    port <port>
+//	    strip_prefix true|false
+//	    header_up <field> <value>
+//	  }
+//	}
+func (g *Gateway) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume directive name
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "node":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			g.Node = d.Val()
+
+		case "tags":
+			g.Tags = append(g.Tags, d.RemainingArgs()...)
+			if len(g.Tags) == 0 {
+				return d.ArgErr()
+			}
+
+		case "port":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			v, err := strconv.ParseUint(d.Val(), 10, 16)
+			if err != nil {
+				return d.WrapErr(err)
+			}
+			g.Port = uint16(v)
+
+		case "strip_prefix":
+			if d.NextArg() {
+				v, err := strconv.ParseBool(d.Val())
+				if err != nil {
+					return d.WrapErr(err)
+				}
+				g.StripPrefix = opt.NewBool(v)
+			} else {
+				g.StripPrefix = opt.NewBool(true)
+			}
+
+		case "peer":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			name := d.Val()
+			var p GatewayPeer
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				switch d.Val() {
+				case "port":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					v, err := strconv.ParseUint(d.Val(), 10, 16)
+					if err != nil {
+						return d.WrapErr(err)
+					}
+					p.Port = uint16(v)
+
+				case "strip_prefix":
+					if d.NextArg() {
+						v, err := strconv.ParseBool(d.Val())
+						if err != nil {
+							return d.WrapErr(err)
+						}
+						p.StripPrefix = opt.NewBool(v)
+					} else {
+						p.StripPrefix = opt.NewBool(true)
+					}
+
+				case "header_up":
+					var field, value string
+					if !d.Args(&field, &value) {
+						return d.ArgErr()
+					}
+					if p.Headers == nil {
+						p.Headers = make(http.Header)
+					}
+					p.Headers.Add(field, value)
+
+				default:
+					return d.Errf("unrecognized peer subdirective: %s", d.Val())
+				}
+			}
+			if g.Peers == nil {
+				g.Peers = make(map[string]GatewayPeer)
+			}
+			g.Peers[name] = p
+
+		default:
+			return d.Errf("unrecognized subdirective: %s", d.Val())
+		}
+	}
+	return nil
+}
+
+// parseGateway parses the tailscale_gateway directive.
+func parseGateway(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	g := new(Gateway)
+	err := g.UnmarshalCaddyfile(h.Dispenser)
+	return g, err
+}
+
+var (
+	_ caddy.Provisioner           = (*Gateway)(nil)
+	_ caddy.CleanerUpper          = (*Gateway)(nil)
+	_ caddyhttp.MiddlewareHandler = (*Gateway)(nil)
+	_ caddyfile.Unmarshaler       = (*Gateway)(nil)
+)
@@ -0,0 +1,89 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+import (
+	"net/http"
+	"net/netip"
+	"reflect"
+	"testing"
+
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/types/key"
+	"tailscale.com/types/opt"
+	"tailscale.com/types/views"
+)
+
+func Test_GatewayPeer(t *testing.T) {
+	peer := func(dnsName string, tags ...string) *ipnstate.PeerStatus {
+		ps := &ipnstate.PeerStatus{
+			DNSName:      dnsName,
+			TailscaleIPs: []netip.Addr{netip.MustParseAddr("100.64.0.1")},
+		}
+		if len(tags) > 0 {
+			v := views.SliceOf(tags)
+			ps.Tags = &v
+		}
+		return ps
+	}
+	st := &ipnstate.Status{
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+			key.NewNode().Public(): peer("grafana.tail1234.ts.net.", "tag:web"),
+			key.NewNode().Public(): peer("db.tail1234.ts.net.", "tag:db"),
+			key.NewNode().Public(): peer("laptop.tail1234.ts.net."),
+		},
+	}
+
+	tests := map[string]bool{
+		"grafana": true,
+		"GRAFANA": true,
+		"db":      false, // not tagged tag:web
+		"laptop":  false, // untagged
+		"missing": false,
+	}
+	for name, want := range tests {
+		got, ok := gatewayPeer(st, name, []string{"tag:web"})
+		if ok != want {
+			t.Errorf("gatewayPeer(%q) = %v, want %v", name, ok, want)
+		}
+		if ok && got.DNSName != "grafana.tail1234.ts.net." {
+			t.Errorf("gatewayPeer(%q) = %q, want grafana", name, got.DNSName)
+		}
+	}
+}
+
+func Test_GatewayPeerSettings(t *testing.T) {
+	g := &Gateway{
+		Port: 8080,
+		Peers: map[string]GatewayPeer{
+			"grafana": {Port: 3000, StripPrefix: opt.NewBool(false)},
+			"wiki":    {Headers: http.Header{"X-Base-Path": {"/wiki"}}},
+		},
+	}
+
+	tests := []struct {
+		name        string
+		port        uint16
+		stripPrefix bool
+		headers     http.Header
+	}{
+		{name: "other", port: 8080, stripPrefix: true},
+		{name: "grafana", port: 3000, stripPrefix: false},
+		{name: "Wiki", port: 8080, stripPrefix: true, headers: http.Header{"X-Base-Path": {"/wiki"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			port, stripPrefix, headers := g.peerSettings(tt.name)
+			if port != tt.port {
+				t.Errorf("port = %d, want %d", port, tt.port)
+			}
+			if stripPrefix != tt.stripPrefix {
+				t.Errorf("stripPrefix = %v, want %v", stripPrefix, tt.stripPrefix)
+			}
+			if !reflect.DeepEqual(headers, tt.headers) {
+				t.Errorf("headers = %v, want %v", headers, tt.headers)
+			}
+		})
+	}
+}
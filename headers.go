@@ -0,0 +1,117 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// headers.go contains per-node response header profiles, so that security headers such as HSTS and CSP
+// can differ between public Funnel traffic and tailnet traffic without repeating them in every route.
+
+import (
+	"net/http"
+	"slices"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func init() {
+	caddy.RegisterModule(IngressHeaders{})
+	httpcaddyfile.RegisterHandlerDirective("tailscale_headers", parseIngressHeaders)
+	httpcaddyfile.RegisterDirectiveOrder("tailscale_headers", httpcaddyfile.Before, "header")
+}
+
+// IngressHeaders is a Caddy HTTP handler that sets the funnel_headers or tailnet_headers
+// of the Tailscale node that received the request on its response,
+// depending on whether the request was received over Funnel.
+// Headers are set before later handlers run, so the header directive can override them.
+//
+// Requests received on other listeners are passed through unchanged.
+type IngressHeaders struct {
+	app *App
+}
+
+func (IngressHeaders) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.tailscale_headers",
+		New: func() caddy.Module { return new(IngressHeaders) },
+	}
+}
+
+// Provision implements caddy.Provisioner.
+func (ih *IngressHeaders) Provision(ctx caddy.Context) error {
+	app, err := getApp(ctx)
+	if err != nil {
+		return err
+	}
+	ih.app = app
+	return nil
+}
+
+// ServeHTTP implements caddyhttp.MiddlewareHandler.
+func (ih IngressHeaders) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	node, ok := requestNode(r)
+	if !ok {
+		return next.ServeHTTP(w, r)
+	}
+
+	headers := getTailnetHeaders(r, node.name, ih.app)
+	if isFunnelRequest(r) {
+		headers = getFunnelHeaders(r, node.name, ih.app)
+	}
+	for field, values := range headers {
+		w.Header()[http.CanonicalHeaderKey(field)] = slices.Clone(values)
+	}
+
+	return next.ServeHTTP(w, r)
+}
+
+// UnmarshalCaddyfile sets up the handler from Caddyfile tokens. Syntax:
+//
+//	tailscale_headers
+func (ih *IngressHeaders) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume directive name
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	if d.NextBlock(0) {
+		return d.Errf("unrecognized subdirective: %s", d.Val())
+	}
+	return nil
+}
+
+// parseIngressHeaders parses the tailscale_headers directive.
+func parseIngressHeaders(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	ih := new(IngressHeaders)
+	err := ih.UnmarshalCaddyfile(h.Dispenser)
+	return ih, err
+}
+
+// getFunnelHeaders returns the response headers for requests received over Funnel on the named node.
+func getFunnelHeaders(r *http.Request, name string, app *App) http.Header {
+	if siteNode, exists := getScopedConfig(r, name); exists && len(siteNode.FunnelHeaders) > 0 {
+		return siteNode.FunnelHeaders
+	}
+	if node, ok := app.Nodes[name]; ok && len(node.FunnelHeaders) > 0 {
+		return node.FunnelHeaders
+	}
+	return app.FunnelHeaders
+}
+
+// getTailnetHeaders returns the response headers for other requests received on the named node.
+func getTailnetHeaders(r *http.Request, name string, app *App) http.Header {
+	if siteNode, exists := getScopedConfig(r, name); exists && len(siteNode.TailnetHeaders) > 0 {
+		return siteNode.TailnetHeaders
+	}
+	if node, ok := app.Nodes[name]; ok && len(node.TailnetHeaders) > 0 {
+		return node.TailnetHeaders
+	}
+	return app.TailnetHeaders
+}
+
+var (
+	_ caddyhttp.MiddlewareHandler = (*IngressHeaders)(nil)
+	_ caddyfile.Unmarshaler       = (*IngressHeaders)(nil)
+	_ caddy.Provisioner           = (*IngressHeaders)(nil)
+)
@@ -0,0 +1,74 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/google/go-cmp/cmp"
+	"tailscale.com/ipn"
+)
+
+func Test_IngressHeaders(t *testing.T) {
+	ih := IngressHeaders{app: &App{
+		TailnetHeaders: http.Header{"X-Frame-Options": {"DENY"}},
+		Nodes: map[string]Node{
+			"app": {
+				FunnelHeaders: http.Header{
+					"Strict-Transport-Security": {"max-age=31536000"},
+					"Content-Security-Policy":   {"default-src 'self'"},
+				},
+			},
+		},
+	}}
+
+	c, _ := net.Pipe()
+	defer c.Close()
+
+	tests := map[string]struct {
+		conn net.Conn // connection the request is received on, if any
+		want http.Header
+	}{
+		"funnel": {
+			conn: &nodeConn{Conn: &ipn.FunnelConn{Conn: c}, node: &tailscaleNode{name: "app"}},
+			want: http.Header{
+				"Strict-Transport-Security": {"max-age=31536000"},
+				"Content-Security-Policy":   {"default-src 'self'"},
+			},
+		},
+		"tailnet": {
+			conn: &nodeConn{Conn: c, node: &tailscaleNode{name: "app"}},
+			want: http.Header{"X-Frame-Options": {"DENY"}},
+		},
+		"funnel without profile": {
+			conn: &nodeConn{Conn: &ipn.FunnelConn{Conn: c}, node: &tailscaleNode{name: "other"}},
+			want: http.Header{},
+		},
+		"other listener": {
+			want: http.Header{},
+		},
+	}
+	for tn, tt := range tests {
+		t.Run(tn, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			if tt.conn != nil {
+				r = r.WithContext(context.WithValue(r.Context(), caddyhttp.ConnCtxKey, tt.conn))
+			}
+
+			next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error { return nil })
+			w := httptest.NewRecorder()
+			if err := ih.ServeHTTP(w, r, next); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.want, w.Header()); diff != "" {
+				t.Errorf("response headers mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
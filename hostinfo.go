@@ -0,0 +1,121 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// hostinfo.go contains configuration of the host information that nodes report to the control server.
+
+import (
+	"cmp"
+	"fmt"
+	"runtime/debug"
+	"slices"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"tailscale.com/feature/buildfeatures"
+	"tailscale.com/hostinfo"
+	"tailscale.com/tailcfg"
+)
+
+// defaultHostinfoApp is the app identifier reported by nodes if none is configured.
+const defaultHostinfoApp = "caddy"
+
+// modulePath is the module path of this plugin, used to find its version in Caddy's build information.
+const modulePath = "github.com/msfjarvis/caddy-tailscale"
+
+// resolveHostinfo resolves placeholders in the host information options,
+// so that invalid options fail to load the config before any host information is applied.
+func (t *App) resolveHostinfo() error {
+	var err error
+	if t.HostinfoApp != "" {
+		if t.hostinfoApp, err = repl.ReplaceOrErr(t.HostinfoApp, true, true); err != nil {
+			return err
+		}
+	}
+	if t.DeviceModel != "" {
+		if t.deviceModel, err = repl.ReplaceOrErr(t.DeviceModel, true, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyHostinfo configures the host information reported by nodes from app options, or their defaults if unset.
+// Host information is process-wide, and only applies to nodes started afterwards.
+// It must be called with knobs locked.
+func (t *App) applyHostinfo() {
+	hostinfo.SetApp(cmp.Or(t.hostinfoApp, defaultHostinfoApp))
+	hostinfo.SetDeviceModel(cmp.Or(t.deviceModel, defaultDeviceModel()))
+}
+
+// getAdvertiseServices returns the Tailscale services the named node advertises as a host for, with the svc: prefix.
+func getAdvertiseServices(name string, app *App) ([]string, error) {
+	var services []string
+
+	// Check site-specific configuration first
+	if siteNode, exists := getSiteConfig(name); exists && len(siteNode.AdvertiseServices) > 0 {
+		services = siteNode.AdvertiseServices
+	} else if node, ok := app.Nodes[name]; ok {
+		services = node.AdvertiseServices
+	}
+
+	var names []string
+	for _, s := range services {
+		if !strings.HasPrefix(s, "svc:") {
+			s = "svc:" + s
+		}
+		if err := tailcfg.ServiceName(s).Validate(); err != nil {
+			return nil, fmt.Errorf("invalid advertised service: %v", err)
+		}
+		names = append(names, s)
+	}
+	slices.Sort(names)
+	return slices.Compact(names), nil
+}
+
+// defaultDeviceModel returns the device model reported by nodes if none is configured,
+// such as "Caddy v2.10.2, caddy-tailscale v0.4.0 (oidc, webui)",
+// so that tailnet admins can audit which plugin versions and features Caddy instances run.
+func defaultDeviceModel() string {
+	caddyVersion, _ := caddy.Version()
+	return fmt.Sprintf("Caddy %s, caddy-tailscale %s (%s)", caddyVersion, pluginVersion(), strings.Join(pluginFeatures(), ", "))
+}
+
+// pluginVersion returns the version of this plugin that Caddy was built with,
+// or "unknown" if the build information is unavailable.
+func pluginVersion() string {
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	if bi.Main.Path == modulePath {
+		return bi.Main.Version
+	}
+	for _, dep := range bi.Deps {
+		if dep.Path != modulePath {
+			continue
+		}
+		if dep.Replace != nil && dep.Replace.Version != "" {
+			return dep.Replace.Version
+		}
+		return dep.Version
+	}
+	return "unknown"
+}
+
+// pluginFeatures returns the sorted names of the optional features of this plugin
+// that weren't omitted from the build with ts_omit_* build tags, and testing mode if the ts_testing tag is set.
+func pluginFeatures() []string {
+	features := []string{}
+	if _, err := caddy.GetModule("http.handlers.tailscale_oidc"); err == nil {
+		features = append(features, "oidc")
+	}
+	if startTestNetwork != nil {
+		features = append(features, "testing")
+	}
+	if buildfeatures.HasWebClient {
+		features = append(features, "webui")
+	}
+	return features
+}
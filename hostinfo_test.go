@@ -0,0 +1,98 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"tailscale.com/hostinfo"
+)
+
+func Test_DefaultDeviceModel(t *testing.T) {
+	caddyVersion, _ := caddy.Version()
+	model := defaultDeviceModel()
+	if want := "Caddy " + caddyVersion + ", caddy-tailscale "; !strings.HasPrefix(model, want) {
+		t.Errorf("defaultDeviceModel() = %q, want prefix %q", model, want)
+	}
+
+	// Tests are built without ts_omit_* tags, so optional features are included,
+	// and testing mode is included if tests are built with the ts_testing tag.
+	want := []string{"oidc", "webui"}
+	if startTestNetwork != nil {
+		want = []string{"oidc", "testing", "webui"}
+	}
+	if got := pluginFeatures(); !slices.Equal(got, want) {
+		t.Errorf("pluginFeatures() = %q, want %q", got, want)
+	}
+	if suffix := " (" + strings.Join(want, ", ") + ")"; !strings.HasSuffix(model, suffix) {
+		t.Errorf("defaultDeviceModel() = %q, want suffix %q", model, suffix)
+	}
+}
+
+func Test_ApplyHostinfo(t *testing.T) {
+	check := func(when, app, model string) {
+		t.Helper()
+		hi := hostinfo.New()
+		if hi.App != app || hi.DeviceModel != model {
+			t.Errorf("%s: hostinfo = (%q, %q), want (%q, %q)", when, hi.App, hi.DeviceModel, app, model)
+		}
+	}
+
+	app := &App{HostinfoApp: "web", DeviceModel: "{env.TEST_DEVICE_MODEL}"}
+	t.Setenv("TEST_DEVICE_MODEL", "edge-1")
+	if err := app.resolveHostinfo(); err != nil {
+		t.Fatal(err)
+	}
+	check("provisioned", defaultHostinfoApp, defaultDeviceModel())
+
+	app.applyKnobs()
+	check("started", "web", "edge-1")
+
+	// Removing the options restores the defaults.
+	replacement := &App{}
+	replacement.applyKnobs()
+	app.resetKnobs()
+	check("options removed", defaultHostinfoApp, defaultDeviceModel())
+
+	if err := (&App{DeviceModel: "{env.TEST_UNSET_DEVICE_MODEL}"}).resolveHostinfo(); err == nil {
+		t.Error("resolveHostinfo() with unknown placeholder succeeded, want error")
+	}
+}
+
+func Test_GetAdvertiseServices(t *testing.T) {
+	tests := map[string]struct {
+		node    Node
+		want    []string
+		wantErr bool
+	}{
+		"no services": {},
+		"services": {
+			node: Node{AdvertiseServices: []string{"svc:web", "api", "web"}},
+			want: []string{"svc:api", "svc:web"},
+		},
+		"invalid": {
+			node:    Node{AdvertiseServices: []string{"svc:web_site"}},
+			wantErr: true,
+		},
+		"empty": {
+			node:    Node{AdvertiseServices: []string{"svc:"}},
+			wantErr: true,
+		},
+	}
+	for tn, tt := range tests {
+		t.Run(tn, func(t *testing.T) {
+			app := &App{Nodes: map[string]Node{"node": tt.node}}
+			got, err := getAdvertiseServices("node", app)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("getAdvertiseServices() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("getAdvertiseServices() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
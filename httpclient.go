@@ -0,0 +1,177 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// httpclient.go contains the HTTPClient module, which other modules can load to make HTTP requests over the tailnet.
+
+import (
+	"cmp"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func init() {
+	caddy.RegisterModule(&HTTPClient{})
+}
+
+// HTTPClient makes HTTP requests through a Tailscale node, so that other modules can reach tailnet services
+// without setting up their own dialer. Modules load it by its ID, "tailscale.http_client", and use it as an
+// [http.RoundTripper], or use the [http.Client] returned by its Client method.
+// HTTPS requests to tailnet peers are verified against their ts.net certificates like any other server.
+type HTTPClient struct {
+	// Node is the name of the node used to make requests, or a label selector such as "region=eu".
+	// Default: caddy-proxy, the default node of the reverse proxy transport.
+	Node string `json:"node,omitempty"`
+
+	// FallbackDNS controls how names that are not tailnet peers are resolved, like the transport's fallback_dns.
+	// Default: system
+	FallbackDNS string `json:"fallback_dns,omitempty"`
+
+	// Timeout limits the time taken by requests made with the client returned by Client, including reading the response body.
+	// Default: no timeout
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	ctx              caddy.Context
+	name             string // resolved node name
+	fallbackResolver string // address of the fallback DNS server, if any
+
+	mu        sync.Mutex
+	node      *tailscaleNode // got on first use
+	transport *http.Transport
+	cleanedUp bool
+}
+
+func (*HTTPClient) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "tailscale.http_client",
+		New: func() caddy.Module { return new(HTTPClient) },
+	}
+}
+
+// UnmarshalCaddyfile populates an HTTPClient config from a caddyfile, for modules that configure it in their block:
+//
+//	http_client [<node>] {
+//	  node <node>
+//	  fallback_dns system|off|<resolver>
+//	  timeout <duration>
+//	}
+func (c *HTTPClient) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // skip module name
+	if d.NextArg() {
+		c.Node = d.Val()
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "node":
+			if !d.AllArgs(&c.Node) {
+				return d.ArgErr()
+			}
+		case "fallback_dns":
+			if !d.AllArgs(&c.FallbackDNS) {
+				return d.ArgErr()
+			}
+			if _, err := parseFallbackDNS(c.FallbackDNS); err != nil {
+				return d.WrapErr(err)
+			}
+		case "timeout":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			v, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.WrapErr(err)
+			}
+			c.Timeout = caddy.Duration(v)
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		default:
+			return d.Errf("unrecognized subdirective: %s", d.Val())
+		}
+	}
+	return nil
+}
+
+// Provision implements caddy.Provisioner.
+func (c *HTTPClient) Provision(ctx caddy.Context) error {
+	c.ctx = ctx
+	if c.Timeout < 0 {
+		return errors.New("timeout must not be negative")
+	}
+	var err error
+	if c.fallbackResolver, err = parseFallbackDNS(c.FallbackDNS); err != nil {
+		return err
+	}
+	c.name, err = resolveNodeName(ctx, cmp.Or(c.Node, defaultTransportNodeName))
+	return err
+}
+
+// Client returns an HTTP client that makes requests through the node.
+// Clients share the module's connection pool, and can be used until the module is cleaned up.
+func (c *HTTPClient) Client() *http.Client {
+	return &http.Client{
+		Transport: c,
+		Timeout:   time.Duration(c.Timeout),
+	}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (c *HTTPClient) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport, err := c.getTransport()
+	if err != nil {
+		return nil, err
+	}
+	return transport.RoundTrip(req)
+}
+
+// getTransport returns the transport dialing through the node, getting the node on first use,
+// since it must not be created while the config is provisioned.
+func (c *HTTPClient) getTransport() (*http.Transport, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cleanedUp {
+		return nil, errors.New("tailscale HTTP client has been cleaned up")
+	}
+	if c.transport != nil {
+		return c.transport, nil
+	}
+	node, err := getNode(c.ctx, c.name)
+	if err != nil {
+		return nil, err
+	}
+	c.node = node
+	dialer := newFallbackDialer(node, c.FallbackDNS, c.fallbackResolver)
+	c.transport = &http.Transport{DialContext: dialer.DialContext}
+	return c.transport, nil
+}
+
+// Cleanup implements caddy.CleanerUpper.
+func (c *HTTPClient) Cleanup() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cleanedUp = true
+	if c.node == nil {
+		return nil
+	}
+	c.transport.CloseIdleConnections()
+	c.node, c.transport = nil, nil
+	_, err := nodes.Delete(c.name)
+	return err
+}
+
+var (
+	_ http.RoundTripper     = (*HTTPClient)(nil)
+	_ caddy.Provisioner     = (*HTTPClient)(nil)
+	_ caddy.CleanerUpper    = (*HTTPClient)(nil)
+	_ caddyfile.Unmarshaler = (*HTTPClient)(nil)
+)
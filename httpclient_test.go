@@ -0,0 +1,123 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/msfjarvis/caddy-tailscale/tscaddytest"
+	"tailscale.com/util/must"
+)
+
+func Test_HTTPClientUnmarshalCaddyfile(t *testing.T) {
+	tests := []struct {
+		name    string
+		d       *caddyfile.Dispenser
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "default node",
+			d:    caddyfile.NewTestDispenser(`http_client`),
+			want: `{}`,
+		},
+		{
+			name: "node argument",
+			d:    caddyfile.NewTestDispenser(`http_client edge-eu`),
+			want: `{"node":"edge-eu"}`,
+		},
+		{
+			name: "options",
+			d: caddyfile.NewTestDispenser(`
+				http_client {
+					node region=eu
+					fallback_dns off
+					timeout 10s
+				}`),
+			want: `{"node":"region=eu","fallback_dns":"off","timeout":10000000000}`,
+		},
+		{
+			name: "invalid fallback dns",
+			d: caddyfile.NewTestDispenser(`
+				http_client {
+					fallback_dns nope
+				}`),
+			wantErr: true,
+		},
+		{
+			name: "invalid timeout",
+			d: caddyfile.NewTestDispenser(`
+				http_client {
+					timeout soon
+				}`),
+			wantErr: true,
+		},
+		{
+			name:    "too many arguments",
+			d:       caddyfile.NewTestDispenser(`http_client a b`),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := new(HTTPClient)
+			err := c.UnmarshalCaddyfile(tt.d)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("UnmarshalCaddyfile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got := string(caddyconfig.JSON(c, nil)); got != tt.want {
+				t.Errorf("UnmarshalCaddyfile() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_HTTPClient(t *testing.T) {
+	control := tscaddytest.NewControl(t)
+	peer := control.NewNode(t, "peer")
+	ln := must.Get(peer.Listen("tcp", ":80"))
+	go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello from the tailnet")
+	}))
+
+	runTestApp(t, newTestApp(t, control, map[string]Node{
+		"egress": {},
+	}))
+
+	ctx := caddy.ActiveContext()
+	mod, err := ctx.LoadModuleByID("tailscale.http_client", json.RawMessage(`{"node":"egress","timeout":30000000000}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := mod.(*HTTPClient)
+
+	resp, err := c.Client().Get("http://peer/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := must.Get(io.ReadAll(resp.Body))
+	resp.Body.Close()
+	if got, want := string(body), "hello from the tailnet"; got != want {
+		t.Errorf("body = %q, want %q", got, want)
+	}
+
+	must.Do(c.Cleanup())
+	if _, ok := nodes.References("egress"); ok {
+		t.Error("node still referenced after cleanup")
+	}
+	client := &http.Client{Transport: c, Timeout: time.Second}
+	if _, err := client.Get("http://peer/"); err == nil {
+		t.Error("request after cleanup succeeded")
+	}
+}
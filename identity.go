@@ -0,0 +1,328 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// identity.go contains the identity resolvers used by the Auth module to identify Tailscale users.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"tailscale.com/client/tailscale"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+func init() {
+	caddy.RegisterModule(&WhoIsResolver{})
+	caddy.RegisterModule(HeaderResolver{})
+	caddy.RegisterModule(StaticResolver{})
+}
+
+// IdentityResolver resolves the Tailscale identity of the client that made a request.
+//
+// Resolvers are Caddy modules in the "tailscale.identity" namespace.
+type IdentityResolver interface {
+	ResolveIdentity(r *http.Request) (*apitype.WhoIsResponse, error)
+}
+
+// errIdentityTimeout is returned when a client's identity isn't resolved within the time allowed.
+var errIdentityTimeout = errors.New("timed out resolving tailscale identity")
+
+// resolveIdentityWithin resolves the identity of the client that made r with resolver,
+// giving up with errIdentityTimeout after timeout, if it is positive.
+// Resolvers give up when the request's context is done, such as when a node's LocalAPI is slow to answer WhoIs.
+func resolveIdentityWithin(resolver IdentityResolver, r *http.Request, timeout time.Duration) (*apitype.WhoIsResponse, error) {
+	if timeout <= 0 {
+		return resolver.ResolveIdentity(r)
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	info, err := resolver.ResolveIdentity(r.WithContext(ctx))
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) && r.Context().Err() == nil {
+		return nil, fmt.Errorf("%w after %s: %w", errIdentityTimeout, timeout, err)
+	}
+	return info, err
+}
+
+// WhoIsResolver identifies users by asking a Tailscale node who the remote address belongs to.
+// If the request was received on a tailscale listener, the node that accepted it is used for the lookup.
+// Otherwise, the local tailscaled daemon running on the system is used.
+//
+// This is the default resolver.
+type WhoIsResolver struct {
+	mu          sync.Mutex
+	localclient *tailscale.LocalClient
+}
+
+func (*WhoIsResolver) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "tailscale.identity.whois",
+		New: func() caddy.Module { return new(WhoIsResolver) },
+	}
+}
+
+// client returns the tailscale LocalClient for the resolver.
+// If the LocalClient has not already been configured, the provided request will be used to
+// lookup the tailscale node that serviced the request, and get the associated LocalClient.
+func (wr *WhoIsResolver) client(r *http.Request) (*tailscale.LocalClient, error) {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+
+	if wr.localclient != nil {
+		return wr.localclient, nil
+	}
+
+	// if request was made through a tsnet listener, set up the client for the associated tsnet
+	// server.
+	server := r.Context().Value(caddyhttp.ServerCtxKey).(*caddyhttp.Server)
+	for _, listener := range server.Listeners() {
+		if tsl, ok := findTsnetListener(listener); ok {
+			var err error
+			wr.localclient, err = tsl.Server().LocalClient()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if wr.localclient == nil {
+		// default to empty client that will talk to local tailscaled
+		wr.localclient = new(tailscale.LocalClient)
+	}
+
+	return wr.localclient, nil
+}
+
+// ResolveIdentity implements IdentityResolver.
+func (wr *WhoIsResolver) ResolveIdentity(r *http.Request) (*apitype.WhoIsResponse, error) {
+	// Sites may be bound to nodes on different tailnets,
+	// so prefer the node that accepted the connection.
+	if node, ok := requestNode(r); ok {
+		client, err := node.LocalClient()
+		if err != nil {
+			return nil, err
+		}
+		return client.WhoIs(r.Context(), r.RemoteAddr)
+	}
+
+	client, err := wr.client(r)
+	if err != nil {
+		return nil, err
+	}
+	return client.WhoIs(r.Context(), r.RemoteAddr)
+}
+
+// UnmarshalCaddyfile sets up the resolver from Caddyfile tokens. Syntax:
+//
+//	resolver whois
+func (wr *WhoIsResolver) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // skip resolver name
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	return nil
+}
+
+// Default header names set by `tailscale serve` when proxying requests from tailnet users.
+const (
+	defaultLoginHeader          = "Tailscale-User-Login"
+	defaultNameHeader           = "Tailscale-User-Name"
+	defaultProfilePictureHeader = "Tailscale-User-Profile-Pic"
+)
+
+// HeaderResolver identifies users from request headers set by another trusted proxy,
+// such as `tailscale serve` or another Caddy instance in front of this one.
+// Headers are only honored on requests from the server's configured trusted_proxies.
+type HeaderResolver struct {
+	// LoginHeader is the header containing the user's login name.
+	// Default: Tailscale-User-Login
+	LoginHeader string `json:"login_header,omitempty"`
+
+	// NameHeader is the header containing the user's display name.
+	// Default: Tailscale-User-Name
+	NameHeader string `json:"name_header,omitempty"`
+
+	// ProfilePictureHeader is the header containing the user's profile picture URL.
+	// Default: Tailscale-User-Profile-Pic
+	ProfilePictureHeader string `json:"profile_picture_header,omitempty"`
+}
+
+func (HeaderResolver) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "tailscale.identity.header",
+		New: func() caddy.Module { return new(HeaderResolver) },
+	}
+}
+
+// Provision implements caddy.Provisioner.
+func (hr *HeaderResolver) Provision(_ caddy.Context) error {
+	if hr.LoginHeader == "" {
+		hr.LoginHeader = defaultLoginHeader
+	}
+	if hr.NameHeader == "" {
+		hr.NameHeader = defaultNameHeader
+	}
+	if hr.ProfilePictureHeader == "" {
+		hr.ProfilePictureHeader = defaultProfilePictureHeader
+	}
+	return nil
+}
+
+// ResolveIdentity implements IdentityResolver.
+func (hr HeaderResolver) ResolveIdentity(r *http.Request) (*apitype.WhoIsResponse, error) {
+	if trusted, _ := caddyhttp.GetVar(r.Context(), caddyhttp.TrustedProxyVarKey).(bool); !trusted {
+		return nil, fmt.Errorf("identity headers from untrusted proxy %s", r.RemoteAddr)
+	}
+
+	login := decodeHeader(r.Header.Get(hr.LoginHeader))
+	if login == "" {
+		return nil, fmt.Errorf("missing %s header", hr.LoginHeader)
+	}
+
+	return &apitype.WhoIsResponse{
+		Node: &tailcfg.Node{},
+		UserProfile: &tailcfg.UserProfile{
+			LoginName:     login,
+			DisplayName:   decodeHeader(r.Header.Get(hr.NameHeader)),
+			ProfilePicURL: r.Header.Get(hr.ProfilePictureHeader),
+		},
+	}, nil
+}
+
+// UnmarshalCaddyfile sets up the resolver from Caddyfile tokens. Syntax:
+//
+//	resolver header {
+//	  login_header <header>
+//	  name_header <header>
+//	  profile_picture_header <header>
+//	}
+func (hr *HeaderResolver) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // skip resolver name
+	for d.NextBlock(0) {
+		var dst *string
+		switch d.Val() {
+		case "login_header":
+			dst = &hr.LoginHeader
+		case "name_header":
+			dst = &hr.NameHeader
+		case "profile_picture_header":
+			dst = &hr.ProfilePictureHeader
+		default:
+			return d.Errf("unrecognized subdirective: %s", d.Val())
+		}
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		*dst = d.Val()
+	}
+	return nil
+}
+
+// decodeHeader decodes RFC 2047 encoded-words, which `tailscale serve` uses for non-ASCII values.
+func decodeHeader(v string) string {
+	dec, err := new(mime.WordDecoder).DecodeHeader(v)
+	if err != nil {
+		return v
+	}
+	return dec
+}
+
+// StaticResolver identifies users from a fixed map of client IP addresses to identities.
+// It is primarily intended for tests and local development without a tailnet.
+type StaticResolver struct {
+	// Identities maps client IP addresses to the identity they are resolved as.
+	Identities map[string]StaticIdentity `json:"identities,omitempty"`
+}
+
+// StaticIdentity is a Tailscale identity returned by StaticResolver.
+type StaticIdentity struct {
+	// Login is the user's login name, such as "user@example.com".
+	Login string `json:"login,omitempty"`
+
+	// Name is the user's display name.
+	Name string `json:"name,omitempty"`
+
+	// ProfilePicture is the URL of the user's profile picture.
+	ProfilePicture string `json:"profile_picture,omitempty"`
+
+	// Node is the fully qualified MagicDNS name of the user's node, such as "laptop.tail1234.ts.net.".
+	Node string `json:"node,omitempty"`
+
+	// Tags is the list of tags applied to the user's node.
+	Tags []string `json:"tags,omitempty"`
+
+	// OS is the operating system of the user's node, such as "linux" or "macOS".
+	OS string `json:"os,omitempty"`
+
+	// Capabilities is the list of peer capabilities granted to the user's node.
+	Capabilities []string `json:"capabilities,omitempty"`
+}
+
+func (StaticResolver) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "tailscale.identity.static",
+		New: func() caddy.Module { return new(StaticResolver) },
+	}
+}
+
+// ResolveIdentity implements IdentityResolver.
+func (sr StaticResolver) ResolveIdentity(r *http.Request) (*apitype.WhoIsResponse, error) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	id, ok := sr.Identities[host]
+	if !ok {
+		return nil, fmt.Errorf("no identity for %s", host)
+	}
+
+	var hostinfo tailcfg.HostinfoView
+	if id.OS != "" {
+		hostinfo = (&tailcfg.Hostinfo{OS: id.OS}).View()
+	}
+	var capMap tailcfg.PeerCapMap
+	for _, c := range id.Capabilities {
+		if capMap == nil {
+			capMap = make(tailcfg.PeerCapMap)
+		}
+		capMap[tailcfg.PeerCapability(c)] = nil
+	}
+
+	computedName, _, _ := strings.Cut(id.Node, ".")
+	return &apitype.WhoIsResponse{
+		Node: &tailcfg.Node{
+			Name:         id.Node,
+			ComputedName: computedName,
+			Tags:         id.Tags,
+			Hostinfo:     hostinfo,
+		},
+		CapMap: capMap,
+		UserProfile: &tailcfg.UserProfile{
+			LoginName:     id.Login,
+			DisplayName:   id.Name,
+			ProfilePicURL: id.ProfilePicture,
+		},
+	}, nil
+}
+
+var (
+	_ IdentityResolver      = (*WhoIsResolver)(nil)
+	_ IdentityResolver      = (*HeaderResolver)(nil)
+	_ IdentityResolver      = (*StaticResolver)(nil)
+	_ caddy.Provisioner     = (*HeaderResolver)(nil)
+	_ caddyfile.Unmarshaler = (*WhoIsResolver)(nil)
+	_ caddyfile.Unmarshaler = (*HeaderResolver)(nil)
+)
@@ -0,0 +1,117 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// ingresslog.go contains support for routing access logs by how requests reached Caddy,
+// since logs of public traffic are often shipped elsewhere than logs of tailnet traffic.
+
+import (
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func init() {
+	caddy.RegisterModule(IngressLogName{})
+	httpcaddyfile.RegisterHandlerDirective("tailscale_log_name", parseIngressLogName)
+	httpcaddyfile.RegisterDirectiveOrder("tailscale_log_name", httpcaddyfile.After, "log_name")
+}
+
+// IngressLogName is a Caddy HTTP handler that selects the access loggers of a request
+// by its ingress, like the log_name directive does for all requests.
+// Loggers are usually defined with the log directive's no_hostname option,
+// so that they only receive the requests routed to them.
+//
+// Requests whose ingress has no logger names use the server's usual access loggers.
+type IngressLogName struct {
+	// Funnel is the list of access logger names for requests received over Funnel.
+	Funnel []string `json:"funnel,omitempty"`
+
+	// Tailscale is the list of access logger names for other requests received on a Tailscale node.
+	Tailscale []string `json:"tailscale,omitempty"`
+
+	// Public is the list of access logger names for requests received on other listeners.
+	Public []string `json:"public,omitempty"`
+}
+
+func (IngressLogName) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.tailscale_log_name",
+		New: func() caddy.Module { return new(IngressLogName) },
+	}
+}
+
+// ServeHTTP implements caddyhttp.MiddlewareHandler.
+func (ln IngressLogName) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	if names := ln.loggerNames(requestIngress(r)); len(names) > 0 {
+		// The server reads the variable as []any, as set by the log_name directive.
+		v := make([]any, len(names))
+		for i, name := range names {
+			v[i] = name
+		}
+		caddyhttp.SetVar(r.Context(), caddyhttp.AccessLoggerNameVarKey, v)
+	}
+	return next.ServeHTTP(w, r)
+}
+
+// loggerNames returns the access logger names for requests with the given ingress.
+func (ln IngressLogName) loggerNames(ingress string) []string {
+	switch ingress {
+	case ingressFunnel:
+		return ln.Funnel
+	case ingressTailscale:
+		return ln.Tailscale
+	default:
+		return ln.Public
+	}
+}
+
+// UnmarshalCaddyfile sets up the handler from Caddyfile tokens. Syntax:
+//
+//	tailscale_log_name {
+//	  funnel <names...>
+//	  tailscale <names...>
+//	  public <names...>
+//	}
+func (ln *IngressLogName) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume directive name
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	for d.NextBlock(0) {
+		var names *[]string
+		switch d.Val() {
+		case ingressFunnel:
+			names = &ln.Funnel
+		case ingressTailscale:
+			names = &ln.Tailscale
+		case ingressPublic:
+			names = &ln.Public
+		default:
+			return d.Errf("unrecognized subdirective: %s", d.Val())
+		}
+		args := d.RemainingArgs()
+		if len(args) == 0 {
+			return d.ArgErr()
+		}
+		*names = append(*names, args...)
+	}
+	return nil
+}
+
+// parseIngressLogName parses the tailscale_log_name directive.
+func parseIngressLogName(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	ln := new(IngressLogName)
+	err := ln.UnmarshalCaddyfile(h.Dispenser)
+	return ln, err
+}
+
+var (
+	_ caddyhttp.MiddlewareHandler = (*IngressLogName)(nil)
+	_ caddyfile.Unmarshaler       = (*IngressLogName)(nil)
+)
@@ -0,0 +1,60 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/google/go-cmp/cmp"
+	"tailscale.com/ipn"
+)
+
+func Test_IngressLogName(t *testing.T) {
+	ln := IngressLogName{
+		Funnel:    []string{"siem", ""},
+		Tailscale: []string{"internal"},
+	}
+
+	c, _ := net.Pipe()
+	defer c.Close()
+
+	tests := map[string]struct {
+		conn net.Conn
+		want any // value of the access_logger_names variable
+	}{
+		"funnel": {
+			conn: &nodeConn{Conn: &ipn.FunnelConn{Conn: c}, node: &tailscaleNode{name: "app"}},
+			want: []any{"siem", ""},
+		},
+		"tailscale": {
+			conn: &nodeConn{Conn: c, node: &tailscaleNode{name: "app"}},
+			want: []any{"internal"},
+		},
+		"public": {
+			conn: c,
+			want: nil,
+		},
+	}
+	for tn, tt := range tests {
+		t.Run(tn, func(t *testing.T) {
+			ctx := context.WithValue(context.Background(), caddyhttp.ConnCtxKey, tt.conn)
+			ctx = context.WithValue(ctx, caddyhttp.VarsCtxKey, map[string]any{})
+			r := httptest.NewRequestWithContext(ctx, "GET", "http://example.com/", nil)
+
+			next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error { return nil })
+			if err := ln.ServeHTTP(httptest.NewRecorder(), r, next); err != nil {
+				t.Fatal(err)
+			}
+			got := caddyhttp.GetVar(r.Context(), caddyhttp.AccessLoggerNameVarKey)
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("access_logger_names mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
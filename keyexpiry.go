@@ -0,0 +1,64 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// keyexpiry.go contains management of node key expiry using the Tailscale API.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"tailscale.com/client/tailscale"
+)
+
+// updateKeyExpiry waits for the node to connect to the tailnet,
+// then enables or disables key expiry for its device.
+// Errors are logged, since the node is otherwise usable.
+func (t *tailscaleNode) updateKeyExpiry() {
+	ctx := context.Background()
+	st, err := t.Up(ctx)
+	if err != nil {
+		t.reportError("waiting for node to set key expiry", err)
+		return
+	}
+	if err := setKeyExpiryDisabled(ctx, t.apiClient, string(st.Self.ID), !t.keyExpiry); err != nil {
+		t.UserLogf("setting key expiry for %s: %v", t.Hostname, err)
+	}
+}
+
+// setKeyExpiryDisabled enables or disables key expiry for a device.
+// The Tailscale API client does not support this endpoint, so the request is made directly.
+func setKeyExpiryDisabled(ctx context.Context, c *tailscale.Client, deviceID string, disabled bool) error {
+	body, err := json.Marshal(struct {
+		KeyExpiryDisabled bool `json:"keyExpiryDisabled"`
+	}{disabled})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", c.BuildURL("device", deviceID, "key"), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.UserAgent != "" {
+		req.Header.Set("User-Agent", c.UserAgent)
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(b))
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// keys.go contains support for reporting the public keys of nodes, for inventory and verification tooling.
+
+import (
+	"context"
+
+	"tailscale.com/ipn"
+	"tailscale.com/types/netmap"
+)
+
+// nodeKeys are the public keys of a node.
+type nodeKeys struct {
+	// Node is the name of the node configuration.
+	Node string `json:"node"`
+
+	// MachineKey is the public key identifying the machine the node runs on to the control server.
+	MachineKey string `json:"machine_key,omitempty"`
+
+	// NodeKey is the node's node key, which is also its WireGuard public key.
+	NodeKey string `json:"node_key,omitempty"`
+
+	// SSHHostKeys are the SSH host keys advertised by the node, if it runs Tailscale SSH.
+	SSHHostKeys []string `json:"ssh_host_keys,omitempty"`
+
+	// Error is why the node's keys couldn't be read, if they couldn't.
+	Error string `json:"error,omitempty"`
+}
+
+// newNodeKeys returns the public keys of the named node from its network map.
+// Keys are empty if the node isn't logged in.
+func newNodeKeys(name string, nm *netmap.NetworkMap) nodeKeys {
+	keys := nodeKeys{Node: name}
+	if nm == nil || !nm.SelfNode.Valid() {
+		return keys
+	}
+	self := nm.SelfNode
+	if mk := self.Machine(); !mk.IsZero() {
+		keys.MachineKey = mk.String()
+	}
+	if nk := self.Key(); !nk.IsZero() {
+		keys.NodeKey = nk.String()
+	}
+	if hi := self.Hostinfo(); hi.Valid() {
+		keys.SSHHostKeys = hi.SSH_HostKeys().AsSlice()
+	}
+	return keys
+}
+
+// tailnetNodeKeys returns the public keys of all running nodes.
+func tailnetNodeKeys(ctx context.Context) ([]nodeKeys, error) {
+	keys := []nodeKeys{}
+	for _, node := range runningNodes() {
+		nm, err := node.netMap(ctx)
+		if err != nil {
+			keys = append(keys, nodeKeys{Node: node.name, Error: err.Error()})
+			continue
+		}
+		keys = append(keys, newNodeKeys(node.name, nm))
+	}
+	return keys, nil
+}
+
+// netMap returns the node's current network map, or nil if it doesn't have one.
+func (t *tailscaleNode) netMap(ctx context.Context) (*netmap.NetworkMap, error) {
+	lc, err := t.LocalClient()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	watcher, err := lc.WatchIPNBus(ctx, ipn.NotifyInitialNetMap|ipn.NotifyNoPrivateKeys)
+	if err != nil {
+		return nil, err
+	}
+	defer watcher.Close()
+
+	// The initial notification has the current network map, if any.
+	n, err := watcher.Next()
+	if err != nil {
+		return nil, err
+	}
+	return n.NetMap, nil
+}
@@ -0,0 +1,68 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+	"tailscale.com/types/netmap"
+)
+
+func Test_NewNodeKeys(t *testing.T) {
+	machineKey := key.NewMachine().Public()
+	nodeKey := key.NewNode().Public()
+
+	tests := []struct {
+		name string
+		nm   *netmap.NetworkMap
+		want nodeKeys
+	}{
+		{
+			name: "not logged in",
+			want: nodeKeys{Node: "node"},
+		},
+		{
+			name: "logged in",
+			nm: &netmap.NetworkMap{
+				SelfNode: (&tailcfg.Node{
+					Machine:  machineKey,
+					Key:      nodeKey,
+					Hostinfo: (&tailcfg.Hostinfo{}).View(),
+				}).View(),
+			},
+			want: nodeKeys{
+				Node:       "node",
+				MachineKey: machineKey.String(),
+				NodeKey:    nodeKey.String(),
+			},
+		},
+		{
+			name: "ssh",
+			nm: &netmap.NetworkMap{
+				SelfNode: (&tailcfg.Node{
+					Machine:  machineKey,
+					Key:      nodeKey,
+					Hostinfo: (&tailcfg.Hostinfo{SSH_HostKeys: []string{"ssh-ed25519 AAAA"}}).View(),
+				}).View(),
+			},
+			want: nodeKeys{
+				Node:        "node",
+				MachineKey:  machineKey.String(),
+				NodeKey:     nodeKey.String(),
+				SSHHostKeys: []string{"ssh-ed25519 AAAA"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := newNodeKeys("node", tt.nm)
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("newNodeKeys() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
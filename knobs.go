@@ -0,0 +1,105 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// knobs.go contains process-wide settings of the Tailscale client library, which are set from app options.
+// They are applied when the app starts rather than when it is provisioned, so that a config that fails to load
+// doesn't change them, and are restored when their options are removed.
+
+import (
+	"cmp"
+	"os"
+	"sync"
+
+	"tailscale.com/envknob"
+)
+
+var knobs struct {
+	sync.Mutex
+
+	// defaults are the values of environment knobs before the app first set them,
+	// which are restored when their options are removed. Knobs that weren't set are recorded as nil.
+	defaults map[string]*string
+
+	// owner is the app that applied the knobs, which resets them when it stops.
+	owner *App
+}
+
+// applyKnobs applies the app's process-wide settings, replacing those of the previous config.
+// It returns a function that restores the previous config's settings, if the app fails to start.
+func (t *App) applyKnobs() (restore func()) {
+	knobs.Lock()
+	defer knobs.Unlock()
+	prev := knobs.owner
+	knobs.owner = t
+	t.applyNetcheckKnobs()
+	t.applyMTUKnob()
+	t.applyHostinfo()
+	t.applyLowMemoryKnobs()
+	return func() {
+		knobs.Lock()
+		defer knobs.Unlock()
+		if knobs.owner == t {
+			knobs.owner = prev
+			prev := cmp.Or(prev, &App{})
+			prev.applyNetcheckKnobs()
+			prev.applyMTUKnob()
+			prev.applyHostinfo()
+			prev.applyLowMemoryKnobs()
+		}
+	}
+}
+
+// resetKnobs restores the process-wide settings when the app stops, unless they were applied by a newer config,
+// so that removing the app stops using them.
+func (t *App) resetKnobs() {
+	knobs.Lock()
+	defer knobs.Unlock()
+	if knobs.owner != t {
+		return
+	}
+	knobs.owner = nil
+	defaults := &App{logger: t.logger}
+	defaults.applyNetcheckKnobs()
+	defaults.applyMTUKnob()
+	defaults.applyHostinfo()
+	defaults.applyLowMemoryKnobs()
+}
+
+// setKnob sets the environment knob env to val, recording its previous value the first time it is set.
+// The knob is only written when its value changes,
+// since the client library does not expect knobs to change while nodes are running.
+// It must be called with knobs locked.
+func setKnob(env, val string) {
+	if _, ok := knobs.defaults[env]; !ok {
+		if knobs.defaults == nil {
+			knobs.defaults = make(map[string]*string)
+		}
+		var prev *string
+		if v, ok := os.LookupEnv(env); ok {
+			prev = &v
+		}
+		knobs.defaults[env] = prev
+	}
+	if v, ok := os.LookupEnv(env); !ok || v != val {
+		envknob.Setenv(env, val)
+	}
+}
+
+// resetKnob restores the environment knob env to its value before the app set it, if it did.
+// It must be called with knobs locked.
+func resetKnob(env string) {
+	prev, ok := knobs.defaults[env]
+	if !ok {
+		return
+	}
+	delete(knobs.defaults, env)
+	if prev != nil {
+		envknob.Setenv(env, *prev)
+		return
+	}
+	// Registered knobs are updated to their zero value before the variable is removed.
+	envknob.Setenv(env, "")
+	os.Unsetenv(env)
+}
@@ -0,0 +1,71 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+import (
+	"os"
+	"testing"
+
+	"tailscale.com/types/opt"
+)
+
+func Test_ApplyKnobs(t *testing.T) {
+	t.Setenv(envDisablePortMapper, "false")
+	t.Setenv(envDisableUPnP, "")
+	os.Unsetenv(envDisableUPnP)
+	t.Setenv(envSTUNStopOnIdle, "")
+	os.Unsetenv(envSTUNStopOnIdle)
+
+	knob := func(env string) string {
+		if v, ok := os.LookupEnv(env); ok {
+			return v
+		}
+		return "unset"
+	}
+	check := func(when string, want map[string]string) {
+		t.Helper()
+		for env, v := range want {
+			if got := knob(env); got != v {
+				t.Errorf("%s: %s = %q, want %q", when, env, got, v)
+			}
+		}
+	}
+
+	app := &App{PortMapping: opt.NewBool(false), UPnP: opt.NewBool(false)}
+	app.applyKnobs()
+	check("options set", map[string]string{envDisablePortMapper: "true", envDisableUPnP: "true", envSTUNStopOnIdle: "unset"})
+
+	// A config that fails to start restores the previous config's settings.
+	failed := &App{STUNWhenIdle: opt.NewBool(false)}
+	restore := failed.applyKnobs()
+	check("failed config", map[string]string{envSTUNStopOnIdle: "true"})
+	restore()
+	check("failed config restored", map[string]string{envDisablePortMapper: "true", envDisableUPnP: "true", envSTUNStopOnIdle: "unset"})
+
+	// Removing the options restores the knobs' values from before they were set.
+	replacement := &App{}
+	replacement.applyKnobs()
+	app.resetKnobs()
+	check("options removed", map[string]string{envDisablePortMapper: "false", envDisableUPnP: "unset", envSTUNStopOnIdle: "unset"})
+
+	app.applyKnobs()
+	app.resetKnobs()
+	check("app stopped", map[string]string{envDisablePortMapper: "false", envDisableUPnP: "unset", envSTUNStopOnIdle: "unset"})
+}
+
+func Test_ApplyLowMemoryKnobs(t *testing.T) {
+	t.Setenv(envRingBufferMaxSize, "")
+	os.Unsetenv(envRingBufferMaxSize)
+
+	app := &App{LowMemory: true}
+	app.applyKnobs()
+	if got := os.Getenv(envRingBufferMaxSize); got != "65536" {
+		t.Errorf("low memory: %s = %q, want %q", envRingBufferMaxSize, got, "65536")
+	}
+
+	app.resetKnobs()
+	if v, ok := os.LookupEnv(envRingBufferMaxSize); ok {
+		t.Errorf("app stopped: %s = %q, want unset", envRingBufferMaxSize, v)
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// labels.go contains support for selecting nodes by their labels rather than their names.
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// isLabelSelector reports whether name is a label selector rather than a node name.
+func isLabelSelector(name string) bool {
+	return strings.Contains(name, "=")
+}
+
+// parseLabelSelector parses a label selector of the form "key=value[,key=value...]".
+func parseLabelSelector(selector string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for term := range strings.SplitSeq(selector, ",") {
+		key, value, ok := strings.Cut(term, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid label selector %q", selector)
+		}
+		labels[key] = value
+	}
+	return labels, nil
+}
+
+// resolveNodeName returns the name of the node configuration that name refers to.
+// If name is a label selector, it must match the labels of exactly one configured node.
+// Other names are returned unchanged.
+func resolveNodeName(ctx caddy.Context, name string) (string, error) {
+	if !isLabelSelector(name) {
+		return name, nil
+	}
+	app, err := getApp(ctx)
+	if err != nil {
+		return "", err
+	}
+	return selectNode(name, app)
+}
+
+// selectNode returns the name of the single node in app matching the label selector.
+func selectNode(selector string, app *App) (string, error) {
+	want, err := parseLabelSelector(selector)
+	if err != nil {
+		return "", err
+	}
+
+	var matches []string
+	for _, name := range slices.Sorted(maps.Keys(app.Nodes)) {
+		labels := app.Nodes[name].Labels
+		if site, ok := getSiteConfig(name); ok && site.Labels != nil {
+			labels = site.Labels
+		}
+		if matchLabels(labels, want) {
+			matches = append(matches, name)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("no tailscale node matches label selector %q", selector)
+	case 1:
+		return matches[0], nil
+	default:
+		return "", fmt.Errorf("label selector %q matches multiple tailscale nodes: %s", selector, strings.Join(matches, ", "))
+	}
+}
+
+// matchLabels reports whether labels contains all key/value pairs in want.
+func matchLabels(labels, want map[string]string) bool {
+	for k, v := range want {
+		if got, ok := labels[k]; !ok || got != v {
+			return false
+		}
+	}
+	return true
+}
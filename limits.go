@@ -0,0 +1,128 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// limits.go contains per-node request limits for sites served on Tailscale nodes,
+// a safety net for internal tools that are reachable from the whole tailnet.
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func init() {
+	caddy.RegisterModule(RequestLimits{})
+	httpcaddyfile.RegisterHandlerDirective("tailscale_limits", parseRequestLimits)
+	httpcaddyfile.RegisterDirectiveOrder("tailscale_limits", httpcaddyfile.Before, "request_body")
+}
+
+// RequestLimits is a Caddy HTTP handler that enforces the max_body_size and methods options
+// of the Tailscale node that received the request.
+// Requests with other methods are rejected with 405 Method Not Allowed,
+// and larger bodies with 413 Request Entity Too Large.
+//
+// Requests received on other listeners are passed through unchanged.
+type RequestLimits struct {
+	app *App
+}
+
+func (RequestLimits) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.tailscale_limits",
+		New: func() caddy.Module { return new(RequestLimits) },
+	}
+}
+
+// Provision implements caddy.Provisioner.
+func (rl *RequestLimits) Provision(ctx caddy.Context) error {
+	app, err := getApp(ctx)
+	if err != nil {
+		return err
+	}
+	rl.app = app
+	return nil
+}
+
+// ServeHTTP implements caddyhttp.MiddlewareHandler.
+func (rl RequestLimits) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	node, ok := requestNode(r)
+	if !ok {
+		return next.ServeHTTP(w, r)
+	}
+
+	methods := getMethods(r, node.name, rl.app)
+	if len(methods) > 0 && !slices.ContainsFunc(methods, func(m string) bool { return strings.EqualFold(m, r.Method) }) {
+		w.Header().Set("Allow", strings.ToUpper(strings.Join(methods, ", ")))
+		return caddyhttp.Error(http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed on node %s", r.Method, node.name))
+	}
+
+	if maxBodySize := getMaxBodySize(r, node.name, rl.app); maxBodySize > 0 {
+		if r.ContentLength > maxBodySize {
+			return caddyhttp.Error(http.StatusRequestEntityTooLarge, fmt.Errorf("request body larger than %d bytes", maxBodySize))
+		}
+		if r.Body != nil {
+			r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
+		}
+	}
+
+	return next.ServeHTTP(w, r)
+}
+
+// UnmarshalCaddyfile sets up the handler from Caddyfile tokens. Syntax:
+//
+//	tailscale_limits
+func (rl *RequestLimits) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume directive name
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	if d.NextBlock(0) {
+		return d.Errf("unrecognized subdirective: %s", d.Val())
+	}
+	return nil
+}
+
+// parseRequestLimits parses the tailscale_limits directive.
+func parseRequestLimits(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	rl := new(RequestLimits)
+	err := rl.UnmarshalCaddyfile(h.Dispenser)
+	return rl, err
+}
+
+// getMaxBodySize returns the maximum size in bytes of the bodies of requests received on the named node.
+// If zero, request bodies are not limited.
+func getMaxBodySize(r *http.Request, name string, app *App) int64 {
+	if siteNode, exists := getScopedConfig(r, name); exists && siteNode.MaxBodySize > 0 {
+		return siteNode.MaxBodySize
+	}
+	if node, ok := app.Nodes[name]; ok && node.MaxBodySize > 0 {
+		return node.MaxBodySize
+	}
+	return app.MaxBodySize
+}
+
+// getMethods returns the HTTP methods allowed for requests received on the named node.
+// If empty, all methods are allowed.
+func getMethods(r *http.Request, name string, app *App) []string {
+	if siteNode, exists := getScopedConfig(r, name); exists && len(siteNode.Methods) > 0 {
+		return siteNode.Methods
+	}
+	if node, ok := app.Nodes[name]; ok && len(node.Methods) > 0 {
+		return node.Methods
+	}
+	return app.Methods
+}
+
+var (
+	_ caddyhttp.MiddlewareHandler = (*RequestLimits)(nil)
+	_ caddyfile.Unmarshaler       = (*RequestLimits)(nil)
+	_ caddy.Provisioner           = (*RequestLimits)(nil)
+)
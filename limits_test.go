@@ -0,0 +1,88 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func Test_RequestLimits(t *testing.T) {
+	rl := RequestLimits{app: &App{
+		MaxBodySize: 4,
+		Nodes: map[string]Node{
+			"admin": {Methods: []string{"get", "HEAD"}},
+		},
+	}}
+
+	tests := []struct {
+		name       string
+		node       string // node the request is received on, if any
+		method     string
+		body       string
+		chunked    bool
+		directive  bool // whether the request is handled by a tailscale directive allowing POST on admin
+		wantStatus int
+		wantAllow  string
+	}{
+		{name: "other listener", method: http.MethodPost, body: "too large"},
+		{name: "allowed", node: "admin", method: http.MethodGet},
+		{name: "method not allowed", node: "admin", method: http.MethodPost, wantStatus: http.StatusMethodNotAllowed, wantAllow: "GET, HEAD"},
+		{name: "method allowed by directive", node: "admin", method: http.MethodPost, directive: true},
+		{name: "method not allowed by directive", node: "admin", method: http.MethodGet, directive: true, wantStatus: http.StatusMethodNotAllowed, wantAllow: "POST"},
+		{name: "small body", node: "app", method: http.MethodPost, body: "ok"},
+		{name: "large body", node: "app", method: http.MethodPost, body: "too large", wantStatus: http.StatusRequestEntityTooLarge},
+		{name: "large chunked body", node: "app", method: http.MethodPost, body: "too large", chunked: true, wantStatus: http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/", strings.NewReader(tt.body))
+			r = r.WithContext(context.WithValue(r.Context(), caddyhttp.VarsCtxKey, map[string]any{}))
+			if tt.chunked {
+				r.ContentLength = -1
+			}
+			if tt.node != "" {
+				conn := &nodeConn{node: &tailscaleNode{name: tt.node}}
+				r = r.WithContext(context.WithValue(r.Context(), caddyhttp.ConnCtxKey, conn))
+			}
+
+			next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				if _, err := io.ReadAll(r.Body); err != nil {
+					return caddyhttp.Error(http.StatusRequestEntityTooLarge, err)
+				}
+				return nil
+			})
+			w := httptest.NewRecorder()
+			var err error
+			if tt.directive {
+				directive := TailscaleDirective{NodeName: "admin", Node: Node{Methods: []string{"POST"}}}
+				err = directive.ServeHTTP(w, r, caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+					return rl.ServeHTTP(w, r, next)
+				}))
+			} else {
+				err = rl.ServeHTTP(w, r, next)
+			}
+
+			var status int
+			if he := (caddyhttp.HandlerError{}); errors.As(err, &he) {
+				status = he.StatusCode
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if status != tt.wantStatus {
+				t.Errorf("ServeHTTP() status = %d, want %d (err: %v)", status, tt.wantStatus, err)
+			}
+			if got := w.Header().Get("Allow"); got != tt.wantAllow {
+				t.Errorf("Allow = %q, want %q", got, tt.wantAllow)
+			}
+		})
+	}
+}
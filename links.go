@@ -0,0 +1,306 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// links.go contains a short link handler in the style of golink,
+// so a node such as "go" can redirect tailnet users from go/<name> to longer URLs.
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/certmagic"
+)
+
+func init() {
+	caddy.RegisterModule(&ShortLinks{})
+	httpcaddyfile.RegisterHandlerDirective("tailscale_links", parseShortLinks)
+	httpcaddyfile.RegisterDirectiveOrder("tailscale_links", httpcaddyfile.Before, "respond")
+}
+
+// linksStoragePrefix is the prefix of the storage keys of short links.
+const linksStoragePrefix = "tailscale/links"
+
+// linkNameRegexp matches valid short link names.
+var linkNameRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]*$`)
+
+// ShortLinks is a Caddy HTTP handler that redirects /<name> to the URL of a short link stored in Caddy's storage.
+// Any path after the name is appended to the URL, so that go/docs/setup redirects to the setup page under the docs link.
+//
+// Links are listed as JSON with GET /, and are created or updated with POST /<name>,
+// with the URL in the "url" form value, and deleted with DELETE /<name>.
+// Only editors can change links. Names are case-insensitive.
+//
+// Requests received over Funnel or on other listeners are rejected, since links are usually internal.
+type ShortLinks struct {
+	// Editors are the login names, such as "alice@example.com", or tags, such as "tag:ci",
+	// allowed to create, update and delete links. If empty, links can't be changed.
+	Editors []string `json:"editors,omitempty"`
+
+	// Namespace separates the links of different handlers that share Caddy's storage.
+	// Default: default
+	Namespace string `json:"namespace,omitempty"`
+
+	storage certmagic.Storage
+}
+
+// shortLink is a short link, as stored and listed.
+type shortLink struct {
+	Name    string    `json:"name"`
+	URL     string    `json:"url"`
+	Owner   string    `json:"owner"`
+	Updated time.Time `json:"updated"`
+}
+
+func (*ShortLinks) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.tailscale_links",
+		New: func() caddy.Module { return new(ShortLinks) },
+	}
+}
+
+// Provision implements caddy.Provisioner.
+func (sl *ShortLinks) Provision(ctx caddy.Context) error {
+	sl.Namespace = cmp.Or(sl.Namespace, "default")
+	if strings.Contains(sl.Namespace, "/") {
+		return fmt.Errorf("invalid namespace %q", sl.Namespace)
+	}
+	sl.storage = ctx.Storage()
+	return nil
+}
+
+// ServeHTTP implements caddyhttp.MiddlewareHandler.
+func (sl *ShortLinks) ServeHTTP(w http.ResponseWriter, r *http.Request, _ caddyhttp.Handler) error {
+	node, ok := requestNode(r)
+	if !ok || isFunnelRequest(r) {
+		return caddyhttp.Error(http.StatusForbidden, errors.New("tailscale_links only serves tailnet clients"))
+	}
+
+	name, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	name = strings.ToLower(name)
+	if name == "" {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			return caddyhttp.Error(http.StatusMethodNotAllowed, nil)
+		}
+		return sl.serveList(w, r)
+	}
+	if !linkNameRegexp.MatchString(name) {
+		return caddyhttp.Error(http.StatusNotFound, fmt.Errorf("invalid link name %q", name))
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		return sl.serveRedirect(w, r, name, rest)
+	case http.MethodPost, http.MethodDelete:
+		lc, err := node.LocalClient()
+		if err != nil {
+			return caddyhttp.Error(http.StatusInternalServerError, err)
+		}
+		info, err := lc.WhoIs(r.Context(), r.RemoteAddr)
+		if err != nil {
+			return caddyhttp.Error(http.StatusForbidden, err)
+		}
+		if !identityAllowed(info, sl.Editors) {
+			return caddyhttp.Error(http.StatusForbidden, fmt.Errorf("%s is not allowed to edit links", identityName(info)))
+		}
+		if rest != "" {
+			return caddyhttp.Error(http.StatusNotFound, errors.New("links can't have a path"))
+		}
+		if r.Method == http.MethodDelete {
+			return sl.deleteLink(w, r, name)
+		}
+		return sl.saveLink(w, r, name, identityName(info))
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST, DELETE")
+		return caddyhttp.Error(http.StatusMethodNotAllowed, nil)
+	}
+}
+
+// serveRedirect redirects to the URL of the named link, with rest appended to its path.
+func (sl *ShortLinks) serveRedirect(w http.ResponseWriter, r *http.Request, name, rest string) error {
+	link, err := sl.load(r, name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return caddyhttp.Error(http.StatusNotFound, fmt.Errorf("no link named %q", name))
+	}
+	if err != nil {
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+	target, err := linkTarget(link.URL, rest, r.URL.RawQuery)
+	if err != nil {
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+	return nil
+}
+
+// linkTarget returns the URL redirected to for a link to linkURL, with rest appended to its path and query added.
+func linkTarget(linkURL, rest, query string) (string, error) {
+	u, err := url.Parse(linkURL)
+	if err != nil {
+		return "", err
+	}
+	if rest != "" {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + rest
+		u.RawPath = ""
+	}
+	if query != "" {
+		if u.RawQuery != "" {
+			u.RawQuery += "&"
+		}
+		u.RawQuery += query
+	}
+	return u.String(), nil
+}
+
+// serveList lists all links as JSON, sorted by name.
+func (sl *ShortLinks) serveList(w http.ResponseWriter, r *http.Request) error {
+	keys, err := sl.storage.List(r.Context(), sl.prefix(), false)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+	links := []shortLink{}
+	for _, key := range keys {
+		link, err := sl.load(r, strings.TrimSuffix(path.Base(key), ".json"))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue // deleted since listing
+		}
+		if err != nil {
+			return caddyhttp.Error(http.StatusInternalServerError, err)
+		}
+		links = append(links, link)
+	}
+	slices.SortFunc(links, func(a, b shortLink) int { return cmp.Compare(a.Name, b.Name) })
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(links)
+}
+
+// saveLink creates or updates the named link, with the URL in the request's "url" form value.
+func (sl *ShortLinks) saveLink(w http.ResponseWriter, r *http.Request, name, owner string) error {
+	r.Body = http.MaxBytesReader(w, r.Body, 64<<10)
+	target := r.PostFormValue("url")
+	if err := validateLinkURL(target); err != nil {
+		return caddyhttp.Error(http.StatusBadRequest, err)
+	}
+	link := shortLink{Name: name, URL: target, Owner: owner, Updated: time.Now().UTC()}
+	data, err := json.Marshal(link)
+	if err != nil {
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+	if err := sl.storage.Store(r.Context(), sl.key(name), data); err != nil {
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(link)
+}
+
+// validateLinkURL reports whether u can be the URL of a link.
+func validateLinkURL(u string) error {
+	if u == "" {
+		return errors.New("url is required")
+	}
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return err
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return fmt.Errorf("url must be http or https, got %q", u)
+	}
+	if parsed.Host == "" {
+		return fmt.Errorf("url must have a host, got %q", u)
+	}
+	return nil
+}
+
+// deleteLink deletes the named link.
+func (sl *ShortLinks) deleteLink(w http.ResponseWriter, r *http.Request, name string) error {
+	if !sl.storage.Exists(r.Context(), sl.key(name)) {
+		return caddyhttp.Error(http.StatusNotFound, fmt.Errorf("no link named %q", name))
+	}
+	if err := sl.storage.Delete(r.Context(), sl.key(name)); err != nil {
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// load loads the named link from storage.
+func (sl *ShortLinks) load(r *http.Request, name string) (shortLink, error) {
+	data, err := sl.storage.Load(r.Context(), sl.key(name))
+	if err != nil {
+		return shortLink{}, err
+	}
+	var link shortLink
+	if err := json.Unmarshal(data, &link); err != nil {
+		return shortLink{}, fmt.Errorf("link %q: %w", name, err)
+	}
+	return link, nil
+}
+
+// prefix returns the storage prefix of the handler's links.
+func (sl *ShortLinks) prefix() string {
+	return path.Join(linksStoragePrefix, sl.Namespace)
+}
+
+// key returns the storage key of the named link.
+func (sl *ShortLinks) key(name string) string {
+	return path.Join(sl.prefix(), name+".json")
+}
+
+// UnmarshalCaddyfile sets up the handler from Caddyfile tokens. Syntax:
+//
+//	tailscale_links [<namespace>] {
+//	  editors <login|tag>...
+//	}
+func (sl *ShortLinks) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume directive name
+	if d.NextArg() {
+		sl.Namespace = d.Val()
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "editors":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			sl.Editors = append(sl.Editors, args...)
+
+		default:
+			return d.Errf("unrecognized subdirective: %s", d.Val())
+		}
+	}
+	return nil
+}
+
+// parseShortLinks parses the tailscale_links directive.
+func parseShortLinks(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	sl := new(ShortLinks)
+	err := sl.UnmarshalCaddyfile(h.Dispenser)
+	return sl, err
+}
+
+var (
+	_ caddyhttp.MiddlewareHandler = (*ShortLinks)(nil)
+	_ caddy.Provisioner           = (*ShortLinks)(nil)
+	_ caddyfile.Unmarshaler       = (*ShortLinks)(nil)
+)
@@ -0,0 +1,158 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/certmagic"
+)
+
+func Test_ShortLinks(t *testing.T) {
+	sl := &ShortLinks{Namespace: "default", storage: &certmagic.FileStorage{Path: t.TempDir()}}
+
+	form := url.Values{"url": {"https://docs.example.com/wiki/"}}
+	r := httptest.NewRequest("POST", "/docs", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if err := sl.saveLink(httptest.NewRecorder(), r, "docs", "alice@example.com"); err != nil {
+		t.Fatalf("saveLink() error = %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	if err := sl.serveRedirect(w, httptest.NewRequest("GET", "/docs/setup?lang=en", nil), "docs", "setup"); err != nil {
+		t.Fatalf("serveRedirect() error = %v", err)
+	}
+	if got, want := w.Header().Get("Location"), "https://docs.example.com/wiki/setup?lang=en"; got != want {
+		t.Errorf("Location = %q, want %q", got, want)
+	}
+
+	w = httptest.NewRecorder()
+	if err := sl.serveList(w, httptest.NewRequest("GET", "/", nil)); err != nil {
+		t.Fatalf("serveList() error = %v", err)
+	}
+	var links []shortLink
+	if err := json.NewDecoder(w.Body).Decode(&links); err != nil {
+		t.Fatal(err)
+	}
+	if len(links) != 1 || links[0].Name != "docs" || links[0].Owner != "alice@example.com" {
+		t.Errorf("serveList() = %+v, want the docs link", links)
+	}
+
+	if err := sl.deleteLink(httptest.NewRecorder(), httptest.NewRequest("DELETE", "/docs", nil), "docs"); err != nil {
+		t.Fatalf("deleteLink() error = %v", err)
+	}
+	err := sl.serveRedirect(httptest.NewRecorder(), httptest.NewRequest("GET", "/docs", nil), "docs", "")
+	var herr caddyhttp.HandlerError
+	if !errors.As(err, &herr) || herr.StatusCode != http.StatusNotFound {
+		t.Errorf("serveRedirect() after delete error = %v, want not found", err)
+	}
+}
+
+func Test_LinkTarget(t *testing.T) {
+	tests := []struct {
+		name  string
+		url   string
+		rest  string
+		query string
+		want  string
+	}{
+		{name: "link only", url: "https://example.com/a", want: "https://example.com/a"},
+		{name: "rest", url: "https://example.com/a/", rest: "b/c", want: "https://example.com/a/b/c"},
+		{name: "query", url: "https://example.com/search?q=1", query: "page=2", want: "https://example.com/search?q=1&page=2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := linkTarget(tt.url, tt.rest, tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("linkTarget() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_ValidateLinkURL(t *testing.T) {
+	tests := []struct {
+		url     string
+		wantErr bool
+	}{
+		{url: "https://example.com/"},
+		{url: "http://grafana:3000/d/abc"},
+		{url: "", wantErr: true},
+		{url: "javascript:alert(1)", wantErr: true},
+		{url: "https:///path", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			if err := validateLinkURL(tt.url); (err != nil) != tt.wantErr {
+				t.Errorf("validateLinkURL(%q) error = %v, wantErr %v", tt.url, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_ShortLinksUnmarshalCaddyfile(t *testing.T) {
+	tests := []struct {
+		name          string
+		d             *caddyfile.Dispenser
+		wantNamespace string
+		wantEditors   []string
+		wantErr       bool
+	}{
+		{
+			name: "editors",
+			d: caddyfile.NewTestDispenser(`
+				tailscale_links {
+					editors alice@example.com tag:ci
+				}`),
+			wantEditors: []string{"alice@example.com", "tag:ci"},
+		},
+		{
+			name:          "namespace",
+			d:             caddyfile.NewTestDispenser(`tailscale_links team`),
+			wantNamespace: "team",
+		},
+		{
+			name:    "too many arguments",
+			d:       caddyfile.NewTestDispenser(`tailscale_links a b`),
+			wantErr: true,
+		},
+		{
+			name: "unknown subdirective",
+			d: caddyfile.NewTestDispenser(`
+				tailscale_links {
+					readers tag:web
+				}`),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sl := new(ShortLinks)
+			err := sl.UnmarshalCaddyfile(tt.d)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("UnmarshalCaddyfile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if sl.Namespace != tt.wantNamespace {
+				t.Errorf("Namespace = %q, want %q", sl.Namespace, tt.wantNamespace)
+			}
+			if strings.Join(sl.Editors, ",") != strings.Join(tt.wantEditors, ",") {
+				t.Errorf("Editors = %q, want %q", sl.Editors, tt.wantEditors)
+			}
+		})
+	}
+}
@@ -0,0 +1,213 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// listener.go contains support for identifying the node that accepted a request,
+// so that a site bound to multiple nodes can behave differently for each of them.
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func init() {
+	caddy.RegisterModule(ListenerPlaceholders{})
+	httpcaddyfile.RegisterHandlerDirective("tailscale_listener", parseListenerPlaceholders)
+	httpcaddyfile.RegisterDirectiveOrder("tailscale_listener", httpcaddyfile.Before, "map")
+}
+
+// nodeListener wraps a listener on a Tailscale node,
+// recording the node on each accepted connection.
+type nodeListener struct {
+	net.Listener
+	node *tailscaleNode
+}
+
+func newNodeListener(ln net.Listener, node *tailscaleNode) *nodeListener {
+	return &nodeListener{Listener: ln, node: node}
+}
+
+func (l *nodeListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &nodeConn{Conn: c, node: l.node}, nil
+}
+
+func (l *nodeListener) Unwrap() net.Listener {
+	return l.Listener
+}
+
+// nodeConn is a connection accepted by a Tailscale node.
+type nodeConn struct {
+	net.Conn
+	node *tailscaleNode
+}
+
+// NetConn returns the underlying connection.
+func (c *nodeConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// connNode returns the Tailscale node that accepted c, if any.
+func connNode(c net.Conn) (*tailscaleNode, bool) {
+	nc, ok := findConn[*nodeConn](c)
+	if !ok {
+		return nil, false
+	}
+	return nc.node, true
+}
+
+// findConn returns the first connection of type T found by unwrapping c.
+// Connections wrapped by TLS or other listeners exposing the underlying connection are unwrapped.
+func findConn[T net.Conn](c net.Conn) (T, bool) {
+	for c != nil {
+		if t, ok := c.(T); ok {
+			return t, true
+		}
+		nc, ok := c.(interface{ NetConn() net.Conn })
+		if !ok {
+			break
+		}
+		c = nc.NetConn()
+	}
+	var zero T
+	return zero, false
+}
+
+// requestNode returns the Tailscale node that accepted the connection r was received on, if any.
+func requestNode(r *http.Request) (*tailscaleNode, bool) {
+	c, ok := r.Context().Value(caddyhttp.ConnCtxKey).(net.Conn)
+	if !ok {
+		return nil, false
+	}
+	return connNode(c)
+}
+
+// Values of the {tailscale.listener.ingress} placeholder.
+const (
+	ingressTailscale = "tailscale"
+	ingressFunnel    = "funnel"
+	ingressPublic    = "public"
+)
+
+// requestIngress returns how r reached Caddy: over Funnel, from the tailnet, or on another listener.
+func requestIngress(r *http.Request) string {
+	if isFunnelRequest(r) {
+		return ingressFunnel
+	}
+	if _, ok := requestNode(r); ok {
+		return ingressTailscale
+	}
+	return ingressPublic
+}
+
+// ListenerPlaceholders is a Caddy HTTP handler that sets placeholders
+// describing the Tailscale node that accepted the request.
+// This allows a site bound to multiple nodes, such as one per tenant tailnet,
+// to select tenant-specific backends.
+//
+// The following placeholders are set for requests received on a Tailscale node:
+//   - {tailscale.listener.node}: the name of the node configuration
+//   - {tailscale.listener.hostname}: the node's hostname
+//
+// Both are empty for requests received on other listeners.
+//
+// The following placeholders describe the approximate location of the tailnet peer that sent the request,
+// and are looked up only if they are used:
+//   - {tailscale.listener.peer_derp_region}: the code of the peer's home DERP region, such as "nyc"
+//   - {tailscale.listener.peer_country}, {tailscale.listener.peer_country_code},
+//     {tailscale.listener.peer_city} and {tailscale.listener.peer_city_code}:
+//     the location reported by the peer, which few peers report
+//
+// They are empty for requests received over Funnel or on other listeners.
+// The {tailscale.listener.ingress} placeholder is set for all requests to
+// "funnel" for requests received over Funnel, "tailscale" for other requests received
+// on a Tailscale node, and "public" for requests received on other listeners.
+type ListenerPlaceholders struct {
+	// ServedViaHeader is the name of a response header to set to the request's ingress,
+	// such as X-Served-Via, so that CDNs and clients can vary caching and security behavior by ingress.
+	ServedViaHeader string `json:"served_via_header,omitempty"`
+}
+
+func (ListenerPlaceholders) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.tailscale_listener",
+		New: func() caddy.Module { return new(ListenerPlaceholders) },
+	}
+}
+
+// ServeHTTP implements caddyhttp.MiddlewareHandler.
+func (lp ListenerPlaceholders) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+
+	var name, hostname string
+	node, ok := requestNode(r)
+	if ok {
+		name = node.name
+		hostname = node.Hostname
+	}
+	ingress := requestIngress(r)
+	repl.Set("tailscale.listener.node", name)
+	repl.Set("tailscale.listener.hostname", hostname)
+	repl.Set("tailscale.listener.ingress", ingress)
+	if ingress != ingressTailscale {
+		// Funnel requests are sent by ingress nodes, not the clients.
+		node = nil
+	}
+	setPeerPlaceholders(repl, r, node)
+
+	if lp.ServedViaHeader != "" {
+		w.Header().Set(lp.ServedViaHeader, ingress)
+	}
+
+	return next.ServeHTTP(w, r)
+}
+
+// UnmarshalCaddyfile sets up the handler from Caddyfile tokens. Syntax:
+//
+//	tailscale_listener {
+//	  served_via <header>
+//	}
+func (lp *ListenerPlaceholders) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume directive name
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "served_via":
+			lp.ServedViaHeader = "X-Served-Via"
+			if d.NextArg() {
+				lp.ServedViaHeader = d.Val()
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+
+		default:
+			return d.Errf("unrecognized subdirective: %s", d.Val())
+		}
+	}
+	return nil
+}
+
+// parseListenerPlaceholders parses the tailscale_listener directive.
+func parseListenerPlaceholders(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	lp := new(ListenerPlaceholders)
+	err := lp.UnmarshalCaddyfile(h.Dispenser)
+	return lp, err
+}
+
+var (
+	_ caddyhttp.MiddlewareHandler = (*ListenerPlaceholders)(nil)
+	_ caddyfile.Unmarshaler       = (*ListenerPlaceholders)(nil)
+)
@@ -0,0 +1,124 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// lock.go contains support for tailnet lock, which requires nodes to be signed by a trusted signing key.
+
+import (
+	"context"
+
+	"tailscale.com/ipn/ipnstate"
+)
+
+// signWithLock waits for the node to connect to the tailnet, then signs its node key
+// with the lock signer node, if tailnet lock is enabled and the node key isn't signed yet.
+// Errors are logged, since the node may also be signed by other means.
+func (t *tailscaleNode) signWithLock() {
+	ctx := context.Background()
+	if _, err := t.Up(ctx); err != nil {
+		t.reportError("waiting for node to sign with tailnet lock", err)
+		return
+	}
+	lc, err := t.LocalClient()
+	if err != nil {
+		t.UserLogf("checking tailnet lock status for %s: %v", t.Hostname, err)
+		return
+	}
+	st, err := lc.NetworkLockStatus(ctx)
+	if err != nil {
+		t.UserLogf("checking tailnet lock status for %s: %v", t.Hostname, err)
+		return
+	}
+	if !st.Enabled || st.NodeKeySigned || st.NodeKey == nil {
+		return
+	}
+
+	if err := t.lockSigner.start(); err != nil {
+		t.UserLogf("starting tailnet lock signer %s: %v", t.lockSigner.name, err)
+		return
+	}
+	signer, err := t.lockSigner.LocalClient()
+	if err != nil {
+		t.UserLogf("signing %s with tailnet lock: %v", t.Hostname, err)
+		return
+	}
+	if err := signer.NetworkLockSign(ctx, *st.NodeKey, nil); err != nil {
+		t.UserLogf("signing %s with tailnet lock signer %s, which must have a trusted tailnet lock key: %v", t.Hostname, t.lockSigner.name, err)
+		return
+	}
+	t.UserLogf("signed %s with tailnet lock signer %s", t.Hostname, t.lockSigner.name)
+}
+
+// nodeLockStatus is the tailnet lock status of a node.
+type nodeLockStatus struct {
+	// Node is the name of the node configuration.
+	Node string `json:"node"`
+
+	// Enabled reports whether tailnet lock is enabled for the tailnet.
+	Enabled bool `json:"enabled"`
+
+	// PublicKey is the node's tailnet lock key, which can be added to the trusted keys
+	// with "tailscale lock add" to make the node a signing node.
+	PublicKey string `json:"public_key,omitempty"`
+
+	// NodeKey is the node's node key, which is signed to allow the node to connect to peers.
+	NodeKey string `json:"node_key,omitempty"`
+
+	// NodeKeySigned reports whether the node key is signed by a trusted key.
+	NodeKeySigned bool `json:"node_key_signed"`
+
+	// Trusted reports whether the node's tailnet lock key is a trusted signing key.
+	Trusted bool `json:"trusted"`
+
+	// TrustedKeys is the number of trusted signing keys.
+	TrustedKeys int `json:"trusted_keys"`
+
+	// Error is why the node's tailnet lock status couldn't be read, if it couldn't.
+	Error string `json:"error,omitempty"`
+}
+
+// newNodeLockStatus returns the tailnet lock status of the named node from its lock status.
+func newNodeLockStatus(name string, st *ipnstate.NetworkLockStatus) nodeLockStatus {
+	ls := nodeLockStatus{
+		Node:          name,
+		Enabled:       st.Enabled,
+		NodeKeySigned: st.NodeKeySigned,
+		TrustedKeys:   len(st.TrustedKeys),
+	}
+	if !st.PublicKey.IsZero() {
+		ls.PublicKey = st.PublicKey.CLIString()
+	}
+	if st.NodeKey != nil {
+		ls.NodeKey = st.NodeKey.String()
+	}
+	for _, k := range st.TrustedKeys {
+		if !st.PublicKey.IsZero() && k.Key.Equal(st.PublicKey) {
+			ls.Trusted = true
+		}
+	}
+	return ls
+}
+
+// lockStatus returns the tailnet lock status of the node.
+func (t *tailscaleNode) lockStatus(ctx context.Context) (*ipnstate.NetworkLockStatus, error) {
+	lc, err := t.LocalClient()
+	if err != nil {
+		return nil, err
+	}
+	return lc.NetworkLockStatus(ctx)
+}
+
+// tailnetLockStatus returns the tailnet lock status of all running nodes.
+func tailnetLockStatus(ctx context.Context) ([]nodeLockStatus, error) {
+	statuses := []nodeLockStatus{}
+	for _, node := range runningNodes() {
+		st, err := node.lockStatus(ctx)
+		if err != nil {
+			statuses = append(statuses, nodeLockStatus{Node: node.name, Error: err.Error()})
+			continue
+		}
+		statuses = append(statuses, newNodeLockStatus(node.name, st))
+	}
+	return statuses, nil
+}
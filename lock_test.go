@@ -0,0 +1,99 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/msfjarvis/caddy-tailscale/tscaddytest"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/types/key"
+)
+
+func Test_NewNodeLockStatus(t *testing.T) {
+	nlKey := key.NewNLPrivate().Public()
+	otherKey := key.NewNLPrivate().Public()
+	nodeKey := key.NewNode().Public()
+
+	tests := []struct {
+		name string
+		st   *ipnstate.NetworkLockStatus
+		want nodeLockStatus
+	}{
+		{
+			name: "not logged in",
+			st:   &ipnstate.NetworkLockStatus{},
+			want: nodeLockStatus{Node: "node"},
+		},
+		{
+			name: "unsigned",
+			st: &ipnstate.NetworkLockStatus{
+				Enabled:     true,
+				PublicKey:   nlKey,
+				NodeKey:     &nodeKey,
+				TrustedKeys: []ipnstate.TKAKey{{Key: otherKey}},
+			},
+			want: nodeLockStatus{
+				Node:        "node",
+				Enabled:     true,
+				PublicKey:   nlKey.CLIString(),
+				NodeKey:     nodeKey.String(),
+				TrustedKeys: 1,
+			},
+		},
+		{
+			name: "signing node",
+			st: &ipnstate.NetworkLockStatus{
+				Enabled:       true,
+				PublicKey:     nlKey,
+				NodeKey:       &nodeKey,
+				NodeKeySigned: true,
+				TrustedKeys:   []ipnstate.TKAKey{{Key: otherKey}, {Key: nlKey}},
+			},
+			want: nodeLockStatus{
+				Node:          "node",
+				Enabled:       true,
+				PublicKey:     nlKey.CLIString(),
+				NodeKey:       nodeKey.String(),
+				NodeKeySigned: true,
+				Trusted:       true,
+				TrustedKeys:   2,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := newNodeLockStatus("node", tt.st)
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("newNodeLockStatus() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func Test_LockSignerReleasedOnError(t *testing.T) {
+	control := tscaddytest.NewControl(t)
+
+	app := newTestApp(t, control, map[string]Node{
+		"signer":  {},
+		"direct":  {},
+		"proxied": {Proxy: "http://proxy.example.com:3128"},
+	})
+	app.LockSigner = "signer"
+	ctx := runTestApp(t, app)
+
+	startTestNode(t, "signer")
+	startTestNode(t, "direct")
+	refs, _ := nodes.References("signer")
+
+	// The proxied node can't share the control server with the direct node, so it isn't created.
+	if _, err := getNode(ctx, "proxied"); err == nil {
+		nodes.Delete("proxied")
+		t.Fatal("getNode() for a node with a different proxy succeeded, want error")
+	}
+	if got, _ := nodes.References("signer"); got != refs {
+		t.Errorf("signer references = %d after failing to create a node; want %d", got, refs)
+	}
+}
@@ -0,0 +1,202 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// loopback.go contains support for short-circuiting tailnet dials from a node to its own listeners.
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// loopbackListeners are the TCP listeners that accept in-process connections,
+// keyed by node name and port (see loopbackKey).
+var loopbackListeners sync.Map // map[string]*loopbackListener
+
+func loopbackKey(nodeName, port string) string {
+	return nodeName + ":" + port
+}
+
+// loopbackListener wraps a tsnet listener, additionally accepting in-memory connections
+// from dials made by the same node to its own address.
+// This avoids sending hairpin traffic through the WireGuard stack.
+type loopbackListener struct {
+	net.Listener
+	key string
+
+	accepted chan net.Conn
+	loopback chan net.Conn
+
+	closeOnce sync.Once
+	done      chan struct{}
+	err       error // set before done is closed
+}
+
+// newLoopbackListener wraps ln and registers it to accept loopback connections
+// for the named node on port.
+func newLoopbackListener(ln net.Listener, nodeName, port string) *loopbackListener {
+	l := &loopbackListener{
+		Listener: ln,
+		key:      loopbackKey(nodeName, port),
+		accepted: make(chan net.Conn),
+		loopback: make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+	loopbackListeners.Store(l.key, l)
+	go l.acceptLoop()
+	return l
+}
+
+func (l *loopbackListener) acceptLoop() {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			l.shutdown(err)
+			return
+		}
+		select {
+		case l.accepted <- c:
+		case <-l.done:
+			c.Close()
+			return
+		}
+	}
+}
+
+func (l *loopbackListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.accepted:
+		return c, nil
+	case c := <-l.loopback:
+		return c, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+func (l *loopbackListener) Close() error {
+	err := l.Listener.Close()
+	l.shutdown(net.ErrClosed)
+	return err
+}
+
+func (l *loopbackListener) shutdown(err error) {
+	l.closeOnce.Do(func() {
+		loopbackListeners.CompareAndDelete(l.key, l)
+		l.err = err
+		close(l.done)
+	})
+}
+
+func (l *loopbackListener) Unwrap() net.Listener {
+	return l.Listener
+}
+
+// dial hands an in-memory connection to the listener, returning the client side.
+// local and remote are the addresses reported by the client side of the connection.
+func (l *loopbackListener) dial(ctx context.Context, local, remote net.Addr) (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case l.loopback <- &loopbackConn{Conn: server, local: remote, remote: local}:
+		return &loopbackConn{Conn: client, local: local, remote: remote}, nil
+	case <-l.done:
+		client.Close()
+		server.Close()
+		return nil, l.err
+	case <-ctx.Done():
+		client.Close()
+		server.Close()
+		return nil, ctx.Err()
+	}
+}
+
+// loopbackConn is one side of an in-memory loopback connection.
+// It reports the node's tailnet addresses rather than net.Pipe's placeholder addresses,
+// so that connections look to Caddy as if they came from the node itself.
+type loopbackConn struct {
+	net.Conn
+	local, remote net.Addr
+}
+
+func (c *loopbackConn) LocalAddr() net.Addr  { return c.local }
+func (c *loopbackConn) RemoteAddr() net.Addr { return c.remote }
+
+// dial connects to address over the tailnet.
+// TCP connections to the node's own address on a port it listens on are connected in-process.
+func (t *tailscaleNode) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			break
+		}
+		portNum, err := strconv.Atoi(port)
+		if err != nil {
+			break
+		}
+		if err := t.start(); err != nil {
+			return nil, err
+		}
+		ip, ok := t.selfAddr(host)
+		if !ok {
+			break
+		}
+		v, ok := loopbackListeners.Load(loopbackKey(t.name, port))
+		if !ok {
+			break
+		}
+		remote := &net.TCPAddr{IP: ip.AsSlice(), Port: portNum}
+		local := &net.TCPAddr{IP: ip.AsSlice()}
+		return v.(*loopbackListener).dial(ctx, local, remote)
+	}
+	if t.nameservers != nil {
+		var err error
+		if address, err = t.nameservers.resolve(ctx, t, network, address); err != nil {
+			return nil, err
+		}
+	}
+	c, err := t.Server.Dial(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	t.upstreams.used(c.RemoteAddr(), time.Now())
+	return c, nil
+}
+
+// selfAddr reports whether host refers to the node itself,
+// either by one of its Tailscale IPs or by its hostname or MagicDNS name.
+// It returns the node's Tailscale IP to use for the connection.
+func (t *tailscaleNode) selfAddr(host string) (netip.Addr, bool) {
+	ip4, ip6 := t.TailscaleIPs()
+	if ip, err := netip.ParseAddr(host); err == nil {
+		if ip == ip4 || ip == ip6 {
+			return ip, true
+		}
+		return netip.Addr{}, false
+	}
+
+	self := ip4
+	if !self.IsValid() {
+		self = ip6
+	}
+	if !self.IsValid() {
+		return netip.Addr{}, false
+	}
+
+	host = strings.TrimSuffix(host, ".")
+	if strings.EqualFold(host, t.Hostname) {
+		return self, true
+	}
+	for _, d := range t.CertDomains() {
+		if strings.EqualFold(host, d) {
+			return self, true
+		}
+	}
+	return netip.Addr{}, false
+}
@@ -0,0 +1,83 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// matcher.go contains request matchers for requests received from the tailnet.
+
+import (
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func init() {
+	caddy.RegisterModule(MatchFromTailnet{})
+}
+
+// MatchFromTailnet matches requests received from the tailnet by a Tailscale node.
+// Requests received over Funnel or on other listeners are not matched.
+//
+// This allows handlers, such as cache plugins, to treat tailnet users differently,
+// for example to always serve them uncached responses.
+type MatchFromTailnet struct {
+	// Tags restricts matching to requests from tagged devices with any of the tags,
+	// such as servers allowed to enroll with an internal ACME server.
+	// Devices are identified by the node that received the request.
+	Tags []string `json:"tags,omitempty"`
+}
+
+func (MatchFromTailnet) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.matchers.from_tailnet",
+		New: func() caddy.Module { return new(MatchFromTailnet) },
+	}
+}
+
+// Provision implements caddy.Provisioner.
+func (m *MatchFromTailnet) Provision(caddy.Context) error {
+	var err error
+	m.Tags, err = normalizeTags(m.Tags)
+	return err
+}
+
+// MatchWithError implements caddyhttp.RequestMatcherWithError.
+func (m MatchFromTailnet) MatchWithError(r *http.Request) (bool, error) {
+	if requestIngress(r) != ingressTailscale {
+		return false, nil
+	}
+	if len(m.Tags) == 0 {
+		return true, nil
+	}
+	node, ok := requestNode(r)
+	if !ok {
+		return false, nil
+	}
+	lc, err := node.LocalClient()
+	if err != nil {
+		return false, err
+	}
+	info, err := lc.WhoIs(r.Context(), r.RemoteAddr)
+	if err != nil {
+		return false, err
+	}
+	return hasAnyTag(info.Node.Tags, m.Tags), nil
+}
+
+// UnmarshalCaddyfile sets up the matcher from Caddyfile tokens. Syntax:
+//
+//	from_tailnet [<tags...>]
+func (m *MatchFromTailnet) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		m.Tags = append(m.Tags, d.RemainingArgs()...)
+	}
+	return nil
+}
+
+var (
+	_ caddy.Provisioner                 = (*MatchFromTailnet)(nil)
+	_ caddyhttp.RequestMatcherWithError = (*MatchFromTailnet)(nil)
+	_ caddyfile.Unmarshaler             = (*MatchFromTailnet)(nil)
+)
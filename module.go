@@ -8,8 +8,10 @@ package tscaddy
 // as well as some shared logic for registered Tailscale nodes.
 
 import (
+	"cmp"
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
@@ -29,24 +31,32 @@ import (
 	"go.uber.org/zap"
 	"golang.org/x/oauth2/clientcredentials"
 	"tailscale.com/client/tailscale"
+	"tailscale.com/feature/buildfeatures"
 	"tailscale.com/hostinfo"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/ipn/store/mem"
 	"tailscale.com/tsnet"
+	"tailscale.com/types/views"
 )
 
 func init() {
 	caddy.RegisterModule(TailscaleDirective{})
 	caddy.RegisterNetwork("tailscale", getTCPListener)
 	caddy.RegisterNetwork("tailscale+tls", getTLSListener)
+	caddy.RegisterNetwork("tailscale+funnel", getTCPListener)
 	caddy.RegisterNetwork("tailscale/udp", getUDPListener)
 	caddyhttp.RegisterNetworkHTTP3("tailscale/udp", "tailscale/udp")
 	caddyhttp.RegisterNetworkHTTP3("tailscale", "tailscale/udp")
+	// Funnel only carries TCP, so HTTP/3 on funnel listeners is served to the tailnet.
+	caddyhttp.RegisterNetworkHTTP3("tailscale+funnel", "tailscale/udp")
 
 	tailscale.I_Acknowledge_This_API_Is_Unstable = true
 	// Caddy uses tscert to get certificates for Tailscale hostnames.
 	// Update the tscert transport to send requests to the correct tsnet server,
 	// rather than just always connecting to the local machine's tailscaled.
 	tscert.TailscaledTransport = &tsnetMuxTransport{}
-	hostinfo.SetApp("caddy")
+	hostinfo.SetApp(defaultHostinfoApp)
 }
 
 func getTCPListener(c context.Context, network string, host string, portRange string, portOffset uint, _ net.ListenConfig) (any, error) {
@@ -54,6 +64,7 @@ func getTCPListener(c context.Context, network string, host string, portRange st
 	if !ok {
 		return nil, fmt.Errorf("context is not a caddy.Context: %T", c)
 	}
+	caddyNetwork := network // "tailscale" or "tailscale+funnel"
 
 	na, err := caddy.ParseNetworkAddress(caddy.JoinNetworkAddress(network, host, portRange))
 	if err != nil {
@@ -70,23 +81,45 @@ func getTCPListener(c context.Context, network string, host string, portRange st
 		network = "tcp"
 	}
 
+	if host, err = resolveNodeName(ctx, host); err != nil {
+		return nil, err
+	}
+
+	if err := checkListenPort(ctx, host, port); err != nil {
+		return nil, err
+	}
+
 	// Get node reference for this listener (increments node reference count)
 	node, err := getNode(ctx, host)
 	if err != nil {
 		return nil, err
 	}
 
+	app, err := getApp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	funnel := listenerFunnel(app, caddyNetwork, host, port)
+
 	// Follow Caddy's standard listener pooling mechanism
-	lnKey := fmt.Sprintf("tailscale/%s:%s:%s", host, network, port)
+	lnKey := fmt.Sprintf("%s/%s:%s:%s", caddyNetwork, host, network, port)
 
 	sharedLn, _, err := tailscaleListeners.LoadOrNew(lnKey, func() (caddy.Destructor, error) {
-		ln, err := node.Server.Listen(network, ":"+port)
+		if err := node.start(); err != nil {
+			return nil, err
+		}
+		var ln net.Listener
+		if funnel {
+			ln, err = node.listenFunnel(network, port)
+		} else {
+			ln, err = node.Server.Listen(network, ":"+port)
+		}
 		if err != nil {
 			return nil, err
 		}
 
 		return &tailscaleSharedListener{
-			Listener: ln,
+			Listener: newCopyBufferListener(newNodeListener(newLoopbackListener(ln, host, port), node), node.copyBufferSize),
 			key:      lnKey,
 		}, nil
 	})
@@ -121,6 +154,14 @@ func getTLSListener(c context.Context, network string, host string, portRange st
 		network = "tcp"
 	}
 
+	if host, err = resolveNodeName(ctx, host); err != nil {
+		return nil, err
+	}
+
+	if err := checkListenPort(ctx, host, port); err != nil {
+		return nil, err
+	}
+
 	// Get node reference for this listener (increments node reference count)
 	node, err := getNode(ctx, host)
 	if err != nil {
@@ -131,13 +172,16 @@ func getTLSListener(c context.Context, network string, host string, portRange st
 	lnKey := fmt.Sprintf("tailscale+tls/%s:%s:%s", host, network, port)
 
 	sharedLn, _, err := tailscaleListeners.LoadOrNew(lnKey, func() (caddy.Destructor, error) {
+		if err := node.start(); err != nil {
+			return nil, err
+		}
 		ln, err := node.Server.Listen(network, ":"+port)
 		if err != nil {
 			return nil, err
 		}
 
 		localClient, _ := node.LocalClient()
-		tlsLn := tls.NewListener(ln, &tls.Config{
+		tlsLn := tls.NewListener(newNodeListener(newLoopbackListener(ln, host, port), node), &tls.Config{
 			GetCertificate: localClient.GetCertificate,
 		})
 
@@ -177,6 +221,10 @@ func getUDPListener(c context.Context, network string, host string, portRange st
 		network = "udp"
 	}
 
+	if host, err = resolveNodeName(ctx, host); err != nil {
+		return nil, err
+	}
+
 	// Get node reference for this listener (increments node reference count)
 	node, err := getNode(ctx, host)
 	if err != nil {
@@ -187,6 +235,9 @@ func getUDPListener(c context.Context, network string, host string, portRange st
 	lnKey := fmt.Sprintf("tailscale/udp/%s:%s:%s", host, network, port)
 
 	sharedPc, _, err := tailscaleListeners.LoadOrNew(lnKey, func() (caddy.Destructor, error) {
+		if err := node.start(); err != nil {
+			return nil, err
+		}
 		st, err := node.Up(context.Background())
 		if err != nil {
 			return nil, err
@@ -252,6 +303,20 @@ func getUDPListener(c context.Context, network string, host string, portRange st
 // Callers should use getNode() to get a node by name, rather than accessing this pool directly.
 var nodes = caddy.NewUsagePool()
 
+// runningNodes returns the nodes that have been started successfully, sorted by name.
+// Nodes that haven't been started yet are not started here, to avoid connecting them to the tailnet early.
+func runningNodes() []*tailscaleNode {
+	var running []*tailscaleNode
+	nodes.Range(func(_, value any) bool {
+		if node, ok := value.(*tailscaleNode); ok && node.started.Load() {
+			running = append(running, node)
+		}
+		return true
+	})
+	slices.SortFunc(running, func(a, b *tailscaleNode) int { return cmp.Compare(a.name, b.name) })
+	return running
+}
+
 // tailscaleListeners tracks individual tailscale listeners to enable proper cleanup during config reloads.
 // This ensures listeners are properly closed when removed from configuration.
 var tailscaleListeners = caddy.NewUsagePool()
@@ -261,14 +326,16 @@ var tailscaleListeners = caddy.NewUsagePool()
 // The specified name will be used to lookup the node configuration from the tailscale caddy app,
 // used to register the node the first time it is used.
 // Only one tailscale node is created per name, even if multiple listeners are created for the node.
+// It must not be called while modules are being provisioned, since tailscale directives may not have registered
+// their site configuration yet; modules that use nodes should get them when they are started or first used.
 func getNode(ctx caddy.Context, name string) (*tailscaleNode, error) {
-	appIface, err := ctx.App("tailscale")
+	app, err := getApp(ctx)
 	if err != nil {
 		return nil, err
 	}
-	app := appIface.(*App)
+	app.resolveSiteConfigs()
 
-	s, _, err := nodes.LoadOrNew(name, func() (caddy.Destructor, error) {
+	s, loaded, err := nodes.LoadOrNew(name, func() (_ caddy.Destructor, err error) {
 		s := &tsnet.Server{
 			Logf: func(format string, args ...any) {
 				app.logger.Sugar().Debugf(format, args...)
@@ -280,59 +347,191 @@ func getNode(ctx caddy.Context, name string) (*tailscaleNode, error) {
 			RunWebClient: getWebUI(name, app),
 			Port:         getPort(name, app),
 		}
+		if s.RunWebClient && !buildfeatures.HasWebClient {
+			return nil, fmt.Errorf("webui is not supported by this build of Caddy, which omits the Tailscale web client")
+		}
 
-		var authKey string
-		if authKey, err = getAuthKey(name, app); err != nil {
+		// In testing mode, nodes join the in-process test tailnet, so auth keys and unique suffixes aren't used.
+		testing := app.testNetwork != nil
+		var authKey, authKeyFile, uniqueSuffix string
+		if !testing {
+			if authKey, err = getAuthKey(name, app); err != nil {
+				return nil, err
+			}
+			authKeyFile = getAuthKeyFile(name, app)
+
+			if s.AuthKey, err = resolveAuthKey(ctx, name, authKey, app); err != nil {
+				return nil, err
+			}
+
+			if s.ControlURL, err = getControlURL(name, app); err != nil {
+				return nil, err
+			}
+			checkClockOnce(s.ControlURL, app.logger)
+			if uniqueSuffix, err = getUniqueSuffix(name, app); err != nil {
+				return nil, err
+			}
+		}
+		if s.Hostname, err = getHostname(name, app); err != nil {
 			return nil, err
 		}
+		if uniqueSuffix != "" {
+			s.Hostname += "-" + uniqueSuffix
+		}
 
-		if s.AuthKey, err = resolveAuthKey(ctx, name, authKey, app); err != nil {
-			return nil, err
+		var persistPort bool
+		if testing {
+			if err := app.joinTestNetwork(name, s); err != nil {
+				return nil, err
+			}
+		} else {
+			if s.Dir, err = prepareStateDir(name, app); err != nil {
+				return nil, err
+			}
+			if err := checkNotExported(name, s.Dir); err != nil {
+				return nil, err
+			}
+			if getReadOnlyState(name, app) {
+				if s.Store, err = newReadOnlyStore(s.UserLogf, s.Dir); err != nil {
+					return nil, fmt.Errorf("node %q: %w", name, err)
+				}
+			} else if err := os.MkdirAll(s.Dir, 0700); err != nil {
+				return nil, fmt.Errorf("%w: creating state directory for node %q, set state_dir to a writable directory: %w", ErrStateDir, name, err)
+			}
+			if uniqueSuffix != "" {
+				if s.Store != nil {
+					return nil, fmt.Errorf("node %q: unique_suffix can't be used with read_only_state", name)
+				}
+				// Nodes with unique hostnames never start with the same identity again, so their state is kept in memory.
+				s.Store = new(mem.Store)
+			}
+
+			// Nodes resuming their identity also resume their automatically selected port.
+			persistPort = s.Port == 0 && s.Store == nil
+			if s.Port == 0 && uniqueSuffix == "" {
+				s.Port = loadPort(s.Dir)
+			}
 		}
 
-		if s.ControlURL, err = getControlURL(name, app); err != nil {
+		staticEndpoints, err := getAdvertiseEndpoints(name, app)
+		if err != nil {
 			return nil, err
 		}
-		if s.Hostname, err = getHostname(name, app); err != nil {
-			return nil, err
+		nameservers, err := newNodeNameservers(s, getNameservers(name, app))
+		if err != nil {
+			return nil, fmt.Errorf("node %q: %w", name, err)
 		}
 
-		if s.Dir, err = getStateDir(name, app); err != nil {
-			return nil, err
+		var apiClient *tailscale.Client
+		if strings.HasPrefix(authKey, "tskey-client-") {
+			// The client outlives this config, so it must not use the config's context.
+			apiClient = newAPIClient(context.Background(), authKey, app)
 		}
-		if err := os.MkdirAll(s.Dir, 0700); err != nil {
-			return nil, err
+		keyExpiry, keyExpirySet := getKeyExpiry(name, app)
+		keyExpirySet = keyExpirySet && !testing
+		if keyExpirySet && apiClient == nil {
+			return nil, fmt.Errorf("node %q: key_expiry: %w", name, ErrOAuthRequired)
+		}
+
+		prefs, err := getPrefs(name, app)
+		if err != nil {
+			return nil, fmt.Errorf("node %q: %w", name, err)
+		}
+		var routes []netip.Prefix
+		if getApproveRoutes(name, app) && !testing {
+			if apiClient == nil {
+				return nil, fmt.Errorf("node %q: approve_routes: %w", name, ErrOAuthRequired)
+			}
+			if prefs != nil {
+				routes = prefs.AdvertiseRoutes
+			}
+		}
+
+		exitNode, err := getExitNode(name, app)
+		if err != nil {
+			return nil, fmt.Errorf("node %q: %w", name, err)
+		}
+
+		var lockSigner *tailscaleNode
+		if app.LockSigner != "" && app.LockSigner != name {
+			if lockSigner, err = getNode(ctx, app.LockSigner); err != nil {
+				return nil, fmt.Errorf("getting tailnet lock signer: %w", err)
+			}
+			defer func() {
+				// The node releases its reference to the signer when it is destroyed, so it must be released here if it isn't created.
+				if err != nil {
+					nodes.Delete(app.LockSigner)
+				}
+			}()
+		}
+
+		var controlProxy *nodeProxy
+		if !testing {
+			if controlProxy, err = addControlProxy(s.ControlURL, getProxy(name, app)); err != nil {
+				return nil, fmt.Errorf("node %q: %w", name, err)
+			}
+		}
+
+		var webUI *webUIGate
+		if allow := getWebUIAllow(name, app); s.RunWebClient && len(allow) > 0 {
+			webUI = &webUIGate{allowed: allow}
 		}
 
 		return &tailscaleNode{
-			s,
+			Server:            s,
+			name:              name,
+			copyBufferSize:    getCopyBufferSize(name, app),
+			tcpSendBufferSize: getTCPSendBufferSize(name, app),
+			tcpRecvBufferSize: getTCPRecvBufferSize(name, app),
+			authKeyFile:       authKeyFile,
+			authKeyFileKey:    authKey,
+			staticEndpoints:   staticEndpoints,
+			nameservers:       nameservers,
+			derpRegion:        getDERPRegion(name, app),
+			persistPort:       persistPort,
+			prefs:             prefs,
+			routes:            routes,
+			exitNode:          exitNode,
+			apiClient:         apiClient,
+			tags:              getTags(name, app),
+			keyExpiry:         keyExpiry,
+			keyExpirySet:      keyExpirySet,
+			lockSigner:        lockSigner,
+			webUI:             webUI,
+			peerAPI:           getPeerAPIGate(name, app),
+			controlProxy:      controlProxy,
+			forgetOnStop:      uniqueSuffix != "",
+			logger:            app.logger.With(zap.String("node", name)),
 		}, nil
 	})
 	if err != nil {
 		return nil, err
 	}
 
-	return s.(*tailscaleNode), nil
+	node := s.(*tailscaleNode)
+	if loaded {
+		// Nodes are reused across config reloads, so tags changed by a reload are applied to the existing device.
+		node.setTags(getTags(name, app))
+	}
+	return node, nil
 }
 
-var repl = caddy.NewReplacer()
-
-func getAuthKey(name string, app *App) (string, error) {
-	// Check site-specific configuration first
-	if siteNode, exists := getSiteConfig(name); exists {
-		if siteNode.AuthKey != "" {
-			return repl.ReplaceOrErr(siteNode.AuthKey, true, true)
-		}
+// getApp returns the tailscale app for the config being loaded by ctx.
+func getApp(ctx caddy.Context) (*App, error) {
+	appIface, err := ctx.App("tailscale")
+	if err != nil {
+		return nil, err
 	}
+	return appIface.(*App), nil
+}
 
-	if node, ok := app.Nodes[name]; ok {
-		if node.AuthKey != "" {
-			return repl.ReplaceOrErr(node.AuthKey, true, true)
-		}
-	}
+var repl = caddy.NewReplacer()
 
-	if app.DefaultAuthKey != "" {
-		return repl.ReplaceOrErr(app.DefaultAuthKey, true, true)
+func getAuthKey(name string, app *App) (string, error) {
+	if key, file := configuredAuthKey(name, app); key != "" {
+		return repl.ReplaceOrErr(key, true, true)
+	} else if file != "" {
+		return readAuthKeyFile(file)
 	}
 
 	// Set authkey to "TS_AUTHKEY_<HOST>".
@@ -364,30 +563,14 @@ func resolveAuthKey(ctx caddy.Context, name string, v string, app *App) (string,
 		return "", fmt.Errorf("oauth authkeys require tags")
 	}
 
-	clientSecret := v
-
-	baseURL := "https://api.tailscale.com"
-	if v := app.ControlURL; v != "" {
-		baseURL = v
-	}
-
-	credentials := clientcredentials.Config{
-		ClientID:     "some-client-id", // ignored
-		ClientSecret: clientSecret,
-		TokenURL:     baseURL + "/api/v2/oauth/token",
-	}
-
-	tsClient := tailscale.NewClient("-", nil)
-	tsClient.UserAgent = "tailscale-cli"
-	tsClient.HTTPClient = credentials.Client(ctx)
-	tsClient.BaseURL = baseURL
+	tsClient := newAPIClient(ctx, v, app)
 
 	caps := tailscale.KeyCapabilities{
 		Devices: tailscale.KeyDeviceCapabilities{
 			Create: tailscale.KeyDeviceCreateCapabilities{
 				Reusable:      false,
 				Ephemeral:     getEphemeral(name, app),
-				Preauthorized: true,
+				Preauthorized: getPreauthorized(name, app),
 				Tags:          getTags(name, app),
 			},
 		},
@@ -417,6 +600,11 @@ func getControlURL(name string, app *App) (string, error) {
 }
 
 func getEphemeral(name string, app *App) bool {
+	// Nodes with unique hostnames are always ephemeral.
+	if getUniqueSuffixConfig(name, app) != "" {
+		return true
+	}
+
 	// Check site-specific configuration first
 	if siteNode, exists := getSiteConfig(name); exists {
 		if v, ok := siteNode.Ephemeral.Get(); ok {
@@ -432,6 +620,101 @@ func getEphemeral(name string, app *App) bool {
 	return app.Ephemeral
 }
 
+// getReadOnlyState returns whether the named node treats its state as read-only.
+func getReadOnlyState(name string, app *App) bool {
+	if siteNode, exists := getSiteConfig(name); exists {
+		if v, ok := siteNode.ReadOnlyState.Get(); ok {
+			return v
+		}
+	}
+
+	if node, ok := app.Nodes[name]; ok {
+		if v, ok := node.ReadOnlyState.Get(); ok {
+			return v
+		}
+	}
+	return app.ReadOnlyState
+}
+
+// getProxy returns the proxy the named node uses to connect to its control server, if it has its own.
+func getProxy(name string, app *App) string {
+	if siteNode, exists := getSiteConfig(name); exists {
+		if siteNode.Proxy != "" {
+			return siteNode.Proxy
+		}
+	}
+
+	if node, ok := app.Nodes[name]; ok {
+		return node.Proxy
+	}
+	return ""
+}
+
+// newAPIClient returns a Tailscale API client authenticated with an OAuth client secret.
+func newAPIClient(ctx context.Context, clientSecret string, app *App) *tailscale.Client {
+	credentials := oauthCredentials(clientSecret, app)
+
+	tsClient := tailscale.NewClient("-", nil)
+	tsClient.UserAgent = "tailscale-cli"
+	tsClient.HTTPClient = credentials.Client(ctx)
+	tsClient.BaseURL = apiBaseURL(app)
+	return tsClient
+}
+
+// apiBaseURL returns the base URL of the Tailscale API used by the app.
+func apiBaseURL(app *App) string {
+	if v := app.ControlURL; v != "" {
+		return v
+	}
+	return "https://api.tailscale.com"
+}
+
+// oauthCredentials returns the OAuth client credentials config for an OAuth client secret.
+func oauthCredentials(clientSecret string, app *App) *clientcredentials.Config {
+	return &clientcredentials.Config{
+		ClientID:     "some-client-id", // ignored
+		ClientSecret: clientSecret,
+		TokenURL:     apiBaseURL(app) + "/api/v2/oauth/token",
+	}
+}
+
+func getPreauthorized(name string, app *App) bool {
+	// Check site-specific configuration first
+	if siteNode, exists := getSiteConfig(name); exists {
+		if v, ok := siteNode.Preauthorized.Get(); ok {
+			return v
+		}
+	}
+
+	if node, ok := app.Nodes[name]; ok {
+		if v, ok := node.Preauthorized.Get(); ok {
+			return v
+		}
+	}
+	if v, ok := app.Preauthorized.Get(); ok {
+		return v
+	}
+	return true
+}
+
+// getKeyExpiry returns whether key expiry should be enabled for the node,
+// and whether it was configured at all.
+func getKeyExpiry(name string, app *App) (bool, bool) {
+	// Check site-specific configuration first
+	if siteNode, exists := getSiteConfig(name); exists {
+		if v, ok := siteNode.KeyExpiry.Get(); ok {
+			return v, true
+		}
+	}
+
+	if node, ok := app.Nodes[name]; ok {
+		if v, ok := node.KeyExpiry.Get(); ok {
+			return v, true
+		}
+	}
+	return app.KeyExpiry.Get()
+}
+
 func getTags(name string, app *App) []string {
 	var nodeTags []string
 
@@ -489,7 +772,114 @@ func getPort(name string, app *App) uint16 {
 	return 0
 }
 
+func getCopyBufferSize(name string, app *App) int {
+	// Check site-specific configuration first
+	if siteNode, exists := getSiteConfig(name); exists {
+		if siteNode.CopyBufferSize != 0 {
+			return siteNode.CopyBufferSize
+		}
+	}
+
+	if node, ok := app.Nodes[name]; ok {
+		return node.CopyBufferSize
+	}
+
+	return 0
+}
+
+func getTCPSendBufferSize(name string, app *App) int {
+	// Check site-specific configuration first
+	if siteNode, exists := getSiteConfig(name); exists {
+		if siteNode.TCPSendBufferSize != 0 {
+			return siteNode.TCPSendBufferSize
+		}
+	}
+
+	if node, ok := app.Nodes[name]; ok && node.TCPSendBufferSize != 0 {
+		return node.TCPSendBufferSize
+	}
+
+	if app.LowMemory {
+		return lowMemoryTCPBufferSize
+	}
+	return 0
+}
+
+// getTCPRecvBufferSize returns the maximum size of the named node's netstack TCP receive buffers,
+// or zero to keep the tsnet default. Unlike send buffers, receive buffers are only limited in low memory mode.
+func getTCPRecvBufferSize(name string, app *App) int {
+	if app.LowMemory {
+		return lowMemoryTCPBufferSize
+	}
+	return 0
+}
+
+func getAdvertiseEndpoints(name string, app *App) ([]netip.AddrPort, error) {
+	var endpoints []string
+
+	// Check site-specific configuration first
+	if siteNode, exists := getSiteConfig(name); exists && len(siteNode.AdvertiseEndpoints) > 0 {
+		endpoints = siteNode.AdvertiseEndpoints
+	} else if node, ok := app.Nodes[name]; ok {
+		endpoints = node.AdvertiseEndpoints
+	}
+
+	var addrs []netip.AddrPort
+	for _, ep := range endpoints {
+		ep, err := repl.ReplaceOrErr(ep, true, true)
+		if err != nil {
+			return nil, err
+		}
+		ap, err := netip.ParseAddrPort(ep)
+		if err != nil {
+			return nil, fmt.Errorf("invalid advertised endpoint: %v", err)
+		}
+		addrs = append(addrs, ap)
+	}
+	return addrs, nil
+}
+
+// Node start modes. See Node.Start.
+const (
+	startEager = "eager"
+	startLazy  = "lazy"
+)
+
+func getStart(name string, app *App) string {
+	// Check site-specific configuration first
+	if siteNode, exists := getSiteConfig(name); exists {
+		if siteNode.Start != "" {
+			return siteNode.Start
+		}
+	}
+
+	if node, ok := app.Nodes[name]; ok {
+		return node.Start
+	}
+
+	return ""
+}
+
+// getStateDir returns the state directory for the named node.
+// It doesn't move state in the legacy default location, so it can be used to inspect nodes.
 func getStateDir(name string, app *App) (string, error) {
+	if dir, err := getConfiguredStateDir(name, app); dir != "" || err != nil {
+		return dir, err
+	}
+	return defaultStateDir(name)
+}
+
+// prepareStateDir returns the state directory for the named node when the node is created,
+// first moving its state out of the legacy default location if no state directory is configured.
+func prepareStateDir(name string, app *App) (string, error) {
+	if dir, err := getConfiguredStateDir(name, app); dir != "" || err != nil {
+		return dir, err
+	}
+	return migrateStateDir(name, app.logger)
+}
+
+// getConfiguredStateDir returns the state directory configured for the named node, or "" if there is none.
+func getConfiguredStateDir(name string, app *App) (string, error) {
 	// Check site-specific configuration first
 	if siteNode, exists := getSiteConfig(name); exists {
 		if siteNode.StateDir != "" {
@@ -511,13 +901,7 @@ func getStateDir(name string, app *App) (string, error) {
 		return filepath.Join(s, name), nil
 	}
 
-	// By default, tsnet will use the name of the running program in the state directory,
-	// but we also include the hostname so that a single caddy instance can have multiple nodes.
-	configDir, err := os.UserConfigDir()
-	if err != nil {
-		return "", err
-	}
-	return filepath.Join(configDir, "tsnet-caddy-"+name), nil
+	return "", nil
 }
 
 func getWebUI(name string, app *App) bool {
@@ -533,17 +917,245 @@ func getWebUI(name string, app *App) bool {
 			return v
 		}
 	}
-	return app.WebUI
+	return app.WebUI && !app.LowMemory
+}
+
+// getPeerAPIGate returns the gate restricting access to the named node's peer API, or nil if access isn't restricted.
+func getPeerAPIGate(name string, app *App) *peerAPIGate {
+	enabled := true
+	var allow []string
+	if node, ok := app.Nodes[name]; ok {
+		if v, ok := node.PeerAPI.Get(); ok {
+			enabled = v
+		}
+		allow = node.PeerAPIAllow
+	}
+	if siteNode, exists := getSiteConfig(name); exists {
+		if v, ok := siteNode.PeerAPI.Get(); ok {
+			enabled = v
+		}
+		if len(siteNode.PeerAPIAllow) > 0 {
+			allow = siteNode.PeerAPIAllow
+		}
+	}
+
+	if !enabled {
+		return &peerAPIGate{}
+	}
+	if len(allow) > 0 {
+		return &peerAPIGate{allowed: allow}
+	}
+	return nil
+}
+
+func getWebUIAllow(name string, app *App) []string {
+	if siteNode, exists := getSiteConfig(name); exists && len(siteNode.WebUIAllow) > 0 {
+		return siteNode.WebUIAllow
+	}
+	if node, ok := app.Nodes[name]; ok && len(node.WebUIAllow) > 0 {
+		return node.WebUIAllow
+	}
+	return app.WebUIAllow
 }
 
 // tailscaleNode is a wrapper around a tsnet.Server that provides a fully self-contained Tailscale node.
 // This node can listen on the tailscale network interface, or be used to connect to other nodes in the tailnet.
 type tailscaleNode struct {
 	*tsnet.Server
+
+	// name is the name of the node configuration, which may differ from its hostname.
+	name string
+
+	// copyBufferSize is the size of the buffer used to write responses on the node's TCP listeners.
+	// If zero, the net/http default is used.
+	copyBufferSize int
+
+	// tcpSendBufferSize is the maximum size of netstack's TCP send buffer.
+	// If zero, the tsnet default is used.
+	tcpSendBufferSize int
+
+	// tcpRecvBufferSize is the maximum size of netstack's TCP receive buffer.
+	// If zero, the tsnet default is used.
+	tcpRecvBufferSize int
+
+	// authKeyFile is the file the node's auth key was read from, if any, which is watched for changes.
+	// authKeyFileKey is the key read from it when the node was created.
+	authKeyFile    string
+	authKeyFileKey string
+
+	// staticEndpoints are additional endpoints advertised to peers for direct connections.
+	staticEndpoints []netip.AddrPort
+
+	// persistPort is whether the node's UDP port was selected automatically,
+	// and is stored in its state directory to be used again when Caddy restarts.
+	persistPort bool
+
+	// nameservers resolve names that are not tailnet peers when the node dials them, if any are configured.
+	nameservers *nodeNameservers
+
+	// derpRegion is the DERP region the node uses as its home, or zero for automatic selection.
+	derpRegion int
+
+	// prefs are preferences applied to the node once it has started, if any.
+	prefs *ipn.MaskedPrefs
+
+	// exitNode is the hostname or IP of the exit node the node routes outbound traffic through, if any.
+	exitNode string
+
+	// apiClient is the Tailscale API client used to manage the node's device,
+	// if it was registered with an OAuth client secret.
+	apiClient *tailscale.Client
+
+	// routes are the advertised routes of the node to approve using apiClient, if any.
+	routes []netip.Prefix
+
+	// tags are the ACL tags configured for the node's device.
+	// If apiClient is set, the device's tags are updated to match when they change.
+	tagsMu sync.Mutex
+	tags   []string
+
+	// keyExpiry is whether key expiry should be enabled for the node's device,
+	// if keyExpirySet is true.
+	keyExpiry    bool
+	keyExpirySet bool
+
+	// lockSigner is the node used to sign this node if tailnet lock is enabled, if any.
+	// The node holds a reference to it until it is destroyed.
+	lockSigner *tailscaleNode
+
+	// webUI restricts which peers can connect to the node's Web UI, if set.
+	webUI *webUIGate
+
+	// peerAPI restricts which peers can connect to the node's peer API, if set.
+	peerAPI *peerAPIGate
+
+	// controlProxy is the node's use of the proxy for its control server, unless it is in testing mode.
+	controlProxy *nodeProxy
+
+	// forgetOnStop is whether the node logs out of the tailnet when it is stopped,
+	// deleting its ephemeral device, because it has a unique hostname.
+	forgetOnStop bool
+
+	// logger logs errors about the node that need attention.
+	logger *zap.Logger
+
+	// upstreams are the tailnet peers the node has connected to, whose latency is monitored.
+	upstreams upstreamPeers
+
+	// stopWatching stops background monitoring of the running node.
+	stopWatching context.CancelFunc
+
+	startOnce sync.Once
+	startErr  error
+
+	// started is set once the node's tsnet server has started, even if configuring it failed.
+	started atomic.Bool
+}
+
+// start starts the node if it is not already running,
+// and applies configuration that can only be set once the node is running.
+// It should be called before listening or dialing on the node.
+func (t *tailscaleNode) start() error {
+	t.startOnce.Do(func() {
+		if t.startErr = t.Start(); t.startErr == nil {
+			t.started.Store(true)
+			t.startErr = t.configure()
+		}
+		if t.startErr != nil {
+			t.startErr = classifyError(t.startErr)
+			t.reportError("starting node", t.startErr)
+			return
+		}
+		nodeErrors.Delete(t.name)
+	})
+	return t.startErr
 }
 
-func (t tailscaleNode) Destruct() error {
-	return t.Close()
+// status returns the status of the node, including its peers.
+func (t *tailscaleNode) status(ctx context.Context) (*ipnstate.Status, error) {
+	lc, err := t.LocalClient()
+	if err != nil {
+		return nil, err
+	}
+	return lc.Status(ctx)
+}
+
+// selfStatus returns the status of the node, without its peers.
+func (t *tailscaleNode) selfStatus(ctx context.Context) (*ipnstate.Status, error) {
+	lc, err := t.LocalClient()
+	if err != nil {
+		return nil, err
+	}
+	return lc.StatusWithoutPeers(ctx)
+}
+
+// configure applies configuration to a running node.
+func (t *tailscaleNode) configure() error {
+	var ctx context.Context
+	ctx, t.stopWatching = context.WithCancel(context.Background())
+	// Gates are installed first, before the node has connected to any peers.
+	t.installGates(ctx)
+	if err := t.configureNetstack(); err != nil {
+		return err
+	}
+	if err := t.applyPrefs(); err != nil {
+		return err
+	}
+	if len(t.staticEndpoints) > 0 {
+		t.Sys().MagicSock.Get().SetStaticEndpoints(views.SliceOf(t.staticEndpoints))
+	}
+	t.pinDERPRegion()
+	if t.controlProxy != nil && t.controlProxy.proxy != nil {
+		go t.watchDERPMap(ctx)
+	}
+	t.savePort()
+	if t.keyExpirySet {
+		go t.updateKeyExpiry()
+	}
+	if len(t.routes) > 0 {
+		go t.approveRoutes()
+	}
+	if t.exitNode != "" {
+		go t.useExitNode()
+	}
+	if t.apiClient != nil {
+		t.tagsMu.Lock()
+		tags := t.tags
+		t.tagsMu.Unlock()
+		go t.reconcileTags(tags)
+	}
+	if t.lockSigner != nil {
+		go t.signWithLock()
+	}
+	if t.authKeyFile != "" {
+		go t.watchAuthKeyFile(ctx)
+	}
+	go t.watchDuplicates(ctx)
+	go t.probePeerLatency(ctx)
+	go t.watchControl(ctx)
+	return nil
+}
+
+func (t *tailscaleNode) Destruct() error {
+	if t.stopWatching != nil {
+		t.stopWatching()
+	}
+	if t.forgetOnStop {
+		if err := t.forget(); err != nil {
+			t.logger.Warn("logging out of the tailnet; the device is deleted once the control server notices it is offline", zap.Error(err))
+		}
+	}
+	err := t.Close()
+	if t.controlProxy != nil {
+		t.controlProxy.remove()
+	}
+	if t.lockSigner != nil {
+		// Release the reference to the signer taken when this node was created.
+		if _, deleteErr := nodes.Delete(t.lockSigner.name); deleteErr != nil {
+			err = errors.Join(err, deleteErr)
+		}
+	}
+	return err
 }
 
 // fakeCloseNode is similar to fakeCloseListener but for node references.
@@ -4,13 +4,33 @@
 package tscaddy
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"io"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/msfjarvis/caddy-tailscale/tscaddytest"
+	"go.uber.org/zap"
+	"tailscale.com/ipn"
+	"tailscale.com/sessionrecording"
+	"tailscale.com/tsnet"
 	"tailscale.com/types/opt"
 	"tailscale.com/util/must"
 )
@@ -21,7 +41,9 @@ func Test_GetAuthKey(t *testing.T) {
 		env        map[string]string // env vars to set
 		defaultKey string            // default key in caddy config
 		hostKey    string            // host key in caddy config
+		hostFile   string            // contents of the host key file in caddy config
 		want       string
+		wantErr    bool
 	}{
 		"default key from environment": {
 			env:  map[string]string{"TS_AUTHKEY": "envkey"},
@@ -57,10 +79,26 @@ func Test_GetAuthKey(t *testing.T) {
 		"empty key from empty env var": {
 			hostKey: "{env.DOES_NOT_EXIST}",
 			want:    "",
+			wantErr: true,
 		},
 		"empty key from bad placeholder": {
 			hostKey: "{bad.placeholder}",
 			want:    "",
+			wantErr: true,
+		},
+		"host key from file": {
+			defaultKey: "defaultkey",
+			hostFile:   "filekey\n",
+			want:       "filekey",
+		},
+		"host key over host key file": {
+			hostKey:  "hostkey",
+			hostFile: "filekey",
+			want:     "hostkey",
+		},
+		"empty host key file": {
+			hostFile: " \n",
+			wantErr:  true,
 		},
 	}
 	for name, tt := range tests {
@@ -72,16 +110,24 @@ func Test_GetAuthKey(t *testing.T) {
 			if err := app.Provision(caddy.Context{}); err != nil {
 				t.Fatal(err)
 			}
-			if tt.hostKey != "" {
-				app.Nodes[host] = Node{
-					AuthKey: tt.hostKey,
+			if tt.hostKey != "" || tt.hostFile != "" {
+				node := Node{AuthKey: tt.hostKey}
+				if tt.hostFile != "" {
+					node.AuthKeyFile = filepath.Join(t.TempDir(), "authkey")
+					if err := os.WriteFile(node.AuthKeyFile, []byte(tt.hostFile), 0600); err != nil {
+						t.Fatal(err)
+					}
 				}
+				app.Nodes[host] = node
 			}
 			for k, v := range tt.env {
 				t.Setenv(k, v)
 			}
 
-			got, _ := getAuthKey(host, app)
+			got, err := getAuthKey(host, app)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GetAuthKey() error = %v, wantErr %v", err, tt.wantErr)
+			}
 			if got != tt.want {
 				t.Errorf("GetAuthKey() = %v, want %v", got, tt.want)
 			}
@@ -179,6 +225,141 @@ func Test_GetEphemeral(t *testing.T) {
 	if got, want := getEphemeral("not-ephemeral", app), false; got != want {
 		t.Errorf("GetEphemeral() = %v, want %v", got, want)
 	}
+
+	// nodes with a unique suffix are always ephemeral
+	app.Nodes["preview"] = Node{Ephemeral: opt.NewBool(false), UniqueSuffix: "random"}
+	if got, want := getEphemeral("preview", app), true; got != want {
+		t.Errorf("GetEphemeral() = %v, want %v", got, want)
+	}
+}
+
+func Test_UniqueSuffix(t *testing.T) {
+	control := tscaddytest.NewControl(t)
+
+	// Nodes with a unique suffix are ephemeral even if the app's nodes aren't.
+	app := newTestApp(t, control, map[string]Node{
+		"preview": {UniqueSuffix: "ci1"},
+	})
+	app.Ephemeral = false
+	runTestApp(t, app)
+
+	node := startTestNode(t, "preview")
+	if !node.Ephemeral || !node.forgetOnStop {
+		t.Errorf("Ephemeral = %v, forgetOnStop = %v; want both true", node.Ephemeral, node.forgetOnStop)
+	}
+	st, err := node.Up(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := st.Self.HostName, "preview-ci1"; got != want {
+		t.Errorf("HostName = %q, want %q", got, want)
+	}
+}
+
+func Test_DirectiveOnlyConfig(t *testing.T) {
+	// The tailscale app isn't configured, so it's only loaded when the modules using it are provisioned.
+	// The modules using the node are provisioned before the directive configuring it.
+	tests := map[string]map[string]any{
+		"dynamic upstreams": {
+			"handler":           "reverse_proxy",
+			"dynamic_upstreams": map[string]any{"source": "tailscale", "node": "site-only", "port": "80"},
+		},
+		"transport": {
+			"handler":   "reverse_proxy",
+			"upstreams": []any{map[string]any{"dial": "localhost:1"}},
+			"transport": map[string]any{"protocol": "tailscale", "name": "site-only"},
+		},
+		"gateway": {
+			"handler": "tailscale_gateway",
+			"node":    "site-only",
+			"tags":    []string{"tag:web"},
+			"port":    80,
+		},
+	}
+	for tn, proxy := range tests {
+		t.Run(tn, func(t *testing.T) {
+			control := tscaddytest.NewControl(t)
+			handler := map[string]any{
+				"handler":     "tailscale",
+				"node_name":   "site-only",
+				"control_url": control.URL,
+				"ephemeral":   true,
+				"state_dir":   t.TempDir(),
+				"hostname":    "from-directive",
+			}
+			server := map[string]any{
+				"listen": []string{"tailscale/site-only:8181"},
+				"routes": []any{
+					map[string]any{"match": []any{map[string]any{"path": []string{"/proxy"}}}, "handle": []any{proxy}},
+					map[string]any{"handle": []any{handler}},
+				},
+			}
+			must.Do(caddy.Run(&caddy.Config{
+				AppsRaw: caddy.ModuleMap{
+					"http": caddyconfig.JSON(map[string]any{"servers": map[string]any{"srv0": server}}, nil),
+				},
+			}))
+			defer caddy.Stop()
+
+			node, err := getNode(caddy.ActiveContext(), "site-only")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer nodes.Delete("site-only")
+			if got, want := node.Hostname, "from-directive"; got != want {
+				t.Errorf("Hostname = %q, want %q", got, want)
+			}
+			if got, want := node.ControlURL, control.URL; got != want {
+				t.Errorf("ControlURL = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func Test_GetUniqueSuffix(t *testing.T) {
+	tests := map[string]struct {
+		env     map[string]string // env vars to set
+		suffix  string            // unique_suffix value in caddy config
+		want    string            // expected suffix; "random" for any random suffix
+		wantErr bool
+	}{
+		"none":   {},
+		"random": {suffix: "random", want: "random"},
+		"build id": {
+			env:    map[string]string{"BUILD_ID": "PR-123"},
+			suffix: "{env.BUILD_ID}",
+			want:   "pr-123",
+		},
+		"invalid": {
+			suffix:  "feature/login",
+			wantErr: true,
+		},
+	}
+	for tn, tt := range tests {
+		t.Run(tn, func(t *testing.T) {
+			app := &App{Nodes: map[string]Node{
+				"node": {UniqueSuffix: tt.suffix},
+			}}
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+
+			got, err := getUniqueSuffix("node", app)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("getUniqueSuffix() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.want == "random" {
+				other, _ := getUniqueSuffix("node", app)
+				if len(got) != 6 || got == other || strings.Trim(got, "abcdefghijklmnopqrstuvwxyz234567") != "" {
+					t.Errorf("getUniqueSuffix() = %q, %q, want different random suffixes", got, other)
+				}
+				return
+			}
+			if got != tt.want {
+				t.Errorf("getUniqueSuffix() = %q, want %q", got, tt.want)
+			}
+		})
+	}
 }
 
 func Test_GetHostname(t *testing.T) {
@@ -249,17 +430,114 @@ func Test_GetPort(t *testing.T) {
 
 }
 
+func Test_GetAdvertiseEndpoints(t *testing.T) {
+	tests := map[string]struct {
+		env       map[string]string // env vars to set
+		endpoints []string          // advertise_endpoints value in caddy config
+		want      []netip.AddrPort
+		wantErr   bool
+	}{
+		"no endpoints": {},
+		"ipv4 and ipv6 endpoints": {
+			endpoints: []string{"203.0.113.1:41641", "[2001:db8::1]:41641"},
+			want: []netip.AddrPort{
+				netip.MustParseAddrPort("203.0.113.1:41641"),
+				netip.MustParseAddrPort("[2001:db8::1]:41641"),
+			},
+		},
+		"endpoint from env": {
+			env:       map[string]string{"PUBLIC_IP": "203.0.113.1"},
+			endpoints: []string{"{env.PUBLIC_IP}:41641"},
+			want:      []netip.AddrPort{netip.MustParseAddrPort("203.0.113.1:41641")},
+		},
+		"missing port": {
+			endpoints: []string{"203.0.113.1"},
+			wantErr:   true,
+		},
+	}
+	for tn, tt := range tests {
+		t.Run(tn, func(t *testing.T) {
+			app := &App{Nodes: map[string]Node{
+				"node": {AdvertiseEndpoints: tt.endpoints},
+			}}
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+
+			got, err := getAdvertiseEndpoints("node", app)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GetAdvertiseEndpoints() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("GetAdvertiseEndpoints() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_GetAdvertiseRoutes(t *testing.T) {
+	tests := map[string]struct {
+		node    Node
+		want    []netip.Prefix
+		wantErr bool
+	}{
+		"no routes": {},
+		"subnet routes": {
+			node: Node{AdvertiseRoutes: []string{"192.168.1.0/24", "10.0.0.0/8", "192.168.1.0/24"}},
+			want: []netip.Prefix{
+				netip.MustParsePrefix("10.0.0.0/8"),
+				netip.MustParsePrefix("192.168.1.0/24"),
+			},
+		},
+		"exit node": {
+			node: Node{AdvertiseRoutes: []string{"fd00::/64"}, AdvertiseExitNode: true},
+			want: []netip.Prefix{
+				netip.MustParsePrefix("0.0.0.0/0"),
+				netip.MustParsePrefix("::/0"),
+				netip.MustParsePrefix("fd00::/64"),
+			},
+		},
+		"host bits set": {
+			node:    Node{AdvertiseRoutes: []string{"192.168.1.1/24"}},
+			wantErr: true,
+		},
+		"invalid": {
+			node:    Node{AdvertiseRoutes: []string{"192.168.1.0"}},
+			wantErr: true,
+		},
+	}
+	for tn, tt := range tests {
+		t.Run(tn, func(t *testing.T) {
+			app := &App{Nodes: map[string]Node{"node": tt.node}}
+			got, err := getAdvertiseRoutes("node", app)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("getAdvertiseRoutes() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("getAdvertiseRoutes() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
 func Test_GetStateDir(t *testing.T) {
 	const nodeName = "node"
-	configDir := must.Get(os.UserConfigDir())
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("XDG_CONFIG_HOME", "")
+	t.Setenv("XDG_DATA_HOME", "")
 	tests := map[string]struct {
 		env        map[string]string // env vars to set
 		defaultDir string            // default state_dir in caddy config
 		nodeDir    string            // node state_dir in caddy config
 		want       string
+		wantErr    bool
 	}{
 		"default statedir from node name": {
-			want: filepath.Join(configDir, "tsnet-caddy-"+nodeName),
+			want: filepath.Join(must.Get(defaultStateRoot()), nodeName),
+		},
+		"no default statedir without home directory": {
+			env:     map[string]string{"HOME": "", "XDG_CONFIG_HOME": "", "AppData": ""},
+			wantErr: true,
 		},
 		"custom hostname from app config": {
 			env:        map[string]string{"TMPDIR": "/tmp/"},
@@ -291,7 +569,10 @@ func Test_GetStateDir(t *testing.T) {
 				t.Setenv(k, v)
 			}
 
-			got, _ := getStateDir(nodeName, app)
+			got, err := getStateDir(nodeName, app)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GetStateDir() error = %v, wantErr %v", err, tt.wantErr)
+			}
 			if got != tt.want {
 				t.Errorf("GetStateDir() = %v, want %v", got, tt.want)
 			}
@@ -299,6 +580,77 @@ func Test_GetStateDir(t *testing.T) {
 	}
 }
 
+func Test_DefaultStateDirMigration(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("XDG_CONFIG_HOME", "")
+	t.Setenv("XDG_DATA_HOME", "")
+	logger := zap.NewNop()
+
+	legacy := must.Get(legacyStateDir("node"))
+	if err := os.MkdirAll(legacy, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(legacy, "tailscaled.state"), []byte("{}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Resolving the directory, such as to inspect the node, doesn't move its state.
+	if got := must.Get(defaultStateDir("node")); got != legacy {
+		t.Errorf("defaultStateDir() = %q, want %q", got, legacy)
+	}
+	if _, err := os.Stat(legacy); err != nil {
+		t.Fatalf("legacy directory moved by defaultStateDir: %v", err)
+	}
+
+	dir, err := migrateStateDir("node", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(must.Get(defaultStateRoot()), "node"); dir != want {
+		t.Fatalf("migrateStateDir() = %q, want %q", dir, want)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "tailscaled.state")); err != nil {
+		t.Errorf("state not moved to new directory: %v", err)
+	}
+	if _, err := os.Stat(legacy); !os.IsNotExist(err) {
+		t.Errorf("legacy directory still exists: %v", err)
+	}
+
+	// Once moved, the new directory is used even if the legacy one reappears.
+	if err := os.MkdirAll(legacy, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if got := must.Get(migrateStateDir("node", logger)); got != dir {
+		t.Errorf("migrateStateDir() = %q, want %q", got, dir)
+	}
+}
+
+func Test_DefaultStateDirMigrationFailure(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("XDG_CONFIG_HOME", "")
+	t.Setenv("XDG_DATA_HOME", "")
+
+	legacy := must.Get(legacyStateDir("node"))
+	if err := os.MkdirAll(legacy, 0700); err != nil {
+		t.Fatal(err)
+	}
+	// The new state root can't be created, since a file is in the way.
+	root := must.Get(defaultStateRoot())
+	if err := os.MkdirAll(filepath.Dir(root), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(root, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := must.Get(migrateStateDir("node", zap.NewNop())); got != legacy {
+		t.Errorf("migrateStateDir() = %q, want legacy directory %q", got, legacy)
+	}
+	if _, err := os.Stat(legacy); err != nil {
+		t.Errorf("legacy directory: %v", err)
+	}
+}
+
 func Test_GetWebUI(t *testing.T) {
 	app := &App{
 		WebUI: true,
@@ -331,6 +683,45 @@ func Test_GetWebUI(t *testing.T) {
 	if got, want := getWebUI("no-webui", app), false; got != want {
 		t.Errorf("GetWebUI() = %v, want %v", got, want)
 	}
+
+	// in low memory mode, only nodes that explicitly enable the webui run it
+	app.LowMemory = true
+	if got, want := getWebUI("empty", app), false; got != want {
+		t.Errorf("GetWebUI() = %v, want %v", got, want)
+	}
+	if got, want := getWebUI("webui", app), true; got != want {
+		t.Errorf("GetWebUI() = %v, want %v", got, want)
+	}
+}
+
+func Test_GetTCPBufferSizes(t *testing.T) {
+	app := &App{
+		Nodes: map[string]Node{
+			"empty": {},
+			"tuned": {TCPSendBufferSize: 1 << 20},
+		},
+	}
+
+	tests := []struct {
+		name      string
+		lowMemory bool
+		wantSend  int
+		wantRecv  int
+	}{
+		{name: "empty"},
+		{name: "tuned", wantSend: 1 << 20},
+		{name: "empty", lowMemory: true, wantSend: lowMemoryTCPBufferSize, wantRecv: lowMemoryTCPBufferSize},
+		{name: "tuned", lowMemory: true, wantSend: 1 << 20, wantRecv: lowMemoryTCPBufferSize},
+	}
+	for _, tt := range tests {
+		app.LowMemory = tt.lowMemory
+		if got := getTCPSendBufferSize(tt.name, app); got != tt.wantSend {
+			t.Errorf("getTCPSendBufferSize(%q, low_memory=%v) = %d, want %d", tt.name, tt.lowMemory, got, tt.wantSend)
+		}
+		if got := getTCPRecvBufferSize(tt.name, app); got != tt.wantRecv {
+			t.Errorf("getTCPRecvBufferSize(%q, low_memory=%v) = %d, want %d", tt.name, tt.lowMemory, got, tt.wantRecv)
+		}
+	}
 }
 
 func Test_Listen(t *testing.T) {
@@ -371,3 +762,788 @@ func Test_Listen(t *testing.T) {
 		t.Fatalf("expected 0 node references after close, got count=%d exists=%v", count, exists)
 	}
 }
+
+func Test_ListenOverTailnet(t *testing.T) {
+	control := tscaddytest.NewControl(t)
+	client := control.NewNode(t, "client")
+
+	ctx := runTestApp(t, newTestApp(t, control, nil))
+
+	ln, err := getTCPListener(ctx, "tailscale", "e2e-server", "80", 0, net.ListenConfig{})
+	if err != nil {
+		t.Fatal("failed to get listener", err)
+	}
+	defer ln.(io.Closer).Close()
+	go http.Serve(ln.(net.Listener), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+
+	node := startTestNode(t, "e2e-server")
+	upCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	st, err := node.Up(upCtx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequestWithContext(upCtx, "GET", "http://"+st.TailscaleIPs[0].String()+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.HTTPClient().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if got, want := string(body), "hello"; got != want {
+		t.Errorf("response body = %q, want %q", got, want)
+	}
+}
+
+func Test_DialLoopback(t *testing.T) {
+	control := tscaddytest.NewControl(t)
+
+	ctx := runTestApp(t, newTestApp(t, control, nil))
+
+	ln, err := getTCPListener(ctx, "tailscale", "loopback", "80", 0, net.ListenConfig{})
+	if err != nil {
+		t.Fatal("failed to get listener", err)
+	}
+	defer ln.(io.Closer).Close()
+	go http.Serve(ln.(net.Listener), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.RemoteAddr)
+	}))
+
+	node := startTestNode(t, "loopback")
+	upCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	st, err := node.Up(upCtx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	self := st.TailscaleIPs[0].String()
+
+	for _, addr := range []string{self + ":80", "loopback:80"} {
+		conn, err := node.dial(upCtx, "tcp", addr)
+		if err != nil {
+			t.Fatalf("dial(%q): %v", addr, err)
+		}
+		if _, ok := conn.(*loopbackConn); !ok {
+			t.Errorf("dial(%q) returned %T, want *loopbackConn", addr, conn)
+		}
+		conn.Close()
+	}
+
+	client := &http.Client{Transport: &http.Transport{DialContext: node.dial}}
+	resp, err := client.Get("http://" + self + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if host, _, _ := net.SplitHostPort(string(body)); host != self {
+		t.Errorf("server saw remote address %q, want host %q", body, self)
+	}
+}
+
+func Test_FallbackDNS(t *testing.T) {
+	control := tscaddytest.NewControl(t)
+	peer := control.NewNode(t, "peer")
+	ln, err := peer.Listen("tcp", ":80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	runTestApp(t, newTestApp(t, control, nil))
+
+	node := startTestNode(t, "fallback")
+	dialCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if _, err := node.Up(dialCtx); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, mode := range []string{"off", "127.0.0.1:1"} {
+		addr := must.Get(parseFallbackDNS(mode))
+		d := newFallbackDialer(node, mode, addr)
+
+		conn, err := d.DialContext(dialCtx, "tcp", "peer:80")
+		if err != nil {
+			t.Fatalf("%s: dial tailnet peer: %v", mode, err)
+		}
+		conn.Close()
+
+		shortCtx, cancel := context.WithTimeout(dialCtx, 2*time.Second)
+		if _, err := d.DialContext(shortCtx, "tcp", "example.invalid:80"); err == nil {
+			t.Errorf("%s: dial non-peer name succeeded, want error", mode)
+		}
+		cancel()
+	}
+}
+
+func Test_ParseFallbackDNS(t *testing.T) {
+	tests := map[string]struct {
+		want    string
+		wantErr bool
+	}{
+		"":             {},
+		"system":       {},
+		"off":          {},
+		"1.1.1.1":      {want: "1.1.1.1:53"},
+		"1.1.1.1:5353": {want: "1.1.1.1:5353"},
+		"2606:4700::1": {want: "[2606:4700::1]:53"},
+		"dns.google":   {wantErr: true},
+	}
+	for in, tt := range tests {
+		got, err := parseFallbackDNS(in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseFallbackDNS(%q) error = %v, wantErr %v", in, err, tt.wantErr)
+		}
+		if got != tt.want {
+			t.Errorf("parseFallbackDNS(%q) = %q, want %q", in, got, tt.want)
+		}
+	}
+}
+
+func Test_ListenerPlaceholders(t *testing.T) {
+	node := &tailscaleNode{name: "tenant-a", Server: &tsnet.Server{Hostname: "acme"}}
+	c, _ := net.Pipe()
+	defer c.Close()
+
+	tests := map[string]struct {
+		conn         net.Conn
+		wantNode     string
+		wantHostname string
+		wantIngress  string
+	}{
+		"tailscale conn": {
+			conn:         &nodeConn{Conn: c, node: node},
+			wantNode:     "tenant-a",
+			wantHostname: "acme",
+			wantIngress:  "tailscale",
+		},
+		"wrapped tailscale conn": {
+			conn:         tls.Server(&copyBufferConn{Conn: &nodeConn{Conn: c, node: node}}, &tls.Config{}),
+			wantNode:     "tenant-a",
+			wantHostname: "acme",
+			wantIngress:  "tailscale",
+		},
+		"funnel conn": {
+			conn:         &nodeConn{Conn: &ipn.FunnelConn{Conn: c}, node: node},
+			wantNode:     "tenant-a",
+			wantHostname: "acme",
+			wantIngress:  "funnel",
+		},
+		"other conn": {
+			conn:        c,
+			wantIngress: "public",
+		},
+	}
+	for tn, tt := range tests {
+		t.Run(tn, func(t *testing.T) {
+			repl := caddy.NewReplacer()
+			ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, repl)
+			ctx = context.WithValue(ctx, caddyhttp.ConnCtxKey, tt.conn)
+			r := httptest.NewRequestWithContext(ctx, "GET", "/", nil)
+
+			next := caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error { return nil })
+			rec := httptest.NewRecorder()
+			if err := (ListenerPlaceholders{ServedViaHeader: "X-Served-Via"}).ServeHTTP(rec, r, next); err != nil {
+				t.Fatal(err)
+			}
+			if got, _ := repl.GetString("tailscale.listener.node"); got != tt.wantNode {
+				t.Errorf("tailscale.listener.node = %q, want %q", got, tt.wantNode)
+			}
+			if got, _ := repl.GetString("tailscale.listener.hostname"); got != tt.wantHostname {
+				t.Errorf("tailscale.listener.hostname = %q, want %q", got, tt.wantHostname)
+			}
+			if got, _ := repl.GetString("tailscale.listener.ingress"); got != tt.wantIngress {
+				t.Errorf("tailscale.listener.ingress = %q, want %q", got, tt.wantIngress)
+			}
+			// The node isn't running, so the peer is unknown.
+			if got, ok := repl.GetString("tailscale.listener.peer_derp_region"); !ok || got != "" {
+				t.Errorf("tailscale.listener.peer_derp_region = %q, %v; want empty", got, ok)
+			}
+			if got := rec.Header().Get("X-Served-Via"); got != tt.wantIngress {
+				t.Errorf("X-Served-Via = %q, want %q", got, tt.wantIngress)
+			}
+		})
+	}
+}
+
+func Test_MatchFromTailnet(t *testing.T) {
+	node := &tailscaleNode{name: "myapp", Server: &tsnet.Server{Hostname: "myapp"}}
+	c, _ := net.Pipe()
+	defer c.Close()
+
+	tests := map[string]struct {
+		conn net.Conn
+		want bool
+	}{
+		"tailscale conn": {conn: &nodeConn{Conn: c, node: node}, want: true},
+		"funnel conn":    {conn: &nodeConn{Conn: &ipn.FunnelConn{Conn: c}, node: node}},
+		"other conn":     {conn: c},
+	}
+	for tn, tt := range tests {
+		t.Run(tn, func(t *testing.T) {
+			ctx := context.WithValue(context.Background(), caddyhttp.ConnCtxKey, tt.conn)
+			r := httptest.NewRequestWithContext(ctx, "GET", "/", nil)
+			got, err := (MatchFromTailnet{}).MatchWithError(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("MatchWithError() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_MatchFromTailnetUnmarshalCaddyfile(t *testing.T) {
+	tests := map[string]struct {
+		d    *caddyfile.Dispenser
+		want string
+	}{
+		"no tags": {d: caddyfile.NewTestDispenser(`from_tailnet`), want: `{}`},
+		"tags":    {d: caddyfile.NewTestDispenser(`from_tailnet tag:server web`), want: `{"tags":["tag:server","web"]}`},
+	}
+	for tn, tt := range tests {
+		t.Run(tn, func(t *testing.T) {
+			m := new(MatchFromTailnet)
+			if err := m.UnmarshalCaddyfile(tt.d); err != nil {
+				t.Fatal(err)
+			}
+			if got := string(caddyconfig.JSON(m, nil)); got != tt.want {
+				t.Errorf("UnmarshalCaddyfile() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_MatchFromTailnetTags(t *testing.T) {
+	control := tscaddytest.NewControl(t)
+	peer := control.NewNode(t, "peer")
+
+	runTestApp(t, newTestApp(t, control, map[string]Node{
+		"ca": {},
+	}))
+
+	node := startTestNode(t, "ca")
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	st := must.Get(node.Up(ctx))
+	ln := must.Get(node.Listen("tcp", ":80"))
+	defer ln.Close()
+
+	matchers := map[string]*MatchFromTailnet{
+		"any":    {},
+		"tagged": {Tags: []string{"server"}},
+	}
+	for _, m := range matchers {
+		must.Do(m.Provision(caddy.ActiveContext()))
+	}
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for name, m := range matchers {
+				ok, err := m.MatchWithError(r)
+				if err != nil {
+					t.Errorf("%s: MatchWithError() error = %v", name, err)
+				}
+				w.Header().Set("X-Match-"+name, strconv.FormatBool(ok))
+			}
+		}),
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, caddyhttp.ConnCtxKey, c)
+		},
+	}
+	go srv.Serve(newNodeListener(ln, node))
+	defer srv.Close()
+
+	client := &http.Client{Transport: &http.Transport{DialContext: peer.Dial}}
+	resp := must.Get(client.Get("http://" + st.TailscaleIPs[0].String() + "/"))
+	resp.Body.Close()
+	if got := resp.Header.Get("X-Match-any"); got != "true" {
+		t.Errorf("from_tailnet matched = %s, want true", got)
+	}
+	// testcontrol doesn't apply advertised tags, so the peer is untagged.
+	if got := resp.Header.Get("X-Match-tagged"); got != "false" {
+		t.Errorf("from_tailnet tag:server matched untagged peer = %s, want false", got)
+	}
+}
+
+func Test_SelectNode(t *testing.T) {
+	app := &App{
+		Nodes: map[string]Node{
+			"edge-eu": {Labels: map[string]string{"region": "eu", "tier": "edge"}},
+			"edge-us": {Labels: map[string]string{"region": "us", "tier": "edge"}},
+			"db-eu":   {Labels: map[string]string{"region": "eu", "tier": "db"}},
+			"plain":   {},
+		},
+	}
+
+	tests := map[string]struct {
+		selector string
+		want     string
+		wantErr  bool
+	}{
+		"single label": {
+			selector: "region=us",
+			want:     "edge-us",
+		},
+		"multiple labels": {
+			selector: "region=eu,tier=edge",
+			want:     "edge-eu",
+		},
+		"ambiguous": {
+			selector: "region=eu",
+			wantErr:  true,
+		},
+		"no match": {
+			selector: "region=ap",
+			wantErr:  true,
+		},
+		"invalid selector": {
+			selector: "region=eu,edge",
+			wantErr:  true,
+		},
+	}
+	for tn, tt := range tests {
+		t.Run(tn, func(t *testing.T) {
+			got, err := selectNode(tt.selector, app)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("selectNode() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("selectNode() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_GetPreauthorized(t *testing.T) {
+	app := &App{
+		Nodes: map[string]Node{
+			"approved": {},
+			"pending":  {Preauthorized: opt.NewBool(false)},
+		},
+	}
+	if err := app.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := getPreauthorized("approved", app); !got {
+		t.Errorf("getPreauthorized(approved) = %v, want true", got)
+	}
+	if got := getPreauthorized("pending", app); got {
+		t.Errorf("getPreauthorized(pending) = %v, want false", got)
+	}
+
+	app.Preauthorized = opt.NewBool(false)
+	if got := getPreauthorized("approved", app); got {
+		t.Errorf("getPreauthorized(approved) with app default false = %v, want false", got)
+	}
+}
+
+func Test_SetKeyExpiryDisabled(t *testing.T) {
+	var gotPath, gotBody string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v2/oauth/token":
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"access_token":"token","token_type":"bearer"}`)
+		default:
+			if r.Header.Get("Authorization") != "Bearer token" {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			b, _ := io.ReadAll(r.Body)
+			gotPath, gotBody = r.URL.Path, string(b)
+		}
+	}))
+	defer srv.Close()
+
+	client := newAPIClient(context.Background(), "tskey-client-secret", &App{ControlURL: srv.URL})
+	if err := setKeyExpiryDisabled(context.Background(), client, "nABC123", true); err != nil {
+		t.Fatal(err)
+	}
+	if want := "/api/v2/device/nABC123/key"; gotPath != want {
+		t.Errorf("request path = %q, want %q", gotPath, want)
+	}
+	if want := `{"keyExpiryDisabled":true}`; gotBody != want {
+		t.Errorf("request body = %q, want %q", gotBody, want)
+	}
+}
+
+func Test_SyncDeviceTags(t *testing.T) {
+	var gotPath, gotBody string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v2/oauth/token":
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"access_token":"token","token_type":"bearer"}`)
+		default:
+			b, _ := io.ReadAll(r.Body)
+			gotPath, gotBody = r.URL.Path, string(b)
+		}
+	}))
+	defer srv.Close()
+	client := newAPIClient(context.Background(), "tskey-client-secret", &App{ControlURL: srv.URL})
+
+	tests := map[string]struct {
+		current     []string
+		desired     []string
+		wantUpdated bool
+		wantBody    string
+	}{
+		"unchanged": {
+			current: []string{"tag:web", "tag:db"},
+			desired: []string{"tag:db", "tag:web"},
+		},
+		"changed": {
+			current:     []string{"tag:web"},
+			desired:     []string{"tag:web", "tag:db"},
+			wantUpdated: true,
+			wantBody:    `{"tags":["tag:db","tag:web"]}`,
+		},
+	}
+	for tn, tt := range tests {
+		t.Run(tn, func(t *testing.T) {
+			gotPath, gotBody = "", ""
+			updated, err := syncDeviceTags(context.Background(), client, "nABC123", tt.current, tt.desired)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if updated != tt.wantUpdated {
+				t.Errorf("syncDeviceTags() = %v, want %v", updated, tt.wantUpdated)
+			}
+			if !tt.wantUpdated {
+				if gotPath != "" {
+					t.Errorf("unexpected request to %s", gotPath)
+				}
+				return
+			}
+			if want := "/api/v2/device/nABC123/tags"; gotPath != want {
+				t.Errorf("request path = %q, want %q", gotPath, want)
+			}
+			if gotBody != tt.wantBody {
+				t.Errorf("request body = %q, want %q", gotBody, tt.wantBody)
+			}
+		})
+	}
+}
+
+func Test_AcceptDNS(t *testing.T) {
+	control := tscaddytest.NewControl(t)
+
+	runTestApp(t, newTestApp(t, control, map[string]Node{
+		"no-dns": {AcceptDNS: opt.NewBool(false)},
+	}))
+
+	node := startTestNode(t, "no-dns")
+
+	lc, err := node.LocalClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefs, err := lc.GetPrefs(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prefs.CorpDNS {
+		t.Errorf("CorpDNS = true, want false")
+	}
+}
+
+func Test_Forward(t *testing.T) {
+	control := tscaddytest.NewControl(t)
+	peer := control.NewNode(t, "db")
+	ln, err := peer.Listen("tcp", ":5432")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	// Find a free local port for the forwarder.
+	free := must.Get(net.Listen("tcp", "127.0.0.1:0"))
+	port := strconv.Itoa(free.Addr().(*net.TCPAddr).Port)
+	free.Close()
+
+	runTestApp(t, newTestApp(t, control, map[string]Node{
+		"forwarder": {Forwards: []Forward{{Listen: port, To: "db:5432"}}},
+	}))
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", port), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	conn.(*net.TCPConn).CloseWrite()
+	got, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "ping" {
+		t.Errorf("forwarded echo = %q, want %q", got, "ping")
+	}
+}
+
+func Test_ForwardRecording(t *testing.T) {
+	control := tscaddytest.NewControl(t)
+	peer := control.NewNode(t, "db")
+	ln, err := peer.Listen("tcp", ":5432")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	free := must.Get(net.Listen("tcp", "127.0.0.1:0"))
+	port := strconv.Itoa(free.Addr().(*net.TCPAddr).Port)
+	free.Close()
+
+	dir := t.TempDir()
+	runTestApp(t, newTestApp(t, control, map[string]Node{
+		"forwarder": {Forwards: []Forward{{Listen: port, To: "db:5432", Record: &Recording{Dir: dir}}}},
+	}))
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", port), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	conn.(*net.TCPConn).CloseWrite()
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	// The recording is written until the forwarder has finished copying both directions.
+	var header sessionrecording.CastHeader
+	data := make(map[string]string) // event kind -> recorded data
+	for deadline := time.Now().Add(10 * time.Second); data["i"] != "ping" || data["o"] != "ping"; time.Sleep(50 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("recorded data = %q; want ping in both directions", data)
+		}
+		files := must.Get(filepath.Glob(filepath.Join(dir, "*.cast")))
+		if len(files) != 1 {
+			continue
+		}
+		dec := json.NewDecoder(bytes.NewReader(must.Get(os.ReadFile(files[0]))))
+		if err := dec.Decode(&header); err != nil {
+			continue
+		}
+		clear(data)
+		var event []any
+		for dec.Decode(&event) == nil {
+			if len(event) == 3 {
+				kind, _ := event[1].(string)
+				s, _ := event[2].(string)
+				data[kind] += s
+			}
+		}
+	}
+	if header.Version != 2 || header.Command != "forward db:5432" {
+		t.Errorf("recording header = %+v; want version 2 forward db:5432", header)
+	}
+}
+
+func Test_Expose(t *testing.T) {
+	// Unix socket paths are limited in length, so avoid the long t.TempDir path.
+	dir := must.Get(os.MkdirTemp("", "tscaddy"))
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "app.sock")
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	control := tscaddytest.NewControl(t)
+	peer := control.NewNode(t, "client")
+
+	runTestApp(t, newTestApp(t, control, map[string]Node{
+		"sock": {Exposes: []Expose{{Port: 8080, To: "unix/" + sock}}},
+	}))
+
+	node := startTestNode(t, "sock")
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if _, err := node.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := peer.Dial(ctx, "tcp", "sock:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "ping" {
+		t.Errorf("exposed echo = %q, want %q", got, "ping")
+	}
+
+	// Other listeners can't use the exposed port of the node.
+	na := must.Get(caddy.ParseNetworkAddress("tailscale/sock:8080"))
+	if _, err := na.Listen(caddy.ActiveContext(), 0, net.ListenConfig{}); !errors.Is(err, ErrPortConflict) {
+		t.Errorf("listening on exposed port: got error %v, want expose conflict", err)
+	}
+}
+
+func Test_ReadOnlyState(t *testing.T) {
+	control := tscaddytest.NewControl(t)
+	stateDir := t.TempDir()
+
+	run := func(readOnly bool) error {
+		app := &App{
+			ControlURL:    control.URL,
+			StateDir:      stateDir,
+			ReadOnlyState: readOnly,
+		}
+		must.Do(caddy.Run(&caddy.Config{
+			AppsRaw: caddy.ModuleMap{"tailscale": caddyconfig.JSON(app, nil)},
+		}))
+		defer caddy.Stop()
+
+		node, err := getNode(caddy.ActiveContext(), "baked")
+		if err != nil {
+			return err
+		}
+		defer nodes.Delete("baked")
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		_, err = node.Up(ctx)
+		return err
+	}
+
+	if err := run(true); err == nil {
+		t.Fatal("node with read-only state started without existing state")
+	}
+	if err := run(false); err != nil {
+		t.Fatalf("registering node: %v", err)
+	}
+	if err := run(true); err != nil {
+		t.Fatalf("starting node with read-only state: %v", err)
+	}
+
+	// Changing the node's identity is refused.
+	s, err := newReadOnlyStore(t.Logf, filepath.Join(stateDir, "baked"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.WriteState(ipn.MachineKeyStateKey, []byte("new key")); !errors.Is(err, errReadOnlyState) {
+		t.Errorf("WriteState() = %v, want %v", err, errReadOnlyState)
+	}
+}
+
+func Test_RunningNodes(t *testing.T) {
+	control := tscaddytest.NewControl(t)
+
+	ctx := runTestApp(t, newTestApp(t, control, nil))
+
+	startTestNode(t, "running-b")
+	startTestNode(t, "running-a")
+	stopped, err := getNode(ctx, "running-stopped")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nodes.Delete("running-stopped")
+
+	var got []string
+	for _, node := range runningNodes() {
+		got = append(got, node.name)
+	}
+	if want := []string{"running-a", "running-b"}; !slices.Equal(got, want) {
+		t.Errorf("runningNodes() = %v; want %v", got, want)
+	}
+
+	// Nodes must be started before they are destroyed.
+	must.Do(stopped.start())
+}
+
+// newTestApp returns an app config with nodes on the test control server,
+// which are ephemeral and keep their state in a temporary directory.
+func newTestApp(t *testing.T, control *tscaddytest.Control, configs map[string]Node) *App {
+	return &App{
+		ControlURL: control.URL,
+		Ephemeral:  true,
+		StateDir:   t.TempDir(),
+		Nodes:      configs,
+	}
+}
+
+// runTestApp runs a config with the app, and stops it when the test ends.
+func runTestApp(t *testing.T, app *App) caddy.Context {
+	t.Helper()
+	must.Do(caddy.Run(&caddy.Config{
+		AppsRaw: caddy.ModuleMap{"tailscale": caddyconfig.JSON(app, nil)},
+	}))
+	t.Cleanup(func() { caddy.Stop() })
+	return caddy.ActiveContext()
+}
+
+// startTestNode gets the named node of the running app and starts it.
+// The node is released when the test ends, before the app is stopped.
+func startTestNode(t *testing.T, name string) *tailscaleNode {
+	t.Helper()
+	node, err := getNode(caddy.ActiveContext(), name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { nodes.Delete(name) })
+	if err := node.start(); err != nil {
+		t.Fatal(err)
+	}
+	return node
+}
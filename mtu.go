@@ -0,0 +1,52 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// mtu.go contains configuration of the MTU used by Tailscale nodes.
+
+import (
+	"fmt"
+	"strconv"
+
+	"go.uber.org/zap"
+	"tailscale.com/net/tstun"
+)
+
+// envMTU is the environment knob read by the Tailscale client library for the TUN MTU.
+// Like the netcheck knobs, it is process-wide.
+const envMTU = "TS_DEBUG_MTU"
+
+// minMTU is the smallest MTU nodes can use, which is the minimum MTU of IPv6.
+const minMTU = 1280
+
+// maxMTU is the largest MTU supported by the Tailscale client library.
+const maxMTU = 65536
+
+// validateMTU checks the app's MTU option.
+func (t *App) validateMTU() error {
+	if t.MTU != 0 && (t.MTU < minMTU || t.MTU > maxMTU) {
+		return fmt.Errorf("invalid mtu %d: must be between %d and %d", t.MTU, minMTU, maxMTU)
+	}
+	return nil
+}
+
+// applyMTUKnob configures the MTU used by nodes from the app's MTU option, restoring the default if it isn't set.
+// The MTU is read when a node starts, so it only applies to nodes started afterwards.
+// Netstack also sizes the packet buffers of running nodes by it, so it isn't lowered while nodes are running.
+// It must be called with knobs locked.
+func (t *App) applyMTUKnob() {
+	before := tstun.DefaultTUNMTU()
+	if t.MTU != 0 {
+		setKnob(envMTU, strconv.Itoa(t.MTU))
+	} else {
+		resetKnob(envMTU)
+	}
+	if after := tstun.DefaultTUNMTU(); after < before && len(runningNodes()) > 0 {
+		setKnob(envMTU, strconv.Itoa(int(before)))
+		if t.logger != nil {
+			t.logger.Warn("mtu can't be lowered while nodes are running, keeping the current mtu until Caddy restarts",
+				zap.Uint32("mtu", uint32(before)), zap.Uint32("configured_mtu", uint32(after)))
+		}
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+import (
+	"os"
+	"testing"
+
+	"github.com/msfjarvis/caddy-tailscale/tscaddytest"
+	"go.uber.org/zap"
+	"tailscale.com/net/tstun"
+)
+
+func Test_ValidateMTU(t *testing.T) {
+	tests := map[int]bool{
+		0:     false,
+		1280:  false,
+		9000:  false,
+		65536: false,
+		1279:  true,
+		-1:    true,
+		65537: true,
+	}
+	for mtu, wantErr := range tests {
+		if err := (&App{MTU: mtu}).validateMTU(); (err != nil) != wantErr {
+			t.Errorf("validateMTU() for %d error = %v, wantErr %v", mtu, err, wantErr)
+		}
+	}
+}
+
+func Test_ApplyMTUKnob(t *testing.T) {
+	t.Setenv(envMTU, "")
+	os.Unsetenv(envMTU)
+
+	app := &App{MTU: 1500, logger: zap.NewNop()}
+	app.applyKnobs()
+	if got := tstun.DefaultTUNMTU(); got != 1500 {
+		t.Errorf("MTU = %d, want 1500", got)
+	}
+
+	// Without running nodes, removing the option restores the default MTU.
+	replacement := &App{logger: zap.NewNop()}
+	replacement.applyKnobs()
+	if got, ok := os.LookupEnv(envMTU); ok {
+		t.Errorf("%s = %q after removing the mtu option, want unset", envMTU, got)
+	}
+
+	control := tscaddytest.NewControl(t)
+	running := newTestApp(t, control, nil)
+	running.MTU = 1500
+	runTestApp(t, running)
+	startTestNode(t, "mtu")
+
+	// Running nodes size their buffers by the MTU, so it isn't lowered.
+	lower := &App{MTU: 1400, logger: zap.NewNop()}
+	lower.applyKnobs()
+	if got := tstun.DefaultTUNMTU(); got != 1500 {
+		t.Errorf("MTU after lowering it with running nodes = %d, want 1500", got)
+	}
+	higher := &App{MTU: 9000, logger: zap.NewNop()}
+	higher.applyKnobs()
+	if got := tstun.DefaultTUNMTU(); got != 9000 {
+		t.Errorf("MTU after raising it with running nodes = %d, want 9000", got)
+	}
+	higher.resetKnobs()
+}
@@ -0,0 +1,39 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// netcheck.go contains configuration of the background network probing done by Tailscale nodes.
+
+import (
+	"strconv"
+
+	"tailscale.com/types/opt"
+)
+
+// Environment knobs read by the Tailscale client library.
+// These are process-wide, so the corresponding options apply to all nodes.
+const (
+	envDisablePortMapper = "TS_DISABLE_PORTMAPPER"
+	envDisableUPnP       = "TS_DISABLE_UPNP"
+	envSTUNStopOnIdle    = "TS_DEBUG_RESTUN_STOP_ON_IDLE"
+)
+
+// applyNetcheckKnobs configures the Tailscale client library's network probing from app options.
+// Options that are not set restore the corresponding environment variable, if it was changed.
+// It must be called with knobs locked.
+func (t *App) applyNetcheckKnobs() {
+	setInvertedKnob(envDisablePortMapper, t.PortMapping)
+	setInvertedKnob(envDisableUPnP, t.UPnP)
+	setInvertedKnob(envSTUNStopOnIdle, t.STUNWhenIdle)
+}
+
+// setInvertedKnob sets the boolean environment knob env to the inverse of v, or resets it if v is not set.
+func setInvertedKnob(env string, v opt.Bool) {
+	b, ok := v.Get()
+	if !ok {
+		resetKnob(env)
+		return
+	}
+	setKnob(env, strconv.FormatBool(!b))
+}
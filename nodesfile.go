@@ -0,0 +1,164 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// nodesfile.go contains support for loading node configs from a JSON file outside the main config,
+// so that fleets can manage their node inventory separately, and for reloading the config when the file changes.
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"go.uber.org/zap"
+)
+
+// nodesFilePollInterval is how often the nodes file is checked for changes.
+var nodesFilePollInterval = 10 * time.Second
+
+// readNodesFile returns the node configs in the nodes file at path, and the hash of its contents.
+// The file contains a JSON object of node configs by name, like the nodes of the app's JSON config.
+func readNodesFile(path string) (map[string]Node, [sha256.Size]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, [sha256.Size]byte{}, fmt.Errorf("reading nodes file: %w", err)
+	}
+	hash := sha256.Sum256(data)
+	var nodes map[string]Node
+	if err := caddy.StrictUnmarshalJSON(data, &nodes); err != nil {
+		return nil, hash, fmt.Errorf("nodes file %s: %w", path, err)
+	}
+	return nodes, hash, nil
+}
+
+// loadNodesFile merges the node configs in the app's nodes file into its Nodes.
+// Nodes configured in the app take precedence over nodes of the same name in the file.
+func (t *App) loadNodesFile() error {
+	if t.NodesFile == "" {
+		return nil
+	}
+	fileNodes, hash, err := readNodesFile(t.NodesFile)
+	if err != nil {
+		return err
+	}
+	t.nodesFileHash = hash
+	if t.Nodes == nil {
+		t.Nodes = make(map[string]Node)
+	}
+	for name, node := range fileNodes {
+		if _, ok := t.Nodes[name]; ok {
+			t.logger.Warn("node in nodes file is also configured in the app, using the app's config",
+				zap.String("node", name), zap.String("nodes_file", t.NodesFile))
+			continue
+		}
+		t.Nodes[name] = node
+	}
+	return nil
+}
+
+// watchNodesFile reloads the config when the app's nodes file changes, so that its node configs are loaded again.
+// Changes that make the file invalid are logged, and the current config is kept.
+// If the admin API doesn't serve this config, the error is logged and the file isn't watched.
+func (t *App) watchNodesFile() {
+	if t.NodesFile == "" {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.stopNodesFileWatch = cancel
+	logger := t.logger.With(zap.String("nodes_file", t.NodesFile))
+
+	go func() {
+		// The admin API serves the config once it has started, so this waits until it has.
+		if _, err := readAdminConfig(t.NodesFile); err != nil {
+			if ctx.Err() == nil {
+				logger.Error("nodes file changes can't be reloaded", zap.Error(err))
+			}
+			return
+		}
+
+		ticker := time.NewTicker(nodesFilePollInterval)
+		defer ticker.Stop()
+		lastHash, invalidHash := t.nodesFileHash, t.nodesFileHash
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			_, hash, err := readNodesFile(t.NodesFile)
+			if hash == lastHash || hash == invalidHash {
+				continue
+			}
+			if err != nil {
+				// Invalid contents are only logged once.
+				invalidHash = hash
+				logger.Error("invalid nodes file, keeping current nodes", zap.Error(err))
+				continue
+			}
+			logger.Info("nodes file changed, reloading config")
+			cfg, err := readAdminConfig(t.NodesFile)
+			if err == nil {
+				err = reloadConfig(cfg)
+			}
+			if err != nil {
+				// The reload is tried again on the next check.
+				logger.Error("reloading config for changed nodes file", zap.Error(err))
+				continue
+			}
+			lastHash = hash
+			return
+		}
+	}()
+}
+
+// readAdminConfig returns Caddy's current config from the admin API, which must listen on its default address,
+// or the one set by the CADDY_ADMIN environment variable. It returns an error if the config doesn't
+// have a tailscale app with the nodes file, such as when another Caddy instance listens on the address.
+var readAdminConfig = func(nodesFile string) ([]byte, error) {
+	addr := caddy.DefaultAdminListen
+	resp, err := caddycmd.AdminAPIRequest(addr, http.MethodGet, "/config/", nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("admin API at %s: %w", addr, err)
+	}
+	cfg, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("admin API at %s: %w", addr, err)
+	}
+
+	var active struct {
+		Apps struct {
+			Tailscale struct {
+				NodesFile string `json:"nodes_file"`
+			} `json:"tailscale"`
+		} `json:"apps"`
+	}
+	if err := json.Unmarshal(cfg, &active); err != nil {
+		return nil, fmt.Errorf("admin API at %s: %w", addr, err)
+	}
+	if got := active.Apps.Tailscale.NodesFile; got != nodesFile {
+		return nil, fmt.Errorf("admin API at %s serves a config with nodes_file %q, not %q; "+
+			"set CADDY_ADMIN to the admin address of this config", addr, got, nodesFile)
+	}
+	return cfg, nil
+}
+
+// reloadConfig loads cfg through the admin API at its default address, like "caddy reload --force",
+// so that its apps are provisioned again.
+var reloadConfig = func(cfg []byte) error {
+	headers := http.Header{"Cache-Control": []string{"must-revalidate"}}
+	resp, err := caddycmd.AdminAPIRequest(caddy.DefaultAdminListen, http.MethodPost, "/load", headers, bytes.NewReader(cfg))
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
@@ -0,0 +1,146 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/google/go-cmp/cmp"
+	"go.uber.org/zap"
+)
+
+func Test_LoadNodesFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		nodes   map[string]Node
+		want    map[string]Node
+		wantErr bool
+	}{
+		{
+			name: "merged",
+			file: `{"web":{"hostname":"web-1","tags":["tag:web"]},"db":{"ephemeral":false}}`,
+			nodes: map[string]Node{
+				"admin": {Hostname: "admin"},
+			},
+			want: map[string]Node{
+				"admin": {Hostname: "admin"},
+				"web":   {Hostname: "web-1", Tags: []string{"tag:web"}},
+				"db":    {Ephemeral: "false"},
+			},
+		},
+		{
+			name: "app takes precedence",
+			file: `{"web":{"hostname":"from-file"}}`,
+			nodes: map[string]Node{
+				"web": {Hostname: "from-app"},
+			},
+			want: map[string]Node{
+				"web": {Hostname: "from-app"},
+			},
+		},
+		{
+			name:    "unknown field",
+			file:    `{"web":{"hostnme":"web-1"}}`,
+			wantErr: true,
+		},
+		{
+			name:    "missing",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "nodes.json")
+			if tt.file != "" {
+				if err := os.WriteFile(path, []byte(tt.file), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			app := &App{NodesFile: path, Nodes: tt.nodes, logger: zap.NewNop()}
+			err := app.loadNodesFile()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadNodesFile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if diff := cmp.Diff(tt.want, app.Nodes, cmp.AllowUnexported(Node{})); diff != "" {
+				t.Errorf("loadNodesFile() nodes mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func Test_WatchNodesFile(t *testing.T) {
+	defer func(interval time.Duration, read func(string) ([]byte, error), reload func([]byte) error) {
+		nodesFilePollInterval, readAdminConfig, reloadConfig = interval, read, reload
+	}(nodesFilePollInterval, readAdminConfig, reloadConfig)
+	nodesFilePollInterval = 10 * time.Millisecond
+	readAdminConfig = func(string) ([]byte, error) { return []byte(`{}`), nil }
+	reloads := make(chan struct{}, 1)
+	failReload := true
+	reloadConfig = func([]byte) error {
+		// The first reload fails, and is tried again.
+		if failReload {
+			failReload = false
+			return errors.New("admin API unavailable")
+		}
+		reloads <- struct{}{}
+		return nil
+	}
+
+	path := filepath.Join(t.TempDir(), "nodes.json")
+	if err := os.WriteFile(path, []byte(`{"web":{}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	app := &App{NodesFile: path, logger: zap.NewNop()}
+	if err := app.loadNodesFile(); err != nil {
+		t.Fatal(err)
+	}
+	app.watchNodesFile()
+	defer app.stopNodesFileWatch()
+
+	// Invalid changes don't reload the config.
+	if err := os.WriteFile(path, []byte(`{"web":`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-reloads:
+		t.Fatal("config reloaded for invalid nodes file")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if err := os.WriteFile(path, []byte(`{"web":{},"db":{}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-reloads:
+	case <-time.After(5 * time.Second):
+		t.Fatal("config not reloaded for changed nodes file")
+	}
+}
+
+func Test_ReadAdminConfig(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"apps":{"tailscale":{"nodes_file":"/etc/caddy/nodes.json"}}}`))
+	}))
+	defer srv.Close()
+	defer func(addr string) { caddy.DefaultAdminListen = addr }(caddy.DefaultAdminListen)
+	caddy.DefaultAdminListen = srv.Listener.Addr().String()
+
+	if _, err := readAdminConfig("/etc/caddy/nodes.json"); err != nil {
+		t.Errorf("readAdminConfig() for this config error = %v", err)
+	}
+	if _, err := readAdminConfig("/srv/nodes.json"); err == nil {
+		t.Error("readAdminConfig() for another config succeeded, want error")
+	}
+}
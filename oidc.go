@@ -0,0 +1,485 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build !ts_omit_oidc
+
+package tscaddy
+
+// oidc.go contains the OIDC handler, which authenticates tailnet users with Tailscale
+// and other visitors, such as those arriving over Funnel, with an OpenID Connect provider.
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/caddyauth"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+func init() {
+	caddy.RegisterModule(OIDC{})
+	httpcaddyfile.RegisterHandlerDirective("tailscale_oidc", parseOIDC)
+	httpcaddyfile.RegisterDirectiveOrder("tailscale_oidc", httpcaddyfile.After, "basicauth")
+}
+
+// Defaults for the OIDC handler.
+const (
+	defaultOIDCCallbackPath    = "/.tailscale/oidc/callback"
+	defaultOIDCSessionLifetime = 24 * time.Hour
+
+	oidcSessionCookie = "caddy_tailscale_oidc"
+	oidcStateCookie   = "caddy_tailscale_oidc_state"
+	oidcStateLifetime = 10 * time.Minute
+)
+
+// oidcKey is the key used to sign OIDC cookies if no secret is configured.
+// It is generated once per process, so that sessions survive config reloads.
+var oidcKey = sync.OnceValue(func() []byte {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return key
+})
+
+// OIDC is a Caddy HTTP handler that authenticates users of sites exposed both on the tailnet and publicly.
+// Requests from the tailnet are authenticated with the caller's Tailscale identity, like the Auth provider.
+// Other requests, such as those received over Funnel, are authenticated with an OpenID Connect login flow.
+//
+// On success, the same placeholders as the Caddy authentication handler are set:
+// {http.auth.user.id} and {http.auth.user.*} for each metadata field.
+// Users authenticated with OIDC have the id set to their email address (or subject, if no email is provided),
+// and the oidc_subject, oidc_email and oidc_name metadata fields.
+// The auth_source metadata field is set to "tailscale" or "oidc".
+type OIDC struct {
+	// Issuer is the URL of the OpenID Connect provider, used for discovery.
+	Issuer string `json:"issuer,omitempty"`
+
+	// ClientID is the OAuth client ID registered with the provider.
+	ClientID string `json:"client_id,omitempty"`
+
+	// ClientSecret is the OAuth client secret registered with the provider. Placeholders are supported.
+	ClientSecret string `json:"client_secret,omitempty"`
+
+	// Scopes are the scopes requested from the provider.
+	// Default: openid email profile
+	Scopes []string `json:"scopes,omitempty"`
+
+	// CallbackPath is the path the provider redirects to after login,
+	// which must be registered as a redirect URL with the provider.
+	// Default: /.tailscale/oidc/callback
+	CallbackPath string `json:"callback_path,omitempty"`
+
+	// Secret is the key used to sign session cookies. Placeholders are supported.
+	// If empty, a random key is generated, and users must log in again when Caddy restarts.
+	Secret string `json:"secret,omitempty"`
+
+	// SessionLifetime is how long OIDC logins last.
+	// Default: 24h
+	SessionLifetime caddy.Duration `json:"session_lifetime,omitempty"`
+
+	// ResolverRaw configures how the Tailscale identity of tailnet callers is resolved.
+	// If unset, the node that received the request is queried with WhoIs.
+	ResolverRaw json.RawMessage `json:"resolver,omitempty" caddy:"namespace=tailscale.identity inline_key=source"`
+
+	tailnet      Auth
+	clientSecret string
+	key          []byte
+
+	mu       *sync.Mutex
+	provider *oidc.Provider
+}
+
+func (OIDC) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.tailscale_oidc",
+		New: func() caddy.Module { return new(OIDC) },
+	}
+}
+
+// Provision implements caddy.Provisioner.
+func (o *OIDC) Provision(ctx caddy.Context) error {
+	if o.Issuer == "" || o.ClientID == "" {
+		return errors.New("issuer and client_id are required")
+	}
+	if len(o.Scopes) == 0 {
+		o.Scopes = []string{oidc.ScopeOpenID, "email", "profile"}
+	}
+	if o.CallbackPath == "" {
+		o.CallbackPath = defaultOIDCCallbackPath
+	}
+	if o.SessionLifetime == 0 {
+		o.SessionLifetime = caddy.Duration(defaultOIDCSessionLifetime)
+	}
+
+	var err error
+	if o.clientSecret, err = repl.ReplaceOrErr(o.ClientSecret, true, true); err != nil {
+		return err
+	}
+	if o.Secret != "" {
+		secret, err := repl.ReplaceOrErr(o.Secret, true, true)
+		if err != nil {
+			return err
+		}
+		o.key = []byte(secret)
+	} else {
+		o.key = oidcKey()
+	}
+
+	o.mu = new(sync.Mutex)
+	o.tailnet.ResolverRaw = o.ResolverRaw
+	return o.tailnet.Provision(ctx)
+}
+
+// getProvider returns the OIDC provider, discovering its configuration on first use
+// so that an unavailable provider doesn't prevent Caddy from loading its config.
+func (o *OIDC) getProvider() (*oidc.Provider, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.provider == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		p, err := oidc.NewProvider(ctx, o.Issuer)
+		if err != nil {
+			return nil, fmt.Errorf("discovering OIDC provider: %w", err)
+		}
+		o.provider = p
+	}
+	return o.provider, nil
+}
+
+// oauth2Config returns the OAuth configuration for requests to r's host.
+func (o *OIDC) oauth2Config(p *oidc.Provider, r *http.Request) *oauth2.Config {
+	scheme := "https"
+	if r.TLS == nil && !isFunnelRequest(r) {
+		scheme = "http"
+	}
+	return &oauth2.Config{
+		ClientID:     o.ClientID,
+		ClientSecret: o.clientSecret,
+		Endpoint:     p.Endpoint(),
+		RedirectURL:  (&url.URL{Scheme: scheme, Host: r.Host, Path: o.CallbackPath}).String(),
+		Scopes:       o.Scopes,
+	}
+}
+
+// ServeHTTP implements caddyhttp.MiddlewareHandler.
+func (o *OIDC) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	if !isFunnelRequest(r) {
+		if user, ok, _ := o.tailnet.Authenticate(w, r); ok {
+			user.Metadata["auth_source"] = "tailscale"
+			setUser(r, user)
+			return next.ServeHTTP(w, r)
+		}
+	}
+
+	if r.URL.Path == o.CallbackPath {
+		return o.handleCallback(w, r)
+	}
+
+	var session oidcSession
+	if c, err := r.Cookie(oidcSessionCookie); err == nil && o.readCookie(c.Value, &session) && time.Now().Before(session.Expiry) {
+		setUser(r, session.user())
+		return next.ServeHTTP(w, r)
+	}
+
+	return o.login(w, r)
+}
+
+// setUser sets placeholders for an authenticated user, as the Caddy authentication handler does.
+func setUser(r *http.Request, user caddyauth.User) {
+	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	repl.Set("http.auth.user.id", user.ID)
+	for k, v := range user.Metadata {
+		repl.Set("http.auth.user."+k, v)
+	}
+}
+
+// oidcSession is the content of the session cookie of a user authenticated with OIDC.
+type oidcSession struct {
+	Subject string    `json:"sub"`
+	Email   string    `json:"email,omitempty"`
+	Name    string    `json:"name,omitempty"`
+	Expiry  time.Time `json:"exp"`
+}
+
+func (s oidcSession) user() caddyauth.User {
+	id := s.Email
+	if id == "" {
+		id = s.Subject
+	}
+	return caddyauth.User{
+		ID: id,
+		Metadata: map[string]string{
+			"auth_source":  "oidc",
+			"oidc_subject": s.Subject,
+			"oidc_email":   s.Email,
+			"oidc_name":    s.Name,
+		},
+	}
+}
+
+// oidcState is the content of the cookie tracking an in-progress login.
+type oidcState struct {
+	State    string    `json:"state"`
+	Nonce    string    `json:"nonce"`
+	Redirect string    `json:"redirect"`
+	Expiry   time.Time `json:"exp"`
+}
+
+// login redirects the user to the provider to log in.
+func (o *OIDC) login(w http.ResponseWriter, r *http.Request) error {
+	// Only redirect requests that can be followed by a browser.
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return caddyhttp.Error(http.StatusUnauthorized, errors.New("not authenticated"))
+	}
+
+	p, err := o.getProvider()
+	if err != nil {
+		return caddyhttp.Error(http.StatusBadGateway, err)
+	}
+
+	state := oidcState{
+		State:    rand.Text(),
+		Nonce:    rand.Text(),
+		Redirect: r.URL.RequestURI(),
+		Expiry:   time.Now().Add(oidcStateLifetime),
+	}
+	if err := o.setCookie(w, oidcStateCookie, state, oidcStateLifetime); err != nil {
+		return err
+	}
+
+	http.Redirect(w, r, o.oauth2Config(p, r).AuthCodeURL(state.State, oidc.Nonce(state.Nonce)), http.StatusFound)
+	return nil
+}
+
+// handleCallback completes a login, setting the session cookie and redirecting to the originally requested page.
+func (o *OIDC) handleCallback(w http.ResponseWriter, r *http.Request) error {
+	var state oidcState
+	c, err := r.Cookie(oidcStateCookie)
+	if err != nil || !o.readCookie(c.Value, &state) || time.Now().After(state.Expiry) {
+		return caddyhttp.Error(http.StatusBadRequest, errors.New("missing or expired login state"))
+	}
+	if !hmac.Equal([]byte(r.URL.Query().Get("state")), []byte(state.State)) {
+		return caddyhttp.Error(http.StatusBadRequest, errors.New("login state mismatch"))
+	}
+	if e := r.URL.Query().Get("error"); e != "" {
+		return caddyhttp.Error(http.StatusUnauthorized, fmt.Errorf("login failed: %s", e))
+	}
+
+	p, err := o.getProvider()
+	if err != nil {
+		return caddyhttp.Error(http.StatusBadGateway, err)
+	}
+	token, err := o.oauth2Config(p, r).Exchange(r.Context(), r.URL.Query().Get("code"))
+	if err != nil {
+		return caddyhttp.Error(http.StatusUnauthorized, fmt.Errorf("exchanging code: %w", err))
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return caddyhttp.Error(http.StatusUnauthorized, errors.New("no id_token in token response"))
+	}
+	idToken, err := p.Verifier(&oidc.Config{ClientID: o.ClientID}).Verify(r.Context(), rawIDToken)
+	if err != nil {
+		return caddyhttp.Error(http.StatusUnauthorized, fmt.Errorf("verifying id_token: %w", err))
+	}
+	if !hmac.Equal([]byte(idToken.Nonce), []byte(state.Nonce)) {
+		return caddyhttp.Error(http.StatusUnauthorized, errors.New("id_token nonce mismatch"))
+	}
+
+	var claims struct {
+		Email string `json:"email"`
+		Name  string `json:"name"`
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		return caddyhttp.Error(http.StatusUnauthorized, err)
+	}
+
+	lifetime := time.Duration(o.SessionLifetime)
+	session := oidcSession{
+		Subject: idToken.Subject,
+		Email:   claims.Email,
+		Name:    claims.Name,
+		Expiry:  time.Now().Add(lifetime),
+	}
+	if err := o.setCookie(w, oidcSessionCookie, session, lifetime); err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: "/", MaxAge: -1})
+
+	redirect := state.Redirect
+	if !strings.HasPrefix(redirect, "/") || strings.HasPrefix(redirect, "//") {
+		redirect = "/"
+	}
+	http.Redirect(w, r, redirect, http.StatusFound)
+	return nil
+}
+
+// setCookie sets a signed cookie containing the JSON encoding of v.
+func (o *OIDC) setCookie(w http.ResponseWriter, name string, v any, lifetime time.Duration) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    payload + "." + base64.RawURLEncoding.EncodeToString(o.mac(name, payload)),
+		Path:     "/",
+		MaxAge:   int(lifetime.Seconds()),
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// readCookie verifies a signed cookie value and decodes it into v.
+func (o *OIDC) readCookie(value string, v any) bool {
+	payload, sig, ok := strings.Cut(value, ".")
+	if !ok {
+		return false
+	}
+	got, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return false
+	}
+	// The cookie name is covered by the MAC, so that state cookies can't be used as sessions.
+	name := oidcSessionCookie
+	if _, isState := v.(*oidcState); isState {
+		name = oidcStateCookie
+	}
+	if !hmac.Equal(got, o.mac(name, payload)) {
+		return false
+	}
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return false
+	}
+	return json.Unmarshal(b, v) == nil
+}
+
+// mac signs a cookie payload. The issuer and client ID are covered too, so that handlers
+// sharing a key (such as the random default key) don't accept each other's sessions.
+func (o *OIDC) mac(name, payload string) []byte {
+	h := hmac.New(sha256.New, o.key)
+	for _, s := range []string{o.Issuer, o.ClientID, name} {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	h.Write([]byte(payload))
+	return h.Sum(nil)
+}
+
+// UnmarshalCaddyfile sets up the handler from Caddyfile tokens. Syntax:
+//
+//	tailscale_oidc {
+//	  issuer <url>
+//	  client_id <id>
+//	  client_secret <secret>
+//	  scopes <scopes...>
+//	  callback_path <path>
+//	  secret <secret>
+//	  session_lifetime <duration>
+//	  resolver <source> [<args...>]
+//	}
+func (o *OIDC) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume directive name
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "issuer":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			o.Issuer = d.Val()
+
+		case "client_id":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			o.ClientID = d.Val()
+
+		case "client_secret":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			o.ClientSecret = d.Val()
+
+		case "scopes":
+			o.Scopes = append(o.Scopes, d.RemainingArgs()...)
+			if len(o.Scopes) == 0 {
+				return d.ArgErr()
+			}
+
+		case "callback_path":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			o.CallbackPath = d.Val()
+
+		case "secret":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			o.Secret = d.Val()
+
+		case "session_lifetime":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			v, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.WrapErr(err)
+			}
+			o.SessionLifetime = caddy.Duration(v)
+
+		case "resolver":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			source := d.Val()
+			unm, err := caddyfile.UnmarshalModule(d, "tailscale.identity."+source)
+			if err != nil {
+				return err
+			}
+			o.ResolverRaw = caddyconfig.JSONModuleObject(unm, "source", source, nil)
+
+		default:
+			return d.Errf("unrecognized subdirective: %s", d.Val())
+		}
+	}
+	return nil
+}
+
+// parseOIDC parses the tailscale_oidc directive.
+func parseOIDC(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	o := new(OIDC)
+	err := o.UnmarshalCaddyfile(h.Dispenser)
+	return o, err
+}
+
+var (
+	_ caddy.Provisioner           = (*OIDC)(nil)
+	_ caddyhttp.MiddlewareHandler = (*OIDC)(nil)
+	_ caddyfile.Unmarshaler       = (*OIDC)(nil)
+)
@@ -0,0 +1,225 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build !ts_omit_oidc
+
+package tscaddy
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/go-jose/go-jose/v4"
+)
+
+// newTestIdP starts a fake OpenID Connect provider that issues ID tokens for a single user.
+func newTestIdP(t *testing.T) *httptest.Server {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: jose.JSONWebKey{Key: key, KeyID: "test"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	nonces := make(map[string]string) // code -> nonce
+
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                                srv.URL,
+			"authorization_endpoint":                srv.URL + "/authorize",
+			"token_endpoint":                        srv.URL + "/token",
+			"jwks_uri":                              srv.URL + "/keys",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: &key.PublicKey, KeyID: "test", Algorithm: "RS256", Use: "sig"}}})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		code := rand.Text()
+		mu.Lock()
+		nonces[code] = q.Get("nonce")
+		mu.Unlock()
+		u, _ := url.Parse(q.Get("redirect_uri"))
+		u.RawQuery = url.Values{"code": {code}, "state": {q.Get("state")}}.Encode()
+		http.Redirect(w, r, u.String(), http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		nonce, ok := nonces[r.FormValue("code")]
+		mu.Unlock()
+		if !ok {
+			http.Error(w, "invalid code", http.StatusBadRequest)
+			return
+		}
+		claims, _ := json.Marshal(map[string]any{
+			"iss":   srv.URL,
+			"aud":   "client",
+			"sub":   "1234",
+			"email": "bob@example.com",
+			"name":  "Bob",
+			"nonce": nonce,
+			"iat":   time.Now().Unix(),
+			"exp":   time.Now().Add(time.Hour).Unix(),
+		})
+		jws, err := signer.Sign(claims)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		idToken, _ := jws.CompactSerialize()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"id_token":     idToken,
+		})
+	})
+	return srv
+}
+
+func Test_OIDC(t *testing.T) {
+	idp := newTestIdP(t)
+	o := &OIDC{
+		Issuer:          idp.URL,
+		ClientID:        "client",
+		Scopes:          []string{"openid", "email"},
+		CallbackPath:    defaultOIDCCallbackPath,
+		SessionLifetime: caddy.Duration(time.Hour),
+		key:             []byte("secret"),
+		mu:              new(sync.Mutex),
+		tailnet: Auth{
+			resolver: StaticResolver{
+				Identities: map[string]StaticIdentity{
+					"100.64.0.1": {Login: "alice@example.com", Node: "laptop.tail1234.ts.net."},
+				},
+			},
+		},
+	}
+
+	// serve makes a request to target from remoteAddr with cookies,
+	// returning the response and the user ID seen by the upstream handler.
+	serve := func(remoteAddr, target string, cookies []*http.Cookie) (*http.Response, string, error) {
+		r := httptest.NewRequest("GET", target, nil)
+		r.RemoteAddr = remoteAddr + ":1234"
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		repl := caddy.NewReplacer()
+		r = r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, repl))
+
+		var user string
+		next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			user = repl.ReplaceAll("{http.auth.user.id} {http.auth.user.auth_source}", "")
+			return nil
+		})
+		rec := httptest.NewRecorder()
+		err := o.ServeHTTP(rec, r, next)
+		return rec.Result(), user, err
+	}
+
+	// Tailnet users are authenticated without logging in.
+	if _, user, err := serve("100.64.0.1", "https://example.com/", nil); err != nil || user != "alice@example.com tailscale" {
+		t.Fatalf("tailnet user = %q, %v; want alice@example.com tailscale", user, err)
+	}
+
+	// Other users are redirected to the provider, then back to the callback.
+	resp, user, err := serve("203.0.113.1", "https://example.com/page?q=1", nil)
+	if err != nil || user != "" || resp.StatusCode != http.StatusFound {
+		t.Fatalf("unauthenticated request = %d, %q, %v; want redirect", resp.StatusCode, user, err)
+	}
+	if loc := resp.Header.Get("Location"); !strings.HasPrefix(loc, idp.URL+"/authorize?") {
+		t.Fatalf("login redirect = %q; want provider", loc)
+	}
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	authResp, err := client.Get(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	callback := authResp.Header.Get("Location")
+	if !strings.HasPrefix(callback, "https://example.com"+defaultOIDCCallbackPath+"?") {
+		t.Fatalf("provider redirect = %q; want callback", callback)
+	}
+
+	// The callback fails without the state cookie.
+	if _, _, err := serve("203.0.113.1", callback, nil); err == nil {
+		t.Error("callback without state cookie succeeded")
+	}
+
+	resp, _, err = serve("203.0.113.1", callback, resp.Cookies())
+	if err != nil {
+		t.Fatalf("callback: %v", err)
+	}
+	if loc := resp.Header.Get("Location"); loc != "/page?q=1" {
+		t.Errorf("callback redirect = %q; want /page?q=1", loc)
+	}
+	var session *http.Cookie
+	for _, c := range resp.Cookies() {
+		if c.Name == oidcSessionCookie {
+			session = c
+		}
+	}
+	if session == nil {
+		t.Fatal("callback did not set session cookie")
+	}
+
+	if _, user, err := serve("203.0.113.1", "https://example.com/page", []*http.Cookie{session}); err != nil || user != "bob@example.com oidc" {
+		t.Errorf("OIDC user = %q, %v; want bob@example.com oidc", user, err)
+	}
+
+	// Tampered sessions are ignored.
+	tampered := *session
+	tampered.Value = "x" + tampered.Value
+	if resp, user, _ := serve("203.0.113.1", "https://example.com/page", []*http.Cookie{&tampered}); user != "" || resp.StatusCode != http.StatusFound {
+		t.Errorf("tampered session = %d, %q; want redirect", resp.StatusCode, user)
+	}
+}
+
+func Test_OIDCCookieHandler(t *testing.T) {
+	key := []byte("shared")
+	a := &OIDC{Issuer: "https://a.example.com", ClientID: "client", key: key}
+	tests := []struct {
+		name string
+		o    *OIDC
+		want bool
+	}{
+		{"same handler", &OIDC{Issuer: "https://a.example.com", ClientID: "client", key: key}, true},
+		{"other issuer", &OIDC{Issuer: "https://b.example.com", ClientID: "client", key: key}, false},
+		{"other client", &OIDC{Issuer: "https://a.example.com", ClientID: "other", key: key}, false},
+	}
+
+	rec := httptest.NewRecorder()
+	session := oidcSession{Subject: "1234", Expiry: time.Now().Add(time.Hour)}
+	if err := a.setCookie(rec, oidcSessionCookie, session, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	cookie := rec.Result().Cookies()[0]
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got oidcSession
+			if ok := tt.o.readCookie(cookie.Value, &got); ok != tt.want {
+				t.Errorf("readCookie = %v; want %v", ok, tt.want)
+			}
+		})
+	}
+}
@@ -6,9 +6,13 @@ package tscaddy
 // parse.go contains shared parsing functions for Tailscale configuration
 
 import (
+	"net/http"
 	"strconv"
+	"strings"
 
+	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/dustin/go-humanize"
 	"tailscale.com/types/opt"
 )
 
@@ -22,6 +26,11 @@ func parseNodeOptionsFromDispenser(d *caddyfile.Dispenser, node *Node) error {
 			}
 			node.AuthKey = d.Val()
 
+		case "auth_key_file":
+			if !d.AllArgs(&node.AuthKeyFile) {
+				return d.ArgErr()
+			}
+
 		case "control_url":
 			if !d.NextArg() {
 				return d.ArgErr()
@@ -39,6 +48,13 @@ func parseNodeOptionsFromDispenser(d *caddyfile.Dispenser, node *Node) error {
 				node.Ephemeral = opt.NewBool(true)
 			}
 
+		case "unique_suffix":
+			if d.NextArg() {
+				node.UniqueSuffix = d.Val()
+			} else {
+				node.UniqueSuffix = uniqueSuffixRandom
+			}
+
 		case "hostname":
 			if !d.NextArg() {
 				return d.ArgErr()
@@ -61,6 +77,34 @@ func parseNodeOptionsFromDispenser(d *caddyfile.Dispenser, node *Node) error {
 			}
 			node.StateDir = d.Val()
 
+		case "read_only_state":
+			if d.NextArg() {
+				v, err := strconv.ParseBool(d.Val())
+				if err != nil {
+					return d.WrapErr(err)
+				}
+				node.ReadOnlyState = opt.NewBool(v)
+			} else {
+				node.ReadOnlyState = opt.NewBool(true)
+			}
+
+		case "proxy":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			node.Proxy = d.Val()
+
+		case "start":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			switch d.Val() {
+			case startEager, startLazy:
+				node.Start = d.Val()
+			default:
+				return d.Errf("start must be %q or %q, got %q", startEager, startLazy, d.Val())
+			}
+
 		case "webui":
 			if d.NextArg() {
 				v, err := strconv.ParseBool(d.Val())
@@ -72,92 +116,289 @@ func parseNodeOptionsFromDispenser(d *caddyfile.Dispenser, node *Node) error {
 				node.WebUI = opt.NewBool(true)
 			}
 
-		case "tags":
-			for d.NextArg() {
-				node.Tags = append(node.Tags, d.Val())
+		case "webui_allow":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
 			}
+			node.WebUIAllow = append(node.WebUIAllow, args...)
 
-		default:
-			return d.Errf("unrecognized subdirective: %s", d.Val())
-		}
-	}
-	return nil
-}
+		case "peerapi":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			v, err := strconv.ParseBool(d.Val())
+			if err != nil {
+				return d.WrapErr(err)
+			}
+			node.PeerAPI = opt.NewBool(v)
 
-// parseNodeOptionsFromHelper parses common node configuration options from an httpcaddyfile.Helper.
-func parseNodeOptionsFromHelper(h interface {
-	NextBlock(int) bool
-	Val() string
-	NextArg() bool
-	ArgErr() error
-	WrapErr(error) error
-	Errf(string, ...interface{}) error
-}, node *Node) error {
-	for h.NextBlock(0) {
-		switch h.Val() {
-		case "auth_key":
-			if !h.NextArg() {
-				return h.ArgErr()
+		case "peerapi_allow":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
 			}
-			node.AuthKey = h.Val()
+			node.PeerAPIAllow = append(node.PeerAPIAllow, args...)
 
-		case "control_url":
-			if !h.NextArg() {
-				return h.ArgErr()
+		case "accept_dns":
+			if d.NextArg() {
+				v, err := strconv.ParseBool(d.Val())
+				if err != nil {
+					return d.WrapErr(err)
+				}
+				node.AcceptDNS = opt.NewBool(v)
+			} else {
+				node.AcceptDNS = opt.NewBool(true)
 			}
-			node.ControlURL = h.Val()
 
-		case "ephemeral":
-			if h.NextArg() {
-				v, err := strconv.ParseBool(h.Val())
+		case "advertise_routes":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			node.AdvertiseRoutes = append(node.AdvertiseRoutes, args...)
+
+		case "advertise_services":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			node.AdvertiseServices = append(node.AdvertiseServices, args...)
+
+		case "advertise_exit_node":
+			if d.NextArg() {
+				v, err := strconv.ParseBool(d.Val())
 				if err != nil {
-					return h.WrapErr(err)
+					return d.WrapErr(err)
 				}
-				node.Ephemeral = opt.NewBool(v)
+				node.AdvertiseExitNode = v
 			} else {
-				node.Ephemeral = opt.NewBool(true)
+				node.AdvertiseExitNode = true
 			}
 
-		case "hostname":
-			if !h.NextArg() {
-				return h.ArgErr()
+		case "approve_routes":
+			if d.NextArg() {
+				v, err := strconv.ParseBool(d.Val())
+				if err != nil {
+					return d.WrapErr(err)
+				}
+				node.ApproveRoutes = v
+			} else {
+				node.ApproveRoutes = true
 			}
-			node.Hostname = h.Val()
 
-		case "port":
-			if !h.NextArg() {
-				return h.ArgErr()
+		case "funnel":
+			if d.NextArg() {
+				v, err := strconv.ParseBool(d.Val())
+				if err != nil {
+					return d.WrapErr(err)
+				}
+				node.Funnel = v
+			} else {
+				node.Funnel = true
 			}
-			v, err := strconv.ParseUint(h.Val(), 10, 16)
-			if err != nil {
-				return h.WrapErr(err)
+
+		case "exit_node":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			node.ExitNode = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
 			}
-			node.Port = uint16(v)
 
-		case "state_dir":
-			if !h.NextArg() {
-				return h.ArgErr()
+		case "tailnet_only":
+			if d.NextArg() {
+				v, err := strconv.ParseBool(d.Val())
+				if err != nil {
+					return d.WrapErr(err)
+				}
+				node.TailnetOnly = v
+			} else {
+				node.TailnetOnly = true
 			}
-			node.StateDir = h.Val()
 
-		case "webui":
-			if h.NextArg() {
-				v, err := strconv.ParseBool(h.Val())
+		case "preauthorized":
+			if d.NextArg() {
+				v, err := strconv.ParseBool(d.Val())
 				if err != nil {
-					return h.WrapErr(err)
+					return d.WrapErr(err)
 				}
-				node.WebUI = opt.NewBool(v)
+				node.Preauthorized = opt.NewBool(v)
 			} else {
-				node.WebUI = opt.NewBool(true)
+				node.Preauthorized = opt.NewBool(true)
+			}
+
+		case "key_expiry":
+			if d.NextArg() {
+				v, err := strconv.ParseBool(d.Val())
+				if err != nil {
+					return d.WrapErr(err)
+				}
+				node.KeyExpiry = opt.NewBool(v)
+			} else {
+				node.KeyExpiry = opt.NewBool(true)
 			}
 
 		case "tags":
-			for h.NextArg() {
-				node.Tags = append(node.Tags, h.Val())
+			for d.NextArg() {
+				node.Tags = append(node.Tags, d.Val())
+			}
+
+		case "label":
+			var key, value string
+			if !d.Args(&key, &value) {
+				return d.ArgErr()
+			}
+			if strings.ContainsAny(key, "=,") {
+				return d.Errf("invalid label key: %s", key)
+			}
+			if node.Labels == nil {
+				node.Labels = make(map[string]string)
+			}
+			node.Labels[key] = value
+
+		case "nameserver":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			ns := Nameserver{Address: d.Val(), Domains: d.RemainingArgs()}
+			if _, err := resolverAddr(ns.Address); err != nil {
+				return d.Errf("nameserver must be a resolver IP address, got %q", ns.Address)
+			}
+			node.Nameservers = append(node.Nameservers, ns)
+
+		case "advertise_endpoints":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			node.AdvertiseEndpoints = append(node.AdvertiseEndpoints, d.Val())
+			for d.NextArg() {
+				node.AdvertiseEndpoints = append(node.AdvertiseEndpoints, d.Val())
+			}
+
+		case "derp_region":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			v, err := strconv.Atoi(d.Val())
+			if err != nil || v <= 0 {
+				return d.Errf("invalid DERP region ID: %s", d.Val())
+			}
+			node.DERPRegion = v
+
+		case "copy_buffer_size":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			v, err := humanize.ParseBytes(d.Val())
+			if err != nil {
+				return d.WrapErr(err)
+			}
+			node.CopyBufferSize = int(v)
+
+		case "slow_request_threshold":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			v, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.WrapErr(err)
+			}
+			node.SlowRequestThreshold = caddy.Duration(v)
+
+		case "max_body_size":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			v, err := humanize.ParseBytes(d.Val())
+			if err != nil {
+				return d.WrapErr(err)
+			}
+			node.MaxBodySize = int64(v)
+
+		case "methods":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			node.Methods = append(node.Methods, args...)
+
+		case "funnel_headers":
+			v, err := parseHeaderBlock(d)
+			if err != nil {
+				return err
+			}
+			node.FunnelHeaders = v
+
+		case "tailnet_headers":
+			v, err := parseHeaderBlock(d)
+			if err != nil {
+				return err
 			}
+			node.TailnetHeaders = v
+
+		case "tcp_send_buffer_size":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			v, err := humanize.ParseBytes(d.Val())
+			if err != nil {
+				return d.WrapErr(err)
+			}
+			node.TCPSendBufferSize = int(v)
+
+		case "forward":
+			var fw Forward
+			if !d.Args(&fw.Listen, &fw.To) {
+				return d.ArgErr()
+			}
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				if fw.Record == nil {
+					fw.Record = new(Recording)
+				}
+				switch d.Val() {
+				case "recorder":
+					recorders := d.RemainingArgs()
+					if len(recorders) == 0 {
+						return d.ArgErr()
+					}
+					fw.Record.Recorders = append(fw.Record.Recorders, recorders...)
+				case "record_dir":
+					if !d.AllArgs(&fw.Record.Dir) {
+						return d.ArgErr()
+					}
+				case "record_fail_open":
+					if d.NextArg() {
+						return d.ArgErr()
+					}
+					fw.Record.FailOpen = true
+				default:
+					return d.Errf("unrecognized forward subdirective: %s", d.Val())
+				}
+			}
+			if err := fw.validate(); err != nil {
+				return d.WrapErr(err)
+			}
+			node.Forwards = append(node.Forwards, fw)
+
+		case "expose":
+			var port, to string
+			if !d.Args(&port, &to) {
+				return d.ArgErr()
+			}
+			v, err := strconv.ParseUint(port, 10, 16)
+			if err != nil {
+				return d.WrapErr(err)
+			}
+			e := Expose{Port: uint16(v), To: to}
+			if err := e.validate(); err != nil {
+				return d.WrapErr(err)
+			}
+			node.Exposes = append(node.Exposes, e)
 
 		default:
-			return h.Errf("unrecognized subdirective: %s", h.Val())
+			return d.Errf("unrecognized subdirective: %s", d.Val())
 		}
 	}
 	return nil
@@ -174,6 +415,37 @@ func parseAppOptions(d *caddyfile.Dispenser, app *App) error {
 			}
 			app.DefaultAuthKey = d.Val()
 
+		case "auth_key_file":
+			if !d.AllArgs(&app.DefaultAuthKeyFile) {
+				return d.ArgErr()
+			}
+
+		case "reap":
+			r, err := parseReaper(d)
+			if err != nil {
+				return err
+			}
+			app.Reap = r
+
+		case "rolling_restart":
+			rr, err := parseRollingRestart(d)
+			if err != nil {
+				return err
+			}
+			app.RollingRestart = rr
+
+		case "nodes_file":
+			if !d.AllArgs(&app.NodesFile) {
+				return d.ArgErr()
+			}
+
+		case "testing":
+			tm, err := parseTestingMode(d)
+			if err != nil {
+				return err
+			}
+			app.Testing = tm
+
 		case "control_url":
 			if !d.NextArg() {
 				return d.ArgErr()
@@ -191,6 +463,13 @@ func parseAppOptions(d *caddyfile.Dispenser, app *App) error {
 				app.Ephemeral = true
 			}
 
+		case "unique_suffix":
+			if d.NextArg() {
+				app.UniqueSuffix = d.Val()
+			} else {
+				app.UniqueSuffix = uniqueSuffixRandom
+			}
+
 		case "state_dir":
 			if !d.NextArg() {
 				return d.ArgErr()
@@ -208,11 +487,170 @@ func parseAppOptions(d *caddyfile.Dispenser, app *App) error {
 				app.WebUI = true
 			}
 
+		case "webui_allow":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			app.WebUIAllow = append(app.WebUIAllow, args...)
+
+		case "read_only_state":
+			if d.NextArg() {
+				v, err := strconv.ParseBool(d.Val())
+				if err != nil {
+					return d.WrapErr(err)
+				}
+				app.ReadOnlyState = v
+			} else {
+				app.ReadOnlyState = true
+			}
+
+		case "preauthorized":
+			if d.NextArg() {
+				v, err := strconv.ParseBool(d.Val())
+				if err != nil {
+					return d.WrapErr(err)
+				}
+				app.Preauthorized = opt.NewBool(v)
+			} else {
+				app.Preauthorized = opt.NewBool(true)
+			}
+
+		case "key_expiry":
+			if d.NextArg() {
+				v, err := strconv.ParseBool(d.Val())
+				if err != nil {
+					return d.WrapErr(err)
+				}
+				app.KeyExpiry = opt.NewBool(v)
+			} else {
+				app.KeyExpiry = opt.NewBool(true)
+			}
+
 		case "tags":
 			for d.NextArg() {
 				app.Tags = append(app.Tags, d.Val())
 			}
 
+		case "port_mapping":
+			if d.NextArg() {
+				v, err := strconv.ParseBool(d.Val())
+				if err != nil {
+					return d.WrapErr(err)
+				}
+				app.PortMapping = opt.NewBool(v)
+			} else {
+				app.PortMapping = opt.NewBool(true)
+			}
+
+		case "upnp":
+			if d.NextArg() {
+				v, err := strconv.ParseBool(d.Val())
+				if err != nil {
+					return d.WrapErr(err)
+				}
+				app.UPnP = opt.NewBool(v)
+			} else {
+				app.UPnP = opt.NewBool(true)
+			}
+
+		case "stun_when_idle":
+			if d.NextArg() {
+				v, err := strconv.ParseBool(d.Val())
+				if err != nil {
+					return d.WrapErr(err)
+				}
+				app.STUNWhenIdle = opt.NewBool(v)
+			} else {
+				app.STUNWhenIdle = opt.NewBool(true)
+			}
+
+		case "low_memory":
+			if d.NextArg() {
+				v, err := strconv.ParseBool(d.Val())
+				if err != nil {
+					return d.WrapErr(err)
+				}
+				app.LowMemory = v
+			} else {
+				app.LowMemory = true
+			}
+
+		case "hostinfo_app":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			app.HostinfoApp = d.Val()
+
+		case "device_model":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			app.DeviceModel = d.Val()
+
+		case "lock_signer":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			app.LockSigner = d.Val()
+
+		case "proxy":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			app.Proxy = d.Val()
+
+		case "slow_request_threshold":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			v, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.WrapErr(err)
+			}
+			app.SlowRequestThreshold = caddy.Duration(v)
+
+		case "max_body_size":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			v, err := humanize.ParseBytes(d.Val())
+			if err != nil {
+				return d.WrapErr(err)
+			}
+			app.MaxBodySize = int64(v)
+
+		case "methods":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			app.Methods = append(app.Methods, args...)
+
+		case "funnel_headers":
+			v, err := parseHeaderBlock(d)
+			if err != nil {
+				return err
+			}
+			app.FunnelHeaders = v
+
+		case "tailnet_headers":
+			v, err := parseHeaderBlock(d)
+			if err != nil {
+				return err
+			}
+			app.TailnetHeaders = v
+
+		case "mtu":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			v, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.WrapErr(err)
+			}
+			app.MTU = v
+
 		default:
 			// Try to parse as a named node configuration
 			node, err := parseNamedNodeConfig(d)
@@ -246,3 +684,24 @@ func parseNamedNodeConfig(d *caddyfile.Dispenser) (Node, error) {
 
 	return node, nil
 }
+
+// parseHeaderBlock parses a block of response headers, with one "<field> <value>" pair per line.
+// A field can be repeated to set multiple values.
+func parseHeaderBlock(d *caddyfile.Dispenser) (http.Header, error) {
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	h := make(http.Header)
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		field := d.Val()
+		var value string
+		if !d.AllArgs(&value) {
+			return nil, d.ArgErr()
+		}
+		h.Add(field, value)
+	}
+	if len(h) == 0 {
+		return nil, d.Err("expected at least one header")
+	}
+	return h, nil
+}
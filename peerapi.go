@@ -0,0 +1,79 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// peerapi.go contains access control for the peer API of nodes, the HTTP server that peers use for features
+// such as DNS over the node and Taildrop, so that nodes present a minimal attack surface to the tailnet.
+
+import (
+	"net/netip"
+	"net/url"
+	"sync/atomic"
+
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/net/packet"
+	"tailscale.com/net/tstun"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/ipproto"
+	"tailscale.com/types/netmap"
+)
+
+// peerAPIGate drops TCP packets sent to the peer API of a node by peers that aren't allowed to use it.
+// Funnel ingress nodes are always allowed, since Funnel requests are sent to the node over its peer API.
+type peerAPIGate struct {
+	// allowed are the login names and tags of the peers allowed to connect. If empty, no peers are allowed.
+	allowed []string
+
+	// state is the node's peer API addresses and its allowed peers, from the latest network map.
+	// The peer API is started when the node receives its first network map, just before it is known here,
+	// so packets are allowed until then.
+	state atomic.Pointer[peerAPIState]
+}
+
+// peerAPIState is the state used to filter packets sent to the peer API.
+type peerAPIState struct {
+	addrs map[netip.AddrPort]bool // the node's peer API addresses
+	peers map[netip.Addr]bool     // addresses of allowed peers
+}
+
+// update implements packetGate.
+func (g *peerAPIGate) update(nm *netmap.NetworkMap, self *ipnstate.PeerStatus) {
+	st := &peerAPIState{
+		addrs: make(map[netip.AddrPort]bool),
+		peers: allowedPeerAddrs(nm, g.allowed),
+	}
+	if self != nil {
+		for _, s := range self.PeerAPIURL {
+			u, err := url.Parse(s)
+			if err != nil {
+				continue
+			}
+			if ap, err := netip.ParseAddrPort(u.Host); err == nil {
+				st.addrs[ap] = true
+			}
+		}
+	}
+	g.state.Store(st)
+}
+
+// allows implements packetGate.
+func (g *peerAPIGate) allows(p *packet.Parsed, tun *tstun.Wrapper) bool {
+	if p.IPProto != ipproto.TCP {
+		return true
+	}
+	st := g.state.Load()
+	if st == nil || !st.addrs[p.Dst] {
+		return true
+	}
+	if st.peers[p.Src.Addr()] {
+		return true
+	}
+	if tun == nil {
+		return false
+	}
+	f := tun.GetFilter()
+	return f != nil && f.CapsWithValues(p.Src.Addr(), p.Dst.Addr()).HasCapability(tailcfg.PeerCapabilityIngress)
+}
+
+var _ packetGate = (*peerAPIGate)(nil)
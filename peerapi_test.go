@@ -0,0 +1,96 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+import (
+	"net/netip"
+	"testing"
+
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/net/packet"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/ipproto"
+	"tailscale.com/types/netmap"
+)
+
+func Test_PeerAPIGate(t *testing.T) {
+	nm := &netmap.NetworkMap{
+		SelfNode: (&tailcfg.Node{
+			Addresses: []netip.Prefix{netip.MustParsePrefix("100.64.0.1/32")},
+		}).View(),
+		Peers: []tailcfg.NodeView{
+			(&tailcfg.Node{
+				ID:        1,
+				User:      1,
+				Addresses: []netip.Prefix{netip.MustParsePrefix("100.64.0.2/32")},
+			}).View(),
+			(&tailcfg.Node{
+				ID:        2,
+				User:      2,
+				Tags:      []string{"tag:server"},
+				Addresses: []netip.Prefix{netip.MustParsePrefix("100.64.0.3/32")},
+			}).View(),
+		},
+		UserProfiles: map[tailcfg.UserID]tailcfg.UserProfileView{
+			1: (&tailcfg.UserProfile{ID: 1, LoginName: "alice@example.com"}).View(),
+			2: (&tailcfg.UserProfile{ID: 2, LoginName: "tagged-devices"}).View(),
+		},
+	}
+	self := &ipnstate.PeerStatus{
+		PeerAPIURL: []string{"http://100.64.0.1:41641", "http://[fd7a:115c:a1e0::1]:41641"},
+	}
+
+	tests := map[string]struct {
+		allowed []string
+		src     string
+		dst     string
+		proto   ipproto.Proto
+		noMap   bool
+		want    bool
+	}{
+		"allowed user": {
+			allowed: []string{"alice@example.com"},
+			src:     "100.64.0.2", dst: "100.64.0.1:41641", proto: ipproto.TCP,
+			want: true,
+		},
+		"other peer": {
+			allowed: []string{"alice@example.com"},
+			src:     "100.64.0.3", dst: "100.64.0.1:41641", proto: ipproto.TCP,
+		},
+		"disabled": {
+			src: "100.64.0.2", dst: "100.64.0.1:41641", proto: ipproto.TCP,
+		},
+		"ipv6": {
+			src: "fd7a:115c:a1e0::2", dst: "[fd7a:115c:a1e0::1]:41641", proto: ipproto.TCP,
+		},
+		"other port": {
+			src: "100.64.0.3", dst: "100.64.0.1:443", proto: ipproto.TCP,
+			want: true,
+		},
+		"udp": {
+			src: "100.64.0.3", dst: "100.64.0.1:41641", proto: ipproto.UDP,
+			want: true,
+		},
+		"before network map": {
+			src: "100.64.0.3", dst: "100.64.0.1:41641", proto: ipproto.TCP, noMap: true,
+			want: true,
+		},
+	}
+	for tn, tt := range tests {
+		t.Run(tn, func(t *testing.T) {
+			g := &peerAPIGate{allowed: tt.allowed}
+			if !tt.noMap {
+				g.update(nm, self)
+			}
+			p := &packet.Parsed{
+				IPProto: tt.proto,
+				Src:     netip.AddrPortFrom(netip.MustParseAddr(tt.src), 40000),
+				Dst:     netip.MustParseAddrPort(tt.dst),
+			}
+			if got := g.allows(p, nil); got != tt.want {
+				t.Errorf("allows() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// peerlatency.go contains latency metrics for peers that nodes connect to as upstreams,
+// so that alerts can fire when the path to an internal service degrades to a relay.
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/net/tsaddr"
+	"tailscale.com/tailcfg"
+)
+
+const (
+	// peerLatencyInterval is how often upstream peers are pinged.
+	peerLatencyInterval = 30 * time.Second
+
+	// peerActiveWindow is how long after a node last connected to a peer that the peer is still pinged.
+	peerActiveWindow = 5 * time.Minute
+)
+
+// peerLatencyMetrics are the latency metrics of upstream peers, labeled by node and peer.
+// Nodes outlive configs, so the metrics are shared by all configs and registered with each config's registry.
+var peerLatencyMetrics = struct {
+	latency *prometheus.HistogramVec
+	relayed *prometheus.GaugeVec
+}{
+	latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "caddy",
+		Subsystem: "tailscale",
+		Name:      "peer_latency_seconds",
+		Help:      "Round-trip time of pings to peers that nodes connect to as upstreams.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 12),
+	}, []string{"node", "peer"}),
+	relayed: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "caddy",
+		Subsystem: "tailscale",
+		Name:      "peer_relayed",
+		Help:      "Whether the last ping to an upstream peer was relayed through DERP or a peer relay, rather than direct.",
+	}, []string{"node", "peer"}),
+}
+
+// registerPeerLatencyMetrics registers the peer latency metrics with registry.
+func registerPeerLatencyMetrics(registry *prometheus.Registry) error {
+	if registry == nil {
+		return nil
+	}
+	for _, c := range []prometheus.Collector{peerLatencyMetrics.latency, peerLatencyMetrics.relayed} {
+		if err := registry.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// upstreamPeers records the tailnet peers a node has connected to, and when.
+type upstreamPeers struct {
+	mu    sync.Mutex
+	peers map[netip.Addr]*upstreamPeer
+}
+
+// upstreamPeer is a tailnet peer a node has connected to.
+type upstreamPeer struct {
+	lastUsed time.Time
+	name     string // name used in metrics, once the peer has been pinged
+}
+
+// used records a connection to addr at now, if addr is a tailnet address.
+func (u *upstreamPeers) used(addr net.Addr, now time.Time) {
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil || !tsaddr.IsTailscaleIP(ap.Addr()) {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.peers == nil {
+		u.peers = make(map[netip.Addr]*upstreamPeer)
+	}
+	if p, ok := u.peers[ap.Addr()]; ok {
+		p.lastUsed = now
+	} else {
+		u.peers[ap.Addr()] = &upstreamPeer{lastUsed: now}
+	}
+}
+
+// active returns the peers connected to within peerActiveWindow of now,
+// forgetting the others and returning the metric names of those that had been pinged.
+func (u *upstreamPeers) active(now time.Time) (active []netip.Addr, expired []string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for ip, p := range u.peers {
+		if now.Sub(p.lastUsed) > peerActiveWindow {
+			delete(u.peers, ip)
+			if p.name != "" {
+				expired = append(expired, p.name)
+			}
+			continue
+		}
+		active = append(active, ip)
+	}
+	return active, expired
+}
+
+// setName records the name used in metrics for the peer at ip.
+func (u *upstreamPeers) setName(ip netip.Addr, name string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if p, ok := u.peers[ip]; ok {
+		p.name = name
+	}
+}
+
+// probePeerLatency periodically pings the node's upstream peers, recording their latency.
+// It runs until ctx is done.
+func (t *tailscaleNode) probePeerLatency(ctx context.Context) {
+	ticker := time.NewTicker(peerLatencyInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			t.forgetPeerLatency()
+			return
+		case <-ticker.C:
+			t.pingUpstreams(ctx, time.Now())
+		}
+	}
+}
+
+// pingUpstreams pings the node's active upstream peers once, recording their latency,
+// and removes the metrics of peers that are no longer used.
+func (t *tailscaleNode) pingUpstreams(ctx context.Context, now time.Time) {
+	active, expired := t.upstreams.active(now)
+	for _, name := range expired {
+		deletePeerLatency(t.name, name)
+	}
+	if len(active) == 0 {
+		return
+	}
+	lc, err := t.LocalClient()
+	if err != nil {
+		return
+	}
+	for _, ip := range active {
+		pctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		res, err := lc.Ping(pctx, ip, tailcfg.PingDisco)
+		cancel()
+		if err != nil || res.Err != "" {
+			continue
+		}
+		name := res.NodeName
+		if name == "" {
+			name = ip.String()
+		}
+		t.upstreams.setName(ip, name)
+		observePeerLatency(t.name, name, res)
+	}
+}
+
+// observePeerLatency records the result of a ping from node to peer.
+func observePeerLatency(node, peer string, res *ipnstate.PingResult) {
+	peerLatencyMetrics.latency.WithLabelValues(node, peer).Observe(res.LatencySeconds)
+	relayed := 0.0
+	if res.Endpoint == "" {
+		relayed = 1
+	}
+	peerLatencyMetrics.relayed.WithLabelValues(node, peer).Set(relayed)
+}
+
+// deletePeerLatency removes the metrics of peer recorded by node.
+func deletePeerLatency(node, peer string) {
+	peerLatencyMetrics.latency.DeleteLabelValues(node, peer)
+	peerLatencyMetrics.relayed.DeleteLabelValues(node, peer)
+}
+
+// forgetPeerLatency removes all peer latency metrics recorded by the node.
+func (t *tailscaleNode) forgetPeerLatency() {
+	peerLatencyMetrics.latency.DeletePartialMatch(prometheus.Labels{"node": t.name})
+	peerLatencyMetrics.relayed.DeletePartialMatch(prometheus.Labels{"node": t.name})
+}
@@ -0,0 +1,71 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/msfjarvis/caddy-tailscale/tscaddytest"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func Test_UpstreamPeers(t *testing.T) {
+	now := time.Now()
+	peer := netip.MustParseAddr("100.64.0.1")
+
+	var u upstreamPeers
+	u.used(&net.TCPAddr{IP: net.ParseIP("192.168.0.1"), Port: 80}, now)
+	u.used(net.TCPAddrFromAddrPort(netip.AddrPortFrom(peer, 80)), now)
+	if active, _ := u.active(now); len(active) != 1 || active[0] != peer {
+		t.Fatalf("active = %v, want only tailnet peer %v", active, peer)
+	}
+
+	u.setName(peer, "peer")
+	active, expired := u.active(now.Add(peerActiveWindow + time.Second))
+	if len(active) != 0 || len(expired) != 1 || expired[0] != "peer" {
+		t.Errorf("after window, active = %v, expired = %v; want no active and peer expired", active, expired)
+	}
+}
+
+func Test_PeerLatency(t *testing.T) {
+	control := tscaddytest.NewControl(t)
+	upstream := control.NewNode(t, "upstream")
+	ln, err := upstream.Listen("tcp", ":80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go http.Serve(ln, http.NotFoundHandler())
+
+	runTestApp(t, newTestApp(t, control, nil))
+
+	node := startTestNode(t, "latency")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if _, err := node.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	ip4, _ := upstream.TailscaleIPs()
+	c, err := node.dial(ctx, "tcp", netip.AddrPortFrom(ip4, 80).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	node.pingUpstreams(ctx, time.Now())
+	if n := testutil.CollectAndCount(peerLatencyMetrics.latency); n != 1 {
+		t.Errorf("recorded latency of %d peers, want 1", n)
+	}
+
+	node.pingUpstreams(ctx, time.Now().Add(peerActiveWindow+time.Second))
+	if n := testutil.CollectAndCount(peerLatencyMetrics.latency); n != 0 {
+		t.Errorf("recorded latency of %d peers after they were no longer used, want 0", n)
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// peerlocation.go contains support for the approximate location of the tailnet peers that send requests,
+// for logging and analytics of where sites are used from, such as which offices use an internal tool.
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+	"tailscale.com/tailcfg"
+)
+
+// peerLocation is the approximate location of a tailnet peer.
+type peerLocation struct {
+	// derpRegion is the code of the peer's home DERP region, such as "nyc",
+	// or its ID if it isn't in the DERP map. The peer is usually closest to this region,
+	// and its traffic is relayed through it when it can't connect directly.
+	derpRegion string
+
+	// Location reported by the peer, which is only set for some peers, such as Mullvad exit nodes.
+	country, countryCode, city, cityCode string
+}
+
+// newPeerLocation returns the location of the peer node using the DERP map dm, which may be nil.
+func newPeerLocation(node *tailcfg.Node, dm *tailcfg.DERPMap) peerLocation {
+	var loc peerLocation
+	if node == nil {
+		return loc
+	}
+	if id := node.HomeDERP; id != 0 {
+		loc.derpRegion = strconv.Itoa(id)
+		if dm != nil {
+			if r := dm.Regions[id]; r != nil && r.RegionCode != "" {
+				loc.derpRegion = r.RegionCode
+			}
+		}
+	}
+	if hi := node.Hostinfo; hi.Valid() && hi.Location().Valid() {
+		l := hi.Location()
+		loc.country = l.Country()
+		loc.countryCode = l.CountryCode()
+		loc.city = l.City()
+		loc.cityCode = l.CityCode()
+	}
+	return loc
+}
+
+// requestPeerLocation returns the location of the tailnet peer that sent r to node.
+// It is empty if the peer isn't known to the node.
+func (t *tailscaleNode) requestPeerLocation(r *http.Request) peerLocation {
+	if !t.started.Load() {
+		return peerLocation{}
+	}
+	lc, err := t.LocalClient()
+	if err != nil {
+		return peerLocation{}
+	}
+	info, err := lc.WhoIs(r.Context(), r.RemoteAddr)
+	if err != nil {
+		return peerLocation{}
+	}
+	dm, _ := lc.CurrentDERPMap(r.Context())
+	return newPeerLocation(info.Node, dm)
+}
+
+// peerPlaceholderPrefix prefixes the placeholders of the location of the peer that sent a request.
+const peerPlaceholderPrefix = "tailscale.listener.peer_"
+
+// setPeerPlaceholders sets the peer location placeholders in repl for r, received on node if it isn't nil.
+// The location is only looked up if a placeholder is used, and at most once.
+// The placeholders are empty for requests that weren't sent by tailnet peers.
+func setPeerPlaceholders(repl *caddy.Replacer, r *http.Request, node *tailscaleNode) {
+	loc := sync.OnceValue(func() peerLocation {
+		if node == nil {
+			return peerLocation{}
+		}
+		return node.requestPeerLocation(r)
+	})
+	repl.Map(func(key string) (any, bool) {
+		field, ok := strings.CutPrefix(key, peerPlaceholderPrefix)
+		if !ok {
+			return nil, false
+		}
+		switch field {
+		case "derp_region":
+			return loc().derpRegion, true
+		case "country":
+			return loc().country, true
+		case "country_code":
+			return loc().countryCode, true
+		case "city":
+			return loc().city, true
+		case "city_code":
+			return loc().cityCode, true
+		}
+		return nil, false
+	})
+}
@@ -0,0 +1,140 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/google/go-cmp/cmp"
+	"github.com/msfjarvis/caddy-tailscale/tscaddytest"
+	"tailscale.com/tailcfg"
+	"tailscale.com/util/must"
+)
+
+func Test_NewPeerLocation(t *testing.T) {
+	dm := &tailcfg.DERPMap{Regions: map[int]*tailcfg.DERPRegion{
+		1: {RegionID: 1, RegionCode: "nyc"},
+		2: {RegionID: 2},
+	}}
+	tests := map[string]struct {
+		node *tailcfg.Node
+		dm   *tailcfg.DERPMap
+		want peerLocation
+	}{
+		"unknown peer": {},
+		"no home region": {
+			node: &tailcfg.Node{},
+			dm:   dm,
+		},
+		"home region": {
+			node: &tailcfg.Node{HomeDERP: 1},
+			dm:   dm,
+			want: peerLocation{derpRegion: "nyc"},
+		},
+		"region without code": {
+			node: &tailcfg.Node{HomeDERP: 2},
+			dm:   dm,
+			want: peerLocation{derpRegion: "2"},
+		},
+		"region not in map": {
+			node: &tailcfg.Node{HomeDERP: 3},
+			dm:   dm,
+			want: peerLocation{derpRegion: "3"},
+		},
+		"no derp map": {
+			node: &tailcfg.Node{HomeDERP: 1},
+			want: peerLocation{derpRegion: "1"},
+		},
+		"reported location": {
+			node: &tailcfg.Node{
+				HomeDERP: 1,
+				Hostinfo: (&tailcfg.Hostinfo{Location: &tailcfg.Location{
+					Country:     "Sweden",
+					CountryCode: "SE",
+					City:        "Stockholm",
+					CityCode:    "STO",
+				}}).View(),
+			},
+			dm: dm,
+			want: peerLocation{
+				derpRegion:  "nyc",
+				country:     "Sweden",
+				countryCode: "SE",
+				city:        "Stockholm",
+				cityCode:    "STO",
+			},
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := newPeerLocation(tt.node, tt.dm)
+			if diff := cmp.Diff(tt.want, got, cmp.AllowUnexported(peerLocation{})); diff != "" {
+				t.Errorf("newPeerLocation() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func Test_PeerPlaceholders(t *testing.T) {
+	control := tscaddytest.NewControl(t)
+	peer := control.NewNode(t, "peer")
+
+	runTestApp(t, newTestApp(t, control, map[string]Node{
+		"office": {},
+	}))
+
+	node := startTestNode(t, "office")
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	st := must.Get(node.Up(ctx))
+	ln := must.Get(node.Listen("tcp", ":80"))
+	defer ln.Close()
+
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			repl := caddy.NewReplacer()
+			r = r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, repl))
+			next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				w.Header().Set("X-Peer-Region", repl.ReplaceKnown("{tailscale.listener.peer_derp_region}", ""))
+				w.Header().Set("X-Peer-Country", repl.ReplaceKnown("{tailscale.listener.peer_country}", ""))
+				return nil
+			})
+			if err := (ListenerPlaceholders{}).ServeHTTP(w, r, next); err != nil {
+				t.Error(err)
+			}
+		}),
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, caddyhttp.ConnCtxKey, c)
+		},
+	}
+	go srv.Serve(newNodeListener(ln, node))
+	defer srv.Close()
+
+	// The peer reports its home region once it has checked the network.
+	client := &http.Client{Transport: &http.Transport{DialContext: peer.Dial}}
+	var region, country string
+	for range 50 {
+		resp := must.Get(client.Get("http://" + st.TailscaleIPs[0].String() + "/"))
+		resp.Body.Close()
+		region, country = resp.Header.Get("X-Peer-Region"), resp.Header.Get("X-Peer-Country")
+		if region != "" {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if region != "test" {
+		t.Errorf("tailscale.listener.peer_derp_region = %q, want %q", region, "test")
+	}
+	// The test peer doesn't report its location.
+	if country != "" {
+		t.Errorf("tailscale.listener.peer_country = %q, want empty", country)
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// portmap.go contains reporting of the port mapping done by Tailscale nodes,
+// to help debug why traffic is relayed through DERP instead of using direct connections.
+
+import (
+	"context"
+
+	"tailscale.com/envknob"
+	"tailscale.com/feature/buildfeatures"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/net/netcheck"
+	"tailscale.com/types/opt"
+	"tailscale.com/util/clientmetric"
+)
+
+// Port mapping protocols, as reported by the port mapping status.
+const (
+	portMapUPnP = "upnp"
+	portMapPMP  = "pmp"
+	portMapPCP  = "pcp"
+)
+
+// portMapMetrics are the client metrics counting successful mappings for each protocol.
+var portMapMetrics = map[string]string{
+	portMapUPnP: "portmap_upnp_ok",
+	portMapPMP:  "portmap_pmp_ok",
+	portMapPCP:  "portmap_pcp_ok",
+}
+
+// portMapStatus is the port mapping status of the process and its running nodes.
+type portMapStatus struct {
+	// Enabled reports whether port mapping is enabled.
+	// It is disabled by the port_mapping option or if Caddy was built without port mapping support.
+	Enabled bool `json:"enabled"`
+
+	// UPnPEnabled reports whether UPnP is used for port mapping.
+	UPnPEnabled bool `json:"upnp_enabled"`
+
+	// Mappings counts the port mappings successfully created or renewed with each protocol by all nodes.
+	// The Tailscale client library only counts mappings for the whole process.
+	Mappings map[string]int64 `json:"mappings"`
+
+	// Nodes is the port mapping status of each running node.
+	Nodes []nodePortMap `json:"nodes"`
+}
+
+// nodePortMap is the port mapping status of a node.
+type nodePortMap struct {
+	// Node is the name of the node configuration.
+	Node string `json:"node"`
+
+	// Available reports whether each protocol was found on the LAN by the node's last network check.
+	// Protocols that haven't been checked are omitted.
+	Available map[string]bool `json:"available"`
+
+	// Endpoints are the addresses the node advertises to peers for direct connections,
+	// including port mapped addresses.
+	Endpoints []string `json:"endpoints"`
+
+	// Error is why the node's port mapping status couldn't be read, if it couldn't.
+	Error string `json:"error,omitempty"`
+}
+
+// getPortMapStatus returns the port mapping status of the process and all running nodes.
+func getPortMapStatus(ctx context.Context) (*portMapStatus, error) {
+	status := &portMapStatus{
+		Enabled:     buildfeatures.HasPortMapper && !envknob.Bool(envDisablePortMapper),
+		UPnPEnabled: buildfeatures.HasPortMapper && !envknob.Bool(envDisableUPnP),
+		Mappings:    make(map[string]int64),
+		Nodes:       []nodePortMap{},
+	}
+	values := make(map[string]int64)
+	for _, m := range clientmetric.Metrics() {
+		values[m.Name()] = m.Value()
+	}
+	for proto, name := range portMapMetrics {
+		status.Mappings[proto] = values[name]
+	}
+
+	for _, node := range runningNodes() {
+		st, err := node.selfStatus(ctx)
+		if err != nil {
+			status.Nodes = append(status.Nodes, nodePortMap{Node: node.name, Error: err.Error()})
+			continue
+		}
+		report := node.Sys().MagicSock.Get().GetLastNetcheckReport(ctx)
+		status.Nodes = append(status.Nodes, newNodePortMap(node.name, report, st.Self))
+	}
+	return status, nil
+}
+
+// newNodePortMap returns the port mapping status of the named node,
+// from its last network check report and its own status, either of which may be nil.
+func newNodePortMap(name string, report *netcheck.Report, self *ipnstate.PeerStatus) nodePortMap {
+	pm := nodePortMap{
+		Node:      name,
+		Available: make(map[string]bool),
+		Endpoints: []string{},
+	}
+	if report != nil {
+		for proto, v := range map[string]opt.Bool{
+			portMapUPnP: report.UPnP,
+			portMapPMP:  report.PMP,
+			portMapPCP:  report.PCP,
+		} {
+			if b, ok := v.Get(); ok {
+				pm.Available[proto] = b
+			}
+		}
+	}
+	if self != nil {
+		pm.Endpoints = append(pm.Endpoints, self.Addrs...)
+	}
+	return pm
+}
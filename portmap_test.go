@@ -0,0 +1,45 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/net/netcheck"
+	"tailscale.com/types/opt"
+)
+
+func Test_NewNodePortMap(t *testing.T) {
+	tests := []struct {
+		name   string
+		report *netcheck.Report
+		self   *ipnstate.PeerStatus
+		want   nodePortMap
+	}{
+		{
+			name: "not checked",
+			want: nodePortMap{Node: "node", Available: map[string]bool{}, Endpoints: []string{}},
+		},
+		{
+			name:   "upnp available",
+			report: &netcheck.Report{UPnP: opt.NewBool(true), PMP: opt.NewBool(false)},
+			self:   &ipnstate.PeerStatus{Addrs: []string{"203.0.113.1:41641", "192.168.1.2:41641"}},
+			want: nodePortMap{
+				Node:      "node",
+				Available: map[string]bool{"upnp": true, "pmp": false},
+				Endpoints: []string{"203.0.113.1:41641", "192.168.1.2:41641"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := newNodePortMap("node", tt.report, tt.self)
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("newNodePortMap() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
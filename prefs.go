@@ -0,0 +1,75 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// prefs.go contains configuration of node preferences that tsnet does not expose directly.
+
+import (
+	"context"
+
+	"tailscale.com/ipn"
+)
+
+// getPrefs returns the preferences to apply to the named node once it has started,
+// or nil if there are none.
+func getPrefs(name string, app *App) (*ipn.MaskedPrefs, error) {
+	var mp ipn.MaskedPrefs
+	if v, ok := getAcceptDNS(name, app); ok {
+		mp.CorpDNS = v
+		mp.CorpDNSSet = true
+	}
+
+	routes, err := getAdvertiseRoutes(name, app)
+	if err != nil {
+		return nil, err
+	}
+	if len(routes) > 0 {
+		mp.AdvertiseRoutes = routes
+		mp.AdvertiseRoutesSet = true
+	}
+
+	services, err := getAdvertiseServices(name, app)
+	if err != nil {
+		return nil, err
+	}
+	if len(services) > 0 {
+		mp.AdvertiseServices = services
+		mp.AdvertiseServicesSet = true
+	}
+
+	if mp.IsEmpty() {
+		return nil, nil
+	}
+	return &mp, nil
+}
+
+// getAcceptDNS returns whether the node should use the tailnet's DNS configuration,
+// and whether it was configured at all.
+func getAcceptDNS(name string, app *App) (bool, bool) {
+	// Check site-specific configuration first
+	if siteNode, exists := getSiteConfig(name); exists {
+		if v, ok := siteNode.AcceptDNS.Get(); ok {
+			return v, true
+		}
+	}
+
+	if node, ok := app.Nodes[name]; ok {
+		return node.AcceptDNS.Get()
+	}
+	return false, false
+}
+
+// applyPrefs applies the node's configured preferences.
+// Preferences are applied after starting the node, since tsnet resets them on start.
+func (t *tailscaleNode) applyPrefs() error {
+	if t.prefs == nil {
+		return nil
+	}
+	lc, err := t.LocalClient()
+	if err != nil {
+		return err
+	}
+	_, err = lc.EditPrefs(context.Background(), t.prefs)
+	return err
+}
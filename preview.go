@@ -0,0 +1,68 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// preview.go contains support for nodes of short-lived instances, such as CI preview deployments,
+// which get unique hostnames and leave the tailnet when they are stopped.
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// uniqueSuffixRandom is the unique_suffix value that generates a random suffix for each node.
+const uniqueSuffixRandom = "random"
+
+// forgetTimeout is how long a node waits to log out of the tailnet when it is stopped.
+const forgetTimeout = 5 * time.Second
+
+// getUniqueSuffixConfig returns the unique_suffix configured for the named node, if any.
+func getUniqueSuffixConfig(name string, app *App) string {
+	if siteNode, exists := getSiteConfig(name); exists && siteNode.UniqueSuffix != "" {
+		return siteNode.UniqueSuffix
+	}
+	if node, ok := app.Nodes[name]; ok && node.UniqueSuffix != "" {
+		return node.UniqueSuffix
+	}
+	return app.UniqueSuffix
+}
+
+// getUniqueSuffix returns the suffix appended to the hostname of the named node, or "" if it has none.
+// A random suffix is generated on each call if the node's unique_suffix is "random".
+func getUniqueSuffix(name string, app *App) (string, error) {
+	v := getUniqueSuffixConfig(name, app)
+	if v == "" {
+		return "", nil
+	}
+	if v == uniqueSuffixRandom {
+		return strings.ToLower(rand.Text()[:6]), nil
+	}
+	v, err := repl.ReplaceOrErr(v, true, true)
+	if err != nil {
+		return "", err
+	}
+	v = strings.ToLower(v)
+	if v == "" || strings.Trim(v, "abcdefghijklmnopqrstuvwxyz0123456789-") != "" {
+		return "", fmt.Errorf("invalid unique_suffix %q: must only contain letters, digits and hyphens", v)
+	}
+	return v, nil
+}
+
+// forget logs the node out of the tailnet, which deletes its ephemeral device immediately
+// instead of when the control server notices it is offline.
+func (t *tailscaleNode) forget() error {
+	if !t.started.Load() {
+		return nil
+	}
+	lc, err := t.LocalClient()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), forgetTimeout)
+	defer cancel()
+	return lc.Logout(ctx)
+}
@@ -0,0 +1,134 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// promsd.go contains Prometheus HTTP service discovery of tailnet peers,
+// so that Prometheus can find scrape targets on the tailnet through Caddy.
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+)
+
+// promTargetGroup is a target group in the Prometheus HTTP service discovery format.
+// See https://prometheus.io/docs/prometheus/latest/http_sd/.
+type promTargetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// promSDQuery selects the peers listed by Prometheus service discovery.
+type promSDQuery struct {
+	// Tags are the tags that peers must all have.
+	Tags []string
+
+	// Port is the port added to peer addresses, if any.
+	Port string
+
+	// Node is the name of the node whose peers are listed. If empty, the peers of all running nodes are listed.
+	Node string
+}
+
+// parsePromSDQuery parses the query parameters of a service discovery request.
+func parsePromSDQuery(tags []string, port, node string) (promSDQuery, error) {
+	for _, tag := range tags {
+		if !strings.HasPrefix(tag, "tag:") {
+			return promSDQuery{}, fmt.Errorf("invalid tag %q, tags must start with \"tag:\"", tag)
+		}
+	}
+	if port != "" {
+		if v, err := strconv.ParseUint(port, 10, 16); err != nil || v == 0 {
+			return promSDQuery{}, fmt.Errorf("invalid port %q", port)
+		}
+	}
+	return promSDQuery{Tags: tags, Port: port, Node: node}, nil
+}
+
+// promSDTargets returns a target group for each peer of running nodes selected by q.
+// Peers seen by more than one node are listed once, for the first node by name.
+func promSDTargets(ctx context.Context, q promSDQuery) ([]promTargetGroup, error) {
+	groups := []promTargetGroup{}
+	seen := make(map[tailcfg.StableNodeID]bool)
+	for _, node := range runningNodes() {
+		if q.Node != "" && node.name != q.Node {
+			continue
+		}
+		st, err := node.status(ctx)
+		if err != nil {
+			// The targets of other nodes are still listed.
+			if node.logger != nil {
+				node.logger.Warn("listing Prometheus targets", zap.Error(err))
+			}
+			continue
+		}
+		var nodeGroups []promTargetGroup
+		for _, ps := range st.Peer {
+			if seen[ps.ID] {
+				continue
+			}
+			if g, ok := newPromTargetGroup(node.name, ps, q); ok {
+				seen[ps.ID] = true
+				nodeGroups = append(nodeGroups, g)
+			}
+		}
+		slices.SortFunc(nodeGroups, func(a, b promTargetGroup) int {
+			return cmp.Compare(a.Labels["__meta_tailscale_dns_name"], b.Labels["__meta_tailscale_dns_name"])
+		})
+		groups = append(groups, nodeGroups...)
+	}
+	return groups, nil
+}
+
+// newPromTargetGroup returns the target group for a peer seen by the named node,
+// or false if the peer isn't selected by q or has no address.
+func newPromTargetGroup(nodeName string, ps *ipnstate.PeerStatus, q promSDQuery) (promTargetGroup, bool) {
+	if len(ps.TailscaleIPs) == 0 {
+		return promTargetGroup{}, false
+	}
+	var tags []string
+	if ps.Tags != nil {
+		tags = ps.Tags.AsSlice()
+	}
+	for _, tag := range q.Tags {
+		if !slices.Contains(tags, tag) {
+			return promTargetGroup{}, false
+		}
+	}
+
+	// Prefer IPv4, since some exporters only listen on IPv4.
+	ip := ps.TailscaleIPs[0]
+	for _, a := range ps.TailscaleIPs {
+		if a.Is4() {
+			ip = a
+			break
+		}
+	}
+	target := ip.String()
+	if q.Port != "" {
+		target = net.JoinHostPort(target, q.Port)
+	}
+
+	labels := map[string]string{
+		"__meta_tailscale_node":     nodeName,
+		"__meta_tailscale_hostname": ps.HostName,
+		"__meta_tailscale_dns_name": strings.TrimSuffix(ps.DNSName, "."),
+		"__meta_tailscale_os":       ps.OS,
+		"__meta_tailscale_online":   strconv.FormatBool(ps.Online),
+	}
+	if len(tags) > 0 {
+		// Tags are joined with leading and trailing separators, like other Prometheus list labels,
+		// so that a tag can be matched with a regex like .*,tag:metrics,.*.
+		labels["__meta_tailscale_tags"] = "," + strings.Join(tags, ",") + ","
+	}
+	return promTargetGroup{Targets: []string{target}, Labels: labels}, true
+}
@@ -0,0 +1,89 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/types/views"
+)
+
+func Test_NewPromTargetGroup(t *testing.T) {
+	tags := views.SliceOf([]string{"tag:metrics", "tag:server"})
+	ps := &ipnstate.PeerStatus{
+		HostName:     "db",
+		DNSName:      "db.tail1234.ts.net.",
+		OS:           "linux",
+		TailscaleIPs: []netip.Addr{netip.MustParseAddr("fd7a:115c:a1e0::1"), netip.MustParseAddr("100.64.0.1")},
+		Tags:         &tags,
+		Online:       true,
+	}
+	labels := map[string]string{
+		"__meta_tailscale_node":     "caddy",
+		"__meta_tailscale_hostname": "db",
+		"__meta_tailscale_dns_name": "db.tail1234.ts.net",
+		"__meta_tailscale_os":       "linux",
+		"__meta_tailscale_online":   "true",
+		"__meta_tailscale_tags":     ",tag:metrics,tag:server,",
+	}
+
+	tests := []struct {
+		name   string
+		q      promSDQuery
+		want   promTargetGroup
+		wantOK bool
+	}{
+		{
+			name:   "all peers",
+			want:   promTargetGroup{Targets: []string{"100.64.0.1"}, Labels: labels},
+			wantOK: true,
+		},
+		{
+			name:   "matching tags and port",
+			q:      promSDQuery{Tags: []string{"tag:metrics", "tag:server"}, Port: "9100"},
+			want:   promTargetGroup{Targets: []string{"100.64.0.1:9100"}, Labels: labels},
+			wantOK: true,
+		},
+		{
+			name: "missing tag",
+			q:    promSDQuery{Tags: []string{"tag:metrics", "tag:canary"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := newPromTargetGroup("caddy", ps, tt.q)
+			if ok != tt.wantOK {
+				t.Fatalf("newPromTargetGroup() ok = %v, want %v", ok, tt.wantOK)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("newPromTargetGroup() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func Test_ParsePromSDQuery(t *testing.T) {
+	tests := []struct {
+		name    string
+		tags    []string
+		port    string
+		wantErr bool
+	}{
+		{name: "empty"},
+		{name: "tag and port", tags: []string{"tag:metrics"}, port: "9100"},
+		{name: "tag without prefix", tags: []string{"metrics"}, wantErr: true},
+		{name: "invalid port", port: "http", wantErr: true},
+		{name: "zero port", port: "0", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parsePromSDQuery(tt.tags, tt.port, ""); (err != nil) != tt.wantErr {
+				t.Errorf("parsePromSDQuery() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,261 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// proxy.go contains configuration of the outbound proxy used by nodes to reach the control server and DERP relays.
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"tailscale.com/ipn"
+	"tailscale.com/net/tshttpproxy"
+	"tailscale.com/tailcfg"
+)
+
+// proxyFuncErr is why the app's proxy function couldn't be installed, if the Tailscale client library
+// resolved a proxy before this package was initialized. Configs that set proxies are rejected if it is set.
+var proxyFuncErr error
+
+func init() {
+	// The Tailscale client library resolves proxies for all nodes in the process with a single function,
+	// which can only be replaced before it is first used.
+	proxyFuncErr = tshttpproxy.SetProxyFunc(proxyForURL)
+}
+
+var proxies struct {
+	sync.Mutex
+
+	// defaultProxy is the app's proxy, used for all connections that don't have a node-specific proxy.
+	// defaultOwner is the app that set it, which resets it when it stops.
+	defaultProxy *url.URL
+	defaultOwner *App
+
+	// controlProxies are the proxies of the nodes using each control server, by control server host.
+	controlProxies map[string]*controlProxy
+}
+
+// controlProxy is the proxy used by the nodes of a control server, and the number of nodes using it.
+type controlProxy struct {
+	proxy *url.URL // nil if the nodes use the app's proxy
+	refs  int
+
+	// derpHosts are the hostnames of the DERP servers in the nodes' DERP map,
+	// which are reached through the same proxy as the control server.
+	derpHosts map[string]bool
+}
+
+// validateProxies checks the proxies of the app and its configured nodes.
+func (t *App) validateProxies() error {
+	configured := t.Proxy != ""
+	for name, node := range t.Nodes {
+		if node.Proxy == "" {
+			continue
+		}
+		configured = true
+		if _, err := parseProxyURL(node.Proxy); err != nil {
+			return fmt.Errorf("node %q: %w", name, err)
+		}
+	}
+	if t.Proxy != "" {
+		if _, err := parseProxyURL(t.Proxy); err != nil {
+			return err
+		}
+	}
+	if configured && proxyFuncErr != nil {
+		return fmt.Errorf("proxies can't be configured: %w", proxyFuncErr)
+	}
+	return nil
+}
+
+// applyProxy sets the app's proxy, replacing the proxy of the previous config.
+// It returns a function that restores the previous config's proxy, if the app fails to start.
+func (t *App) applyProxy() (restore func(), err error) {
+	var u *url.URL
+	if t.Proxy != "" {
+		if u, err = parseProxyURL(t.Proxy); err != nil {
+			return nil, err
+		}
+	}
+	proxies.Lock()
+	defer proxies.Unlock()
+	prevProxy, prevOwner := proxies.defaultProxy, proxies.defaultOwner
+	proxies.defaultProxy = u
+	proxies.defaultOwner = t
+	return func() {
+		proxies.Lock()
+		defer proxies.Unlock()
+		if proxies.defaultOwner == t {
+			proxies.defaultProxy, proxies.defaultOwner = prevProxy, prevOwner
+		}
+	}, nil
+}
+
+// resetProxy resets the app's proxy when it stops, unless it was replaced by a newer config,
+// so that removing the app stops using it.
+func (t *App) resetProxy() {
+	proxies.Lock()
+	defer proxies.Unlock()
+	if proxies.defaultOwner == t {
+		proxies.defaultProxy = nil
+		proxies.defaultOwner = nil
+	}
+}
+
+// parseProxyURL parses a proxy URL, which must be an http, https or socks5 URL.
+func parseProxyURL(v string) (*url.URL, error) {
+	u, err := url.Parse(v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL %q: %w", v, err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("proxy URL must be an http, https or socks5 URL, got %q", v)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("proxy URL %q has no host", v)
+	}
+	return u, nil
+}
+
+// nodeProxy is a node's use of the proxy for its control server.
+type nodeProxy struct {
+	host  string
+	proxy *url.URL
+}
+
+// addControlProxy registers a node using controlURL with proxy, or with the app's proxy if proxy is empty.
+// A control server can only have one proxy, since connections to it can't be attributed to nodes,
+// so it is an error for nodes of the same control server to use different proxies.
+func addControlProxy(controlURL, proxy string) (*nodeProxy, error) {
+	if controlURL == "" {
+		controlURL = ipn.DefaultControlURL
+	}
+	cu, err := url.Parse(controlURL)
+	if err != nil {
+		return nil, err
+	}
+	var pu *url.URL
+	if proxy != "" {
+		if pu, err = parseProxyURL(proxy); err != nil {
+			return nil, err
+		}
+	}
+	host := cu.Hostname()
+
+	proxies.Lock()
+	defer proxies.Unlock()
+	if cp, ok := proxies.controlProxies[host]; ok {
+		if proxyName(cp.proxy) != proxyName(pu) {
+			return nil, fmt.Errorf("nodes using control server %s must use the same proxy, got %s and %s",
+				host, proxyName(cp.proxy), proxyName(pu))
+		}
+		cp.refs++
+	} else {
+		if proxies.controlProxies == nil {
+			proxies.controlProxies = make(map[string]*controlProxy)
+		}
+		proxies.controlProxies[host] = &controlProxy{proxy: pu, refs: 1}
+	}
+	return &nodeProxy{host: host, proxy: pu}, nil
+}
+
+// proxyName describes a node's proxy in errors.
+func proxyName(u *url.URL) string {
+	if u == nil {
+		return "the app's proxy"
+	}
+	return u.String()
+}
+
+// remove unregisters the node from its control server's proxy.
+func (np *nodeProxy) remove() {
+	proxies.Lock()
+	defer proxies.Unlock()
+	if cp := proxies.controlProxies[np.host]; cp != nil {
+		if cp.refs--; cp.refs == 0 {
+			delete(proxies.controlProxies, np.host)
+		}
+	}
+}
+
+// setDERPMap sets the DERP servers reached through the proxy of the node's control server.
+func (np *nodeProxy) setDERPMap(dm *tailcfg.DERPMap) {
+	hosts := make(map[string]bool)
+	for _, r := range dm.Regions {
+		for _, n := range r.Nodes {
+			// DERP connections are proxied by the server's TLS name.
+			hosts[cmp.Or(n.CertName, n.HostName)] = true
+		}
+	}
+	proxies.Lock()
+	defer proxies.Unlock()
+	if cp := proxies.controlProxies[np.host]; cp != nil {
+		cp.derpHosts = hosts
+	}
+}
+
+// watchDERPMap keeps the DERP servers of the node's proxy up to date with its DERP map.
+func (t *tailscaleNode) watchDERPMap(ctx context.Context) {
+	lc, err := t.LocalClient()
+	if err != nil {
+		return
+	}
+	watcher, err := lc.WatchIPNBus(ctx, ipn.NotifyInitialNetMap|ipn.NotifyNoPrivateKeys)
+	if err != nil {
+		t.reportError("watching DERP map; DERP relays are reached through the app's proxy", err)
+		return
+	}
+	defer watcher.Close()
+
+	for {
+		n, err := watcher.Next()
+		if err != nil {
+			return
+		}
+		if n.NetMap != nil && n.NetMap.DERPMap != nil {
+			t.controlProxy.setDERPMap(n.NetMap.DERPMap)
+		}
+	}
+}
+
+// proxyForURL returns the proxy to use for connections to u.
+// Connections to control servers and their DERP servers use the proxy of their nodes,
+// unless DERP servers are shared by control servers with different proxies.
+func proxyForURL(u *url.URL) (*url.URL, error) {
+	host := u.Hostname()
+	proxies.Lock()
+	proxy := proxies.defaultProxy
+	if cp := proxies.controlProxies[host]; cp != nil {
+		if cp.proxy != nil {
+			proxy = cp.proxy
+		}
+	} else {
+		var derpProxy *url.URL
+		found, shared := false, false
+		for _, cp := range proxies.controlProxies {
+			if !cp.derpHosts[host] {
+				continue
+			}
+			if found && proxyName(cp.proxy) != proxyName(derpProxy) {
+				shared = true
+			}
+			derpProxy, found = cp.proxy, true
+		}
+		if derpProxy != nil && !shared {
+			proxy = derpProxy
+		}
+	}
+	proxies.Unlock()
+
+	if proxy != nil {
+		return proxy, nil
+	}
+	return http.ProxyFromEnvironment(&http.Request{URL: u})
+}
@@ -0,0 +1,125 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// reachability.go contains support for reporting where Tailscale listeners are reachable on the tailnet,
+// for orchestration tools that need the tailnet addresses assigned to nodes at runtime.
+
+import (
+	"cmp"
+	"context"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// listenerAddrs describes where a Tailscale listener is reachable on the tailnet.
+type listenerAddrs struct {
+	// Listen is the listen address of the listener, such as "tailscale+tls/myhost:443".
+	Listen string `json:"listen"`
+
+	// Node is the name of the node configuration.
+	Node string `json:"node"`
+
+	// Network is the network of the listener, such as "tcp" or "udp".
+	Network string `json:"network"`
+
+	// Port is the port the listener accepts connections on.
+	Port string `json:"port"`
+
+	// DNSName is the MagicDNS name of the node, if it is logged in.
+	DNSName string `json:"dns_name,omitempty"`
+
+	// Addresses are the tailnet addresses of the listener, made of the node's Tailscale IPs and the port.
+	Addresses []string `json:"addresses"`
+
+	// URL is the URL of sites served on TCP listeners, using the node's MagicDNS name.
+	URL string `json:"url,omitempty"`
+}
+
+// parseListenerKey returns the listen address, node name, network and port of a Tailscale listener from its pool key,
+// such as "tailscale+tls/myhost:tcp:443".
+func parseListenerKey(key string) (listen, node, network, port string, ok bool) {
+	i := strings.LastIndex(key, ":")
+	j := strings.LastIndex(key[:max(i, 0)], ":")
+	k := strings.LastIndex(key[:max(j, 0)], "/")
+	if i < 0 || j < 0 || k < 0 {
+		return "", "", "", "", false
+	}
+	caddyNetwork, node, network, port := key[:k], key[k+1:j], key[j+1:i], key[i+1:]
+	return caddyNetwork + "/" + net.JoinHostPort(node, port), node, network, port, true
+}
+
+// newListenerAddrs returns where the listener with key is reachable, given the Tailscale IPs and MagicDNS name of its node.
+func newListenerAddrs(key string, ips []netip.Addr, dnsName string) (listenerAddrs, bool) {
+	listen, node, network, port, ok := parseListenerKey(key)
+	if !ok {
+		return listenerAddrs{}, false
+	}
+	la := listenerAddrs{
+		Listen:    listen,
+		Node:      node,
+		Network:   network,
+		Port:      port,
+		DNSName:   strings.TrimSuffix(dnsName, "."),
+		Addresses: []string{},
+	}
+	for _, ip := range ips {
+		la.Addresses = append(la.Addresses, net.JoinHostPort(ip.String(), port))
+	}
+	if la.DNSName != "" && strings.HasPrefix(network, "tcp") {
+		scheme, defaultPort := "http", "80"
+		if strings.HasPrefix(listen, "tailscale+tls/") || port == "443" {
+			scheme, defaultPort = "https", "443"
+		}
+		host := la.DNSName
+		if port != defaultPort {
+			host = net.JoinHostPort(host, port)
+		}
+		la.URL = scheme + "://" + host
+	}
+	return la, true
+}
+
+// tailnetListeners returns where the Tailscale listeners of running nodes are reachable.
+func tailnetListeners(ctx context.Context) []listenerAddrs {
+	var keys []string
+	tailscaleListeners.Range(func(key, _ any) bool {
+		if k, ok := key.(string); ok {
+			keys = append(keys, k)
+		}
+		return true
+	})
+
+	running := make(map[string]*tailscaleNode)
+	for _, node := range runningNodes() {
+		running[node.name] = node
+	}
+
+	listeners := []listenerAddrs{}
+	for _, key := range keys {
+		_, name, _, _, ok := parseListenerKey(key)
+		if !ok {
+			continue
+		}
+		var ips []netip.Addr
+		var dnsName string
+		if node, ok := running[name]; ok {
+			if lc, err := node.LocalClient(); err == nil {
+				if st, err := lc.StatusWithoutPeers(ctx); err == nil {
+					ips = st.TailscaleIPs
+					if st.Self != nil {
+						dnsName = st.Self.DNSName
+					}
+				}
+			}
+		}
+		if la, ok := newListenerAddrs(key, ips, dnsName); ok {
+			listeners = append(listeners, la)
+		}
+	}
+	slices.SortFunc(listeners, func(a, b listenerAddrs) int { return cmp.Compare(a.Listen, b.Listen) })
+	return listeners
+}
@@ -0,0 +1,94 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func Test_NewListenerAddrs(t *testing.T) {
+	ips := []netip.Addr{netip.MustParseAddr("100.64.0.1"), netip.MustParseAddr("fd7a:115c:a1e0::1")}
+
+	tests := []struct {
+		name    string
+		key     string
+		ips     []netip.Addr
+		dnsName string
+		want    listenerAddrs
+	}{
+		{
+			name:    "http",
+			key:     "tailscale/myhost:tcp:80",
+			ips:     ips,
+			dnsName: "myhost.tailnet.ts.net.",
+			want: listenerAddrs{
+				Listen:    "tailscale/myhost:80",
+				Node:      "myhost",
+				Network:   "tcp",
+				Port:      "80",
+				DNSName:   "myhost.tailnet.ts.net",
+				Addresses: []string{"100.64.0.1:80", "[fd7a:115c:a1e0::1]:80"},
+				URL:       "http://myhost.tailnet.ts.net",
+			},
+		},
+		{
+			name:    "tls on other port",
+			key:     "tailscale+tls/myhost:tcp:8443",
+			ips:     ips[:1],
+			dnsName: "myhost.tailnet.ts.net.",
+			want: listenerAddrs{
+				Listen:    "tailscale+tls/myhost:8443",
+				Node:      "myhost",
+				Network:   "tcp",
+				Port:      "8443",
+				DNSName:   "myhost.tailnet.ts.net",
+				Addresses: []string{"100.64.0.1:8443"},
+				URL:       "https://myhost.tailnet.ts.net:8443",
+			},
+		},
+		{
+			name:    "udp",
+			key:     "tailscale/udp/myhost:udp:443",
+			ips:     ips[:1],
+			dnsName: "myhost.tailnet.ts.net.",
+			want: listenerAddrs{
+				Listen:    "tailscale/udp/myhost:443",
+				Node:      "myhost",
+				Network:   "udp",
+				Port:      "443",
+				DNSName:   "myhost.tailnet.ts.net",
+				Addresses: []string{"100.64.0.1:443"},
+			},
+		},
+		{
+			name: "not logged in",
+			key:  "tailscale/myhost:tcp:443",
+			want: listenerAddrs{
+				Listen:    "tailscale/myhost:443",
+				Node:      "myhost",
+				Network:   "tcp",
+				Port:      "443",
+				Addresses: []string{},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := newListenerAddrs(tt.key, tt.ips, tt.dnsName)
+			if !ok {
+				t.Fatalf("newListenerAddrs(%q) failed", tt.key)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("newListenerAddrs() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	if _, ok := newListenerAddrs("invalid", nil, ""); ok {
+		t.Error("newListenerAddrs(invalid) succeeded")
+	}
+}
@@ -0,0 +1,231 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// reaper.go contains the device reaper, which deletes stale devices using the Tailscale API,
+// keeping tailnets tidy when many short-lived instances register nodes, such as preview environments.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+	"tailscale.com/client/tailscale"
+)
+
+// Defaults for the device reaper.
+const (
+	defaultReapTTL      = 24 * time.Hour
+	defaultReapInterval = time.Hour
+)
+
+// Reaper configures periodic deletion of devices that have been offline for longer than TTL.
+// Only devices whose hostname starts with HostnamePrefix and that have one of Tags are deleted,
+// so at least one of them must be set.
+type Reaper struct {
+	// AuthKey is an OAuth client secret with the devices:core scope, used to list and delete devices.
+	// If empty, the app's auth key is used, which must be an OAuth client secret.
+	AuthKey string `json:"auth_key,omitempty"`
+
+	// HostnamePrefix is the prefix of the hostnames of devices to delete.
+	HostnamePrefix string `json:"hostname_prefix,omitempty"`
+
+	// Tags are the ACL tags of devices to delete. Devices with any of the tags are deleted.
+	Tags []string `json:"tags,omitempty"`
+
+	// TTL is how long a device must have been offline before it is deleted. Default: 24h
+	TTL caddy.Duration `json:"ttl,omitempty"`
+
+	// Interval is how often devices are checked. Default: 1h
+	Interval caddy.Duration `json:"interval,omitempty"`
+}
+
+// validate returns an error if the reaper could delete devices of the whole tailnet.
+func (r *Reaper) validate() error {
+	if r.HostnamePrefix == "" && len(r.Tags) == 0 {
+		return errors.New("reap requires hostname_prefix or tags")
+	}
+	if r.TTL < 0 || r.Interval < 0 {
+		return errors.New("reap ttl and interval must not be negative")
+	}
+	return nil
+}
+
+// ttl returns how long a device must have been offline before it is deleted.
+func (r *Reaper) ttl() time.Duration {
+	if r.TTL > 0 {
+		return time.Duration(r.TTL)
+	}
+	return defaultReapTTL
+}
+
+// interval returns how often devices are checked.
+func (r *Reaper) interval() time.Duration {
+	if r.Interval > 0 {
+		return time.Duration(r.Interval)
+	}
+	return defaultReapInterval
+}
+
+// expired reports whether d matches the reaper's filters and has been offline for longer than its TTL at now.
+// Devices whose last seen time is unknown are kept.
+func (r *Reaper) expired(d *tailscale.Device, now time.Time) bool {
+	if r.HostnamePrefix != "" && !strings.HasPrefix(d.Hostname, r.HostnamePrefix) {
+		return false
+	}
+	if len(r.Tags) > 0 && !slices.ContainsFunc(d.Tags, func(tag string) bool { return slices.Contains(r.Tags, tag) }) {
+		return false
+	}
+	lastSeen, err := time.Parse(time.RFC3339, d.LastSeen)
+	if err != nil {
+		return false
+	}
+	return now.Sub(lastSeen) > r.ttl()
+}
+
+// sweep deletes the expired devices of the tailnet, other than those of running nodes.
+func (r *Reaper) sweep(ctx context.Context, c *tailscale.Client, logger *zap.Logger, now time.Time) error {
+	devices, err := c.Devices(ctx, tailscale.DeviceDefaultFields)
+	if err != nil {
+		return err
+	}
+	running := runningNodeIDs()
+
+	var errs []error
+	for _, d := range devices {
+		if !r.expired(d, now) || running[d.NodeID] {
+			continue
+		}
+		if err := c.DeleteDevice(ctx, d.DeviceID); err != nil {
+			errs = append(errs, fmt.Errorf("deleting device %s: %w", d.Hostname, err))
+			continue
+		}
+		logger.Info("deleted stale device", zap.String("hostname", d.Hostname), zap.String("last_seen", d.LastSeen))
+	}
+	return errors.Join(errs...)
+}
+
+// runningNodeIDs returns the stable node IDs of the running nodes that are logged in.
+func runningNodeIDs() map[string]bool {
+	ids := make(map[string]bool)
+	for _, node := range runningNodes() {
+		if st, err := node.selfStatus(context.Background()); err == nil && st.Self != nil {
+			ids[string(st.Self.ID)] = true
+		}
+	}
+	return ids
+}
+
+// cancelReaper stops the app's device reaper, if it's running.
+func (t *App) cancelReaper() {
+	if t.stopReaper != nil {
+		t.stopReaper()
+		t.stopReaper = nil
+	}
+}
+
+// startReaper starts the app's device reaper, if configured, until the app stops.
+func (t *App) startReaper() error {
+	if t.Reap == nil {
+		return nil
+	}
+	if t.testNetwork != nil {
+		t.logger.Info("testing mode enabled, not starting device reaper")
+		return nil
+	}
+	if err := t.Reap.validate(); err != nil {
+		return err
+	}
+	authKey := t.Reap.AuthKey
+	if authKey == "" {
+		authKey = t.DefaultAuthKey
+	}
+	var err error
+	if authKey == "" && t.DefaultAuthKeyFile != "" {
+		authKey, err = readAuthKeyFile(t.DefaultAuthKeyFile)
+	} else {
+		authKey, err = repl.ReplaceOrErr(authKey, true, true)
+	}
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(authKey, "tskey-client-") {
+		return fmt.Errorf("reap: %w", ErrOAuthRequired)
+	}
+
+	var ctx context.Context
+	ctx, t.stopReaper = context.WithCancel(context.Background())
+	c := newAPIClient(ctx, authKey, t)
+	logger := t.logger.Named("reaper")
+	go func() {
+		ticker := time.NewTicker(t.Reap.interval())
+		defer ticker.Stop()
+		for {
+			if err := t.Reap.sweep(ctx, c, logger, time.Now()); err != nil && ctx.Err() == nil {
+				logger.Error("deleting stale devices", zap.Error(err))
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return nil
+}
+
+// parseReaper parses the reap block of the tailscale global option.
+func parseReaper(d *caddyfile.Dispenser) (*Reaper, error) {
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	r := new(Reaper)
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "auth_key":
+			if !d.AllArgs(&r.AuthKey) {
+				return nil, d.ArgErr()
+			}
+		case "hostname_prefix":
+			if !d.AllArgs(&r.HostnamePrefix) {
+				return nil, d.ArgErr()
+			}
+		case "tags":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return nil, d.ArgErr()
+			}
+			r.Tags = append(r.Tags, args...)
+		case "ttl", "interval":
+			opt := d.Val()
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			v, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return nil, d.WrapErr(err)
+			}
+			if opt == "ttl" {
+				r.TTL = caddy.Duration(v)
+			} else {
+				r.Interval = caddy.Duration(v)
+			}
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+		default:
+			return nil, d.Errf("unrecognized subdirective: %s", d.Val())
+		}
+	}
+	if err := r.validate(); err != nil {
+		return nil, d.Err(err.Error())
+	}
+	return r, nil
+}
@@ -0,0 +1,105 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+	"tailscale.com/client/tailscale"
+)
+
+func Test_ReaperExpired(t *testing.T) {
+	now := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	stale := now.Add(-48 * time.Hour).Format(time.RFC3339)
+	recent := now.Add(-time.Hour).Format(time.RFC3339)
+
+	tests := map[string]struct {
+		reaper Reaper
+		device tailscale.Device
+		want   bool
+	}{
+		"stale with prefix": {
+			reaper: Reaper{HostnamePrefix: "preview-"},
+			device: tailscale.Device{Hostname: "preview-123", LastSeen: stale},
+			want:   true,
+		},
+		"recently seen": {
+			reaper: Reaper{HostnamePrefix: "preview-"},
+			device: tailscale.Device{Hostname: "preview-123", LastSeen: recent},
+		},
+		"other prefix": {
+			reaper: Reaper{HostnamePrefix: "preview-"},
+			device: tailscale.Device{Hostname: "prod", LastSeen: stale},
+		},
+		"stale with tag": {
+			reaper: Reaper{Tags: []string{"tag:ci"}},
+			device: tailscale.Device{Hostname: "runner", Tags: []string{"tag:web", "tag:ci"}, LastSeen: stale},
+			want:   true,
+		},
+		"without tag": {
+			reaper: Reaper{Tags: []string{"tag:ci"}},
+			device: tailscale.Device{Hostname: "runner", Tags: []string{"tag:web"}, LastSeen: stale},
+		},
+		"prefix and tag both required": {
+			reaper: Reaper{HostnamePrefix: "preview-", Tags: []string{"tag:ci"}},
+			device: tailscale.Device{Hostname: "preview-123", LastSeen: stale},
+		},
+		"custom ttl": {
+			reaper: Reaper{HostnamePrefix: "preview-", TTL: caddy.Duration(30 * time.Minute)},
+			device: tailscale.Device{Hostname: "preview-123", LastSeen: recent},
+			want:   true,
+		},
+		"unknown last seen": {
+			reaper: Reaper{HostnamePrefix: "preview-"},
+			device: tailscale.Device{Hostname: "preview-123"},
+		},
+	}
+	for tn, tt := range tests {
+		t.Run(tn, func(t *testing.T) {
+			if got := tt.reaper.expired(&tt.device, now); got != tt.want {
+				t.Errorf("expired() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_ReaperSweep(t *testing.T) {
+	now := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	var deleted []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/api/v2/oauth/token":
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"access_token":"token","token_type":"bearer"}`)
+		case r.Method == "GET" && r.URL.Path == "/api/v2/tailnet/-/devices":
+			io.WriteString(w, `{"devices":[
+				{"id":"1","hostname":"preview-1","lastSeen":"2023-12-30T00:00:00Z"},
+				{"id":"2","hostname":"preview-2","lastSeen":"2024-01-01T23:00:00Z"},
+				{"id":"3","hostname":"prod","lastSeen":"2023-12-30T00:00:00Z"}
+			]}`)
+		case r.Method == "DELETE":
+			deleted = append(deleted, r.URL.Path)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	client := newAPIClient(context.Background(), "tskey-client-secret", &App{ControlURL: srv.URL})
+
+	r := &Reaper{HostnamePrefix: "preview-"}
+	if err := r.sweep(context.Background(), client, zap.NewNop(), now); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"/api/v2/device/1"}; !slices.Equal(deleted, want) {
+		t.Errorf("deleted = %v, want %v", deleted, want)
+	}
+}
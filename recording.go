@@ -0,0 +1,160 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// recording.go contains session recording for forwarded connections,
+// which streams the data of each connection to tsrecorder nodes or to files in a local directory.
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"tailscale.com/sessionrecording"
+)
+
+// Recording configures session recording for the connections of a forward.
+// Each connection is recorded in the asciicast v2 format used by Tailscale SSH session recording,
+// with data sent by the client as input events and data sent by the target as output events.
+// Binary data is not preserved exactly, since asciicast events hold text.
+type Recording struct {
+	// Recorders are the tailnet addresses (<ip>:<port>) of tsrecorder nodes to upload recordings to,
+	// tried in order. Recorders are dialed through the forward's node.
+	Recorders []string `json:"recorders,omitempty"`
+
+	// Dir is a local directory to write recordings to, with one file per connection.
+	// If Recorders are also set, the directory is only used if no recorder can be reached.
+	Dir string `json:"dir,omitempty"`
+
+	// FailOpen allows connections to be forwarded without a recording if the recording can't be started,
+	// and keeps them open if it fails. By default, such connections are closed.
+	FailOpen bool `json:"fail_open,omitempty"`
+}
+
+// validate checks that the recording has a destination and valid recorder addresses.
+func (rec *Recording) validate() error {
+	if len(rec.Recorders) == 0 && rec.Dir == "" {
+		return errors.New("recording requires recorders or a directory")
+	}
+	for _, r := range rec.Recorders {
+		if _, err := netip.ParseAddrPort(r); err != nil {
+			return fmt.Errorf("recorder address must be <ip>:<port>, got %q", r)
+		}
+	}
+	return nil
+}
+
+// open starts a recording of a connection forwarded by node to target.
+func (rec *Recording) open(ctx context.Context, node *tailscaleNode, target string, logger *zap.Logger) (*recording, error) {
+	header := sessionrecording.CastHeader{
+		Version:      2,
+		Timestamp:    time.Now().Unix(),
+		Command:      "forward " + target,
+		ConnectionID: rand.Text(),
+	}
+	if lc, err := node.LocalClient(); err == nil {
+		if st, err := lc.StatusWithoutPeers(ctx); err == nil && st.Self != nil {
+			header.SrcNode = strings.TrimSuffix(st.Self.DNSName, ".")
+			header.SrcNodeID = st.Self.ID
+		}
+	}
+
+	w, err := rec.connect(ctx, node, header, logger)
+	if err != nil {
+		return nil, err
+	}
+	r := &recording{w: w, enc: json.NewEncoder(w), start: time.Now()}
+	if err := r.enc.Encode(header); err != nil {
+		w.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// connect opens the destination of a recording, trying the recorders before the directory.
+func (rec *Recording) connect(ctx context.Context, node *tailscaleNode, header sessionrecording.CastHeader, logger *zap.Logger) (io.WriteCloser, error) {
+	var errs []error
+	if len(rec.Recorders) > 0 {
+		addrs := make([]netip.AddrPort, len(rec.Recorders))
+		for i, r := range rec.Recorders {
+			addrs[i], _ = netip.ParseAddrPort(r)
+		}
+		w, _, errc, err := sessionrecording.ConnectToRecorder(ctx, addrs, node.Dial)
+		if err == nil {
+			go func() {
+				if err := <-errc; err != nil {
+					logger.Error("uploading session recording", zap.Error(err))
+				}
+			}()
+			return w, nil
+		}
+		errs = append(errs, err)
+	}
+	if rec.Dir != "" {
+		if err := os.MkdirAll(rec.Dir, 0o700); err != nil {
+			return nil, errors.Join(append(errs, err)...)
+		}
+		name := fmt.Sprintf("%s-%s.cast", time.Unix(header.Timestamp, 0).UTC().Format("20060102T150405Z"), header.ConnectionID)
+		f, err := os.OpenFile(filepath.Join(rec.Dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+		if err != nil {
+			return nil, errors.Join(append(errs, err)...)
+		}
+		return f, nil
+	}
+	return nil, errors.Join(errs...)
+}
+
+// errRecordingFailed is returned when forwarding data that can't be recorded.
+var errRecordingFailed = errors.New("session recording failed")
+
+// recording is the recording of a forwarded connection.
+// Both directions of the connection write events to it concurrently.
+type recording struct {
+	mu    sync.Mutex
+	w     io.WriteCloser
+	enc   *json.Encoder
+	start time.Time
+	err   error // the first error writing the recording
+}
+
+// writeEvent records data sent in one direction of the connection.
+// The kind is "i" for data sent by the client, and "o" for data sent by the target.
+func (r *recording) writeEvent(kind string, data []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err == nil {
+		r.err = r.enc.Encode([]any{time.Since(r.start).Seconds(), kind, string(data)})
+	}
+	return r.err
+}
+
+// Close finishes the recording.
+func (r *recording) Close() error {
+	return r.w.Close()
+}
+
+// recordingWriter records the data written to it as events of a kind.
+// If failOpen is set, recording errors are not returned, so that the connection isn't closed.
+type recordingWriter struct {
+	rec      *recording
+	kind     string
+	failOpen bool
+}
+
+func (w recordingWriter) Write(p []byte) (int, error) {
+	if err := w.rec.writeEvent(w.kind, p); err != nil && !w.failOpen {
+		return 0, fmt.Errorf("%w: %w", errRecordingFailed, err)
+	}
+	return len(p), nil
+}
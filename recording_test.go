@@ -0,0 +1,95 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.uber.org/zap"
+	"tailscale.com/sessionrecording"
+)
+
+func Test_RecordingDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "recordings")
+	rec := &Recording{Dir: dir}
+	if err := rec.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Recordings written to a directory don't use the node.
+	header := sessionrecording.CastHeader{Version: 2, Timestamp: 1700000000, ConnectionID: "conn"}
+	w, err := rec.connect(context.Background(), nil, header, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &recording{w: w, enc: json.NewEncoder(w)}
+	if err := r.enc.Encode(header); err != nil {
+		t.Fatal(err)
+	}
+	recordingWriter{rec: r, kind: "i"}.Write([]byte("ping"))
+	recordingWriter{rec: r, kind: "o"}.Write([]byte("pong"))
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(filepath.Join(dir, "20231114T221320Z-conn.cast"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	var got sessionrecording.CastHeader
+	if err := dec.Decode(&got); err != nil || got.ConnectionID != "conn" {
+		t.Errorf("header = %+v, %v; want connection conn", got, err)
+	}
+	for _, want := range []string{"i ping", "o pong"} {
+		var event []any
+		if err := dec.Decode(&event); err != nil || len(event) != 3 || event[1].(string)+" "+event[2].(string) != want {
+			t.Errorf("event = %v, %v; want %s", event, err, want)
+		}
+	}
+}
+
+func Test_RecordingWriterFailOpen(t *testing.T) {
+	r := &recording{w: nopWriteCloser{}, enc: json.NewEncoder(failingWriter{})}
+	if _, err := (recordingWriter{rec: r, kind: "i"}).Write([]byte("data")); !errors.Is(err, errRecordingFailed) {
+		t.Errorf("fail closed Write() err = %v; want %v", err, errRecordingFailed)
+	}
+	if n, err := (recordingWriter{rec: r, kind: "i", failOpen: true}).Write([]byte("data")); n != 4 || err != nil {
+		t.Errorf("fail open Write() = %d, %v; want 4, nil", n, err)
+	}
+}
+
+func Test_RecordingValidate(t *testing.T) {
+	tests := map[string]struct {
+		rec     Recording
+		wantErr bool
+	}{
+		"recorders":         {rec: Recording{Recorders: []string{"100.64.0.10:80"}}},
+		"directory":         {rec: Recording{Dir: "/var/lib/caddy/recordings"}},
+		"no destination":    {wantErr: true},
+		"recorder hostname": {rec: Recording{Recorders: []string{"recorder:80"}}, wantErr: true},
+	}
+	for tn, tt := range tests {
+		t.Run(tn, func(t *testing.T) {
+			if err := tt.rec.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) { return 0, errors.New("disk full") }
+
+type nopWriteCloser struct{}
+
+func (nopWriteCloser) Write(p []byte) (int, error) { return len(p), nil }
+func (nopWriteCloser) Close() error                { return nil }
@@ -0,0 +1,172 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// requestmetrics.go contains per-node request metrics and slow request logging for sites served on Tailscale nodes,
+// since requests from the tailnet can't be told apart by the usual per-client debugging at a load balancer.
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(RequestMetrics{})
+	httpcaddyfile.RegisterHandlerDirective("tailscale_metrics", parseRequestMetrics)
+	httpcaddyfile.RegisterDirectiveOrder("tailscale_metrics", httpcaddyfile.After, "tracing")
+}
+
+// requestMetrics are the metrics of requests received on Tailscale nodes, labeled by node.
+type requestMetrics struct {
+	inFlight *prometheus.GaugeVec
+	slow     *prometheus.CounterVec
+}
+
+// newRequestMetrics creates request metrics and registers them with registry.
+func newRequestMetrics(registry *prometheus.Registry) (*requestMetrics, error) {
+	m := &requestMetrics{
+		inFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "caddy",
+			Subsystem: "tailscale",
+			Name:      "requests_in_flight",
+			Help:      "Number of requests currently being handled, by the Tailscale node that received them.",
+		}, []string{"node"}),
+		slow: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "caddy",
+			Subsystem: "tailscale",
+			Name:      "slow_requests_total",
+			Help:      "Number of requests that took longer than the node's slow request threshold.",
+		}, []string{"node"}),
+	}
+	if registry == nil {
+		return m, nil
+	}
+	for _, c := range []prometheus.Collector{m.inFlight, m.slow} {
+		if err := registry.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// RequestMetrics is a Caddy HTTP handler that records metrics of requests received on Tailscale nodes,
+// and logs requests that take longer than the node's slow request threshold.
+//
+// The following metrics are exported through Caddy's metrics endpoint, labeled by node:
+//   - caddy_tailscale_requests_in_flight: the number of requests currently being handled
+//   - caddy_tailscale_slow_requests_total: the number of requests slower than the threshold
+//
+// Requests received on other listeners are passed through unchanged.
+type RequestMetrics struct {
+	app    *App
+	logger *zap.Logger
+}
+
+func (RequestMetrics) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.tailscale_metrics",
+		New: func() caddy.Module { return new(RequestMetrics) },
+	}
+}
+
+// Provision implements caddy.Provisioner.
+func (rm *RequestMetrics) Provision(ctx caddy.Context) error {
+	app, err := getApp(ctx)
+	if err != nil {
+		return err
+	}
+	if app.requestMetrics == nil {
+		return errors.New("tailscale app has no request metrics")
+	}
+	rm.app = app
+	rm.logger = ctx.Logger(rm)
+	return nil
+}
+
+// ServeHTTP implements caddyhttp.MiddlewareHandler.
+func (rm RequestMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	node, ok := requestNode(r)
+	if !ok {
+		return next.ServeHTTP(w, r)
+	}
+
+	inFlight := rm.app.requestMetrics.inFlight.WithLabelValues(node.name)
+	inFlight.Inc()
+	defer inFlight.Dec()
+
+	threshold := getSlowRequestThreshold(r, node.name, rm.app)
+	if threshold <= 0 {
+		return next.ServeHTTP(w, r)
+	}
+
+	start := time.Now()
+	rec := caddyhttp.NewResponseRecorder(w, nil, nil)
+	err := next.ServeHTTP(rec, r)
+	if d := time.Since(start); d >= threshold {
+		rm.app.requestMetrics.slow.WithLabelValues(node.name).Inc()
+		rm.logger.Warn("slow request",
+			zap.String("node", node.name),
+			zap.String("remote_addr", r.RemoteAddr),
+			zap.String("method", r.Method),
+			zap.String("host", r.Host),
+			zap.String("uri", r.RequestURI),
+			zap.Int("status", rec.Status()),
+			zap.Duration("duration", d),
+			zap.Duration("threshold", threshold),
+		)
+	}
+	return err
+}
+
+// UnmarshalCaddyfile sets up the handler from Caddyfile tokens. Syntax:
+//
+//	tailscale_metrics
+func (rm *RequestMetrics) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume directive name
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	if d.NextBlock(0) {
+		return d.Errf("unrecognized subdirective: %s", d.Val())
+	}
+	return nil
+}
+
+// parseRequestMetrics parses the tailscale_metrics directive.
+func parseRequestMetrics(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	rm := new(RequestMetrics)
+	err := rm.UnmarshalCaddyfile(h.Dispenser)
+	return rm, err
+}
+
+// getSlowRequestThreshold returns how long requests received on the named node can take before they are logged as slow.
+// If zero, slow requests are not logged.
+func getSlowRequestThreshold(r *http.Request, name string, app *App) time.Duration {
+	if siteNode, exists := getScopedConfig(r, name); exists {
+		if siteNode.SlowRequestThreshold != 0 {
+			return time.Duration(siteNode.SlowRequestThreshold)
+		}
+	}
+
+	if node, ok := app.Nodes[name]; ok {
+		if node.SlowRequestThreshold != 0 {
+			return time.Duration(node.SlowRequestThreshold)
+		}
+	}
+	return time.Duration(app.SlowRequestThreshold)
+}
+
+var (
+	_ caddyhttp.MiddlewareHandler = (*RequestMetrics)(nil)
+	_ caddyfile.Unmarshaler       = (*RequestMetrics)(nil)
+	_ caddy.Provisioner           = (*RequestMetrics)(nil)
+)
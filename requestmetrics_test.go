@@ -0,0 +1,78 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+)
+
+func Test_RequestMetrics(t *testing.T) {
+	app := &App{
+		Nodes: map[string]Node{
+			"slow": {SlowRequestThreshold: caddy.Duration(time.Nanosecond)},
+		},
+	}
+	var err error
+	if app.requestMetrics, err = newRequestMetrics(prometheus.NewRegistry()); err != nil {
+		t.Fatal(err)
+	}
+	rm := RequestMetrics{app: app, logger: zap.NewNop()}
+
+	tests := []struct {
+		name     string
+		node     string // node the request is received on, if any
+		wantSlow float64
+	}{
+		// Runs first, so that no metrics have been recorded yet.
+		{name: "other listener"},
+		{name: "node", node: "fast"},
+		{name: "slow node", node: "slow", wantSlow: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.node != "" {
+				conn := &nodeConn{node: &tailscaleNode{name: tt.node}}
+				r = r.WithContext(context.WithValue(r.Context(), caddyhttp.ConnCtxKey, conn))
+			}
+
+			var inFlight float64
+			next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				if tt.node != "" {
+					inFlight = testutil.ToFloat64(app.requestMetrics.inFlight.WithLabelValues(tt.node))
+				}
+				return nil
+			})
+			if err := rm.ServeHTTP(httptest.NewRecorder(), r, next); err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.node == "" {
+				if n := testutil.CollectAndCount(app.requestMetrics.inFlight); n != 0 {
+					t.Errorf("recorded %d in-flight metrics for a request on another listener, want 0", n)
+				}
+				return
+			}
+			if inFlight != 1 {
+				t.Errorf("in-flight requests during request = %v, want 1", inFlight)
+			}
+			if got := testutil.ToFloat64(app.requestMetrics.inFlight.WithLabelValues(tt.node)); got != 0 {
+				t.Errorf("in-flight requests after request = %v, want 0", got)
+			}
+			if got := testutil.ToFloat64(app.requestMetrics.slow.WithLabelValues(tt.node)); got != tt.wantSlow {
+				t.Errorf("slow requests = %v, want %v", got, tt.wantSlow)
+			}
+		})
+	}
+}
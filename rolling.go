@@ -0,0 +1,268 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// rolling.go contains rolling restart coordination, which lets multiple Caddy instances serving the same
+// tailnet service tag restart one at a time, so that tag-based upstream consumers always have instances to use.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+	"tailscale.com/ipn"
+)
+
+// Defaults for rolling restart coordination.
+const (
+	defaultRollingTimeout = 5 * time.Minute
+	defaultRollingSettle  = 10 * time.Second
+)
+
+// rollingPollInterval is how often the lease and nodes are checked while waiting.
+var rollingPollInterval = time.Second
+
+// RollingRestart coordinates restarts of Caddy instances whose nodes share Tag, using a lease in Caddy's storage,
+// which must be shared by the instances. An instance takes the lease when it shuts down,
+// waiting for other instances to release it, and releases it once its nodes with Tag are running again.
+type RollingRestart struct {
+	// Tag is the ACL tag shared by the nodes of the instances, such as "tag:web".
+	Tag string `json:"tag,omitempty"`
+
+	// Timeout is how long an instance waits for the lease before shutting down anyway,
+	// and how long the lease is held before it expires if the instance doesn't come back. Default: 5m
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	// Settle is how long an instance keeps the lease after its nodes are running,
+	// so that consumers can discover them before another instance restarts. Default: 10s
+	Settle caddy.Duration `json:"settle,omitempty"`
+}
+
+// rollingLease is the lease stored in Caddy's storage.
+type rollingLease struct {
+	// Owner is the instance ID of the Caddy instance holding the lease.
+	Owner string `json:"owner"`
+
+	// Expires is when the lease expires.
+	Expires time.Time `json:"expires"`
+}
+
+// timeout returns how long to wait for the lease, and how long it is held for.
+func (rr *RollingRestart) timeout() time.Duration {
+	if rr.Timeout > 0 {
+		return time.Duration(rr.Timeout)
+	}
+	return defaultRollingTimeout
+}
+
+// settle returns how long the lease is kept after the instance's nodes are running.
+func (rr *RollingRestart) settle() time.Duration {
+	if rr.Settle > 0 {
+		return time.Duration(rr.Settle)
+	}
+	return defaultRollingSettle
+}
+
+// leaseKey returns the storage key of the lease.
+func (rr *RollingRestart) leaseKey() string {
+	return "tailscale/rolling_restart/" + strings.TrimPrefix(rr.Tag, "tag:") + ".json"
+}
+
+// tryAcquire takes the lease for owner if it is free, expired or already held by owner.
+// It reports whether owner holds the lease.
+func (rr *RollingRestart) tryAcquire(ctx context.Context, s certmagic.Storage, owner string, now time.Time) (bool, error) {
+	key := rr.leaseKey()
+	if err := s.Lock(ctx, key); err != nil {
+		return false, err
+	}
+	defer s.Unlock(context.Background(), key)
+
+	var lease rollingLease
+	data, err := s.Load(ctx, key)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		return false, err
+	default:
+		if err := json.Unmarshal(data, &lease); err != nil {
+			return false, fmt.Errorf("invalid rolling restart lease: %w", err)
+		}
+	}
+	if lease.Owner != "" && lease.Owner != owner && now.Before(lease.Expires) {
+		return false, nil
+	}
+
+	data, err = json.Marshal(rollingLease{Owner: owner, Expires: now.Add(rr.timeout())})
+	if err != nil {
+		return false, err
+	}
+	return true, s.Store(ctx, key, data)
+}
+
+// release removes the lease if it is held by owner.
+func (rr *RollingRestart) release(ctx context.Context, s certmagic.Storage, owner string) error {
+	key := rr.leaseKey()
+	if err := s.Lock(ctx, key); err != nil {
+		return err
+	}
+	defer s.Unlock(context.Background(), key)
+
+	data, err := s.Load(ctx, key)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var lease rollingLease
+	if err := json.Unmarshal(data, &lease); err == nil && lease.Owner != owner {
+		return nil
+	}
+	return s.Delete(ctx, key)
+}
+
+// acquire waits until owner holds the lease, or until ctx is done.
+func (rr *RollingRestart) acquire(ctx context.Context, storage certmagic.Storage, owner string) error {
+	for {
+		ok, err := rr.tryAcquire(ctx, storage, owner, time.Now())
+		if err != nil || ok {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(rollingPollInterval):
+		}
+	}
+}
+
+// taggedNodesRunning reports whether there are nodes created with tag, and all of them are running on the tailnet.
+func taggedNodesRunning(ctx context.Context, tag string) bool {
+	// Nodes are queried after collecting them, so the pool isn't held during I/O.
+	var tagged []*tailscaleNode
+	nodes.Range(func(_, value any) bool {
+		node, ok := value.(*tailscaleNode)
+		if !ok {
+			return true
+		}
+		node.tagsMu.Lock()
+		defer node.tagsMu.Unlock()
+		if slices.Contains(node.tags, tag) {
+			tagged = append(tagged, node)
+		}
+		return true
+	})
+	if len(tagged) == 0 {
+		return false
+	}
+	for _, node := range tagged {
+		if !node.started.Load() {
+			return false
+		}
+		st, err := node.selfStatus(ctx)
+		if err != nil || st.BackendState != ipn.Running.String() {
+			return false
+		}
+	}
+	return true
+}
+
+// startRollingRestart releases the instance's lease, if it holds one from a previous shutdown,
+// once its nodes with the tag are running and have settled, or once the lease has expired.
+func (t *App) startRollingRestart() error {
+	rr := t.RollingRestart
+	if rr == nil {
+		return nil
+	}
+	owner, err := caddy.InstanceID()
+	if err != nil {
+		return err
+	}
+	storage := t.ctx.Storage()
+	logger := t.logger.Named("rolling_restart")
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), rr.timeout())
+		defer cancel()
+		for !taggedNodesRunning(ctx, rr.Tag) {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(rollingPollInterval):
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(rr.settle()):
+		}
+		if err := rr.release(ctx, storage, owner.String()); err != nil {
+			logger.Error("releasing rolling restart lease", zap.Error(err))
+		}
+	}()
+	return nil
+}
+
+// stopRollingRestart takes the lease before the instance shuts down,
+// so that other instances don't shut down until the instance is running again.
+// Config reloads don't take the lease, since nodes keep running across them.
+func (t *App) stopRollingRestart() {
+	rr := t.RollingRestart
+	if rr == nil || !caddy.Exiting() {
+		return
+	}
+	owner, err := caddy.InstanceID()
+	if err != nil {
+		t.logger.Error("getting instance ID for rolling restart", zap.Error(err))
+		return
+	}
+	logger := t.logger.Named("rolling_restart")
+	logger.Info("waiting for rolling restart lease", zap.String("tag", rr.Tag))
+
+	ctx, cancel := context.WithTimeout(context.Background(), rr.timeout())
+	defer cancel()
+	if err := rr.acquire(ctx, t.ctx.Storage(), owner.String()); err != nil {
+		logger.Warn("shutting down without rolling restart lease", zap.String("tag", rr.Tag), zap.Error(err))
+	}
+}
+
+// parseRollingRestart parses the rolling_restart option of the tailscale global option.
+func parseRollingRestart(d *caddyfile.Dispenser) (*RollingRestart, error) {
+	rr := new(RollingRestart)
+	if !d.AllArgs(&rr.Tag) {
+		return nil, d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "timeout", "settle":
+			opt := d.Val()
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			v, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return nil, d.WrapErr(err)
+			}
+			if opt == "timeout" {
+				rr.Timeout = caddy.Duration(v)
+			} else {
+				rr.Settle = caddy.Duration(v)
+			}
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+		default:
+			return nil, d.Errf("unrecognized subdirective: %s", d.Val())
+		}
+	}
+	return rr, nil
+}
@@ -0,0 +1,84 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/certmagic"
+	"github.com/msfjarvis/caddy-tailscale/tscaddytest"
+	"tailscale.com/util/must"
+)
+
+func Test_RollingRestartLease(t *testing.T) {
+	ctx := context.Background()
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	rr := &RollingRestart{Tag: "tag:web", Timeout: caddy.Duration(time.Minute)}
+	now := time.Now()
+
+	acquired := func(owner string, now time.Time) bool {
+		t.Helper()
+		ok, err := rr.tryAcquire(ctx, storage, owner, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+
+	if !acquired("a", now) {
+		t.Fatal("a couldn't take a free lease")
+	}
+	if !acquired("a", now) {
+		t.Error("a couldn't take its own lease again")
+	}
+	if acquired("b", now.Add(30*time.Second)) {
+		t.Error("b took a's lease before it expired")
+	}
+
+	// Releasing another instance's lease does nothing.
+	if err := rr.release(ctx, storage, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if acquired("b", now.Add(30*time.Second)) {
+		t.Error("b took a's lease after releasing it itself")
+	}
+
+	if !acquired("b", now.Add(2*time.Minute)) {
+		t.Error("b couldn't take a's expired lease")
+	}
+	if err := rr.release(ctx, storage, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if !acquired("c", now.Add(2*time.Minute)) {
+		t.Error("c couldn't take the released lease")
+	}
+}
+
+func Test_TaggedNodesRunning(t *testing.T) {
+	control := tscaddytest.NewControl(t)
+
+	runTestApp(t, newTestApp(t, control, map[string]Node{
+		"rolling": {Tags: []string{"tag:web"}},
+	}))
+
+	node := must.Get(getNode(caddy.ActiveContext(), "rolling"))
+	defer nodes.Delete("rolling")
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if taggedNodesRunning(ctx, "tag:web") {
+		t.Error("taggedNodesRunning() = true before the node started; want false")
+	}
+	must.Do(node.start())
+	must.Get(node.Up(ctx))
+	if !taggedNodesRunning(ctx, "tag:web") {
+		t.Error("taggedNodesRunning() = false once the node is running; want true")
+	}
+	if taggedNodesRunning(ctx, "tag:db") {
+		t.Error("taggedNodesRunning() = true without nodes with the tag; want false")
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// routes.go contains support for nodes acting as subnet routers and exit nodes,
+// and approval of their routes using the Tailscale API.
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"net/netip"
+	"slices"
+
+	"go.uber.org/zap"
+	"tailscale.com/net/tsaddr"
+)
+
+// getAdvertiseRoutes returns the routes the named node advertises to the tailnet,
+// including exit node routes if it advertises itself as an exit node.
+func getAdvertiseRoutes(name string, app *App) ([]netip.Prefix, error) {
+	var routes []string
+	var exitNode bool
+
+	// Check site-specific configuration first
+	if siteNode, exists := getSiteConfig(name); exists && (len(siteNode.AdvertiseRoutes) > 0 || siteNode.AdvertiseExitNode) {
+		routes, exitNode = siteNode.AdvertiseRoutes, siteNode.AdvertiseExitNode
+	} else if node, ok := app.Nodes[name]; ok {
+		routes, exitNode = node.AdvertiseRoutes, node.AdvertiseExitNode
+	}
+
+	var prefixes []netip.Prefix
+	for _, r := range routes {
+		p, err := netip.ParsePrefix(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid advertised route: %v", err)
+		}
+		if p != p.Masked() {
+			return nil, fmt.Errorf("invalid advertised route %s: non-zero host bits, use %s", p, p.Masked())
+		}
+		prefixes = append(prefixes, p)
+	}
+	if exitNode {
+		prefixes = append(prefixes, tsaddr.ExitRoutes()...)
+	}
+	slices.SortFunc(prefixes, func(a, b netip.Prefix) int {
+		return cmp.Or(a.Addr().Compare(b.Addr()), cmp.Compare(a.Bits(), b.Bits()))
+	})
+	return slices.Compact(prefixes), nil
+}
+
+// getApproveRoutes returns whether the named node's advertised routes are approved using the Tailscale API.
+func getApproveRoutes(name string, app *App) bool {
+	if siteNode, exists := getSiteConfig(name); exists && siteNode.ApproveRoutes {
+		return true
+	}
+	if node, ok := app.Nodes[name]; ok {
+		return node.ApproveRoutes
+	}
+	return false
+}
+
+// approveRoutes waits for the node to connect to the tailnet,
+// then approves its advertised routes for its device.
+// Errors are logged, since the node is otherwise usable.
+func (t *tailscaleNode) approveRoutes() {
+	ctx := context.Background()
+	st, err := t.Up(ctx)
+	if err != nil {
+		t.reportError("waiting for node to approve routes", err)
+		return
+	}
+	if _, err := t.apiClient.SetRoutes(ctx, string(st.Self.ID), t.routes); err != nil {
+		t.reportError("approving advertised routes", err, zap.Stringers("routes", t.routes))
+		return
+	}
+	t.logger.Info("approved advertised routes", zap.Stringers("routes", t.routes))
+}
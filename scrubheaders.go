@@ -0,0 +1,97 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// scrubheaders.go contains a handler that removes spoofed identity headers from requests,
+// so that clients can't impersonate tailnet users to upstreams that trust the headers.
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(&ScrubHeaders{})
+}
+
+// defaultIdentityHeaders are the identity headers set by tailscale-proxy and `tailscale serve`.
+var defaultIdentityHeaders = []string{
+	"X-Webauth-User",
+	"X-Webauth-Email",
+	"X-Webauth-Name",
+	"X-Webauth-Photo",
+	"X-Webauth-Tailnet",
+	defaultLoginHeader,
+	defaultNameHeader,
+	defaultProfilePictureHeader,
+}
+
+// ScrubHeaders is a Caddy HTTP handler that removes identity headers sent by clients,
+// before the headers are set from the client's Tailscale identity.
+// It is added automatically before tailscale_auth in the Caddyfile, and runs on all listeners.
+//
+// Variants of the headers, such as X-Webauth_User, are always removed, since many upstreams treat
+// underscores and hyphens in header names the same. The headers themselves are kept on requests
+// from the server's trusted_proxies, which may set them for the header identity resolver.
+// Removed headers are logged, since they are a sign of an impersonation attempt.
+type ScrubHeaders struct {
+	// Headers are the names of identity headers to remove, in addition to the defaults:
+	// the X-Webauth-* headers set by tailscale-proxy, and the Tailscale-User-* headers set by `tailscale serve`.
+	Headers []string `json:"headers,omitempty"`
+
+	logger *zap.Logger
+	names  map[string]string // normalized name to header name
+}
+
+func (*ScrubHeaders) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.tailscale_scrub_headers",
+		New: func() caddy.Module { return new(ScrubHeaders) },
+	}
+}
+
+// Provision implements caddy.Provisioner.
+func (sh *ScrubHeaders) Provision(ctx caddy.Context) error {
+	sh.logger = ctx.Logger(sh)
+	sh.names = make(map[string]string)
+	for _, h := range slices.Concat(defaultIdentityHeaders, sh.Headers) {
+		sh.names[normalizeHeaderName(h)] = http.CanonicalHeaderKey(h)
+	}
+	return nil
+}
+
+// ServeHTTP implements caddyhttp.MiddlewareHandler.
+func (sh *ScrubHeaders) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	trusted, _ := caddyhttp.GetVar(r.Context(), caddyhttp.TrustedProxyVarKey).(bool)
+	for key := range r.Header {
+		name, ok := sh.names[normalizeHeaderName(key)]
+		if !ok || (trusted && key == name) {
+			continue
+		}
+		delete(r.Header, key) // not Del, which canonicalizes key
+		sh.logger.Warn("removed identity header sent by client",
+			zap.String("header", key),
+			zap.String("remote_addr", r.RemoteAddr),
+			zap.String("host", r.Host),
+			zap.String("uri", r.RequestURI),
+		)
+	}
+	return next.ServeHTTP(w, r)
+}
+
+// normalizeHeaderName returns the name that upstreams may treat header as,
+// which is case-insensitive and doesn't distinguish underscores from hyphens.
+func normalizeHeaderName(header string) string {
+	return strings.ReplaceAll(strings.ToLower(header), "_", "-")
+}
+
+var (
+	_ caddyhttp.MiddlewareHandler = (*ScrubHeaders)(nil)
+	_ caddy.Provisioner           = (*ScrubHeaders)(nil)
+)
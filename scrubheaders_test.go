@@ -0,0 +1,108 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/google/go-cmp/cmp"
+)
+
+func Test_ScrubHeaders(t *testing.T) {
+	sh := &ScrubHeaders{Headers: []string{"X-Remote-User"}}
+	if err := sh.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		trusted bool
+		headers map[string]string
+		want    http.Header
+	}{
+		"spoofed headers": {
+			headers: map[string]string{
+				"X-Webauth-User":       "alice@example.com",
+				"Tailscale-User-Login": "alice@example.com",
+				"Accept":               "text/html",
+			},
+			want: http.Header{"Accept": {"text/html"}},
+		},
+		"underscore variant": {
+			headers: map[string]string{"X-Webauth_User": "alice@example.com", "TAILSCALE_USER_LOGIN": "alice@example.com"},
+			want:    http.Header{},
+		},
+		"custom header": {
+			headers: map[string]string{"X-Remote-User": "alice", "X_Remote_User": "alice"},
+			want:    http.Header{},
+		},
+		"trusted proxy": {
+			trusted: true,
+			headers: map[string]string{"Tailscale-User-Login": "alice@example.com", "Tailscale_User_Login": "mallory@example.com"},
+			want:    http.Header{"Tailscale-User-Login": {"alice@example.com"}},
+		},
+	}
+	for tn, tt := range tests {
+		t.Run(tn, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			for k, v := range tt.headers {
+				r.Header[k] = []string{v} // not canonicalized, as underscores are received
+			}
+			vars := map[string]any{caddyhttp.TrustedProxyVarKey: tt.trusted}
+			r = r.WithContext(context.WithValue(r.Context(), caddyhttp.VarsCtxKey, vars))
+
+			var got http.Header
+			next := caddyhttp.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) error {
+				got = r.Header
+				return nil
+			})
+			if err := sh.ServeHTTP(httptest.NewRecorder(), r, next); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(got, tt.want); diff != "" {
+				t.Errorf("ServeHTTP() headers diff(-got +want):\n%s", diff)
+			}
+		})
+	}
+}
+
+func Test_AuthDirectiveScrubHeaders(t *testing.T) {
+	tests := map[string]struct {
+		body      string
+		wantScrub bool
+	}{
+		"default": {
+			body:      "tailscale_auth",
+			wantScrub: true,
+		},
+		"custom headers": {
+			body:      "tailscale_auth {\n\t\tscrub_headers X-Remote-User\n\t}",
+			wantScrub: true,
+		},
+		"off": {
+			body: "tailscale_auth {\n\t\tscrub_headers off\n\t}",
+		},
+	}
+	for tn, tt := range tests {
+		t.Run(tn, func(t *testing.T) {
+			caddyfile := ":80 {\n\t" + tt.body + "\n\trespond ok\n}\n"
+			cfg, warnings, err := caddyconfig.GetAdapter("caddyfile").Adapt([]byte(caddyfile), nil)
+			if err != nil {
+				t.Fatalf("Adapt() error = %v, warnings: %v", err, warnings)
+			}
+			if got := strings.Contains(string(cfg), `"handler":"tailscale_scrub_headers"`); got != tt.wantScrub {
+				t.Errorf("Adapt() scrub handler = %v, want %v:\n%s", got, tt.wantScrub, cfg)
+			}
+			if !strings.Contains(string(cfg), `"handler":"authentication"`) {
+				t.Errorf("Adapt() has no authentication handler:\n%s", cfg)
+			}
+		})
+	}
+}
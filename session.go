@@ -0,0 +1,299 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// session.go contains the SessionBinding handler, which binds session cookies to the Tailscale identity they were issued to.
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"tailscale.com/client/tailscale/apitype"
+)
+
+func init() {
+	caddy.RegisterModule(SessionBinding{})
+	httpcaddyfile.RegisterHandlerDirective("tailscale_session_binding", parseSessionBinding)
+	httpcaddyfile.RegisterDirectiveOrder("tailscale_session_binding", httpcaddyfile.After, "forward_auth")
+}
+
+// sessionBindingKey is the key used to sign cookies if no secret is configured.
+// It is generated once per process, so that bound cookies survive config reloads.
+var sessionBindingKey = sync.OnceValue(func() []byte {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return key
+})
+
+// sessionMACSize is the size in bytes of the MAC appended to bound cookie values.
+const sessionMACSize = 16
+
+// SessionBinding is a Caddy HTTP handler that binds cookies issued by upstream handlers
+// to the Tailscale user and node they were issued to.
+//
+// When a response sets one of the configured cookies, a MAC of the cookie value and the caller's identity
+// is appended to the value. When a request presents one of the cookies, the MAC is verified against
+// the caller's identity and removed before the request is passed on, so the upstream application sees
+// the cookie values it issued. Requests presenting a cookie issued to another identity, or without a MAC,
+// are rejected with 403 Forbidden, preventing session and CSRF tokens from being replayed from other devices.
+type SessionBinding struct {
+	// Cookies is the list of names of cookies to bind.
+	Cookies []string `json:"cookies,omitempty"`
+
+	// Secret is the key used to sign cookies. Placeholders are supported.
+	// If empty, a random key is generated, and bound cookies are invalidated when Caddy restarts.
+	Secret string `json:"secret,omitempty"`
+
+	// ResolverRaw configures how the Tailscale identity of the client is resolved.
+	// If unset, the node that received the request is queried with WhoIs.
+	ResolverRaw json.RawMessage `json:"resolver,omitempty" caddy:"namespace=tailscale.identity inline_key=source"`
+
+	resolver IdentityResolver
+	key      []byte
+}
+
+func (SessionBinding) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.tailscale_session_binding",
+		New: func() caddy.Module { return new(SessionBinding) },
+	}
+}
+
+// Provision implements caddy.Provisioner.
+func (sb *SessionBinding) Provision(ctx caddy.Context) error {
+	if len(sb.Cookies) == 0 {
+		return fmt.Errorf("no cookies to bind")
+	}
+
+	if sb.Secret != "" {
+		secret, err := repl.ReplaceOrErr(sb.Secret, true, true)
+		if err != nil {
+			return err
+		}
+		sb.key = []byte(secret)
+	} else {
+		sb.key = sessionBindingKey()
+	}
+
+	if sb.ResolverRaw == nil {
+		sb.resolver = new(WhoIsResolver)
+		return nil
+	}
+	mod, err := ctx.LoadModule(sb, "ResolverRaw")
+	if err != nil {
+		return fmt.Errorf("loading identity resolver: %v", err)
+	}
+	sb.resolver = mod.(IdentityResolver)
+	return nil
+}
+
+// ServeHTTP implements caddyhttp.MiddlewareHandler.
+func (sb *SessionBinding) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	// Callers without a Tailscale identity can't present or be issued bound cookies.
+	var identity string
+	if info, err := sb.resolver.ResolveIdentity(r); err == nil {
+		identity = sessionIdentity(info)
+	}
+
+	cookies := r.Cookies()
+	var bound bool
+	for _, c := range cookies {
+		if !slices.Contains(sb.Cookies, c.Name) {
+			continue
+		}
+		value, ok := sb.verify(identity, c.Name, c.Value)
+		if !ok {
+			return caddyhttp.Error(http.StatusForbidden, fmt.Errorf("cookie %s was not issued to this tailscale identity", c.Name))
+		}
+		c.Value = value
+		bound = true
+	}
+	if bound {
+		r.Header.Del("Cookie")
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+	}
+
+	if identity != "" {
+		w = &sessionResponseWriter{
+			ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w},
+			binding:               sb,
+			identity:              identity,
+		}
+	}
+	return next.ServeHTTP(w, r)
+}
+
+// sessionIdentity returns the identity that cookies are bound to: the user and their node.
+func sessionIdentity(info *apitype.WhoIsResponse) string {
+	return strings.Join([]string{info.UserProfile.LoginName, string(info.Node.StableID), info.Node.Name}, "\x00")
+}
+
+// mac returns the MAC binding the named cookie's value to identity.
+func (sb *SessionBinding) mac(identity, name, value string) []byte {
+	h := hmac.New(sha256.New, sb.key)
+	for _, s := range []string{identity, name, value} {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	return h.Sum(nil)[:sessionMACSize]
+}
+
+// sign returns value with a MAC binding it to identity appended.
+func (sb *SessionBinding) sign(identity, name, value string) string {
+	return value + "." + base64.RawURLEncoding.EncodeToString(sb.mac(identity, name, value))
+}
+
+// verify checks that signed was issued to identity, returning the original value.
+func (sb *SessionBinding) verify(identity, name, signed string) (string, bool) {
+	if identity == "" {
+		return "", false
+	}
+	i := strings.LastIndexByte(signed, '.')
+	if i < 0 {
+		return "", false
+	}
+	value := signed[:i]
+	got, err := base64.RawURLEncoding.DecodeString(signed[i+1:])
+	if err != nil {
+		return "", false
+	}
+	return value, hmac.Equal(got, sb.mac(identity, name, value))
+}
+
+// sessionResponseWriter binds cookies set by the response before its headers are written.
+type sessionResponseWriter struct {
+	*caddyhttp.ResponseWriterWrapper
+	binding     *SessionBinding
+	identity    string
+	wroteHeader bool
+}
+
+func (w *sessionResponseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	// 1xx responses aren't final; cookies are only signed once, for the final response.
+	if status >= 100 && status <= 199 {
+		w.ResponseWriterWrapper.WriteHeader(status)
+		return
+	}
+	w.wroteHeader = true
+
+	h := w.ResponseWriterWrapper.Header()
+	setCookies := h["Set-Cookie"]
+	for i, line := range setCookies {
+		c, err := http.ParseSetCookie(line)
+		if err != nil || !slices.Contains(w.binding.Cookies, c.Name) || c.Value == "" {
+			continue
+		}
+		c.Value = w.binding.sign(w.identity, c.Name, c.Value)
+		setCookies[i] = c.String()
+	}
+
+	w.ResponseWriterWrapper.WriteHeader(status)
+}
+
+func (w *sessionResponseWriter) Write(d []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriterWrapper.Write(d)
+}
+
+func (w *sessionResponseWriter) ReadFrom(r io.Reader) (int64, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriterWrapper.ReadFrom(r)
+}
+
+// FlushError commits the headers, with cookies signed, before flushing the response.
+// http.ResponseController calls it instead of unwrapping to a writer that would skip signing.
+func (w *sessionResponseWriter) FlushError() error {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return http.NewResponseController(w.ResponseWriterWrapper).Flush()
+}
+
+func (w *sessionResponseWriter) Flush() {
+	_ = w.FlushError()
+}
+
+// Unwrap returns the underlying ResponseWriter, so that http.ResponseController can reach
+// deadlines, full duplex and hijacking. None of these commit the headers: flushing is handled
+// by FlushError, and writes must go through this writer.
+func (w *sessionResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriterWrapper.Unwrap()
+}
+
+// UnmarshalCaddyfile sets up the handler from Caddyfile tokens. Syntax:
+//
+//	tailscale_session_binding <cookies...> {
+//	  secret <secret>
+//	  resolver <source> [<args...>]
+//	}
+func (sb *SessionBinding) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume directive name
+	sb.Cookies = append(sb.Cookies, d.RemainingArgs()...)
+
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "secret":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			sb.Secret = d.Val()
+
+		case "resolver":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			source := d.Val()
+			unm, err := caddyfile.UnmarshalModule(d, "tailscale.identity."+source)
+			if err != nil {
+				return err
+			}
+			sb.ResolverRaw = caddyconfig.JSONModuleObject(unm, "source", source, nil)
+
+		default:
+			return d.Errf("unrecognized subdirective: %s", d.Val())
+		}
+	}
+
+	if len(sb.Cookies) == 0 {
+		return d.Err("at least one cookie name is required")
+	}
+	return nil
+}
+
+// parseSessionBinding parses the tailscale_session_binding directive.
+func parseSessionBinding(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	sb := new(SessionBinding)
+	err := sb.UnmarshalCaddyfile(h.Dispenser)
+	return sb, err
+}
+
+var (
+	_ caddy.Provisioner           = (*SessionBinding)(nil)
+	_ caddyhttp.MiddlewareHandler = (*SessionBinding)(nil)
+	_ caddyfile.Unmarshaler       = (*SessionBinding)(nil)
+	_ http.ResponseWriter         = (*sessionResponseWriter)(nil)
+)
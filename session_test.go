@@ -0,0 +1,150 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func Test_SessionBinding(t *testing.T) {
+	sb := &SessionBinding{
+		Cookies: []string{"session"},
+		key:     []byte("secret"),
+		resolver: StaticResolver{
+			Identities: map[string]StaticIdentity{
+				"100.64.0.1": {Login: "alice@example.com", Node: "laptop.tail1234.ts.net."},
+				"100.64.0.2": {Login: "alice@example.com", Node: "phone.tail1234.ts.net."},
+			},
+		},
+	}
+
+	// serve makes a request from remoteAddr with the given session cookie,
+	// returning the cookie seen by the upstream handler and the cookie it issued.
+	serve := func(remoteAddr, cookie string) (seen, issued string, err error) {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = remoteAddr + ":1234"
+		if cookie != "" {
+			r.AddCookie(&http.Cookie{Name: "session", Value: cookie})
+		}
+		r.AddCookie(&http.Cookie{Name: "other", Value: "unbound"})
+
+		next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			if c, err := r.Cookie("session"); err == nil {
+				seen = c.Value
+			}
+			if c, err := r.Cookie("other"); err != nil || c.Value != "unbound" {
+				t.Errorf("unbound cookie = %v, %v; want unchanged", c, err)
+			}
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "token123"})
+			_, err := w.Write([]byte("ok"))
+			return err
+		})
+		rec := httptest.NewRecorder()
+		if err := sb.ServeHTTP(rec, r, next); err != nil {
+			return "", "", err
+		}
+		for _, c := range rec.Result().Cookies() {
+			if c.Name == "session" {
+				issued = c.Value
+			}
+		}
+		return seen, issued, nil
+	}
+
+	_, issued, err := serve("100.64.0.1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if issued == "token123" || issued == "" {
+		t.Fatalf("issued cookie = %q, want bound value", issued)
+	}
+
+	seen, _, err := serve("100.64.0.1", issued)
+	if err != nil {
+		t.Fatalf("same identity: %v", err)
+	}
+	if seen != "token123" {
+		t.Errorf("upstream saw cookie %q, want %q", seen, "token123")
+	}
+
+	tests := map[string]struct {
+		remoteAddr string
+		cookie     string
+	}{
+		"other node":      {remoteAddr: "100.64.0.2", cookie: issued},
+		"unknown caller":  {remoteAddr: "203.0.113.1", cookie: issued},
+		"unbound cookie":  {remoteAddr: "100.64.0.1", cookie: "token123"},
+		"tampered cookie": {remoteAddr: "100.64.0.1", cookie: "token456" + issued[len("token123"):]},
+	}
+	for tn, tt := range tests {
+		t.Run(tn, func(t *testing.T) {
+			_, _, err := serve(tt.remoteAddr, tt.cookie)
+			var herr caddyhttp.HandlerError
+			if !errors.As(err, &herr) || herr.StatusCode != http.StatusForbidden {
+				t.Errorf("ServeHTTP() err = %v, want status %d", err, http.StatusForbidden)
+			}
+		})
+	}
+}
+
+// headerLog is a response writer that records the headers sent with each status.
+type headerLog struct {
+	header http.Header
+	sent   map[int]http.Header
+}
+
+func (l *headerLog) Header() http.Header         { return l.header }
+func (l *headerLog) Write(b []byte) (int, error) { return len(b), nil }
+func (l *headerLog) WriteHeader(status int)      { l.sent[status] = l.header.Clone() }
+
+func Test_SessionBindingEarlyHints(t *testing.T) {
+	sb := &SessionBinding{Cookies: []string{"session"}, key: []byte("secret")}
+	log := &headerLog{header: make(http.Header), sent: make(map[int]http.Header)}
+	w := &sessionResponseWriter{
+		ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: log},
+		binding:               sb,
+		identity:              "alice",
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: "session", Value: "token123"})
+	w.WriteHeader(http.StatusEarlyHints)
+	w.WriteHeader(http.StatusOK)
+
+	want := (&http.Cookie{Name: "session", Value: sb.sign("alice", "session", "token123")}).String()
+	if got := log.sent[http.StatusOK]["Set-Cookie"]; len(got) != 1 || got[0] != want {
+		t.Errorf("final Set-Cookie = %q; want %q", got, want)
+	}
+}
+
+func Test_SessionBindingReadFromAndFlush(t *testing.T) {
+	sb := &SessionBinding{Cookies: []string{"session"}, key: []byte("secret")}
+	want := (&http.Cookie{Name: "session", Value: sb.sign("alice", "session", "token123")}).String()
+
+	for name, send := range map[string]func(w http.ResponseWriter){
+		"ReadFrom": func(w http.ResponseWriter) { io.Copy(w, strings.NewReader("body")) },
+		"Flush":    func(w http.ResponseWriter) { http.NewResponseController(w).Flush() },
+	} {
+		t.Run(name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			w := &sessionResponseWriter{
+				ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: rec},
+				binding:               sb,
+				identity:              "alice",
+			}
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "token123"})
+			send(w)
+
+			if got := rec.Result().Header["Set-Cookie"]; len(got) != 1 || got[0] != want {
+				t.Errorf("Set-Cookie = %q; want %q", got, want)
+			}
+		})
+	}
+}
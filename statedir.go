@@ -0,0 +1,103 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// statedir.go contains the platform-specific default location of Tailscale node state.
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// defaultStateRoot returns the directory under which node state is stored if no state_dir is configured:
+//   - Windows: %ProgramData%\Caddy\tailscale, which is shared by services and the users running them
+//   - macOS: ~/Library/Application Support/Caddy/tailscale
+//   - Linux and others: $XDG_DATA_HOME/caddy/tailscale, or ~/.local/share/caddy/tailscale
+//
+// These are alongside Caddy's own data, such as certificates.
+func defaultStateRoot() (string, error) {
+	if runtime.GOOS == "windows" {
+		if dir := os.Getenv("ProgramData"); dir != "" {
+			return filepath.Join(dir, "Caddy", "tailscale"), nil
+		}
+	}
+	// AppDataDir falls back to a relative path if there is no home directory,
+	// such as for rc.d services on the BSDs, which would move with the working directory.
+	dir := caddy.AppDataDir()
+	if !filepath.IsAbs(dir) {
+		return "", errors.New("no home directory")
+	}
+	return filepath.Join(dir, "tailscale"), nil
+}
+
+// legacyStateDir returns the default state directory used by previous versions, in the user's config directory.
+func legacyStateDir(name string) (string, error) {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, "tsnet-caddy-"+name), nil
+}
+
+// defaultStateDirs returns the default state directory for the named node if no state_dir is configured,
+// and the legacy directory if the node's state is still there and hasn't been moved yet.
+func defaultStateDirs(name string) (dir, legacy string, err error) {
+	root, err := defaultStateRoot()
+	if err != nil {
+		// Services on some platforms, such as rc.d services on the BSDs, run without a home directory.
+		return "", "", fmt.Errorf("no default state directory for node %q, set state_dir: %w", name, err)
+	}
+	dir = filepath.Join(root, name)
+
+	legacy, err = legacyStateDir(name)
+	if err != nil || legacy == dir {
+		return dir, "", nil
+	}
+	if _, err := os.Stat(dir); err == nil {
+		return dir, "", nil
+	}
+	if _, err := os.Stat(legacy); err != nil {
+		return dir, "", nil
+	}
+	return dir, legacy, nil
+}
+
+// defaultStateDir returns the state directory for the named node if no state_dir is configured,
+// without moving any state. State in the legacy location is used there until migrateStateDir moves it.
+func defaultStateDir(name string) (string, error) {
+	dir, legacy, err := defaultStateDirs(name)
+	if legacy != "" {
+		return legacy, err
+	}
+	return dir, err
+}
+
+// migrateStateDir returns the state directory for the named node if no state_dir is configured.
+// State in the legacy location is moved to the new one, so that nodes keep their identity.
+// If it can't be moved, the legacy location continues to be used.
+func migrateStateDir(name string, logger *zap.Logger) (string, error) {
+	dir, legacy, err := defaultStateDirs(name)
+	if err != nil || legacy == "" {
+		return dir, err
+	}
+
+	err = os.MkdirAll(filepath.Dir(dir), 0700)
+	if err == nil {
+		err = os.Rename(legacy, dir)
+	}
+	if err != nil {
+		logger.Warn("unable to move node state to new default state directory, continuing to use old directory",
+			zap.String("node", name), zap.String("old", legacy), zap.String("new", dir), zap.Error(err))
+		return legacy, nil
+	}
+	logger.Info("moved node state to new default state directory",
+		zap.String("node", name), zap.String("old", legacy), zap.String("new", dir))
+	return dir, nil
+}
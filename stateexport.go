@@ -0,0 +1,156 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// stateexport.go contains export and import of node state, to migrate node identity between hosts.
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// stateExportMarker is the name of the file written to a node's state directory when its state is exported.
+// Nodes with the marker refuse to start, so that the exported identity isn't used on two hosts at once.
+const stateExportMarker = "exported"
+
+// stateExportIterations is the number of PBKDF2 iterations used to derive the key that encrypts exported state.
+const stateExportIterations = 600_000
+
+// errStateExists is returned when importing state for a node that already has state.
+var errStateExists = errors.New("node already has state")
+
+// stateExport is a node's state, encrypted with a key derived from a passphrase.
+type stateExport struct {
+	// Node is the name of the node the state was exported from.
+	Node string `json:"node"`
+
+	// Exported is when the state was exported.
+	Exported time.Time `json:"exported"`
+
+	// Salt is the salt used to derive the key from the passphrase.
+	Salt []byte `json:"salt"`
+
+	// Ciphertext is the AES-GCM nonce followed by the encrypted state.
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// stateExportKey derives the AES-GCM cipher used to encrypt exported state from a passphrase.
+func stateExportKey(passphrase string, salt []byte) (cipher.AEAD, error) {
+	if passphrase == "" {
+		return nil, errors.New("a passphrase is required")
+	}
+	key, err := pbkdf2.Key(sha256.New, passphrase, salt, stateExportIterations, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealState encrypts the state of the named node with passphrase.
+// The node name is authenticated, so that state can only be imported under the same name.
+func sealState(name, passphrase string, state []byte) (*stateExport, error) {
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	aead, err := stateExportKey(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	rand.Read(nonce)
+	return &stateExport{
+		Node:       name,
+		Exported:   time.Now().UTC(),
+		Salt:       salt,
+		Ciphertext: aead.Seal(nonce, nonce, state, []byte(name)),
+	}, nil
+}
+
+// openState decrypts exported state with passphrase.
+func openState(exp *stateExport, passphrase string) ([]byte, error) {
+	aead, err := stateExportKey(passphrase, exp.Salt)
+	if err != nil {
+		return nil, err
+	}
+	if len(exp.Ciphertext) < aead.NonceSize() {
+		return nil, errors.New("exported state is truncated")
+	}
+	nonce, ciphertext := exp.Ciphertext[:aead.NonceSize()], exp.Ciphertext[aead.NonceSize():]
+	state, err := aead.Open(nil, nonce, ciphertext, []byte(exp.Node))
+	if err != nil {
+		return nil, errors.New("decrypting exported state: wrong passphrase or corrupted state")
+	}
+	return state, nil
+}
+
+// exportState reads the state in dir and encrypts it for import on another host,
+// then marks the state as exported so the node refuses to start here.
+func exportState(name, dir, passphrase string) (*stateExport, error) {
+	state, err := os.ReadFile(filepath.Join(dir, stateFileName))
+	if err != nil {
+		return nil, fmt.Errorf("reading state of node %q: %w", name, err)
+	}
+	exp, err := sealState(name, passphrase, state)
+	if err != nil {
+		return nil, err
+	}
+	marker := fmt.Sprintf("state exported at %s\n", exp.Exported.Format(time.RFC3339))
+	if err := os.WriteFile(filepath.Join(dir, stateExportMarker), []byte(marker), 0600); err != nil {
+		return nil, fmt.Errorf("marking state of node %q as exported: %w", name, err)
+	}
+	return exp, nil
+}
+
+// importState decrypts exported state and writes it to dir, which must not already contain state.
+// Any export marker in dir is removed, so that the node can start with the imported state.
+func importState(name, dir, passphrase string, exp *stateExport) error {
+	if exp.Node != name {
+		return fmt.Errorf("state was exported from node %q, not %q", exp.Node, name)
+	}
+	state, err := openState(exp, passphrase)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, stateFileName)
+	if _, err := os.Stat(path); !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%w: %s", errStateExists, path)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, state, 0600); err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(dir, stateExportMarker)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// checkNotExported returns an error if the state in dir has been exported to another host.
+func checkNotExported(name, dir string) error {
+	marker := filepath.Join(dir, stateExportMarker)
+	b, err := os.ReadFile(marker)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("node %q %s, so it may be running on another host; remove %s to use the state here",
+		name, strings.TrimSpace(string(b)), marker)
+}
@@ -0,0 +1,55 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// statestore.go contains the read-only state store, for nodes whose state is baked into an image.
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/store"
+	"tailscale.com/types/logger"
+)
+
+// stateFileName is the name of the file in a node's state directory that tsnet stores its state in.
+const stateFileName = "tailscaled.state"
+
+// errReadOnlyState is returned when a node with read-only state tries to change it.
+var errReadOnlyState = errors.New("node state is read-only")
+
+// readOnlyStore is a state store that refuses to change existing state,
+// so that nodes with state baked into an image fail instead of silently changing their identity.
+// Writes that don't change the stored value are allowed, since nodes rewrite unchanged state when they start.
+type readOnlyStore struct {
+	ipn.StateStore
+	logf logger.Logf
+}
+
+// newReadOnlyStore returns a read-only store for the state in dir, which must already exist.
+func newReadOnlyStore(logf logger.Logf, dir string) (*readOnlyStore, error) {
+	path := filepath.Join(dir, stateFileName)
+	if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("read-only state requires existing state: %w", err)
+	}
+	fs, err := store.NewFileStore(logf, path)
+	if err != nil {
+		return nil, err
+	}
+	return &readOnlyStore{StateStore: fs, logf: logf}, nil
+}
+
+// WriteState implements ipn.StateStore.
+func (s *readOnlyStore) WriteState(id ipn.StateKey, bs []byte) error {
+	cur, err := s.ReadState(id)
+	if err == nil && bytes.Equal(cur, bs) {
+		return nil
+	}
+	s.logf("refusing to change state %q: %v", id, errReadOnlyState)
+	return fmt.Errorf("writing %q: %w", id, errReadOnlyState)
+}
@@ -0,0 +1,145 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// tags.go contains normalization of the ACL tags applied to nodes,
+// and reconciliation of the tags of their devices using the Tailscale API.
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"go.uber.org/zap"
+	"tailscale.com/client/tailscale"
+	"tailscale.com/tailcfg"
+)
+
+// normalizeTags returns tags lowercased, with a "tag:" prefix added where missing,
+// sorted and deduplicated. It returns an error if a tag is not valid after normalization,
+// so that nodes don't fail to join the tailnet with a less helpful error from the control server.
+func normalizeTags(tags []string) ([]string, error) {
+	if len(tags) == 0 {
+		return tags, nil
+	}
+
+	normalized := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if !strings.HasPrefix(tag, "tag:") {
+			tag = "tag:" + tag
+		}
+		if err := tailcfg.CheckTag(tag); err != nil {
+			return nil, fmt.Errorf("invalid tag %q: %w", tag, err)
+		}
+		normalized = append(normalized, tag)
+	}
+	slices.Sort(normalized)
+	return slices.Compact(normalized), nil
+}
+
+// hasAnyTag reports whether a device with the tags have has any of the tags want.
+func hasAnyTag(have, want []string) bool {
+	return slices.ContainsFunc(have, func(tag string) bool { return slices.Contains(want, tag) })
+}
+
+// normalizeNodeTags normalizes tags, logging a warning if they were changed.
+func normalizeNodeTags(logger *zap.Logger, tags []string) ([]string, error) {
+	normalized, err := normalizeTags(tags)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Equal(tags, normalized) {
+		logger.Warn("normalized tags; update the configuration to avoid this warning",
+			zap.Strings("tags", tags),
+			zap.Strings("normalized", normalized))
+	}
+	return normalized, nil
+}
+
+// normalizeTags normalizes the tags of the app and all of its nodes.
+func (t *App) normalizeTags() error {
+	var err error
+	if t.Tags, err = normalizeNodeTags(t.logger, t.Tags); err != nil {
+		return err
+	}
+	if t.Reap != nil {
+		if t.Reap.Tags, err = normalizeNodeTags(t.logger.Named("reaper"), t.Reap.Tags); err != nil {
+			return fmt.Errorf("reap: %w", err)
+		}
+	}
+	if t.RollingRestart != nil {
+		tags, err := normalizeNodeTags(t.logger.Named("rolling_restart"), []string{t.RollingRestart.Tag})
+		if err != nil {
+			return fmt.Errorf("rolling_restart: %w", err)
+		}
+		t.RollingRestart.Tag = tags[0]
+	}
+	for name, node := range t.Nodes {
+		if node.Tags, err = normalizeNodeTags(t.logger.With(zap.String("node", name)), node.Tags); err != nil {
+			return fmt.Errorf("node %s: %w", name, err)
+		}
+		t.Nodes[name] = node
+	}
+	return nil
+}
+
+// setTags sets the ACL tags configured for the node, such as after a config reload,
+// and updates the tags of its device if they changed and the node has an API client.
+func (t *tailscaleNode) setTags(tags []string) {
+	t.tagsMu.Lock()
+	defer t.tagsMu.Unlock()
+	if slices.Equal(t.tags, tags) {
+		return
+	}
+	t.tags = tags
+	// Nodes that haven't started yet reconcile their tags once they do.
+	if t.apiClient != nil && t.started.Load() {
+		go t.reconcileTags(tags)
+	}
+}
+
+// reconcileTags waits for the node to connect to the tailnet,
+// then updates the tags of its device to tags if they differ.
+// Otherwise, a device keeps the tags it was registered with until it is re-registered,
+// even if they are changed in the config.
+// Errors are logged, since the node is otherwise usable.
+func (t *tailscaleNode) reconcileTags(tags []string) {
+	if len(tags) == 0 {
+		return
+	}
+	ctx := context.Background()
+	st, err := t.Up(ctx)
+	if err != nil {
+		t.reportError("waiting for node to reconcile tags", err)
+		return
+	}
+	var current []string
+	if st.Self.Tags != nil {
+		current = st.Self.Tags.AsSlice()
+	}
+	updated, err := syncDeviceTags(ctx, t.apiClient, string(st.Self.ID), current, tags)
+	if err != nil {
+		t.reportError("updating device tags", err, zap.Strings("tags", tags), zap.Strings("current", current))
+		return
+	}
+	if updated {
+		t.logger.Info("updated device tags", zap.Strings("tags", tags), zap.Strings("previous", current))
+	}
+}
+
+// syncDeviceTags sets the tags of a device to desired if they differ from its current tags,
+// reporting whether they were updated.
+func syncDeviceTags(ctx context.Context, c *tailscale.Client, deviceID string, current, desired []string) (bool, error) {
+	current = slices.Compact(slices.Sorted(slices.Values(current)))
+	desired = slices.Compact(slices.Sorted(slices.Values(desired)))
+	if slices.Equal(current, desired) {
+		return false, nil
+	}
+	if err := c.SetTags(ctx, deviceID, desired); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,96 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// tailnetonly.go contains validation of sites that must only be reachable from the tailnet,
+// to catch configs that would also serve them publicly, such as when a site's bind directive is forgotten.
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// checkTailnetOnly returns an error if a server of the HTTP app with a tailnet_only site
+// also listens on an address that isn't only reachable from the tailnet.
+// Servers are checked when the app starts, after every app of the config has been provisioned,
+// so that the config fails to load.
+func (t *App) checkTailnetOnly() error {
+	httpApp, err := t.ctx.AppIfConfigured("http")
+	if err != nil {
+		return nil
+	}
+	servers := httpApp.(*caddyhttp.App).Servers
+	for _, name := range slices.Sorted(maps.Keys(servers)) {
+		srv := servers[name]
+		node, ok := tailnetOnlyNode(serverRoutes(srv))
+		if !ok {
+			continue
+		}
+		for _, l := range srv.Listen {
+			if !t.tailnetOnlyAddress(l) {
+				return fmt.Errorf("server %s: site with tailnet_only set for tailscale node %q also listens on %s, which isn't only reachable from the tailnet; bind the site to a tailscale address",
+					name, node, l)
+			}
+		}
+	}
+	return nil
+}
+
+// serverRoutes returns the top-level routes of srv, including its error and named routes.
+func serverRoutes(srv *caddyhttp.Server) caddyhttp.RouteList {
+	routes := slices.Clone(srv.Routes)
+	if srv.Errors != nil {
+		routes = append(routes, srv.Errors.Routes...)
+	}
+	for _, name := range slices.Sorted(maps.Keys(srv.NamedRoutes)) {
+		routes = append(routes, *srv.NamedRoutes[name])
+	}
+	return routes
+}
+
+// tailnetOnlyNode returns the node name of the first tailscale directive with tailnet_only set in routes,
+// including in their subroutes.
+func tailnetOnlyNode(routes caddyhttp.RouteList) (string, bool) {
+	for _, route := range routes {
+		for _, h := range route.Handlers {
+			switch h := h.(type) {
+			case *TailscaleDirective:
+				if h.TailnetOnly {
+					return cmp.Or(h.NodeName, "default"), true
+				}
+			case *caddyhttp.Subroute:
+				if node, ok := tailnetOnlyNode(h.Routes); ok {
+					return node, true
+				}
+			}
+		}
+	}
+	return "", false
+}
+
+// tailnetOnlyAddress reports whether the listen address l is only reachable from the tailnet:
+// it is on the tailscale network, and none of its ports are exposed with Funnel.
+func (t *App) tailnetOnlyAddress(l string) bool {
+	na, err := caddy.ParseNetworkAddress(l)
+	if err != nil || !strings.HasPrefix(na.Network, "tailscale") {
+		return false
+	}
+	name, err := resolveNodeName(t.ctx, na.Host)
+	if err != nil {
+		name = na.Host
+	}
+	for port := na.StartPort; port <= na.EndPort; port++ {
+		if listenerFunnel(t, na.Network, name, strconv.FormatUint(uint64(port), 10)) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,107 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func Test_TailnetOnlyNode(t *testing.T) {
+	directive := func(name string, tailnetOnly bool) *TailscaleDirective {
+		return &TailscaleDirective{NodeName: name, Node: Node{TailnetOnly: tailnetOnly}}
+	}
+	tests := map[string]struct {
+		routes   caddyhttp.RouteList
+		wantNode string
+		wantOK   bool
+	}{
+		"no directive": {
+			routes: caddyhttp.RouteList{{Handlers: []caddyhttp.MiddlewareHandler{&caddyhttp.StaticResponse{}}}},
+		},
+		"directive without tailnet_only": {
+			routes: caddyhttp.RouteList{{Handlers: []caddyhttp.MiddlewareHandler{directive("admin", false)}}},
+		},
+		"directive": {
+			routes:   caddyhttp.RouteList{{Handlers: []caddyhttp.MiddlewareHandler{directive("admin", true)}}},
+			wantNode: "admin",
+			wantOK:   true,
+		},
+		"default node": {
+			routes:   caddyhttp.RouteList{{Handlers: []caddyhttp.MiddlewareHandler{directive("", true)}}},
+			wantNode: "default",
+			wantOK:   true,
+		},
+		"subroute": {
+			routes: caddyhttp.RouteList{{Handlers: []caddyhttp.MiddlewareHandler{
+				&caddyhttp.Subroute{Routes: caddyhttp.RouteList{
+					{Handlers: []caddyhttp.MiddlewareHandler{directive("other", false)}},
+					{Handlers: []caddyhttp.MiddlewareHandler{&caddyhttp.Subroute{Routes: caddyhttp.RouteList{
+						{Handlers: []caddyhttp.MiddlewareHandler{directive("admin", true)}},
+					}}}},
+				}},
+			}}},
+			wantNode: "admin",
+			wantOK:   true,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			node, ok := tailnetOnlyNode(tt.routes)
+			if node != tt.wantNode || ok != tt.wantOK {
+				t.Errorf("tailnetOnlyNode() = %q, %v; want %q, %v", node, ok, tt.wantNode, tt.wantOK)
+			}
+		})
+	}
+}
+
+func Test_TailnetOnlyAddress(t *testing.T) {
+	app := &App{Nodes: map[string]Node{"public": {Funnel: true}}}
+	tests := map[string]bool{
+		"tailscale/admin:443":         true,
+		"tailscale/admin:80-443":      true,
+		"tailscale/public:80":         true,
+		"tailscale/public:443":        false,
+		"tailscale/public:80-443":     false,
+		"tailscale+funnel/admin:80":   true,
+		"tailscale+funnel/admin:8443": false,
+		":443":                        false,
+		"0.0.0.0:80":                  false,
+		"unix//run/admin.sock":        false,
+	}
+	for l, want := range tests {
+		if got := app.tailnetOnlyAddress(l); got != want {
+			t.Errorf("tailnetOnlyAddress(%q) = %v, want %v", l, got, want)
+		}
+	}
+}
+
+func Test_CheckTailnetOnly(t *testing.T) {
+	server := map[string]any{
+		"listen": []string{"localhost:0"},
+		"routes": []any{
+			map[string]any{"handle": []any{
+				map[string]any{"handler": "tailscale", "node_name": "admin", "tailnet_only": true},
+				map[string]any{"handler": "static_response"},
+			}},
+		},
+	}
+	err := caddy.Run(&caddy.Config{
+		AppsRaw: caddy.ModuleMap{
+			"http": caddyconfig.JSON(map[string]any{"servers": map[string]any{"srv0": server}}, nil),
+		},
+	})
+	if err == nil {
+		caddy.Stop()
+		t.Fatal("caddy.Run() succeeded, want tailnet_only error")
+	}
+	if !strings.Contains(err.Error(), `tailnet_only set for tailscale node "admin" also listens on localhost:0`) {
+		t.Errorf("caddy.Run() error = %v, want tailnet_only error", err)
+	}
+}
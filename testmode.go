@@ -0,0 +1,143 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// testmode.go contains testing mode, which runs nodes on an in-process tailnet so that
+// Caddy configs using Tailscale can be run in integration tests without a real tailnet.
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+	"tailscale.com/ipn/store/mem"
+	"tailscale.com/tsnet"
+)
+
+// TestingMode runs nodes on an in-process tailnet with its own control, DERP and STUN servers,
+// for integration tests of Caddy configs. Nodes keep their state in memory, use their hostname without
+// a unique suffix, and are assigned addresses in the order they are created, starting at 100.64.0.1.
+type TestingMode struct {
+	// ControlListen is the address the control server listens on, so that test clients
+	// can join the tailnet with a known control URL. Default: a random port on 127.0.0.1.
+	ControlListen string `json:"control_listen,omitempty" caddy:"namespace=tailscale.testing.control_listen"`
+
+	// BasePort is the port of the first node created. Later nodes use the following ports in the
+	// order they are created, unless they are configured with a port. Default: random ports.
+	BasePort uint16 `json:"base_port,omitempty" caddy:"namespace=tailscale.testing.base_port"`
+}
+
+// testNetwork is a running in-process tailnet that nodes join in testing mode.
+// Test networks run for the lifetime of the process, so nodes keep their addresses across config reloads.
+type testNetwork struct {
+	controlURL string
+	dir        string // root of the nodes' state directories
+
+	mu       sync.Mutex
+	ports    map[string]uint16 // ports assigned to nodes, by node name
+	nextPort int
+}
+
+// startTestNetwork returns the test network whose control server listens on listen, starting it if needed.
+// It is nil in builds without the ts_testing tag.
+var startTestNetwork func(listen string) (*testNetwork, error)
+
+// provisionTesting starts the app's test network, if testing mode is enabled.
+func (t *App) provisionTesting() error {
+	if t.Testing == nil {
+		return nil
+	}
+	if base := int(t.Testing.BasePort); base != 0 && base+len(t.Nodes) > math.MaxUint16+1 {
+		return fmt.Errorf("testing base_port %d leaves no ports for %d nodes", base, len(t.Nodes))
+	}
+	if startTestNetwork == nil {
+		return errors.New("testing mode is only available in builds with the ts_testing tag")
+	}
+	listen := t.Testing.ControlListen
+	if listen == "" {
+		listen = "127.0.0.1:0"
+	}
+	tn, err := startTestNetwork(listen)
+	if err != nil {
+		return fmt.Errorf("starting test network: %w", err)
+	}
+	t.testNetwork = tn
+	t.logger.Warn("testing mode enabled, nodes run on an in-process tailnet", zap.String("control_url", tn.controlURL))
+	return nil
+}
+
+// joinTestNetwork configures s to join the app's test network as the named node.
+func (t *App) joinTestNetwork(name string, s *tsnet.Server) error {
+	tn := t.testNetwork
+	s.ControlURL = tn.controlURL
+	// Nodes with in-memory state must be ephemeral, which also removes them from the tailnet when they stop.
+	s.Ephemeral = true
+	s.Store = new(mem.Store)
+	s.Dir = filepath.Join(tn.dir, name)
+	if err := os.MkdirAll(s.Dir, 0700); err != nil {
+		return fmt.Errorf("%w: creating test state directory for node %q: %w", ErrStateDir, name, err)
+	}
+	if s.Port == 0 && t.Testing.BasePort != 0 {
+		port, err := tn.port(name, t.Testing.BasePort)
+		if err != nil {
+			return fmt.Errorf("node %q: %w", name, err)
+		}
+		s.Port = port
+	}
+	return nil
+}
+
+// port returns the port assigned to the named node, assigning the next port from base if it has none.
+// Ports aren't reused, so nodes keep their ports across config reloads.
+func (tn *testNetwork) port(name string, base uint16) (uint16, error) {
+	tn.mu.Lock()
+	defer tn.mu.Unlock()
+	if port, ok := tn.ports[name]; ok {
+		return port, nil
+	}
+	port := int(base) + tn.nextPort
+	if port > math.MaxUint16 {
+		return 0, fmt.Errorf("no ports left after testing base_port %d", base)
+	}
+	if tn.ports == nil {
+		tn.ports = make(map[string]uint16)
+	}
+	tn.nextPort++
+	tn.ports[name] = uint16(port)
+	return uint16(port), nil
+}
+
+func parseTestingMode(d *caddyfile.Dispenser) (*TestingMode, error) {
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	tm := new(TestingMode)
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "control_listen":
+			if !d.AllArgs(&tm.ControlListen) {
+				return nil, d.ArgErr()
+			}
+		case "base_port":
+			var port string
+			if !d.AllArgs(&port) {
+				return nil, d.ArgErr()
+			}
+			v, err := strconv.ParseUint(port, 10, 16)
+			if err != nil || v == 0 {
+				return nil, d.Errf("invalid base_port: %s", port)
+			}
+			tm.BasePort = uint16(v)
+		default:
+			return nil, d.Errf("unrecognized subdirective: %s", d.Val())
+		}
+	}
+	return tm, nil
+}
@@ -0,0 +1,140 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build ts_testing
+
+package tscaddy
+
+// testnet.go contains the in-process tailnet used by testing mode.
+// It is only included in builds with the ts_testing tag, as it links the test control, DERP and STUN servers into Caddy.
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+
+	"tailscale.com/derp/derpserver"
+	"tailscale.com/net/stunserver"
+	"tailscale.com/tailcfg"
+	"tailscale.com/tstest/integration/testcontrol"
+	"tailscale.com/types/key"
+	"tailscale.com/types/logger"
+)
+
+// testMagicDNSDomain is the MagicDNS suffix of nodes in testing mode.
+const testMagicDNSDomain = "tail-scale.ts.net"
+
+func init() {
+	startTestNetwork = runTestNetwork
+}
+
+var (
+	testNetworksMu sync.Mutex
+	testNetworks   = make(map[string]*testNetwork) // running test networks, by control listen address
+)
+
+// runTestNetwork returns the test network whose control server listens on listen, starting it if needed.
+// Nodes on the test network only connect to localhost, which netns doesn't bind to an interface,
+// so it works without the privileges netns requires.
+func runTestNetwork(listen string) (_ *testNetwork, err error) {
+	testNetworksMu.Lock()
+	defer testNetworksMu.Unlock()
+	if tn, ok := testNetworks[listen]; ok {
+		return tn, nil
+	}
+
+	dir, err := os.MkdirTemp("", "caddy-tailscale-testing-")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(dir)
+		}
+	}()
+	derpMap, stopDERP, err := runTestDERPAndSTUN()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			stopDERP()
+		}
+	}()
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, err
+	}
+	control := &testcontrol.Server{
+		DERPMap: derpMap,
+		DNSConfig: &tailcfg.DNSConfig{
+			Proxied: true,
+		},
+		MagicDNSDomain:  testMagicDNSDomain,
+		Logf:            logger.Discard,
+		ExplicitBaseURL: "http://" + ln.Addr().String(),
+	}
+	go http.Serve(ln, control)
+
+	tn := &testNetwork{
+		controlURL: control.ExplicitBaseURL,
+		dir:        dir,
+	}
+	testNetworks[listen] = tn
+	return tn, nil
+}
+
+// runTestDERPAndSTUN starts a DERP and STUN server on localhost and returns a DERP map containing them,
+// and a function that stops them.
+func runTestDERPAndSTUN() (*tailcfg.DERPMap, func(), error) {
+	const ip = "127.0.0.1"
+
+	ln, err := net.Listen("tcp", net.JoinHostPort(ip, "0"))
+	if err != nil {
+		return nil, nil, err
+	}
+	d := derpserver.New(key.NewNode(), logger.Discard)
+	httpsrv := httptest.NewUnstartedServer(derpserver.Handler(d))
+	httpsrv.Listener.Close()
+	httpsrv.Listener = ln
+	httpsrv.Config.ErrorLog = logger.StdLogger(logger.Discard)
+	httpsrv.Config.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	httpsrv.StartTLS()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stun := stunserver.New(ctx)
+	if err := stun.Listen(net.JoinHostPort(ip, "0")); err != nil {
+		cancel()
+		httpsrv.Close()
+		return nil, nil, err
+	}
+	go stun.Serve()
+	stop := func() {
+		cancel()
+		httpsrv.Close()
+	}
+
+	return &tailcfg.DERPMap{
+		Regions: map[int]*tailcfg.DERPRegion{
+			1: {
+				RegionID:   1,
+				RegionCode: "test",
+				Nodes: []*tailcfg.DERPNode{{
+					Name:             "t1",
+					RegionID:         1,
+					HostName:         ip,
+					IPv4:             ip,
+					IPv6:             "none",
+					STUNPort:         stun.LocalAddr().(*net.UDPAddr).Port,
+					DERPPort:         ln.Addr().(*net.TCPAddr).Port,
+					InsecureForTests: true,
+					STUNTestIP:       ip,
+				}},
+			},
+		},
+	}, stop, nil
+}
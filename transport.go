@@ -6,7 +6,12 @@ package tscaddy
 // transport.go contains the Transport module.
 
 import (
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"net/http"
+	"strings"
+	"sync"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
@@ -17,17 +22,56 @@ func init() {
 	caddy.RegisterModule(&Transport{})
 }
 
+// defaultTransportNodeName is the name of the node used by the transport if none is specified in the Caddyfile.
+const defaultTransportNodeName = "caddy-proxy"
+
 // Transport is a caddy transport that uses a tailscale node to make requests.
 type Transport struct {
+	// Name is the name of the node used to make requests, or a label selector such as "region=eu".
+	// It may contain request placeholders to choose the node per request,
+	// in which case it must resolve to the name of a node configured in the App.
 	Name string `json:"name,omitempty"`
 
-	node *tailscaleNode
+	// FallbackDNS controls how upstream names that are not tailnet peers are resolved,
+	// so that a single proxy can have both tailnet and other upstreams.
+	// It is "system" to use the system resolver, "off" to only allow tailnet peers,
+	// or the IP address of a DNS server, with an optional port.
+	// Default: system
+	FallbackDNS string `json:"fallback_dns,omitempty"`
+
+	// RequireTailnetCert requires HTTPS upstreams to be tailnet peers with a valid certificate for their ts.net name.
+	// It enables TLS, and connections to other upstreams fail.
+	// Certificates of tailnet peers are verified against their MagicDNS names whether or not this is set.
+	RequireTailnetCert bool `json:"require_tailnet_cert,omitempty"`
+
+	// ClientIdentity enables client certificates identifying the node, for HTTPS upstreams that require mTLS.
+	// It enables TLS.
+	ClientIdentity *ClientIdentity `json:"client_identity,omitempty"`
+
+	ctx              caddy.Context
+	staticName       string // resolved node name, if not chosen per request
+	fallbackResolver string // address of the fallback DNS server, if any
+	tlsConfig        *tls.Config
+	clientCA         *clientCA // issuer of client certificates, if ClientIdentity is set
+	mu               sync.Mutex
+	egresses         map[string]*egress
+	closed           bool // set by Cleanup, after which no egresses are created
 
 	// A non-nil TLS config enables TLS.
-	// We do not currently use the config values for anything.
 	TLS *reverseproxy.TLSConfig `json:"tls,omitempty"`
 }
 
+// egress is a node used by the transport, along with the http.Transport that dials through it.
+// Each node has its own http.Transport so that pooled connections are not shared between nodes.
+type egress struct {
+	node      *tailscaleNode
+	transport *http.Transport
+}
+
+// errEgressClosed is returned for requests that need a new egress after the transport or gateway was cleaned up,
+// since the node it would create would never be released.
+var errEgressClosed = errors.New("tailscale egress is closed")
+
 func (t *Transport) CaddyModule() caddy.ModuleInfo {
 	return caddy.ModuleInfo{
 		ID:  "http.reverse_proxy.transport.tailscale",
@@ -37,37 +81,266 @@ func (t *Transport) CaddyModule() caddy.ModuleInfo {
 
 // UnmarshalCaddyfile populates a Transport config from a caddyfile.
 //
-// We only support a single token identifying the name of a node in the App config.
+// The name of a node in the App config can be specified as an argument or in a block.
 // For example:
 //
 //	reverse_proxy {
 //	  transport tailscale my-node
 //	}
 //
+//	reverse_proxy {
+//	  transport tailscale {
+//	    node {http.request.header.X-Region}
+//	    fallback_dns system|off|<resolver>
+//	    require_tailnet_cert
+//	    client_identity {
+//	      trust_domain <domain>
+//	      lifetime <duration>
+//	    }
+//	  }
+//	}
+//
 // If a node name is not specified, a default name is used.
 func (t *Transport) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
-	const defaultNodeName = "caddy-proxy"
-
 	d.Next() // skip transport name
 	if d.NextArg() {
 		t.Name = d.Val()
-	} else {
-		t.Name = defaultNodeName
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "node":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			t.Name = d.Val()
+		case "fallback_dns":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if _, err := parseFallbackDNS(d.Val()); err != nil {
+				return d.WrapErr(err)
+			}
+			t.FallbackDNS = d.Val()
+		case "require_tailnet_cert":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			t.RequireTailnetCert = true
+		case "client_identity":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			id := new(ClientIdentity)
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				switch d.Val() {
+				case "trust_domain":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					id.TrustDomain = d.Val()
+				case "lifetime":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					v, err := caddy.ParseDuration(d.Val())
+					if err != nil {
+						return d.WrapErr(err)
+					}
+					id.Lifetime = caddy.Duration(v)
+				default:
+					return d.Errf("unrecognized client_identity subdirective: %s", d.Val())
+				}
+			}
+			t.ClientIdentity = id
+		default:
+			return d.Errf("unrecognized subdirective: %s", d.Val())
+		}
+	}
+
+	if t.Name == "" {
+		t.Name = defaultTransportNodeName
 	}
 
 	return nil
 }
 
 func (t *Transport) Provision(ctx caddy.Context) error {
+	t.ctx = ctx
+	t.egresses = make(map[string]*egress)
 	var err error
-	t.node, err = getNode(ctx, t.Name)
-	return err
+	if t.fallbackResolver, err = parseFallbackDNS(t.FallbackDNS); err != nil {
+		return err
+	}
+	if (t.RequireTailnetCert || t.ClientIdentity != nil) && t.TLS == nil {
+		t.TLS = new(reverseproxy.TLSConfig)
+	}
+	if t.ClientIdentity != nil {
+		if t.ClientIdentity.Lifetime < 0 {
+			return errors.New("client_identity lifetime must be positive")
+		}
+		if t.clientCA, err = newClientCA(ctx, ctx.Storage(), t.ClientIdentity); err != nil {
+			return err
+		}
+	}
+	if t.TLS != nil {
+		if t.RequireTailnetCert && (t.TLS.InsecureSkipVerify || t.TLS.ServerName != "") {
+			return errors.New("require_tailnet_cert can't be used with insecure_skip_verify or server_name")
+		}
+		if t.tlsConfig, err = t.TLS.MakeTLSClientConfig(ctx); err != nil {
+			return fmt.Errorf("making TLS client config: %w", err)
+		}
+	}
+
+	if t.perRequest() {
+		// nodes are chosen when requests are made
+		return nil
+	}
+
+	app, err := getApp(ctx)
+	if err != nil {
+		return err
+	}
+	name, err := resolveNodeName(ctx, t.Name)
+	if err != nil {
+		return err
+	}
+	t.staticName = name
+
+	// Nodes must not be created while the config is provisioned,
+	// so the app creates the transport's node when it starts, unless it's created on first use.
+	app.registerTransport(t)
+	return nil
+}
+
+// start creates the transport's node when the app starts, and connects it to the tailnet if it starts eagerly.
+// Nodes that start lazily are created on first use.
+func (t *Transport) start(app *App) error {
+	switch getStart(t.staticName, app) {
+	case startLazy:
+		return nil
+	case startEager:
+		e, err := t.getEgress(t.staticName)
+		if err != nil {
+			return err
+		}
+		return e.node.start()
+	default:
+		_, err := t.getEgress(t.staticName)
+		return err
+	}
+}
+
+// registerTransport registers a proxy transport of the app's config, whose node is created when the app starts.
+// Modules of a config are provisioned before its apps start, so transports don't need to be locked.
+func (t *App) registerTransport(tr *Transport) {
+	t.transports = append(t.transports, tr)
+}
+
+// startTransports creates the nodes of the app's proxy transports.
+// It is called when the app starts, once the site configurations of every tailscale directive are resolved.
+func (t *App) startTransports() error {
+	for _, tr := range t.transports {
+		if err := tr.start(t); err != nil {
+			return fmt.Errorf("proxy transport: %w", err)
+		}
+	}
+	return nil
+}
+
+// perRequest reports whether the transport's node is chosen per request.
+func (t *Transport) perRequest() bool {
+	return strings.Contains(t.Name, "{")
+}
+
+// nodeName returns the name of the node to use for req.
+func (t *Transport) nodeName(req *http.Request) (string, error) {
+	if !t.perRequest() {
+		return t.staticName, nil
+	}
+
+	repl, ok := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if !ok {
+		repl = caddy.NewReplacer()
+	}
+	name, err := repl.ReplaceOrErr(t.Name, true, true)
+	if err != nil {
+		return "", err
+	}
+
+	// Only allow configured nodes, so that requests can't register arbitrary nodes.
+	app, err := getApp(t.ctx)
+	if err != nil {
+		return "", err
+	}
+	if isLabelSelector(name) {
+		return selectNode(name, app)
+	}
+	if _, ok := app.Nodes[name]; ok {
+		return name, nil
+	}
+	if _, ok := getSiteConfig(name); !ok {
+		return "", fmt.Errorf("tailscale node %q is not configured", name)
+	}
+	return name, nil
+}
+
+// getEgress returns the transport's egress for the named node, creating it if needed.
+func (t *Transport) getEgress(name string) (*egress, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return nil, errEgressClosed
+	}
+	if e, ok := t.egresses[name]; ok {
+		return e, nil
+	}
+	node, err := getNode(t.ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	dialer := newFallbackDialer(node, t.FallbackDNS, t.fallbackResolver)
+	e := &egress{
+		node:      node,
+		transport: &http.Transport{DialContext: dialer.DialContext},
+	}
+	if t.tlsConfig != nil {
+		config := t.tlsConfig
+		if t.clientCA != nil {
+			config = config.Clone()
+			config.GetClientCertificate = t.clientCA.getClientCertificate(node)
+		}
+		e.transport.DialTLSContext = (&tailnetTLSDialer{
+			node:    node,
+			dial:    dialer.DialContext,
+			config:  config,
+			require: t.RequireTailnetCert,
+		}).DialTLSContext
+	}
+	t.egresses[name] = e
+	return e, nil
 }
 
 func (t *Transport) Cleanup() error {
-	// Decrement usage count of this node.
-	_, err := nodes.Delete(t.Name)
-	return err
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.closed = true
+	var errs []error
+	for name, e := range t.egresses {
+		e.transport.CloseIdleConnections()
+
+		// Decrement usage count of this node.
+		if _, err := nodes.Delete(name); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	t.egresses = nil
+	return errors.Join(errs...)
 }
 
 func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
@@ -78,11 +351,20 @@ func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 			req.URL.Scheme = "http"
 		}
 	}
-	return t.node.HTTPClient().Transport.RoundTrip(req)
+
+	name, err := t.nodeName(req)
+	if err != nil {
+		return nil, err
+	}
+	e, err := t.getEgress(name)
+	if err != nil {
+		return nil, err
+	}
+	return e.transport.RoundTrip(req)
 }
 
 // TLSEnabled returns true if TLS is enabled.
-func (h Transport) TLSEnabled() bool {
+func (h *Transport) TLSEnabled() bool {
 	return h.TLS != nil
 }
 
@@ -0,0 +1,204 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func Test_TransportUnmarshalCaddyfile(t *testing.T) {
+	tests := []struct {
+		name           string
+		d              *caddyfile.Dispenser
+		want           string
+		wantPerRequest bool
+		wantRequire    bool
+		wantErr        bool
+	}{
+		{
+			name: "default node",
+			d:    caddyfile.NewTestDispenser(`tailscale`),
+			want: "caddy-proxy",
+		},
+		{
+			name: "node argument",
+			d:    caddyfile.NewTestDispenser(`tailscale edge-eu`),
+			want: "edge-eu",
+		},
+		{
+			name: "node in block",
+			d: caddyfile.NewTestDispenser(`
+				tailscale {
+					node edge-eu
+				}`),
+			want: "edge-eu",
+		},
+		{
+			name: "node placeholder",
+			d: caddyfile.NewTestDispenser(`
+				tailscale {
+					node edge-{http.request.header.X-Region}
+				}`),
+			want:           "edge-{http.request.header.X-Region}",
+			wantPerRequest: true,
+		},
+		{
+			name: "fallback dns",
+			d: caddyfile.NewTestDispenser(`
+				tailscale edge-eu {
+					fallback_dns 1.1.1.1
+				}`),
+			want: "edge-eu",
+		},
+		{
+			name: "invalid fallback dns",
+			d: caddyfile.NewTestDispenser(`
+				tailscale {
+					fallback_dns dns.google
+				}`),
+			wantErr: true,
+		},
+		{
+			name: "require tailnet cert",
+			d: caddyfile.NewTestDispenser(`
+				tailscale edge-eu {
+					require_tailnet_cert
+				}`),
+			want:        "edge-eu",
+			wantRequire: true,
+		},
+		{
+			name: "require tailnet cert with argument",
+			d: caddyfile.NewTestDispenser(`
+				tailscale {
+					require_tailnet_cert true
+				}`),
+			wantErr: true,
+		},
+		{
+			name: "client identity",
+			d: caddyfile.NewTestDispenser(`
+				tailscale edge-eu {
+					client_identity {
+						trust_domain example.internal
+						lifetime 12h
+					}
+				}`),
+			want: "edge-eu",
+		},
+		{
+			name: "unknown client identity subdirective",
+			d: caddyfile.NewTestDispenser(`
+				tailscale {
+					client_identity {
+						key_type rsa
+					}
+				}`),
+			wantErr: true,
+		},
+		{
+			name:    "too many arguments",
+			d:       caddyfile.NewTestDispenser(`tailscale edge-eu edge-us`),
+			wantErr: true,
+		},
+		{
+			name: "unknown subdirective",
+			d: caddyfile.NewTestDispenser(`
+				tailscale {
+					region eu
+				}`),
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := new(Transport)
+			err := tr.UnmarshalCaddyfile(tt.d)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("UnmarshalCaddyfile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if tr.Name != tt.want {
+				t.Errorf("Name = %q, want %q", tr.Name, tt.want)
+			}
+			if got := tr.perRequest(); got != tt.wantPerRequest {
+				t.Errorf("perRequest() = %v, want %v", got, tt.wantPerRequest)
+			}
+			if tr.RequireTailnetCert != tt.wantRequire {
+				t.Errorf("RequireTailnetCert = %v, want %v", tr.RequireTailnetCert, tt.wantRequire)
+			}
+		})
+	}
+}
+
+func Test_TailnetTLSDialer_ServerName(t *testing.T) {
+	remote := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 443}
+	tests := []struct {
+		name    string
+		require bool
+		want    string
+		wantErr bool
+	}{
+		{name: "upstream outside tailnet", want: "backend.example.com"},
+		{name: "required tailnet cert", require: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &tailnetTLSDialer{require: tt.require}
+			got, err := d.serverName(context.Background(), "backend.example.com", remote)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("serverName() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("serverName() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_TSNetName(t *testing.T) {
+	tests := []struct {
+		name   string
+		want   string
+		wantOK bool
+	}{
+		{name: "web1.tail1234.ts.net.", want: "web1.tail1234.ts.net", wantOK: true},
+		{name: "web1.example.com.", want: "web1.example.com"},
+		{name: "web1", want: "web1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := tsNetName(tt.name)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("tsNetName(%q) = %q, %v, want %q, %v", tt.name, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func Test_EgressAfterCleanup(t *testing.T) {
+	tr := &Transport{egresses: map[string]*egress{}}
+	if err := tr.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tr.getEgress("node"); !errors.Is(err, errEgressClosed) {
+		t.Errorf("Transport.getEgress() after Cleanup err = %v, want %v", err, errEgressClosed)
+	}
+
+	g := &Gateway{egresses: map[string]*egress{}}
+	if err := g.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.getEgress("node"); !errors.Is(err, errEgressClosed) {
+		t.Errorf("Gateway.getEgress() after Cleanup err = %v, want %v", err, errEgressClosed)
+	}
+}
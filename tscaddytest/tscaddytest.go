@@ -0,0 +1,151 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+// Package tscaddytest provides helpers for writing end-to-end tests of Caddy configurations
+// that use the Tailscale plugin, without needing a real tailnet.
+//
+// It runs an in-process Tailscale control server, DERP and STUN server,
+// and can create in-process nodes registered with that control server.
+// Caddy nodes are pointed at the control server by setting their control_url to [Control.URL].
+package tscaddytest
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"tailscale.com/derp/derpserver"
+	"tailscale.com/ipn/store/mem"
+	"tailscale.com/net/netns"
+	"tailscale.com/net/stun/stuntest"
+	"tailscale.com/tailcfg"
+	"tailscale.com/tsnet"
+	"tailscale.com/tstest/integration/testcontrol"
+	"tailscale.com/types/key"
+	"tailscale.com/types/logger"
+	"tailscale.com/types/nettype"
+)
+
+// MagicDNSDomain is the MagicDNS suffix used by nodes registered with a [Control] server.
+const MagicDNSDomain = "tail-scale.ts.net"
+
+// Control is an in-process Tailscale control server.
+// Nodes registered with it are authorized automatically and can reach each other.
+type Control struct {
+	*testcontrol.Server
+
+	// URL is the base URL of the control server, suitable for use as a node's control_url.
+	URL string
+}
+
+// NewControl starts an in-process control server along with a DERP and STUN server.
+// All servers are shut down when the test completes.
+func NewControl(t testing.TB) *Control {
+	t.Helper()
+
+	// Don't use netns for tests; it requires privileges that tests usually don't have.
+	netns.SetEnabled(false)
+	t.Cleanup(func() { netns.SetEnabled(true) })
+
+	derpMap := runDERPAndSTUN(t)
+	control := &testcontrol.Server{
+		DERPMap: derpMap,
+		DNSConfig: &tailcfg.DNSConfig{
+			Proxied: true,
+		},
+		MagicDNSDomain: MagicDNSDomain,
+		Logf:           logger.Discard,
+	}
+	control.HTTPTestServer = httptest.NewUnstartedServer(control)
+	control.HTTPTestServer.Start()
+	t.Cleanup(control.HTTPTestServer.Close)
+
+	return &Control{
+		Server: control,
+		URL:    control.HTTPTestServer.URL,
+	}
+}
+
+// NewNode starts an ephemeral tsnet node with the given hostname, registered with c.
+// NewNode blocks until the node is running, and the node is closed when the test completes.
+func (c *Control) NewNode(t testing.TB, hostname string) *tsnet.Server {
+	t.Helper()
+
+	dir := filepath.Join(t.TempDir(), hostname)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &tsnet.Server{
+		Dir:        dir,
+		ControlURL: c.URL,
+		Hostname:   hostname,
+		Store:      new(mem.Store),
+		Ephemeral:  true,
+		Logf:       logger.Discard,
+		UserLogf:   t.Logf,
+	}
+	t.Cleanup(func() { s.Close() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if _, err := s.Up(ctx); err != nil {
+		t.Fatalf("starting node %q: %v", hostname, err)
+	}
+	return s
+}
+
+// runDERPAndSTUN starts a DERP and STUN server on localhost and returns a DERP map containing them.
+func runDERPAndSTUN(t testing.TB) *tailcfg.DERPMap {
+	t.Helper()
+
+	const ip = "127.0.0.1"
+
+	d := derpserver.New(key.NewNode(), logger.Discard)
+	ln, err := net.Listen("tcp", net.JoinHostPort(ip, "0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	httpsrv := httptest.NewUnstartedServer(derpserver.Handler(d))
+	httpsrv.Listener.Close()
+	httpsrv.Listener = ln
+	httpsrv.Config.ErrorLog = logger.StdLogger(logger.Discard)
+	httpsrv.Config.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	httpsrv.StartTLS()
+
+	stunAddr, stunCleanup := stuntest.ServeWithPacketListener(t, nettype.Std{})
+
+	t.Cleanup(func() {
+		httpsrv.CloseClientConnections()
+		httpsrv.Close()
+		d.Close()
+		stunCleanup()
+	})
+
+	return &tailcfg.DERPMap{
+		Regions: map[int]*tailcfg.DERPRegion{
+			1: {
+				RegionID:   1,
+				RegionCode: "test",
+				Nodes: []*tailcfg.DERPNode{{
+					Name:             "t1",
+					RegionID:         1,
+					HostName:         ip,
+					IPv4:             ip,
+					IPv6:             "none",
+					STUNPort:         stunAddr.Port,
+					DERPPort:         ln.Addr().(*net.TCPAddr).Port,
+					InsecureForTests: true,
+					STUNTestIP:       ip,
+				}},
+			},
+		},
+	}
+}
@@ -0,0 +1,431 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// upstreams.go contains a reverse proxy upstream source that selects tailnet peers by tag,
+// so that replicas of an internal service can be load balanced without listing them in the config.
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"go.uber.org/zap"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+	"tailscale.com/util/cmpver"
+)
+
+func init() {
+	caddy.RegisterModule(&PeerUpstreams{})
+}
+
+const (
+	// defaultPeerUpstreamsRefresh is how long the list of peers is cached by default.
+	defaultPeerUpstreamsRefresh = 10 * time.Second
+
+	// maxPeerWeight is the largest weight of a peer.
+	// Peers are listed once per unit of weight, so this bounds the number of upstreams.
+	maxPeerWeight = 100
+)
+
+// peerWeightCap is the value of the weight capability granted by a peer.
+type peerWeightCap struct {
+	Weight int `json:"weight"`
+}
+
+// PeerUpstreams is a dynamic upstream source for the reverse proxy that returns the online tailnet peers
+// of a node that have all of the given tags, excluding peers matching any of the exclusion rules.
+// Requests to the upstreams must be made with the tailscale transport using the same node.
+type PeerUpstreams struct {
+	// Node is the name of the node whose peers are used, or a label selector such as "region=eu".
+	// Default: caddy-proxy
+	Node string `json:"node,omitempty"`
+
+	// Tags are the tags that peers must all have, such as "tag:web".
+	Tags []string `json:"tags,omitempty"`
+
+	// Port is the port to connect to on each peer.
+	Port string `json:"port"`
+
+	// Refresh is how long the list of peers is cached.
+	// Default: 10s
+	Refresh caddy.Duration `json:"refresh,omitempty"`
+
+	// ExcludeHostnames are glob patterns of peer hostnames to exclude, such as "canary-*".
+	// Hostnames are matched case-insensitively.
+	ExcludeHostnames []string `json:"exclude_hostnames,omitempty"`
+
+	// ExcludeOS are operating systems of peers to exclude, such as "windows".
+	ExcludeOS []string `json:"exclude_os,omitempty"`
+
+	// ExcludeTags are tags of peers to exclude, such as "tag:canary".
+	ExcludeTags []string `json:"exclude_tags,omitempty"`
+
+	// MinVersion is the minimum Tailscale version of peers, such as "1.80".
+	// Peers running older versions, or whose version is unknown, are excluded.
+	MinVersion string `json:"min_version,omitempty"`
+
+	// WeightCapability is the name of a peer capability, such as "example.com/cap/weight",
+	// whose value {"weight": <n>} sets the weight of peers that are granted it.
+	WeightCapability string `json:"weight_capability,omitempty"`
+
+	// Weights are static weights of peers by hostname, which take precedence over the weight capability.
+	// Peers are listed once per unit of weight, so that they receive a proportional share of requests
+	// with selection policies such as random or round_robin. Peers with a weight of 0 are excluded.
+	// Default: 1
+	Weights map[string]int `json:"weights,omitempty"`
+
+	ctx    caddy.Context
+	logger *zap.Logger
+	name   string // resolved node name
+
+	mu        sync.Mutex
+	node      *tailscaleNode // got on first use
+	cleanedUp bool
+	upstreams []*reverseproxy.Upstream
+	fetched   time.Time
+}
+
+func (*PeerUpstreams) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.reverse_proxy.upstreams.tailscale",
+		New: func() caddy.Module { return new(PeerUpstreams) },
+	}
+}
+
+// Provision implements caddy.Provisioner.
+func (u *PeerUpstreams) Provision(ctx caddy.Context) error {
+	u.ctx = ctx
+	u.logger = ctx.Logger(u)
+	if u.Port == "" {
+		return errors.New("port is required")
+	}
+	if v, err := strconv.ParseUint(u.Port, 10, 16); err != nil || v == 0 {
+		return fmt.Errorf("invalid port %q", u.Port)
+	}
+	for _, pattern := range u.ExcludeHostnames {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid hostname pattern %q: %w", pattern, err)
+		}
+	}
+	for hostname, w := range u.Weights {
+		if w < 0 || w > maxPeerWeight {
+			return fmt.Errorf("weight of %s must be between 0 and %d, got %d", hostname, maxPeerWeight, w)
+		}
+	}
+	if u.Refresh == 0 {
+		u.Refresh = caddy.Duration(defaultPeerUpstreamsRefresh)
+	}
+
+	name, err := resolveNodeName(ctx, cmp.Or(u.Node, defaultTransportNodeName))
+	if err != nil {
+		return err
+	}
+	u.name = name
+	return nil
+}
+
+// Cleanup implements caddy.CleanerUpper.
+func (u *PeerUpstreams) Cleanup() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.cleanedUp = true
+	if u.node == nil {
+		return nil
+	}
+	u.node = nil
+	_, err := nodes.Delete(u.name)
+	return err
+}
+
+// GetUpstreams implements reverseproxy.UpstreamSource.
+func (u *PeerUpstreams) GetUpstreams(r *http.Request) ([]*reverseproxy.Upstream, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.upstreams == nil || time.Since(u.fetched) >= time.Duration(u.Refresh) {
+		upstreams, err := u.fetch(r.Context())
+		if err != nil {
+			if u.upstreams == nil {
+				return nil, err
+			}
+			u.logger.Warn("refreshing tailnet peers failed, using cached peers", zap.Error(err))
+		} else {
+			u.upstreams = upstreams
+		}
+		u.fetched = time.Now()
+	}
+
+	// Upstreams are copied, since the reverse proxy sets their hosts.
+	upstreams := make([]*reverseproxy.Upstream, len(u.upstreams))
+	for i, up := range u.upstreams {
+		upstreams[i] = &reverseproxy.Upstream{Dial: up.Dial}
+	}
+	return upstreams, nil
+}
+
+// fetch returns the upstreams of the node's peers that are selected, listing each peer once per unit of weight.
+func (u *PeerUpstreams) fetch(ctx context.Context) ([]*reverseproxy.Upstream, error) {
+	if u.cleanedUp {
+		return nil, errors.New("upstream source has been cleaned up")
+	}
+	if u.node == nil {
+		// The node is got on first use, since it must not be created while the config is provisioned.
+		node, err := getNode(u.ctx, u.name)
+		if err != nil {
+			return nil, err
+		}
+		u.node = node
+	}
+	if err := u.node.start(); err != nil {
+		return nil, err
+	}
+	lc, err := u.node.LocalClient()
+	if err != nil {
+		return nil, err
+	}
+	st, err := lc.Status(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	upstreams := []*reverseproxy.Upstream{}
+	for _, ps := range st.Peer {
+		if !u.selectPeer(ps) {
+			continue
+		}
+		var capMap tailcfg.PeerCapMap
+		if u.MinVersion != "" || u.WeightCapability != "" {
+			whois, err := lc.WhoIs(ctx, ps.TailscaleIPs[0].String())
+			if err != nil {
+				return nil, err
+			}
+			if u.MinVersion != "" {
+				var version string
+				if whois.Node != nil && whois.Node.Hostinfo.Valid() {
+					version = whois.Node.Hostinfo.IPNVersion()
+				}
+				if !versionAtLeast(version, u.MinVersion) {
+					continue
+				}
+			}
+			capMap = whois.CapMap
+		}
+		weight, err := u.peerWeight(ps.HostName, capMap)
+		if err != nil {
+			return nil, err
+		}
+		dial := net.JoinHostPort(peerAddr(ps), u.Port)
+		for range weight {
+			upstreams = append(upstreams, &reverseproxy.Upstream{Dial: dial})
+		}
+	}
+	slices.SortFunc(upstreams, func(a, b *reverseproxy.Upstream) int { return cmp.Compare(a.Dial, b.Dial) })
+	return upstreams, nil
+}
+
+// selectPeer reports whether ps is online, has all of the tags, and matches none of the exclusion rules.
+// The peer's version is checked separately, since it isn't part of its status.
+func (u *PeerUpstreams) selectPeer(ps *ipnstate.PeerStatus) bool {
+	if !ps.Online || len(ps.TailscaleIPs) == 0 {
+		return false
+	}
+	var tags []string
+	if ps.Tags != nil {
+		tags = ps.Tags.AsSlice()
+	}
+	for _, tag := range u.Tags {
+		if !slices.Contains(tags, tag) {
+			return false
+		}
+	}
+	for _, tag := range u.ExcludeTags {
+		if slices.Contains(tags, tag) {
+			return false
+		}
+	}
+	for _, pattern := range u.ExcludeHostnames {
+		if ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(ps.HostName)); ok {
+			return false
+		}
+	}
+	for _, os := range u.ExcludeOS {
+		if strings.EqualFold(os, ps.OS) {
+			return false
+		}
+	}
+	return true
+}
+
+// peerWeight returns the weight of the peer with the given hostname, which was granted the capabilities in capMap.
+func (u *PeerUpstreams) peerWeight(hostname string, capMap tailcfg.PeerCapMap) (int, error) {
+	if w, ok := u.Weights[hostname]; ok {
+		return w, nil
+	}
+	if u.WeightCapability == "" {
+		return 1, nil
+	}
+	caps, err := tailcfg.UnmarshalCapJSON[peerWeightCap](capMap, tailcfg.PeerCapability(u.WeightCapability))
+	if err != nil {
+		return 0, fmt.Errorf("peer %s: invalid %s capability: %w", hostname, u.WeightCapability, err)
+	}
+	if len(caps) == 0 {
+		return 1, nil
+	}
+	// A peer may be granted the capability more than once; grants are additive, so the largest weight is used.
+	weight := 0
+	for _, c := range caps {
+		weight = max(weight, c.Weight)
+	}
+	return min(weight, maxPeerWeight), nil
+}
+
+// peerAddr returns the address used to connect to a peer, preferring IPv4.
+func peerAddr(ps *ipnstate.PeerStatus) string {
+	for _, ip := range ps.TailscaleIPs {
+		if ip.Is4() {
+			return ip.String()
+		}
+	}
+	return ps.TailscaleIPs[0].String()
+}
+
+// versionAtLeast reports whether the Tailscale version is at least min.
+// Unknown versions are not.
+func versionAtLeast(version, min string) bool {
+	if version == "" {
+		return false
+	}
+	// Versions have a suffix identifying the build, such as "1.80.2-t1234abcd-g5678efgh".
+	version, _, _ = strings.Cut(version, "-")
+	return cmpver.Compare(version, min) >= 0
+}
+
+// UnmarshalCaddyfile sets up the upstream source from Caddyfile tokens. Syntax:
+//
+//	dynamic tailscale [<node>] {
+//	  node <node>
+//	  tags <tag>...
+//	  port <port>
+//	  refresh <duration>
+//	  exclude_hostname <pattern>...
+//	  exclude_os <os>...
+//	  exclude_tag <tag>...
+//	  min_version <version>
+//	  weight_capability <capability>
+//	  weight <hostname> <weight>
+//	}
+func (u *PeerUpstreams) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume upstream source name
+	if d.NextArg() {
+		u.Node = d.Val()
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "node":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			u.Node = d.Val()
+
+		case "tags":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			u.Tags = append(u.Tags, args...)
+
+		case "port":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			u.Port = d.Val()
+
+		case "refresh":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			v, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.WrapErr(err)
+			}
+			u.Refresh = caddy.Duration(v)
+
+		case "exclude_hostname":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			u.ExcludeHostnames = append(u.ExcludeHostnames, args...)
+
+		case "exclude_os":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			u.ExcludeOS = append(u.ExcludeOS, args...)
+
+		case "exclude_tag":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			u.ExcludeTags = append(u.ExcludeTags, args...)
+
+		case "min_version":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			u.MinVersion = d.Val()
+
+		case "weight_capability":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			u.WeightCapability = d.Val()
+
+		case "weight":
+			var hostname, weight string
+			if !d.Args(&hostname, &weight) {
+				return d.ArgErr()
+			}
+			v, err := strconv.Atoi(weight)
+			if err != nil {
+				return d.WrapErr(err)
+			}
+			if u.Weights == nil {
+				u.Weights = make(map[string]int)
+			}
+			u.Weights[hostname] = v
+
+		default:
+			return d.Errf("unrecognized subdirective: %s", d.Val())
+		}
+	}
+	return nil
+}
+
+var (
+	_ reverseproxy.UpstreamSource = (*PeerUpstreams)(nil)
+	_ caddy.Provisioner           = (*PeerUpstreams)(nil)
+	_ caddy.CleanerUpper          = (*PeerUpstreams)(nil)
+	_ caddyfile.Unmarshaler       = (*PeerUpstreams)(nil)
+)
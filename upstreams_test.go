@@ -0,0 +1,256 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/views"
+)
+
+func Test_PeerUpstreams_SelectPeer(t *testing.T) {
+	peer := func(hostname, os string, online bool, tags ...string) *ipnstate.PeerStatus {
+		v := views.SliceOf(tags)
+		return &ipnstate.PeerStatus{
+			HostName:     hostname,
+			OS:           os,
+			Online:       online,
+			Tags:         &v,
+			TailscaleIPs: []netip.Addr{netip.MustParseAddr("100.64.0.1")},
+		}
+	}
+
+	tests := []struct {
+		name string
+		u    *PeerUpstreams
+		ps   *ipnstate.PeerStatus
+		want bool
+	}{
+		{
+			name: "matching tags",
+			u:    &PeerUpstreams{Tags: []string{"tag:web"}},
+			ps:   peer("web1", "linux", true, "tag:web", "tag:prod"),
+			want: true,
+		},
+		{
+			name: "offline",
+			u:    &PeerUpstreams{Tags: []string{"tag:web"}},
+			ps:   peer("web1", "linux", false, "tag:web"),
+		},
+		{
+			name: "missing tag",
+			u:    &PeerUpstreams{Tags: []string{"tag:web", "tag:prod"}},
+			ps:   peer("web1", "linux", true, "tag:web"),
+		},
+		{
+			name: "excluded tag",
+			u:    &PeerUpstreams{Tags: []string{"tag:web"}, ExcludeTags: []string{"tag:canary"}},
+			ps:   peer("web1", "linux", true, "tag:web", "tag:canary"),
+		},
+		{
+			name: "excluded hostname",
+			u:    &PeerUpstreams{Tags: []string{"tag:web"}, ExcludeHostnames: []string{"canary-*"}},
+			ps:   peer("Canary-web1", "linux", true, "tag:web"),
+		},
+		{
+			name: "hostname not excluded",
+			u:    &PeerUpstreams{Tags: []string{"tag:web"}, ExcludeHostnames: []string{"canary-*"}},
+			ps:   peer("web1", "linux", true, "tag:web"),
+			want: true,
+		},
+		{
+			name: "excluded os",
+			u:    &PeerUpstreams{Tags: []string{"tag:web"}, ExcludeOS: []string{"windows"}},
+			ps:   peer("web1", "Windows", true, "tag:web"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.u.selectPeer(tt.ps); got != tt.want {
+				t.Errorf("selectPeer() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_PeerUpstreams_PeerWeight(t *testing.T) {
+	const weightCap = tailcfg.PeerCapability("example.com/cap/weight")
+	u := &PeerUpstreams{
+		WeightCapability: string(weightCap),
+		Weights:          map[string]int{"web1": 3, "web2": 0},
+	}
+
+	tests := []struct {
+		name     string
+		hostname string
+		capMap   tailcfg.PeerCapMap
+		want     int
+		wantErr  bool
+	}{
+		{name: "default", hostname: "web3", want: 1},
+		{name: "static weight", hostname: "web1", want: 3},
+		{name: "static zero weight", hostname: "web2", want: 0},
+		{
+			name:     "static weight takes precedence",
+			hostname: "web1",
+			capMap:   tailcfg.PeerCapMap{weightCap: {`{"weight": 5}`}},
+			want:     3,
+		},
+		{
+			name:     "capability",
+			hostname: "web3",
+			capMap:   tailcfg.PeerCapMap{weightCap: {`{"weight": 5}`}},
+			want:     5,
+		},
+		{
+			name:     "largest capability",
+			hostname: "web3",
+			capMap:   tailcfg.PeerCapMap{weightCap: {`{"weight": 5}`, `{"weight": 10}`}},
+			want:     10,
+		},
+		{
+			name:     "capability capped",
+			hostname: "web3",
+			capMap:   tailcfg.PeerCapMap{weightCap: {`{"weight": 1000}`}},
+			want:     maxPeerWeight,
+		},
+		{
+			name:     "invalid capability",
+			hostname: "web3",
+			capMap:   tailcfg.PeerCapMap{weightCap: {`{"weight": "heavy"}`}},
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := u.peerWeight(tt.hostname, tt.capMap)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("peerWeight() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("peerWeight() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_VersionAtLeast(t *testing.T) {
+	tests := []struct {
+		version string
+		min     string
+		want    bool
+	}{
+		{version: "1.80.2-t1234abcd-g5678efgh", min: "1.80", want: true},
+		{version: "1.80.2", min: "1.80.2", want: true},
+		{version: "1.78.1-t1234abcd", min: "1.80"},
+		{version: "", min: "1.0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.version, func(t *testing.T) {
+			if got := versionAtLeast(tt.version, tt.min); got != tt.want {
+				t.Errorf("versionAtLeast(%q, %q) = %v, want %v", tt.version, tt.min, got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_PeerUpstreams_UnmarshalCaddyfile(t *testing.T) {
+	tests := []struct {
+		name    string
+		d       *caddyfile.Dispenser
+		want    *PeerUpstreams
+		wantErr bool
+	}{
+		{
+			name: "node argument",
+			d: caddyfile.NewTestDispenser(`
+				tailscale myhost {
+					tags tag:web
+					port 8080
+				}`),
+			want: &PeerUpstreams{Node: "myhost", Tags: []string{"tag:web"}, Port: "8080"},
+		},
+		{
+			name: "exclusion rules",
+			d: caddyfile.NewTestDispenser(`
+				tailscale {
+					node myhost
+					tags tag:web tag:prod
+					port 8080
+					refresh 30s
+					exclude_hostname canary-* test-*
+					exclude_os windows
+					exclude_tag tag:canary
+					min_version 1.80
+					weight_capability example.com/cap/weight
+					weight web1 3
+					weight web2 0
+				}`),
+			want: &PeerUpstreams{
+				Node:             "myhost",
+				Tags:             []string{"tag:web", "tag:prod"},
+				Port:             "8080",
+				Refresh:          caddy.Duration(30 * time.Second),
+				ExcludeHostnames: []string{"canary-*", "test-*"},
+				ExcludeOS:        []string{"windows"},
+				ExcludeTags:      []string{"tag:canary"},
+				MinVersion:       "1.80",
+				WeightCapability: "example.com/cap/weight",
+				Weights:          map[string]int{"web1": 3, "web2": 0},
+			},
+		},
+		{
+			name:    "too many arguments",
+			d:       caddyfile.NewTestDispenser(`tailscale a b`),
+			wantErr: true,
+		},
+		{
+			name: "missing exclude_os value",
+			d: caddyfile.NewTestDispenser(`
+				tailscale {
+					exclude_os
+				}`),
+			wantErr: true,
+		},
+		{
+			name: "invalid weight",
+			d: caddyfile.NewTestDispenser(`
+				tailscale {
+					weight web1 heavy
+				}`),
+			wantErr: true,
+		},
+		{
+			name: "unknown subdirective",
+			d: caddyfile.NewTestDispenser(`
+				tailscale {
+					bogus 1
+				}`),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := new(PeerUpstreams)
+			err := got.UnmarshalCaddyfile(tt.d)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("UnmarshalCaddyfile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if diff := cmp.Diff(tt.want, got, cmpopts.IgnoreUnexported(PeerUpstreams{})); diff != "" {
+				t.Errorf("UnmarshalCaddyfile() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// upstreamtls.go contains TLS for HTTPS upstreams of the transport,
+// verifying the ts.net certificates of tailnet peers against their MagicDNS names.
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+
+	"tailscale.com/net/tsaddr"
+)
+
+// tailnetTLSDialer dials TLS connections to upstreams through a node.
+// Connections to tailnet peers use the peer's MagicDNS name for SNI and certificate verification,
+// since upstreams are often addressed by IP address or short name, which their ts.net certificates don't cover.
+type tailnetTLSDialer struct {
+	node *tailscaleNode
+	dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// config is the base TLS config. If it has a server name, the server name is always used.
+	config *tls.Config
+
+	// require is whether connections to upstreams other than tailnet peers with ts.net names fail.
+	require bool
+}
+
+func (d *tailnetTLSDialer) DialTLSContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := d.dial(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := d.config.Clone()
+	if cfg.ServerName == "" {
+		if cfg.ServerName, err = d.serverName(ctx, host, conn.RemoteAddr()); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	tc := tls.Client(conn, cfg)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tc, nil
+}
+
+// serverName returns the name used to verify the certificate of the upstream host, connected to at remote.
+// It is the MagicDNS name of tailnet peers, and host otherwise.
+func (d *tailnetTLSDialer) serverName(ctx context.Context, host string, remote net.Addr) (string, error) {
+	var peerIP netip.Addr
+	if ap, err := netip.ParseAddrPort(remote.String()); err == nil && tsaddr.IsTailscaleIP(ap.Addr().Unmap()) {
+		peerIP = ap.Addr().Unmap()
+	}
+	if peerIP.IsValid() {
+		lc, err := d.node.LocalClient()
+		if err != nil {
+			return "", err
+		}
+		whois, err := lc.WhoIs(ctx, peerIP.String())
+		if err != nil {
+			return "", fmt.Errorf("looking up tailnet upstream %s: %w", host, err)
+		}
+		if whois.Node != nil {
+			if name, ok := tsNetName(whois.Node.Name); ok {
+				return name, nil
+			}
+		}
+	}
+	if d.require {
+		return "", fmt.Errorf("upstream %s is not a tailnet peer with a ts.net name", host)
+	}
+	return host, nil
+}
+
+// tsNetName returns the MagicDNS name of a node without the trailing dot,
+// if it is a ts.net name that can have a certificate.
+func tsNetName(name string) (string, bool) {
+	name = strings.TrimSuffix(name, ".")
+	return name, strings.HasSuffix(name, ".ts.net")
+}
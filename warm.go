@@ -0,0 +1,61 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// warm.go contains support for resuming nodes quickly when Caddy is restarted, such as to upgrade its binary.
+// Nodes reuse their identity from their state directory, and also their UDP port if it was selected automatically,
+// so that the direct endpoints cached by peers stay valid and connections resume without going through DERP.
+// Nodes aren't handed off to a new process, since tsnet can't adopt another process's WireGuard sessions.
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// portFileName is the name of the file in a node's state directory that its automatically selected UDP port is stored in.
+const portFileName = "caddy-port"
+
+// loadPort returns the UDP port stored in the state directory dir, or zero if there is none.
+func loadPort(dir string) uint16 {
+	b, err := os.ReadFile(filepath.Join(dir, portFileName))
+	if err != nil {
+		return 0
+	}
+	port, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 16)
+	if err != nil {
+		return 0
+	}
+	return uint16(port)
+}
+
+// storePort stores port in the state directory dir, if it isn't already stored.
+func storePort(dir string, port uint16) error {
+	if port == 0 || loadPort(dir) == port {
+		return nil
+	}
+	err := os.WriteFile(filepath.Join(dir, portFileName), []byte(strconv.Itoa(int(port))+"\n"), 0600)
+	if errors.Is(err, fs.ErrNotExist) {
+		// The state directory was removed, so there is no identity to resume either.
+		return nil
+	}
+	return err
+}
+
+// savePort stores the running node's UDP port in its state directory,
+// if the port was selected automatically, so that the node binds it again when Caddy restarts.
+// If the port is in use by then, such as by a Caddy process that hasn't exited yet, another port is selected.
+func (t *tailscaleNode) savePort() {
+	if !t.persistPort {
+		return
+	}
+	if err := storePort(t.Dir, t.Sys().MagicSock.Get().LocalPort()); err != nil {
+		t.logger.Warn("saving UDP port for restarts", zap.Error(err))
+	}
+}
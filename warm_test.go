@@ -0,0 +1,37 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_StorePort(t *testing.T) {
+	dir := t.TempDir()
+	if got := loadPort(dir); got != 0 {
+		t.Errorf("loadPort() with no stored port = %d, want 0", got)
+	}
+
+	for _, port := range []uint16{41641, 50000} {
+		if err := storePort(dir, port); err != nil {
+			t.Fatalf("storePort(%d) error = %v", port, err)
+		}
+		if got := loadPort(dir); got != port {
+			t.Errorf("loadPort() = %d, want %d", got, port)
+		}
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, portFileName), []byte("not a port"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if got := loadPort(dir); got != 0 {
+		t.Errorf("loadPort() with invalid stored port = %d, want 0", got)
+	}
+
+	if err := storePort(filepath.Join(dir, "removed"), 41641); err != nil {
+		t.Errorf("storePort() in missing state directory error = %v, want nil", err)
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// webui.go contains access control for the Web UI of nodes, so that only some tailnet users
+// can reach it, rather than every peer that the tailnet policy allows to connect to the node.
+
+import (
+	"net/netip"
+	"sync/atomic"
+
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/net/packet"
+	"tailscale.com/net/tstun"
+	"tailscale.com/tsconst"
+	"tailscale.com/types/ipproto"
+	"tailscale.com/types/netmap"
+)
+
+// webUIGate drops TCP packets sent to the Web UI port of a node by peers that aren't allowed to use it.
+// The Web UI is served by the node itself, before connections reach Caddy's listeners,
+// so access is enforced on packets received from peers.
+type webUIGate struct {
+	// allowed are the login names and tags of the peers allowed to connect.
+	allowed []string
+
+	// addrs are the Tailscale addresses of the node and its allowed peers,
+	// from the latest network map. No peer is allowed until the first network map is received.
+	addrs atomic.Pointer[webUIAddrs]
+}
+
+// webUIAddrs are the addresses used to filter packets sent to the Web UI.
+type webUIAddrs struct {
+	self  map[netip.Addr]bool
+	peers map[netip.Addr]bool
+}
+
+// update implements packetGate.
+func (g *webUIGate) update(nm *netmap.NetworkMap, _ *ipnstate.PeerStatus) {
+	g.addrs.Store(&webUIAddrs{
+		self:  selfAddrs(nm),
+		peers: allowedPeerAddrs(nm, g.allowed),
+	})
+}
+
+// allows implements packetGate.
+func (g *webUIGate) allows(p *packet.Parsed, _ *tstun.Wrapper) bool {
+	if p.IPProto != ipproto.TCP || p.Dst.Port() != tsconst.WebListenPort {
+		return true
+	}
+	addrs := g.addrs.Load()
+	if addrs == nil {
+		return false
+	}
+	if !addrs.self[p.Dst.Addr()] {
+		return true // not for the node, such as traffic to a subnet route
+	}
+	return addrs.peers[p.Src.Addr()]
+}
+
+var _ packetGate = (*webUIGate)(nil)
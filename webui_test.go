@@ -0,0 +1,80 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+import (
+	"net/netip"
+	"testing"
+
+	"tailscale.com/net/packet"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/ipproto"
+	"tailscale.com/types/netmap"
+)
+
+func Test_WebUIGate(t *testing.T) {
+	self := netip.MustParseAddr("100.64.0.1")
+	nm := &netmap.NetworkMap{
+		SelfNode: (&tailcfg.Node{
+			Addresses: []netip.Prefix{netip.PrefixFrom(self, 32)},
+		}).View(),
+		Peers: []tailcfg.NodeView{
+			(&tailcfg.Node{
+				ID:        1,
+				User:      1,
+				Addresses: []netip.Prefix{netip.MustParsePrefix("100.64.0.2/32")},
+			}).View(),
+			(&tailcfg.Node{
+				ID:        2,
+				User:      2,
+				Addresses: []netip.Prefix{netip.MustParsePrefix("100.64.0.3/32")},
+			}).View(),
+			(&tailcfg.Node{
+				ID:        3,
+				User:      3,
+				Tags:      []string{"tag:admin"},
+				Addresses: []netip.Prefix{netip.MustParsePrefix("100.64.0.4/32")},
+			}).View(),
+		},
+		UserProfiles: map[tailcfg.UserID]tailcfg.UserProfileView{
+			1: (&tailcfg.UserProfile{ID: 1, LoginName: "alice@example.com"}).View(),
+			2: (&tailcfg.UserProfile{ID: 2, LoginName: "bob@example.com"}).View(),
+			3: (&tailcfg.UserProfile{ID: 3, LoginName: "tagged-devices"}).View(),
+		},
+	}
+
+	tests := map[string]struct {
+		src   string
+		dst   string
+		port  uint16
+		proto ipproto.Proto
+		noMap bool
+		want  bool
+	}{
+		"allowed user":       {src: "100.64.0.2", dst: "100.64.0.1", port: 5252, proto: ipproto.TCP, want: true},
+		"allowed tag":        {src: "100.64.0.4", dst: "100.64.0.1", port: 5252, proto: ipproto.TCP, want: true},
+		"other user":         {src: "100.64.0.3", dst: "100.64.0.1", port: 5252, proto: ipproto.TCP},
+		"unknown peer":       {src: "100.64.0.9", dst: "100.64.0.1", port: 5252, proto: ipproto.TCP},
+		"other port":         {src: "100.64.0.3", dst: "100.64.0.1", port: 443, proto: ipproto.TCP, want: true},
+		"udp":                {src: "100.64.0.3", dst: "100.64.0.1", port: 5252, proto: ipproto.UDP, want: true},
+		"not for the node":   {src: "100.64.0.3", dst: "192.168.1.10", port: 5252, proto: ipproto.TCP, want: true},
+		"before network map": {src: "100.64.0.2", dst: "100.64.0.1", port: 5252, proto: ipproto.TCP, noMap: true},
+	}
+	for tn, tt := range tests {
+		t.Run(tn, func(t *testing.T) {
+			g := &webUIGate{allowed: []string{"alice@example.com", "tag:admin"}}
+			if !tt.noMap {
+				g.update(nm, nil)
+			}
+			p := &packet.Parsed{
+				IPProto: tt.proto,
+				Src:     netip.AddrPortFrom(netip.MustParseAddr(tt.src), 40000),
+				Dst:     netip.AddrPortFrom(netip.MustParseAddr(tt.dst), tt.port),
+			}
+			if got := g.allows(p, nil); got != tt.want {
+				t.Errorf("allows() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}